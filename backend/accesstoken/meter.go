@@ -0,0 +1,175 @@
+package accesstoken
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrQuotaExhausted = errors.New("access token allowance exhausted")
+
+// Usage is what has been consumed of one contract.
+type Usage struct {
+	ContractID uuid.UUID
+	Reads      uint64
+	Bytes      uint64
+}
+
+// LocalMeter spends down token allowances in memory, so a gateway can
+// enforce quotas without a round trip per request. It is safe for
+// concurrent use.
+//
+// Usage is kept per contract, not per token, so unlocking a contract again
+// does not buy a fresh allowance: every token for the contract is charged
+// for everything metered under any of them. A token carries what the
+// marketplace knew was left when it was issued, so it is only charged for
+// usage metered beyond what had been reported with Drain when the meter
+// first saw it.
+type LocalMeter struct {
+	mu        sync.Mutex
+	contracts map[uuid.UUID]*meterEntry
+}
+
+type meterEntry struct {
+	// used is everything metered for the contract, and reported the part
+	// of it handed out by Drain and not put back.
+	used     Usage
+	reported Usage
+	tokens   map[uuid.UUID]tokenBase
+}
+
+// tokenBase is how much of a contract's usage a token's allowance already
+// accounts for.
+type tokenBase struct {
+	reads, bytes uint64
+	expires      time.Time
+}
+
+func NewLocalMeter() *LocalMeter {
+	return &LocalMeter{contracts: make(map[uuid.UUID]*meterEntry)}
+}
+
+// Debit records reads and bytes against the token, or fails with
+// ErrQuotaExhausted and records nothing if that would exceed its allowance.
+func (m *LocalMeter) Debit(claims *Claims, reads, bytes uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, base := m.entry(claims)
+	if claims.Reads != nil && e.used.Reads-base.reads+reads > *claims.Reads {
+		return ErrQuotaExhausted
+	}
+	if claims.Bytes != nil && e.used.Bytes-base.bytes+bytes > *claims.Bytes {
+		return ErrQuotaExhausted
+	}
+	e.used.Reads += reads
+	e.used.Bytes += bytes
+	return nil
+}
+
+// Charge records usage that has already happened, such as response bytes
+// counted after the fact, even if it goes over the allowance. It reports
+// whether the token is still within it.
+func (m *LocalMeter) Charge(claims *Claims, reads, bytes uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, base := m.entry(claims)
+	e.used.Reads += reads
+	e.used.Bytes += bytes
+	return (claims.Reads == nil || e.used.Reads-base.reads <= *claims.Reads) &&
+		(claims.Bytes == nil || e.used.Bytes-base.bytes <= *claims.Bytes)
+}
+
+// Remaining reports what is left of the token's allowance. ok is false for
+// an unlimited dimension.
+func (m *LocalMeter) Remaining(claims *Claims) (reads uint64, readsOK bool, bytes uint64, bytesOK bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, base := m.entry(claims)
+	if claims.Reads != nil {
+		reads, readsOK = *claims.Reads-min(e.used.Reads-base.reads, *claims.Reads), true
+	}
+	if claims.Bytes != nil {
+		bytes, bytesOK = *claims.Bytes-min(e.used.Bytes-base.bytes, *claims.Bytes), true
+	}
+	return reads, readsOK, bytes, bytesOK
+}
+
+// Drain returns usage recorded since the previous Drain, one entry per
+// contract with anything new. Usage that could not be passed on should be
+// handed back with Restore.
+func (m *LocalMeter) Drain() []Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []Usage
+	for contractID, e := range m.contracts {
+		delta := Usage{
+			ContractID: contractID,
+			Reads:      e.used.Reads - e.reported.Reads,
+			Bytes:      e.used.Bytes - e.reported.Bytes,
+		}
+		if delta.Reads == 0 && delta.Bytes == 0 {
+			continue
+		}
+		e.reported = e.used
+		out = append(out, delta)
+	}
+	return out
+}
+
+// Restore puts usage returned by Drain back, so the next Drain returns it
+// again.
+func (m *LocalMeter) Restore(usage Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.contracts[usage.ContractID]
+	if !ok {
+		return
+	}
+	e.reported.Reads -= min(usage.Reads, e.reported.Reads)
+	e.reported.Bytes -= min(usage.Bytes, e.reported.Bytes)
+}
+
+// Prune forgets tokens that have expired by now, and contracts with no
+// unexpired tokens and nothing left to drain.
+func (m *LocalMeter) Prune(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for contractID, e := range m.contracts {
+		for tokenID, base := range e.tokens {
+			if now.After(base.expires) {
+				delete(e.tokens, tokenID)
+			}
+		}
+		if len(e.tokens) == 0 && e.used == e.reported {
+			delete(m.contracts, contractID)
+		}
+	}
+}
+
+// entry returns the contract's entry and the token's base in it, taking
+// the base from what has been reported so far if the token is new.
+func (m *LocalMeter) entry(claims *Claims) (*meterEntry, tokenBase) {
+	e, ok := m.contracts[claims.ContractID]
+	if !ok {
+		e = &meterEntry{
+			used:     Usage{ContractID: claims.ContractID},
+			reported: Usage{ContractID: claims.ContractID},
+			tokens:   make(map[uuid.UUID]tokenBase),
+		}
+		m.contracts[claims.ContractID] = e
+	}
+	base, ok := e.tokens[claims.TokenID]
+	if !ok {
+		base = tokenBase{reads: e.reported.Reads, bytes: e.reported.Bytes, expires: claims.Expiry()}
+		e.tokens[claims.TokenID] = base
+	}
+	return e, base
+}
@@ -0,0 +1,161 @@
+// Package accesstoken issues and verifies the signed tokens that grant a
+// contract owner access to a datastream.
+//
+// Tokens are compact JWTs signed with Ed25519 ("EdDSA"), so a data gateway
+// holding only the public key can check them without calling back to the
+// marketplace. A token carries the quota left on the contract when it was
+// issued, which the gateway spends down locally with a LocalMeter.
+package accesstoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"contract_market_demo/backend/clock"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMalformed    = errors.New("malformed access token")
+	ErrBadSignature = errors.New("access token signature is invalid")
+	ErrExpired      = errors.New("access token has expired")
+	ErrNotYetValid  = errors.New("access token is not valid yet")
+)
+
+// header is the only JOSE header this package writes or accepts.
+const header = `{"alg":"EdDSA","typ":"JWT"}`
+
+var encodedHeader = base64.RawURLEncoding.EncodeToString([]byte(header))
+
+// Claims is what a token asserts. Reads and Bytes are the allowance the
+// token grants; nil means unlimited.
+type Claims struct {
+	TokenID      uuid.UUID `json:"jti"`
+	ContractID   uuid.UUID `json:"sub"`
+	OwnerID      uuid.UUID `json:"owner"`
+	DatastreamID uuid.UUID `json:"datastream"`
+	Reads        *uint64   `json:"reads,omitempty"`
+	Bytes        *uint64   `json:"bytes,omitempty"`
+	IssuedAt     int64     `json:"iat"`
+	ExpiresAt    int64     `json:"exp"`
+}
+
+func (c *Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Signer issues tokens.
+type Signer struct {
+	key ed25519.PrivateKey
+}
+
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key}
+}
+
+func (s *Signer) PublicKey() ed25519.PublicKey {
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Sign returns claims as a signed token. A zero TokenID is filled in.
+func (s *Signer) Sign(claims *Claims) (string, error) {
+	if claims.TokenID == uuid.Nil {
+		claims.TokenID = uuid.New()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig := ed25519.Sign(s.key, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Verifier checks tokens against a public key.
+type Verifier struct {
+	key   ed25519.PublicKey
+	clock clock.Clock
+	// leeway tolerates clock skew between issuer and gateway.
+	leeway time.Duration
+}
+
+func NewVerifier(key ed25519.PublicKey, clk clock.Clock) *Verifier {
+	return &Verifier{key: key, clock: clk, leeway: 30 * time.Second}
+}
+
+// Verify returns the claims of a well-formed, correctly signed token that
+// is within its validity window.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	if parts[0] != encodedHeader {
+		return nil, fmt.Errorf("%w: unsupported header", ErrMalformed)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if !ed25519.Verify(v.key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrBadSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	now := v.clock.Now()
+	if now.Add(-v.leeway).After(claims.Expiry()) {
+		return nil, ErrExpired
+	}
+	if now.Add(v.leeway).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, ErrNotYetValid
+	}
+	return claims, nil
+}
+
+// ParsePrivateKey decodes a base64 Ed25519 seed (32 bytes) or full private
+// key (64 bytes).
+func ParsePrivateKey(encoded string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	switch len(raw) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(raw), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(raw), nil
+	}
+	return nil, fmt.Errorf("ed25519 private key must be %d or %d bytes, got %d",
+		ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// EncodePublicKey is the inverse of ParsePublicKey.
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
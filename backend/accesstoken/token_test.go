@@ -0,0 +1,93 @@
+package accesstoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/clock"
+
+	"github.com/google/uuid"
+)
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// withPart replaces part i of token with s encoded.
+func withPart(token string, i int, s string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = base64.RawURLEncoding.EncodeToString([]byte(s))
+	return strings.Join(parts, ".")
+}
+
+func TestVerify(t *testing.T) {
+	key := newKey(t)
+	issued := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	reads := uint64(100)
+	claims := &Claims{
+		TokenID:      uuid.New(),
+		ContractID:   uuid.New(),
+		OwnerID:      uuid.New(),
+		DatastreamID: uuid.New(),
+		Reads:        &reads,
+		IssuedAt:     issued.Unix(),
+		ExpiresAt:    issued.Add(time.Hour).Unix(),
+	}
+	token, err := NewSigner(key).Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := NewSigner(newKey(t)).Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+
+	cases := []struct {
+		name  string
+		token string
+		// at is when the token is verified, relative to when it was issued.
+		at   time.Duration
+		want error
+	}{
+		{name: "valid", token: token},
+		{name: "signed with another key", token: otherToken, want: ErrBadSignature},
+		{
+			name:  "more reads claimed",
+			token: withPart(token, 1, strings.Replace(string(payload), `"reads":100`, `"reads":1000000`, 1)),
+			want:  ErrBadSignature,
+		},
+		{name: "signature replaced", token: withPart(token, 2, "not a signature"), want: ErrBadSignature},
+		{name: "alg none", token: withPart(token, 0, `{"alg":"none","typ":"JWT"}`), want: ErrMalformed},
+		{name: "alg HS256", token: withPart(token, 0, `{"alg":"HS256","typ":"JWT"}`), want: ErrMalformed},
+		{name: "header fields reordered", token: withPart(token, 0, `{"typ":"JWT","alg":"EdDSA"}`), want: ErrMalformed},
+		{name: "missing signature", token: token[:strings.LastIndex(token, ".")], want: ErrMalformed},
+		{name: "signature not base64", token: token[:strings.LastIndex(token, ".")+1] + "!!", want: ErrMalformed},
+		{name: "just expired, within leeway", token: token, at: time.Hour + 29*time.Second},
+		{name: "expired past leeway", token: token, at: time.Hour + 31*time.Second, want: ErrExpired},
+		{name: "issued ahead of the gateway's clock, within leeway", token: token, at: -29 * time.Second},
+		{name: "issued ahead of the gateway's clock, past leeway", token: token, at: -31 * time.Second, want: ErrNotYetValid},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v := NewVerifier(key.Public().(ed25519.PublicKey), clock.NewFake(issued.Add(c.at)))
+			got, err := v.Verify(c.token)
+			if !errors.Is(err, c.want) {
+				t.Fatalf("err = %v, want %v", err, c.want)
+			}
+			if err == nil && !reflect.DeepEqual(got, claims) {
+				t.Errorf("claims = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
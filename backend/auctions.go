@@ -0,0 +1,809 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuctionTick    = 15 * time.Second
+	auctionCloseBatchSize = 100
+)
+
+var errAuctionNotRunning = errors.New("auction is not taking bids")
+
+type AuctionCreateRequest struct {
+	ListingID string `json:"listing_id"`
+	// Kind is "english" or "dutch".
+	Kind              string `json:"kind"`
+	Quantity          uint64 `json:"quantity"`
+	ReservePriceNanos int64  `json:"reserve_price_nanos"`
+
+	// English auctions only.
+	BidIncrementNanos   int64 `json:"bid_increment_nanos"`
+	ExtendWindowSeconds int64 `json:"extend_window_seconds"`
+
+	// Dutch auctions only.
+	StartPriceNanos       int64 `json:"start_price_nanos"`
+	PriceStepNanos        int64 `json:"price_step_nanos"`
+	PriceStepEverySeconds int64 `json:"price_step_every_seconds"`
+
+	// StartsAt defaults to now. Both are RFC 3339.
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   time.Time  `json:"ends_at"`
+}
+
+// auction validates req and builds the auction it describes.
+func (req *AuctionCreateRequest) auction(sellerID uuid.UUID, now time.Time) (*models.AuctionListing, error) {
+	listingID, err := uuid.Parse(req.ListingID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listing_id: %w", err)
+	}
+	kind, err := models.ParseAuctionKind(req.Kind)
+	if err != nil {
+		return nil, err
+	}
+	if req.Quantity == 0 {
+		return nil, errors.New("quantity must be positive")
+	}
+	if req.ReservePriceNanos <= 0 {
+		return nil, errors.New("reserve_price_nanos must be positive")
+	}
+	startsAt := now
+	if req.StartsAt != nil && req.StartsAt.After(now) {
+		startsAt = *req.StartsAt
+	}
+	if !req.EndsAt.After(startsAt) {
+		return nil, errors.New("ends_at must be after the auction starts")
+	}
+
+	auction := &models.AuctionListing{
+		ID:                uuid.New(),
+		ListingID:         listingID,
+		SellerID:          sellerID,
+		Kind:              kind,
+		Quantity:          req.Quantity,
+		Remaining:         req.Quantity,
+		ReservePriceNanos: req.ReservePriceNanos,
+		StartsAt:          startsAt,
+		EndsAt:            req.EndsAt,
+		Status:            models.AuctionOpen,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	switch kind {
+	case models.AuctionEnglish:
+		if req.BidIncrementNanos < 0 || req.ExtendWindowSeconds < 0 {
+			return nil, errors.New("bid_increment_nanos and extend_window_seconds cannot be negative")
+		}
+		auction.BidIncrementNanos = req.BidIncrementNanos
+		auction.ExtendWindow = time.Duration(req.ExtendWindowSeconds) * time.Second
+	case models.AuctionDutch:
+		if req.StartPriceNanos < req.ReservePriceNanos {
+			return nil, errors.New("start_price_nanos must be at least the reserve price")
+		}
+		if req.PriceStepNanos <= 0 || req.PriceStepEverySeconds <= 0 {
+			return nil, errors.New("price_step_nanos and price_step_every_seconds must be positive")
+		}
+		auction.StartPriceNanos = req.StartPriceNanos
+		auction.PriceStepNanos = req.PriceStepNanos
+		auction.PriceStepEvery = time.Duration(req.PriceStepEverySeconds) * time.Second
+	}
+	return auction, nil
+}
+
+type AuctionBidRequest struct {
+	// PriceNanos is the English bid per unit. A Dutch auction always sells
+	// at its current price and ignores it.
+	PriceNanos int64  `json:"price_nanos"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// AuctionView is an auction with its bids. CurrentPriceNanos is the least
+// an English bid must now be, or the price a Dutch auction is selling at.
+type AuctionView struct {
+	*models.AuctionListing
+	CurrentPriceNanos int64               `json:"current_price_nanos"`
+	Bids              []models.AuctionBid `json:"bids"`
+}
+
+// minimumBid is the least an English bidder may bid per unit: the reserve
+// while the other bids cover fewer units than are on sale, and otherwise
+// the lowest of those bids that would still win plus the increment. bids
+// must be best first.
+func minimumBid(auction *models.AuctionListing, bids []models.AuctionBid, bidderID uuid.UUID) int64 {
+	var units uint64
+	for _, bid := range bids {
+		if bid.BidderID == bidderID {
+			continue
+		}
+		units += bid.Quantity
+		if units >= auction.Quantity {
+			return max(auction.ReservePriceNanos, bid.PriceNanos+auction.BidIncrementNanos)
+		}
+	}
+	return auction.ReservePriceNanos
+}
+
+// awardBids sets WonQuantity on the best bids until quantity units are
+// given out and returns those bids. bids must be best first; the last
+// winner may get fewer units than it bid for.
+func awardBids(quantity uint64, bids []models.AuctionBid) []*models.AuctionBid {
+	var winners []*models.AuctionBid
+	for i := range bids {
+		if quantity == 0 {
+			break
+		}
+		bid := &bids[i]
+		bid.WonQuantity = min(bid.Quantity, quantity)
+		quantity -= bid.WonQuantity
+		winners = append(winners, bid)
+	}
+	return winners
+}
+
+// CreateAuction puts auction.Quantity units of the seller's listing up for
+// auction, taking them out of its remaining supply until the auction ends.
+func CreateAuction(auction *models.AuctionListing, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		listing, err := tx.Listings.FindByID(auction.ListingID)
+		if err != nil {
+			return err
+		}
+		if listing.SellerID != auction.SellerID {
+			return errNotParticipant
+		}
+		if listing.ContractType == models.ContractSubscription {
+			return errors.New("subscription listings cannot be auctioned")
+		}
+		if listing.ExerciseBy != nil && listing.ExerciseBy.Before(auction.EndsAt) {
+			return errors.New("auction must end before the listing's contracts expire")
+		}
+		seller, err := tx.Users.FindByID(auction.SellerID)
+		if err != nil {
+			return err
+		}
+		if seller.StripeConnectAccountID == "" || !seller.StripeChargesEnabled {
+			return errSellerNotPayable
+		}
+		if err := FillSupplyAvailable(tx.Reservations, listing); err != nil {
+			return err
+		}
+		if listing.SupplyAvailable < auction.Quantity {
+			return repos.ErrInsufficientSupply
+		}
+		if err := tx.Listings.DecrementSupply(listing.ID, auction.Quantity); err != nil {
+			return err
+		}
+		return tx.Auctions.Create(auction)
+	})
+}
+
+// PlaceEnglishBid places or raises the bidder's bid. A bid may not lower an
+// earlier one, and one placed within the auction's ExtendWindow of its end
+// pushes the end back so other bidders have time to answer.
+func PlaceEnglishBid(
+	auctionID, bidderID uuid.UUID,
+	priceNanos int64,
+	quantity uint64,
+	now time.Time,
+	uow repos.UnitOfWork) (*models.AuctionBid, error) {
+
+	var bid *models.AuctionBid
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		auction, err := runningAuction(tx, auctionID, bidderID, now)
+		if err != nil {
+			return err
+		}
+		if auction.Kind != models.AuctionEnglish {
+			return errors.New("not an english auction")
+		}
+		if quantity == 0 || quantity > auction.Quantity {
+			return fmt.Errorf("quantity must be between 1 and %d", auction.Quantity)
+		}
+
+		bids, err := tx.Auctions.FindBidsByAuctionID(auction.ID)
+		if err != nil {
+			return err
+		}
+		if least := minimumBid(auction, bids, bidderID); priceNanos < least {
+			return fmt.Errorf("bid must be at least %d nanos per unit", least)
+		}
+
+		bid, err = tx.Auctions.FindBid(auction.ID, bidderID)
+		switch {
+		case errors.Is(err, repos.ErrAuctionBidNotFound):
+			bid = &models.AuctionBid{
+				ID:        uuid.New(),
+				AuctionID: auction.ID,
+				BidderID:  bidderID,
+				CreatedAt: now,
+			}
+		case err != nil:
+			return err
+		case priceNanos < bid.PriceNanos || quantity < bid.Quantity:
+			return errors.New("a bid can only be raised")
+		}
+		bid.PriceNanos = priceNanos
+		bid.Quantity = quantity
+		bid.PlacedAt = now
+		bid.UpdatedAt = now
+
+		if auction.EndsAt.Sub(now) < auction.ExtendWindow {
+			auction.EndsAt = now.Add(auction.ExtendWindow)
+		}
+		auction.UpdatedAt = now
+		// The version check makes concurrent bids on one auction retry.
+		if err := tx.Auctions.Update(auction); err != nil {
+			return err
+		}
+		return tx.Auctions.SaveBid(bid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bid, nil
+}
+
+// runningAuction loads an auction that is taking bids from bidderID at now.
+func runningAuction(tx *repos.Repos, auctionID, bidderID uuid.UUID, now time.Time) (*models.AuctionListing, error) {
+	auction, err := tx.Auctions.FindByID(auctionID)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Status != models.AuctionOpen || now.Before(auction.StartsAt) || !now.Before(auction.EndsAt) {
+		return nil, errAuctionNotRunning
+	}
+	if auction.SellerID == bidderID {
+		return nil, errors.New("cannot bid on your own auction")
+	}
+	return auction, nil
+}
+
+// auctionCheckout is the checkout for units won at auction, its record and
+// hold already saved, waiting for a payment session.
+type auctionCheckout struct {
+	bid   *models.AuctionBid
+	order *checkoutOrder
+}
+
+// holdWinnings saves a pending purchase of the units bid won at priceNanos
+// each and holds them for the winner, exactly as CheckoutHandler would for
+// a fixed-price purchase. The units must already be back in the listing's
+// remaining supply.
+func holdWinnings(
+	tx *repos.Repos,
+	auction *models.AuctionListing,
+	listing *models.ContractListing,
+	bid *models.AuctionBid,
+	priceNanos int64,
+	now time.Time) (*checkoutOrder, error) {
+
+	unitCents := (priceNanos + 5_000_000) / 10_000_000
+	tr := NewPrimaryTransaction(listing, bid.BidderID, int64(bid.WonQuantity), unitCents)
+	if err := tx.Transactions.Create(tr); err != nil {
+		return nil, err
+	}
+	hold, err := tx.Reservations.Hold(listing.ID, tr.ID, bid.WonQuantity, now.Add(ReservationTTL()))
+	if err != nil {
+		return nil, err
+	}
+	bid.TransactionID = tr.ID
+	bid.UpdatedAt = now
+	return &checkoutOrder{
+		record:    tr,
+		hold:      hold,
+		unitCents: unitCents,
+		metadata: map[string]string{
+			"transaction_id": tr.ID.String(),
+			"listing_id":     listing.ID.String(),
+			"auction_id":     auction.ID.String(),
+			"buyer_id":       bid.BidderID.String(),
+		},
+	}, nil
+}
+
+// checkoutWinnings opens payment sessions for checkouts whose records and
+// holds have committed, and saves each winner's checkout URL on their bid.
+// A winner whose session cannot be opened loses their hold, so those units
+// go back on sale.
+func checkoutWinnings(
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	listing *models.ContractListing,
+	checkouts []auctionCheckout) error {
+
+	if len(checkouts) == 0 {
+		return nil
+	}
+	rs := uow.Repos()
+	seller, err := rs.Users.FindByID(listing.SellerID)
+	if err != nil {
+		return err
+	}
+	productName, err := listingProductName(listing, rs.Datastreams)
+	if err != nil {
+		productName = "Data Contract"
+	}
+
+	var firstErr error
+	for _, c := range checkouts {
+		c.order.seller = seller
+		c.order.productName = productName
+		s, err := startCheckout(provider, uow, c.order)
+		if err != nil {
+			log.Printf("auction checkout for bid %s failed: %v", c.bid.ID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		c.bid.CheckoutURL = s.URL
+		if err := rs.Auctions.SaveBid(c.bid); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// BuyDutchAuction buys quantity units at the auction's current price. The
+// units go straight back into the listing's supply under a hold for the
+// buyer, and the auction closes once it has nothing left to sell.
+func BuyDutchAuction(
+	auctionID, buyerID uuid.UUID,
+	quantity uint64,
+	now time.Time,
+	uow repos.UnitOfWork) (*models.AuctionBid, *models.ContractListing, *checkoutOrder, error) {
+
+	var bid *models.AuctionBid
+	var listing *models.ContractListing
+	var order *checkoutOrder
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		auction, err := runningAuction(tx, auctionID, buyerID, now)
+		if err != nil {
+			return err
+		}
+		if auction.Kind != models.AuctionDutch {
+			return errors.New("not a dutch auction")
+		}
+		if quantity == 0 || quantity > auction.Remaining {
+			return fmt.Errorf("quantity must be between 1 and %d", auction.Remaining)
+		}
+		listing, err = tx.Listings.FindByID(auction.ListingID)
+		if err != nil {
+			return err
+		}
+		if _, err := listingProductName(listing, tx.Datastreams); err != nil {
+			return err
+		}
+
+		auction.Remaining -= quantity
+		if auction.Remaining == 0 {
+			auction.Status = models.AuctionClosed
+		}
+		auction.UpdatedAt = now
+		if err := tx.Auctions.Update(auction); err != nil {
+			return err
+		}
+		if err := tx.Listings.RestoreSupply(listing.ID, quantity); err != nil {
+			return err
+		}
+
+		price := auction.PriceAt(now)
+		bid = &models.AuctionBid{
+			ID:          uuid.New(),
+			AuctionID:   auction.ID,
+			BidderID:    buyerID,
+			PriceNanos:  price,
+			Quantity:    quantity,
+			PlacedAt:    now,
+			WonQuantity: quantity,
+			CreatedAt:   now,
+		}
+		order, err = holdWinnings(tx, auction, listing, bid, price, now)
+		if err != nil {
+			return err
+		}
+		return tx.Auctions.SaveBid(bid)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bid, listing, order, nil
+}
+
+// CloseAuction ends an auction whose time is up. An English auction's
+// best bids at or above the reserve win their units, and each winner gets
+// a checkout for them at their bid price. Units nobody won go back to the
+// listing's remaining supply, as do won units whose checkout lapses.
+func CloseAuction(
+	auctionID uuid.UUID,
+	now time.Time,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) error {
+
+	var listing *models.ContractListing
+	var checkouts []auctionCheckout
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		auction, err := tx.Auctions.FindByID(auctionID)
+		if err != nil {
+			return err
+		}
+		if auction.Status != models.AuctionOpen {
+			return repos.ErrAuctionNotOpen
+		}
+		if now.Before(auction.EndsAt) {
+			// A late bid extended it.
+			return nil
+		}
+		auction.Status = models.AuctionClosed
+		auction.UpdatedAt = now
+		// The version check stops a bid landing while the auction closes.
+		if err := tx.Auctions.Update(auction); err != nil {
+			return err
+		}
+		listing, err = tx.Listings.FindByID(auction.ListingID)
+		if errors.Is(err, repos.ErrListingNotFound) {
+			// The listing was deleted; there is nothing to sell or return.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Listings.RestoreSupply(listing.ID, auction.Remaining); err != nil {
+			return err
+		}
+		if auction.Kind != models.AuctionEnglish {
+			return nil
+		}
+
+		seller, err := tx.Users.FindByID(auction.SellerID)
+		if err != nil {
+			return err
+		}
+		_, err = listingProductName(listing, tx.Datastreams)
+		if seller.StripeConnectAccountID == "" || !seller.StripeChargesEnabled || err != nil {
+			log.Printf("auction %s closed unsold: seller cannot take payment", auction.ID)
+			return nil
+		}
+
+		bids, err := tx.Auctions.FindBidsByAuctionID(auction.ID)
+		if err != nil {
+			return err
+		}
+		for _, bid := range awardBids(auction.Quantity, bids) {
+			order, err := holdWinnings(tx, auction, listing, bid, bid.PriceNanos, now)
+			if err != nil {
+				return err
+			}
+			if err := tx.Auctions.SaveBid(bid); err != nil {
+				return err
+			}
+			checkouts = append(checkouts, auctionCheckout{bid: bid, order: order})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return checkoutWinnings(provider, uow, listing, checkouts)
+}
+
+// CancelAuction withdraws an auction and returns its unsold units to the
+// listing's supply. An English auction cannot be withdrawn once bid on.
+func CancelAuction(auctionID uuid.UUID, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		auction, err := tx.Auctions.FindByID(auctionID)
+		if err != nil {
+			return err
+		}
+		if auction.Status != models.AuctionOpen {
+			return repos.ErrAuctionNotOpen
+		}
+		if auction.Kind == models.AuctionEnglish {
+			bids, err := tx.Auctions.FindBidsByAuctionID(auction.ID)
+			if err != nil {
+				return err
+			}
+			if len(bids) > 0 {
+				return errors.New("auction has bids and cannot be withdrawn")
+			}
+		}
+		auction.Status = models.AuctionCancelled
+		auction.UpdatedAt = time.Now()
+		if err := tx.Auctions.Update(auction); err != nil {
+			return err
+		}
+		err = tx.Listings.RestoreSupply(auction.ListingID, auction.Remaining)
+		if errors.Is(err, repos.ErrListingNotFound) {
+			return nil
+		}
+		return err
+	})
+}
+
+// CloseDueAuctions closes every open auction whose end has passed.
+func CloseDueAuctions(now time.Time, provider payments.PaymentProvider, uow repos.UnitOfWork) (int, error) {
+	closed := 0
+	for {
+		due, err := uow.Repos().Auctions.FindAllDueToClose(now, auctionCloseBatchSize)
+		if err != nil {
+			return closed, err
+		}
+
+		progressed := false
+		for _, auction := range due {
+			err := CloseAuction(auction.ID, now, provider, uow)
+			if errors.Is(err, repos.ErrAuctionNotOpen) || errors.Is(err, repos.ErrAuctionVersionConflict) {
+				continue
+			}
+			if err != nil {
+				// A failed checkout leaves the auction closed; anything
+				// else is retried on the next tick.
+				log.Printf("closing auction %s: %v", auction.ID, err)
+				continue
+			}
+			closed++
+			progressed = true
+		}
+
+		if len(due) < auctionCloseBatchSize || !progressed {
+			return closed, nil
+		}
+	}
+}
+
+// StartAuctionScheduler runs CloseDueAuctions on every tick of clk until the
+// returned stop function is called.
+func StartAuctionScheduler(
+	interval time.Duration,
+	clk clock.Clock,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (stop func()) {
+
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := CloseDueAuctions(clk.Now(), provider, uow)
+				if err != nil {
+					log.Printf("auction close failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("closed %d auctions", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// AuctionsHandler serves /v1/auctions: GET lists open auctions, or the
+// caller's own with ?mine=true, and POST lets a seller auction units of
+// one of their listings.
+func AuctionsHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var auctions []models.AuctionListing
+			if r.URL.Query().Get("mine") == "true" {
+				auctions, err = rs.Auctions.FindAllBySellerID(u.ID)
+			} else {
+				auctions, err = rs.Auctions.FindAllOpen()
+			}
+			if err != nil {
+				http.Error(w, "failed to fetch auctions: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(auctions)
+		case http.MethodPost:
+			req := &AuctionCreateRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			auction, err := req.auction(u.ID, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = CreateAuction(auction, uow)
+			switch {
+			case errors.Is(err, repos.ErrListingNotFound):
+				http.Error(w, "listing not found", http.StatusNotFound)
+				return
+			case errors.Is(err, errNotParticipant):
+				http.Error(w, "only the seller may auction this listing", http.StatusForbidden)
+				return
+			case errors.Is(err, repos.ErrInsufficientSupply):
+				http.Error(w, "quantity exceeds available supply", http.StatusConflict)
+				return
+			case errors.Is(err, errSellerNotPayable):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case err != nil:
+				http.Error(w, "failed to create auction: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(auction)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// AuctionHandler serves /v1/auctions/{id}: GET shows an auction with its
+// bids and current price, and DELETE lets its seller withdraw it.
+func AuctionHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid auction id", http.StatusBadRequest)
+			return
+		}
+		auction, err := rs.Auctions.FindByID(id)
+		if err != nil {
+			http.Error(w, "auction not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			bids, err := rs.Auctions.FindBidsByAuctionID(auction.ID)
+			if err != nil {
+				http.Error(w, "failed to fetch bids: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			view := &AuctionView{AuctionListing: auction, Bids: bids}
+			if auction.Kind == models.AuctionDutch {
+				view.CurrentPriceNanos = auction.PriceAt(time.Now())
+			} else {
+				view.CurrentPriceNanos = minimumBid(auction, bids, uuid.Nil)
+			}
+			for i := range view.Bids {
+				if view.Bids[i].BidderID != u.ID {
+					view.Bids[i].CheckoutURL = ""
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(view)
+		case http.MethodDelete:
+			if auction.SellerID != u.ID {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if err := CancelAuction(auction.ID, uow); err != nil {
+				http.Error(w, "failed to withdraw auction: "+err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// AuctionBidHandler serves POST /v1/auctions/{id}/bids. On an English
+// auction it places or raises the caller's bid. On a Dutch auction it buys
+// at the current price and answers with a checkout, as /v1/checkout does.
+func AuctionBidHandler(provider payments.PaymentProvider, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid auction id", http.StatusBadRequest)
+			return
+		}
+		req := &AuctionBidRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		auction, err := rs.Auctions.FindByID(id)
+		if err != nil {
+			http.Error(w, "auction not found", http.StatusNotFound)
+			return
+		}
+
+		if auction.Kind == models.AuctionEnglish {
+			bid, err := PlaceEnglishBid(auction.ID, u.ID, req.PriceNanos, req.Quantity, time.Now(), uow)
+			if err != nil {
+				auctionBidError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(bid)
+			return
+		}
+
+		bid, listing, order, err := BuyDutchAuction(auction.ID, u.ID, req.Quantity, time.Now(), uow)
+		if err != nil {
+			auctionBidError(w, err)
+			return
+		}
+		if err := checkoutWinnings(provider, uow, listing, []auctionCheckout{{bid: bid, order: order}}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"transaction_id": order.record.ID.String(),
+			"checkout_url":   bid.CheckoutURL,
+			"expires_at":     order.hold.ExpiresAt,
+			"bid":            bid,
+		})
+	}
+}
+
+func auctionBidError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errAuctionNotRunning),
+		errors.Is(err, errDatastreamInactive),
+		errors.Is(err, repos.ErrInsufficientSupply):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, repos.ErrAuctionVersionConflict):
+		http.Error(w, "auction was bid on concurrently, retry", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// AuctionBidsHandler serves GET /v1/auctions/bids, the caller's own bids,
+// including the checkout URL of any they have won.
+func AuctionBidsHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		bids, err := rs.Auctions.FindBidsByBidderID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch bids: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(bids)
+	}
+}
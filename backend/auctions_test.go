@@ -0,0 +1,268 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+)
+
+// auction opens the auction req describes on listing at now, with a
+// reserve of one unit of currency unless req sets one.
+func (m *testMarket) auction(t *testing.T, listing *models.ContractListing, req *AuctionCreateRequest, now time.Time) *models.AuctionListing {
+	t.Helper()
+	req.ListingID = listing.ID.String()
+	if req.ReservePriceNanos == 0 {
+		req.ReservePriceNanos = 1_000_000_000
+	}
+	auction, err := req.auction(m.seller.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateAuction(auction, m.uow); err != nil {
+		t.Fatal(err)
+	}
+	return auction
+}
+
+// auctionNow reloads an auction.
+func (m *testMarket) auctionNow(t *testing.T, id uuid.UUID) *models.AuctionListing {
+	t.Helper()
+	auction, err := m.uow.Repos().Auctions.FindByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auction
+}
+
+// supplyAvailable is what of listing's supply is neither sold, auctioned
+// nor held for a checkout.
+func (m *testMarket) supplyAvailable(t *testing.T, listingID uuid.UUID) uint64 {
+	t.Helper()
+	rs := m.uow.Repos()
+	listing, err := rs.Listings.FindByID(listingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := FillSupplyAvailable(rs.Reservations, listing); err != nil {
+		t.Fatal(err)
+	}
+	return listing.SupplyAvailable
+}
+
+func TestMinimumBid(t *testing.T) {
+	bidder, other, third := uuid.New(), uuid.New(), uuid.New()
+	auction := &models.AuctionListing{Quantity: 2, ReservePriceNanos: 100, BidIncrementNanos: 10}
+	cases := []struct {
+		name string
+		bids []models.AuctionBid
+		want int64
+	}{
+		{"no bids", nil, 100},
+		{
+			"other bids cover fewer units than are on sale",
+			[]models.AuctionBid{{BidderID: other, PriceNanos: 150, Quantity: 1}},
+			100,
+		},
+		{
+			"other bids cover every unit",
+			[]models.AuctionBid{
+				{BidderID: other, PriceNanos: 150, Quantity: 1},
+				{BidderID: third, PriceNanos: 120, Quantity: 1},
+			},
+			130,
+		},
+		{
+			"one bid covers every unit",
+			[]models.AuctionBid{{BidderID: other, PriceNanos: 200, Quantity: 5}},
+			210,
+		},
+		{
+			"the bidder's own bid is not counted",
+			[]models.AuctionBid{
+				{BidderID: bidder, PriceNanos: 150, Quantity: 1},
+				{BidderID: other, PriceNanos: 120, Quantity: 1},
+			},
+			100,
+		},
+		{
+			"losing bids do not count",
+			[]models.AuctionBid{
+				{BidderID: other, PriceNanos: 150, Quantity: 2},
+				{BidderID: third, PriceNanos: 101, Quantity: 2},
+			},
+			160,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := minimumBid(auction, c.bids, bidder); got != c.want {
+				t.Errorf("minimumBid = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAwardBids(t *testing.T) {
+	cases := []struct {
+		name     string
+		quantity uint64
+		bids     []uint64
+		want     []uint64
+	}{
+		{"best bids win until the units run out", 3, []uint64{2, 2, 1}, []uint64{2, 1}},
+		{"more units than bids", 5, []uint64{1, 2}, []uint64{1, 2}},
+		{"exactly enough", 3, []uint64{1, 2, 4}, []uint64{1, 2}},
+		{"no bids", 3, nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bids := make([]models.AuctionBid, len(c.bids))
+			for i, q := range c.bids {
+				bids[i] = models.AuctionBid{ID: uuid.New(), Quantity: q}
+			}
+			var got []uint64
+			for i, winner := range awardBids(c.quantity, bids) {
+				if winner != &bids[i] {
+					t.Fatalf("winner %d is not bid %d", i, i)
+				}
+				got = append(got, winner.WonQuantity)
+			}
+			if !slices.Equal(got, c.want) {
+				t.Errorf("won %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDutchPriceAt(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	auction := &models.AuctionListing{
+		Kind:              models.AuctionDutch,
+		StartsAt:          start,
+		StartPriceNanos:   1000,
+		PriceStepNanos:    100,
+		PriceStepEvery:    time.Minute,
+		ReservePriceNanos: 650,
+	}
+	cases := []struct {
+		name string
+		at   time.Duration
+		want int64
+	}{
+		{"before it starts", -time.Minute, 1000},
+		{"as it starts", 0, 1000},
+		{"just before the first step", time.Minute - time.Second, 1000},
+		{"at the first step", time.Minute, 900},
+		{"at the last step above the reserve", 3 * time.Minute, 700},
+		{"when the next step would go under the reserve", 4 * time.Minute, 650},
+		{"long after", time.Hour, 650},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := auction.PriceAt(start.Add(c.at)); got != c.want {
+				t.Errorf("PriceAt(start%+v) = %d, want %d", c.at, got, c.want)
+			}
+		})
+	}
+
+	english := *auction
+	english.Kind = models.AuctionEnglish
+	if got := english.PriceAt(start.Add(time.Hour)); got != 650 {
+		t.Errorf("english PriceAt = %d, want the reserve", got)
+	}
+}
+
+func TestLateBidExtendsEnglishAuction(t *testing.T) {
+	cases := []struct {
+		name  string
+		bidAt time.Duration
+		ends  time.Duration
+	}{
+		{"bid before the window", time.Minute, 10 * time.Minute},
+		{"bid inside the window", 8 * time.Minute, 13 * time.Minute},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMarket(t)
+			listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+			now := time.Now()
+			auction := m.auction(t, listing, &AuctionCreateRequest{
+				Kind:                "english",
+				Quantity:            1,
+				ExtendWindowSeconds: 5 * 60,
+				EndsAt:              now.Add(10 * time.Minute),
+			}, now)
+
+			if _, err := PlaceEnglishBid(auction.ID, m.buyer.ID, auction.ReservePriceNanos, 1, now.Add(c.bidAt), m.uow); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := m.auctionNow(t, auction.ID).EndsAt, now.Add(c.ends); !got.Equal(want) {
+				t.Errorf("auction ends %v after it started, want %v", got.Sub(now), c.ends)
+			}
+
+			if err := CloseAuction(auction.ID, now.Add(10*time.Minute), m.provider, m.uow); err != nil {
+				t.Fatal(err)
+			}
+			wantClosed := c.ends == 10*time.Minute
+			if closed := m.auctionNow(t, auction.ID).Status == models.AuctionClosed; closed != wantClosed {
+				t.Errorf("closed at the original end = %v, want %v", closed, wantClosed)
+			}
+		})
+	}
+}
+
+func TestUnsoldAuctionUnitsGoBackToSupply(t *testing.T) {
+	cases := []struct {
+		name string
+		kind string
+		// sold is how many units the buyer bids for or buys.
+		sold uint64
+	}{
+		{"english without bids", "english", 0},
+		{"english with fewer units bid for than offered", "english", 1},
+		{"dutch partly bought", "dutch", 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMarket(t)
+			listing := m.listing(t, &ListingParams{SupplyLimit: 5})
+			now := time.Now()
+			req := &AuctionCreateRequest{Kind: c.kind, Quantity: 3, EndsAt: now.Add(time.Hour)}
+			if c.kind == "dutch" {
+				req.StartPriceNanos = 2_000_000_000
+				req.PriceStepNanos = 100_000_000
+				req.PriceStepEverySeconds = 60
+			}
+			auction := m.auction(t, listing, req, now)
+			if got := m.supplyAvailable(t, listing.ID); got != 2 {
+				t.Fatalf("%d units available during the auction, want 2", got)
+			}
+
+			if c.sold > 0 {
+				var err error
+				if c.kind == "dutch" {
+					_, _, _, err = BuyDutchAuction(auction.ID, m.buyer.ID, c.sold, now, m.uow)
+				} else {
+					_, err = PlaceEnglishBid(auction.ID, m.buyer.ID, auction.ReservePriceNanos, c.sold, now, m.uow)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := CloseAuction(auction.ID, now.Add(time.Hour), m.provider, m.uow); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := m.supplyRemaining(t, listing.ID); got != 5 {
+				t.Errorf("%d units remaining after the auction, want all 5 back", got)
+			}
+			if got, want := m.supplyAvailable(t, listing.ID), 5-c.sold; got != want {
+				t.Errorf("%d units available after the auction, want %d with the rest held for the winner", got, want)
+			}
+		})
+	}
+}
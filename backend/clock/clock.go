@@ -0,0 +1,133 @@
+// Package clock abstracts the passage of time so schedulers can be driven
+// deterministically.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and makes tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of *time.Ticker schedulers use.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real returns a Clock backed by package time.
+func Real() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// Fake is a Clock that only moves when told to. Its tickers fire from
+// Advance and Set, once for every period boundary crossed; like
+// time.Ticker they drop ticks the receiver is not ready for.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{
+		fake:   f,
+		period: d,
+		next:   f.now.Add(d),
+		c:      make(chan time.Time, 1),
+	}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to now, which must not be before the current time.
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Before(f.now) {
+		panic("clock: Fake moved backwards")
+	}
+	f.now = now
+
+	for _, t := range f.tickers {
+		for !t.next.After(now) {
+			t.fire(t.next)
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+type fakeTicker struct {
+	fake   *Fake
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+func (t *fakeTicker) fire(at time.Time) {
+	select {
+	case t.c <- at:
+	default:
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.fake.mu.Lock()
+	defer t.fake.mu.Unlock()
+	for i, other := range t.fake.tickers {
+		if other == t {
+			t.fake.tickers = append(t.fake.tickers[:i], t.fake.tickers[i+1:]...)
+			return
+		}
+	}
+}
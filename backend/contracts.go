@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/accesstoken"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+var errNotParticipant = errors.New("caller neither owns nor sold this contract")
+
+const defaultAccessTokenTTL = 15 * time.Minute
+
+// AccessTokenTTL reads how long unlock tokens last from ACCESS_TOKEN_TTL.
+func AccessTokenTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL"))
+	if err != nil || ttl <= 0 {
+		return defaultAccessTokenTTL
+	}
+	return ttl
+}
+
+type UnlockResponse struct {
+	ContractID   uuid.UUID `json:"contract_id"`
+	DatastreamID uuid.UUID `json:"datastream_id"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type UsageDebitRequest struct {
+	Reads uint64 `json:"reads"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// UsageReport is a contract's consumption against its quotas. Remaining
+// counts are omitted where the quota is unlimited.
+type UsageReport struct {
+	ContractID     uuid.UUID             `json:"contract_id"`
+	Status         models.ContractStatus `json:"status"`
+	QuotaReads     uint64                `json:"quota_reads"`
+	ReadBytes      uint64                `json:"read_bytes"`
+	ReadsUsed      uint64                `json:"reads_used"`
+	BytesUsed      uint64                `json:"bytes_used"`
+	ReadsRemaining *uint64               `json:"reads_remaining,omitempty"`
+	BytesRemaining *uint64               `json:"bytes_remaining,omitempty"`
+
+	// The overage fields are set when the contract's listing prices reads
+	// past the quota.
+	OverageReadPriceNanos int64   `json:"overage_read_price_nanos,omitempty"`
+	OverageReads          *uint64 `json:"overage_reads,omitempty"`
+	OverageReadsBilled    *uint64 `json:"overage_reads_billed,omitempty"`
+	OverageCapCents       *int64  `json:"overage_cap_cents,omitempty"`
+}
+
+func NewUsageReport(header *models.ContractHeader, state *models.ContractState) *UsageReport {
+	report := &UsageReport{
+		ContractID: header.ID,
+		Status:     state.Status,
+		QuotaReads: header.QuotaReads,
+		ReadBytes:  header.ReadBytes,
+		ReadsUsed:  state.ReadsUsed,
+		BytesUsed:  state.BytesUsed,
+	}
+	if header.QuotaReads > 0 {
+		report.ReadsRemaining = &state.ReadsRemaining
+	}
+	if header.ReadBytes > 0 {
+		report.BytesRemaining = &state.BytesRemaining
+	}
+	if header.OverageReadPriceNanos > 0 {
+		report.OverageReadPriceNanos = header.OverageReadPriceNanos
+		report.OverageReads = &state.OverageReads
+		report.OverageReadsBilled = &state.OverageReadsBilled
+		report.OverageCapCents = &state.OverageCapCents
+	}
+	return report
+}
+
+// MeterUsage debits reads and bytes from a contract's quotas in a single
+// conditional UPDATE, so concurrent readers can never overdraw it. It fails
+// with repos.ErrQuotaExhausted once the contract has run out, with
+// repos.ErrOverageCapReached once reads past the quota would cost more than
+// the owner's overage cap allows, and with
+// repos.ErrContractNotUsable if it is not in one of
+// lifecycle.UsableStatusesFor its type.
+func MeterUsage(
+	header *models.ContractHeader,
+	reads, bytes uint64,
+	stateRepo repos.ContractStateRepository) (*models.ContractState, error) {
+
+	if end := header.AccessEnd(); end != nil && !end.After(time.Now()) {
+		// Due but not yet swept by the expiry scheduler.
+		return nil, repos.ErrContractNotUsable
+	}
+	usable := lifecycle.UsableStatusesFor(header.ContractType)
+	var err error
+	if header.OverageReadPriceNanos > 0 && header.QuotaReads > 0 {
+		err = stateRepo.DebitUsageWithOverage(
+			header.ID, reads, bytes, header.ReadBytes > 0, header.OverageReadPriceNanos, usable)
+	} else {
+		err = stateRepo.DebitUsage(header.ID, reads, bytes, header.QuotaReads > 0, header.ReadBytes > 0, usable)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return stateRepo.FindByID(header.ID)
+}
+
+// contractForParticipant loads the contract named by the {id} path value and
+// checks that the caller currently owns it or sold it originally. It writes
+// the HTTP error itself and returns ok=false when the request cannot go on.
+func contractForParticipant(
+	w http.ResponseWriter,
+	r *http.Request,
+	uow repos.UnitOfWork) (u *models.User, header *models.ContractHeader, state *models.ContractState, ok bool) {
+
+	rs := uow.Repos()
+	u, err := CurrentUser(r, rs.Users)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, nil, nil, false
+	}
+
+	id, err := uuid.Parse(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "invalid contract id", http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+	header, err = rs.Headers.FindByID(id)
+	if err != nil {
+		http.Error(w, "contract not found", http.StatusNotFound)
+		return nil, nil, nil, false
+	}
+	state, err = rs.States.FindByID(id)
+	if err != nil {
+		http.Error(w, "contract not found", http.StatusNotFound)
+		return nil, nil, nil, false
+	}
+
+	if state.OwnerID != u.ID {
+		listing, err := rs.Listings.FindByID(header.ListingID)
+		if err != nil || listing.SellerID != u.ID {
+			http.Error(w, errNotParticipant.Error(), http.StatusForbidden)
+			return nil, nil, nil, false
+		}
+	}
+	return u, header, state, true
+}
+
+// ContractHistoryHandler serves GET /v1/contracts/{id}/history: every status
+// change of the contract, oldest first.
+func ContractHistoryHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, header, _, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+
+		history, err := uow.Repos().StateHistory.FindAllByHeaderID(header.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch history: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(history)
+	}
+}
+
+// CustodyReport is a contract's chain of custody and whether replaying it
+// reproduces who owns the contract now.
+type CustodyReport struct {
+	HeaderID   uuid.UUID               `json:"header_id"`
+	OwnerID    uuid.UUID               `json:"owner_id"`
+	Entries    []models.OwnershipEntry `json:"entries"`
+	Consistent bool                    `json:"consistent"`
+	Problems   []string                `json:"problems"`
+}
+
+func NewCustodyReport(state *models.ContractState, entries []models.OwnershipEntry) *CustodyReport {
+	problems := lifecycle.CheckOwnership(state, entries)
+	if problems == nil {
+		problems = []string{}
+	}
+	return &CustodyReport{
+		HeaderID:   state.HeaderID,
+		OwnerID:    state.OwnerID,
+		Entries:    entries,
+		Consistent: len(problems) == 0,
+		Problems:   problems,
+	}
+}
+
+// ContractCustodyHandler serves GET /v1/contracts/{id}/custody: every
+// change of hands of the contract, oldest first, checked against its
+// current owner.
+func ContractCustodyHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _, state, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+
+		entries, err := uow.Repos().Ownership.FindAllByHeaderID(state.HeaderID)
+		if err != nil {
+			http.Error(w, "failed to fetch custody: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(NewCustodyReport(state, entries))
+	}
+}
+
+// ContractUsageHandler serves GET /v1/contracts/{id}/usage to the contract's
+// owner and its seller.
+func ContractUsageHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, header, state, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(NewUsageReport(header, state))
+	}
+}
+
+// ContractMeterHandler serves POST /v1/contracts/{id}/usage, which records
+// reads and bytes the owner consumed and answers with the updated usage.
+// Requests that would overdraw a quota are refused whole with 429.
+func ContractMeterHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, header, state, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+		if state.OwnerID != u.ID {
+			http.Error(w, "only the owner may consume this contract", http.StatusForbidden)
+			return
+		}
+
+		req := &UsageDebitRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Reads == 0 && req.Bytes == 0 {
+			http.Error(w, "nothing to meter", http.StatusBadRequest)
+			return
+		}
+
+		state, err := MeterUsage(header, req.Reads, req.Bytes, uow.Repos().States)
+		switch {
+		case errors.Is(err, repos.ErrQuotaExhausted), errors.Is(err, repos.ErrOverageCapReached):
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		case errors.Is(err, repos.ErrContractNotUsable):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, "failed to meter usage: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(NewUsageReport(header, state))
+	}
+}
+
+// ContractUnlockHandler serves POST /v1/contracts/{id}/unlock. The owner of
+// an owned contract moves it to StatusUnlocked and gets an access token for
+// its datastream, valid for AccessTokenTTL or until the contract expires,
+// whichever is sooner, and carrying what is left of its quota. Unlocking an
+// already unlocked contract just issues a fresh token.
+func ContractUnlockHandler(uow repos.UnitOfWork, signer *accesstoken.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, header, state, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+		if state.OwnerID != u.ID {
+			http.Error(w, "only the owner may unlock this contract", http.StatusForbidden)
+			return
+		}
+
+		now := time.Now()
+		if end := header.AccessEnd(); end != nil && !end.After(now) {
+			http.Error(w, "contract has expired", http.StatusConflict)
+			return
+		}
+		if header.DatastreamID == uuid.Nil {
+			http.Error(w, "contract grants no datastream", http.StatusConflict)
+			return
+		}
+		datastream, err := uow.Repos().Datastreams.FindByID(header.DatastreamID)
+		if err != nil {
+			http.Error(w, "datastream not found", http.StatusInternalServerError)
+			return
+		}
+		if datastream.Status != models.DatastreamActive {
+			http.Error(w, "datastream is "+datastream.Status.String(), http.StatusConflict)
+			return
+		}
+		if readsExhausted(header, state) ||
+			(header.ReadBytes > 0 && state.BytesRemaining == 0) {
+			http.Error(w, repos.ErrQuotaExhausted.Error(), http.StatusTooManyRequests)
+			return
+		}
+
+		switch state.Status {
+		case models.StatusOwned:
+			if header.ContractType == models.ContractOption {
+				http.Error(w, "option must be exercised before it can be unlocked", http.StatusConflict)
+				return
+			}
+			err := uow.WithTx(func(tx *repos.Repos) error {
+				return lifecycle.TransitionContract(tx, state, models.StatusUnlocked, u.ID, "unlocked by owner")
+			})
+			if errors.Is(err, repos.ErrContractStatusConflict) {
+				http.Error(w, "contract changed concurrently, retry", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "failed to unlock: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case models.StatusUnlocked:
+		default:
+			http.Error(w, "contract is "+state.Status.String(), http.StatusConflict)
+			return
+		}
+
+		expiresAt := now.Add(AccessTokenTTL())
+		if end := header.AccessEnd(); end != nil && end.Before(expiresAt) {
+			expiresAt = *end
+		}
+		claims := &accesstoken.Claims{
+			ContractID:   header.ID,
+			OwnerID:      state.OwnerID,
+			DatastreamID: header.DatastreamID,
+			IssuedAt:     now.Unix(),
+			ExpiresAt:    expiresAt.Unix(),
+		}
+		if header.QuotaReads > 0 {
+			// Reads the owner's overage cap still allows count too.
+			reads := state.ReadsRemaining + overageReadsLeft(header, state)
+			claims.Reads = &reads
+		}
+		if header.ReadBytes > 0 {
+			claims.Bytes = &state.BytesRemaining
+		}
+		token, err := signer.Sign(claims)
+		if err != nil {
+			http.Error(w, "failed to sign token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&UnlockResponse{
+			ContractID:   header.ID,
+			DatastreamID: header.DatastreamID,
+			Token:        token,
+			ExpiresAt:    claims.Expiry(),
+		})
+	}
+}
+
+// AccessTokenKeyHandler serves the public half of the token signing key, for
+// gateways to verify tokens with.
+func AccessTokenKeyHandler(signer *accesstoken.Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"alg":        "EdDSA",
+			"public_key": accesstoken.EncodePublicKey(signer.PublicKey()),
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+)
+
+type debit struct {
+	reads, bytes uint64
+	err          error
+}
+
+type usage struct {
+	readsRemaining, bytesRemaining, readsUsed, bytesUsed, overageReads uint64
+}
+
+var meterCases = []struct {
+	name    string
+	listing ListingParams
+	// prepare, when set, adjusts the contract before it is metered.
+	prepare func(header *models.ContractHeader, state *models.ContractState)
+	debits  []debit
+	want    usage
+}{
+	{
+		name:    "within quota",
+		listing: ListingParams{QuotaReads: 10, ReadBytes: 1000},
+		debits:  []debit{{reads: 4, bytes: 400}, {reads: 6, bytes: 600}},
+		want:    usage{readsUsed: 10, bytesUsed: 1000},
+	},
+	{
+		name:    "reads exhausted",
+		listing: ListingParams{QuotaReads: 10, ReadBytes: 1000},
+		debits:  []debit{{reads: 8, bytes: 100}, {reads: 3, bytes: 100, err: repos.ErrQuotaExhausted}, {reads: 2, bytes: 100}},
+		want:    usage{bytesRemaining: 800, readsUsed: 10, bytesUsed: 200},
+	},
+	{
+		name:    "bytes exhausted",
+		listing: ListingParams{QuotaReads: 10, ReadBytes: 1000},
+		debits:  []debit{{reads: 1, bytes: 900}, {reads: 1, bytes: 101, err: repos.ErrQuotaExhausted}},
+		want:    usage{readsRemaining: 9, bytesRemaining: 100, readsUsed: 1, bytesUsed: 900},
+	},
+	{
+		name:    "unlimited",
+		listing: ListingParams{},
+		debits:  []debit{{reads: 1 << 40, bytes: 1 << 50}},
+		want:    usage{readsUsed: 1 << 40, bytesUsed: 1 << 50},
+	},
+	{
+		name:    "overage within cap",
+		listing: ListingParams{QuotaReads: 10, OverageReadPriceNanos: 10_000_000},
+		prepare: func(_ *models.ContractHeader, s *models.ContractState) { s.OverageCapCents = 5 },
+		debits:  []debit{{reads: 12}, {reads: 3}},
+		want:    usage{readsUsed: 15, overageReads: 5},
+	},
+	{
+		name:    "overage cap reached",
+		listing: ListingParams{QuotaReads: 10, OverageReadPriceNanos: 10_000_000},
+		prepare: func(_ *models.ContractHeader, s *models.ContractState) { s.OverageCapCents = 5 },
+		debits:  []debit{{reads: 14}, {reads: 2, err: repos.ErrOverageCapReached}, {reads: 1}},
+		want:    usage{readsUsed: 15, overageReads: 5},
+	},
+	{
+		name:    "billed overage frees the cap",
+		listing: ListingParams{QuotaReads: 10, OverageReadPriceNanos: 10_000_000},
+		prepare: func(_ *models.ContractHeader, s *models.ContractState) {
+			s.OverageCapCents, s.OverageReads, s.OverageReadsBilled = 5, 20, 18
+		},
+		debits: []debit{{reads: 14, err: repos.ErrOverageCapReached}, {reads: 13}},
+		want:   usage{readsUsed: 13, overageReads: 23},
+	},
+	{
+		name:    "overage without a cap",
+		listing: ListingParams{QuotaReads: 10, OverageReadPriceNanos: 10_000_000},
+		debits:  []debit{{reads: 11, err: repos.ErrQuotaExhausted}, {reads: 10}},
+		want:    usage{readsUsed: 10},
+	},
+	{
+		name:    "overage bytes exhausted",
+		listing: ListingParams{QuotaReads: 10, ReadBytes: 100, OverageReadPriceNanos: 10_000_000},
+		prepare: func(_ *models.ContractHeader, s *models.ContractState) { s.OverageCapCents = 5 },
+		debits:  []debit{{reads: 12, bytes: 101, err: repos.ErrQuotaExhausted}},
+		want:    usage{readsRemaining: 10, bytesRemaining: 100},
+	},
+	{
+		name:    "listed",
+		listing: ListingParams{QuotaReads: 10},
+		prepare: func(_ *models.ContractHeader, s *models.ContractState) { s.Status = models.StatusListed },
+		debits:  []debit{{reads: 1, err: repos.ErrContractNotUsable}},
+		want:    usage{readsRemaining: 10},
+	},
+	{
+		name:    "unexercised option",
+		listing: ListingParams{QuotaReads: 10, ContractType: models.ContractOption, StrikePriceNanos: 1_000_000_000},
+		debits:  []debit{{reads: 1, err: repos.ErrContractNotUsable}},
+		want:    usage{readsRemaining: 10},
+	},
+	{
+		name:    "access ended",
+		listing: ListingParams{QuotaReads: 10},
+		prepare: func(h *models.ContractHeader, _ *models.ContractState) {
+			ended := time.Now().Add(-time.Minute)
+			h.AccessUntil = &ended
+		},
+		debits: []debit{{reads: 1, err: repos.ErrContractNotUsable}},
+		want:   usage{readsRemaining: 10},
+	},
+}
+
+func TestMeterUsage(t *testing.T) {
+	testMeterUsage(t, newTestMarket)
+}
+
+// TestMeterUsagePostgres runs the cases against the conditional UPDATEs
+// that do the metering in production.
+func TestMeterUsagePostgres(t *testing.T) {
+	testMeterUsage(t, newPostgresTestMarket)
+}
+
+func testMeterUsage(t *testing.T, newMarket func(t *testing.T) *testMarket) {
+	for _, c := range meterCases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newMarket(t)
+			header, state := m.meteredContract(t, c.listing)
+			if c.prepare != nil {
+				c.prepare(header, state)
+				if err := m.uow.Repos().States.Update(state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, d := range c.debits {
+				_, err := MeterUsage(header, d.reads, d.bytes, m.uow.Repos().States)
+				if !errors.Is(err, d.err) {
+					t.Errorf("debit %d: err = %v, want %v", i, err, d.err)
+				}
+			}
+			state = m.state(t, state)
+			got := usage{state.ReadsRemaining, state.BytesRemaining, state.ReadsUsed, state.BytesUsed, state.OverageReads}
+			if got != c.want {
+				t.Errorf("usage = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+// meteredContract sells the buyer one contract from a listing made with p.
+func (m *testMarket) meteredContract(t *testing.T, p ListingParams) (*models.ContractHeader, *models.ContractState) {
+	t.Helper()
+	p.SupplyLimit = 1
+	if p.ContractType == models.ContractOption {
+		exerciseBy := time.Now().Add(time.Hour)
+		p.ExerciseBy, p.AccessHours = &exerciseBy, 1
+	}
+	listing := m.listing(t, &p)
+	m.buy(t, listing.ID, 1)
+	state := &m.owned(t, m.buyer)[0]
+	header, err := m.uow.Repos().Headers.FindByID(state.HeaderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header, state
+}
+
+func TestContractMeterHandler(t *testing.T) {
+	m := newTestMarket(t)
+	header, _ := m.meteredContract(t, ListingParams{QuotaReads: 10})
+	stranger := m.user(t, "stranger")
+
+	steps := []struct {
+		name string
+		as   *models.User
+		body string
+		want int
+	}{
+		{"stranger", stranger, `{"reads":1}`, http.StatusForbidden},
+		{"seller", m.seller, `{"reads":1}`, http.StatusForbidden},
+		{"nothing to meter", m.buyer, `{}`, http.StatusBadRequest},
+		{"within quota", m.buyer, `{"reads":10}`, http.StatusOK},
+		{"exhausted", m.buyer, `{"reads":1}`, http.StatusTooManyRequests},
+	}
+	for _, step := range steps {
+		r := as(httptest.NewRequest(http.MethodPost, "/v1/contracts/"+header.ID.String()+"/usage", bytes.NewBufferString(step.body)), step.as)
+		r.SetPathValue("id", header.ID.String())
+		w := httptest.NewRecorder()
+		ContractMeterHandler(m.uow)(w, r)
+		if w.Code != step.want {
+			t.Errorf("%s: status %d, want %d: %s", step.name, w.Code, step.want, w.Body)
+		}
+	}
+}
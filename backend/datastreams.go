@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+type DatastreamRequest struct {
+	Name             string `json:"name"`
+	Description      string `json:"description"`
+	Schema           string `json:"schema"`
+	DeliveryEndpoint string `json:"delivery_endpoint"`
+	// Status is "active", "paused" or "retired". Empty keeps the current
+	// status, or makes a new datastream active.
+	Status string `json:"status"`
+}
+
+// apply validates req and copies it onto datastream.
+func (req *DatastreamRequest) apply(datastream *models.Datastream) error {
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+	if req.DeliveryEndpoint != "" {
+		u, err := url.Parse(req.DeliveryEndpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("delivery_endpoint must be an absolute http(s) URL")
+		}
+	}
+	if req.Status != "" {
+		status, err := models.ParseDatastreamStatus(req.Status)
+		if err != nil {
+			return err
+		}
+		datastream.Status = status
+	}
+
+	datastream.Name = req.Name
+	datastream.Description = req.Description
+	datastream.Schema = req.Schema
+	datastream.DeliveryEndpoint = req.DeliveryEndpoint
+	return nil
+}
+
+// sellerDatastreamID parses the datastream a seller wants a listing linked
+// to. The seller must own it and it must not be retired. An empty id links
+// no datastream.
+func sellerDatastreamID(
+	id string,
+	sellerID uuid.UUID,
+	datastreamRepo repos.DatastreamRepository) (uuid.UUID, error) {
+
+	if id == "" {
+		return uuid.Nil, nil
+	}
+	datastreamID, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	datastream, err := datastreamRepo.FindByID(datastreamID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if datastream.OwnerID != sellerID {
+		return uuid.Nil, errors.New("datastream belongs to another seller")
+	}
+	if datastream.Status == models.DatastreamRetired {
+		return uuid.Nil, errors.New("datastream is retired")
+	}
+	return datastream.ID, nil
+}
+
+// DatastreamsHandler serves /v1/datastreams: GET lists the caller's
+// datastreams and POST registers a new one.
+func DatastreamsHandler(
+	datastreamRepo repos.DatastreamRepository,
+	userRepo repos.UserRepository) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			datastreams, err := datastreamRepo.FindAllByOwnerID(u.ID)
+			if err != nil {
+				http.Error(w, "failed to fetch datastreams: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(datastreams)
+		case http.MethodPost:
+			req := &DatastreamRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			now := time.Now()
+			datastream := &models.Datastream{
+				ID:        uuid.New(),
+				OwnerID:   u.ID,
+				Status:    models.DatastreamActive,
+				CreatedAt: now,
+				UpdatedAt: now,
+			}
+			if err := req.apply(datastream); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := datastreamRepo.Create(datastream); err != nil {
+				http.Error(w, "failed to create datastream: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(datastream)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// DatastreamHandler serves /v1/datastreams/{id}. Anyone signed in may GET a
+// datastream, to see what a listing sells, but only its owner sees the
+// delivery endpoint. PUT and DELETE are for the owner only, and a
+// datastream that listings still point at cannot be deleted; retire it
+// instead.
+func DatastreamHandler(
+	datastreamRepo repos.DatastreamRepository,
+	listingRepo repos.ContractListingRepository,
+	userRepo repos.UserRepository) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid datastream id", http.StatusBadRequest)
+			return
+		}
+		datastream, err := datastreamRepo.FindByID(id)
+		if err != nil {
+			http.Error(w, "datastream not found", http.StatusNotFound)
+			return
+		}
+		isOwner := datastream.OwnerID == u.ID
+
+		switch r.Method {
+		case http.MethodGet:
+			if !isOwner {
+				datastream.DeliveryEndpoint = ""
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(datastream)
+		case http.MethodPut:
+			if !isOwner {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			req := &DatastreamRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := req.apply(datastream); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			datastream.UpdatedAt = time.Now()
+			if err := datastreamRepo.Update(datastream); err != nil {
+				http.Error(w, "failed to update datastream: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(datastream)
+		case http.MethodDelete:
+			if !isOwner {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			listings, err := listingRepo.FindAllByDatastreamID(datastream.ID)
+			if err != nil {
+				http.Error(w, "failed to fetch listings: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(listings) > 0 {
+				http.Error(w, "datastream is used by listings; retire it instead", http.StatusConflict)
+				return
+			}
+			if err := datastreamRepo.Delete(datastream.ID); err != nil {
+				http.Error(w, "failed to delete datastream: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
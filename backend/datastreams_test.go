@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+)
+
+// datastreamRequest calls the datastream API as u and returns the status
+// and body.
+func (m *testMarket) datastreamRequest(t *testing.T, u *models.User, method, id, body string) (int, *bytes.Buffer) {
+	t.Helper()
+	rs := m.uow.Repos()
+	handler := DatastreamsHandler(rs.Datastreams, rs.Users)
+	path := "/v1/datastreams"
+	if id != "" {
+		handler = DatastreamHandler(rs.Datastreams, rs.Listings, rs.Users)
+		path += "/" + id
+	}
+	r := as(httptest.NewRequest(method, path, bytes.NewBufferString(body)), u)
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code, w.Body
+}
+
+func (m *testMarket) datastream(t *testing.T, u *models.User, body string) *models.Datastream {
+	t.Helper()
+	code, resp := m.datastreamRequest(t, u, http.MethodPost, "", body)
+	if code != http.StatusCreated {
+		t.Fatalf("create datastream: %d %s", code, resp)
+	}
+	ds := &models.Datastream{}
+	if err := json.NewDecoder(resp).Decode(ds); err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func TestDatastreamCRUD(t *testing.T) {
+	m := newTestMarket(t)
+	ds := m.datastream(t, m.seller, `{"name":"ticks","schema":"{}","delivery_endpoint":"https://feed.example/ticks"}`)
+	if ds.OwnerID != m.seller.ID || ds.Status != models.DatastreamActive {
+		t.Fatalf("created %+v", ds)
+	}
+	id := ds.ID.String()
+
+	code, body := m.datastreamRequest(t, m.seller, http.MethodGet, "", "")
+	var mine []models.Datastream
+	if err := json.NewDecoder(body).Decode(&mine); code != http.StatusOK || err != nil || len(mine) != 1 || mine[0].ID != ds.ID {
+		t.Fatalf("list: %d %v %+v", code, err, mine)
+	}
+
+	code, body = m.datastreamRequest(t, m.seller, http.MethodPut, id, `{"name":"ticks v2","status":"paused"}`)
+	if code != http.StatusOK {
+		t.Fatalf("update: %d %s", code, body)
+	}
+	got, err := m.uow.Repos().Datastreams.FindByID(ds.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "ticks v2" || got.Status != models.DatastreamPaused || got.DeliveryEndpoint != "" {
+		t.Errorf("updated to %+v", got)
+	}
+
+	if code, body = m.datastreamRequest(t, m.seller, http.MethodDelete, id, ""); code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", code, body)
+	}
+	if code, _ = m.datastreamRequest(t, m.seller, http.MethodGet, id, ""); code != http.StatusNotFound {
+		t.Errorf("get deleted: %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestDatastreamRequestValidation(t *testing.T) {
+	m := newTestMarket(t)
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"no name", `{"delivery_endpoint":"https://feed.example"}`},
+		{"relative endpoint", `{"name":"ticks","delivery_endpoint":"/ticks"}`},
+		{"not http", `{"name":"ticks","delivery_endpoint":"ftp://feed.example/ticks"}`},
+		{"unknown status", `{"name":"ticks","status":"sleeping"}`},
+		{"not JSON", `{`},
+	}
+	for _, c := range cases {
+		if code, _ := m.datastreamRequest(t, m.seller, http.MethodPost, "", c.body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", c.name, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDatastreamOwnership(t *testing.T) {
+	m := newTestMarket(t)
+	ds := m.datastream(t, m.seller, `{"name":"ticks","delivery_endpoint":"https://feed.example/ticks"}`)
+	id := ds.ID.String()
+
+	code, body := m.datastreamRequest(t, m.buyer, http.MethodGet, id, "")
+	seen := &models.Datastream{}
+	if err := json.NewDecoder(body).Decode(seen); code != http.StatusOK || err != nil {
+		t.Fatalf("get as buyer: %d %v", code, err)
+	}
+	if seen.Name != "ticks" || seen.DeliveryEndpoint != "" {
+		t.Errorf("buyer sees %+v", seen)
+	}
+	if code, body := m.datastreamRequest(t, m.buyer, http.MethodGet, "", ""); code != http.StatusOK || bytes.Contains(body.Bytes(), []byte(id)) {
+		t.Errorf("buyer's list: %d %s", code, body)
+	}
+
+	if code, _ := m.datastreamRequest(t, m.buyer, http.MethodPut, id, `{"name":"mine now"}`); code != http.StatusForbidden {
+		t.Errorf("update as buyer: %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := m.datastreamRequest(t, m.buyer, http.MethodDelete, id, ""); code != http.StatusForbidden {
+		t.Errorf("delete as buyer: %d, want %d", code, http.StatusForbidden)
+	}
+	if got, err := m.uow.Repos().Datastreams.FindByID(ds.ID); err != nil || got.Name != "ticks" {
+		t.Errorf("after the buyer's attempts: %+v, %v", got, err)
+	}
+
+	// A datastream a listing sells cannot be deleted, only retired.
+	m.listing(t, &ListingParams{SupplyLimit: 1, DatastreamID: ds.ID})
+	if code, _ := m.datastreamRequest(t, m.seller, http.MethodDelete, id, ""); code != http.StatusConflict {
+		t.Errorf("delete while listed: %d, want %d", code, http.StatusConflict)
+	}
+	if code, _ := m.datastreamRequest(t, m.seller, http.MethodPut, id, `{"name":"ticks","status":"retired"}`); code != http.StatusOK {
+		t.Errorf("retire: %d", code)
+	}
+}
+
+func TestSellerDatastreamID(t *testing.T) {
+	m := newTestMarket(t)
+	ds := m.datastream(t, m.seller, `{"name":"ticks"}`)
+	retired := m.datastream(t, m.seller, `{"name":"old ticks","status":"retired"}`)
+	datastreams := m.uow.Repos().Datastreams
+
+	cases := []struct {
+		name     string
+		id       string
+		sellerID uuid.UUID
+		want     uuid.UUID
+		wantErr  bool
+	}{
+		{name: "none", sellerID: m.seller.ID},
+		{name: "own", id: ds.ID.String(), sellerID: m.seller.ID, want: ds.ID},
+		{name: "another seller's", id: ds.ID.String(), sellerID: m.buyer.ID, wantErr: true},
+		{name: "retired", id: retired.ID.String(), sellerID: m.seller.ID, wantErr: true},
+		{name: "unknown", id: uuid.NewString(), sellerID: m.seller.ID, wantErr: true},
+		{name: "malformed", id: "ticks", sellerID: m.seller.ID, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := sellerDatastreamID(c.id, c.sellerID, datastreams)
+		if (err != nil) != c.wantErr || got != c.want {
+			t.Errorf("%s: got %s, %v", c.name, got, err)
+		}
+	}
+}
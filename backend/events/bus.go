@@ -0,0 +1,104 @@
+// Package events carries in-process notifications about marketplace
+// activity from the code that causes it to whoever cares.
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Type string
+
+const (
+	// ContractExpired is published when a contract reaches its exercise-by
+	// time, or an exercised option the end of its access period, and loses
+	// access to its datastream.
+	ContractExpired Type = "contract.expired"
+
+	// FillReleased is published when an order book fill goes unpaid and
+	// its contracts are put back on offer; TransactionID is the fill's.
+	FillReleased Type = "fill.released"
+
+	// ContractFrozen is published when a contract is frozen because the
+	// payment that bought it is disputed; it has been taken off offer
+	// first if need be.
+	ContractFrozen Type = "contract.frozen"
+
+	// The refund request events are published once to the buyer and once
+	// to the seller of the transaction a request is about.
+	RefundRequested Type = "refund.requested"
+	RefundApproved  Type = "refund.approved"
+	RefundDenied    Type = "refund.denied"
+	RefundWithdrawn Type = "refund.withdrawn"
+	RefundFailed    Type = "refund.failed"
+)
+
+// Event is one thing that happened. ContractID, TransactionID and UserID
+// are set where the event concerns a contract, a transaction or a user;
+// Reason is free text.
+type Event struct {
+	Type          Type
+	At            time.Time
+	ContractID    uuid.UUID
+	TransactionID uuid.UUID
+	UserID        uuid.UUID
+	Reason        string
+}
+
+type Handler func(Event)
+
+// Bus delivers published events synchronously to every subscriber of their
+// type, in subscription order. A panicking handler is logged and does not
+// stop delivery to the others.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[Type][]Handler
+	all      []Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[Type][]Handler)}
+}
+
+// Subscribe calls h for every event of type t.
+func (b *Bus) Subscribe(t Type, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[t] = append(b.handlers[t], h)
+}
+
+// SubscribeAll calls h for every event.
+func (b *Bus) SubscribeAll(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.all = append(b.all, h)
+}
+
+// Publish delivers ev. Publish on a nil Bus does nothing, so publishers
+// need not care whether anyone is listening.
+func (b *Bus) Publish(ev Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.handlers[ev.Type])+len(b.all))
+	handlers = append(handlers, b.handlers[ev.Type]...)
+	handlers = append(handlers, b.all...)
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		deliver(h, ev)
+	}
+}
+
+func deliver(h Handler, ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("events: %s handler panicked: %v", ev.Type, r)
+		}
+	}()
+	h(ev)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+)
+
+const (
+	defaultExpiryTick = time.Minute
+	expiryBatchSize   = 1000
+)
+
+// expirableStatuses are the statuses a contract can expire from.
+func expirableStatuses() []models.ContractStatus {
+	var statuses []models.ContractStatus
+	for s := models.StatusDraft; s < models.StatusExpiryReached; s++ {
+		if lifecycle.CanTransitionContract(s, models.StatusExpiryReached) {
+			statuses = append(statuses, s)
+		}
+	}
+	return statuses
+}
+
+// ExpireDueContracts moves every contract whose exercise-by time, or for an
+// exercised option the end of its access period, is at or before now to
+// StatusExpiryReached, which takes it out of
+// lifecycle.UsableStatuses and so cuts off its access. A
+// events.ContractExpired event is published for each one once its
+// transition has committed. Contracts that change status concurrently are
+// skipped and picked up by a later run if still due.
+func ExpireDueContracts(now time.Time, uow repos.UnitOfWork, bus *events.Bus) (int, error) {
+	statuses := expirableStatuses()
+	expired := 0
+	for {
+		due, err := uow.Repos().States.FindAllDueForExpiry(now, statuses, expiryBatchSize)
+		if err != nil {
+			return expired, err
+		}
+
+		progressed := false
+		for i := range due {
+			state := &due[i]
+			reason := "exercise-by reached"
+			if state.Status == models.StatusUnlocked {
+				reason = "access period ended"
+			}
+			err := uow.WithTx(func(tx *repos.Repos) error {
+				return lifecycle.TransitionContract(
+					tx, state, models.StatusExpiryReached, lifecycle.SystemActor, reason)
+			})
+			if errors.Is(err, repos.ErrContractStatusConflict) {
+				continue
+			}
+			if err != nil {
+				return expired, err
+			}
+
+			expired++
+			progressed = true
+			bus.Publish(events.Event{
+				Type:       events.ContractExpired,
+				At:         now,
+				ContractID: state.HeaderID,
+				UserID:     state.OwnerID,
+				Reason:     reason,
+			})
+		}
+
+		if len(due) < expiryBatchSize || !progressed {
+			return expired, nil
+		}
+	}
+}
+
+// StartExpiryScheduler runs ExpireDueContracts on every tick of clk until
+// the returned stop function is called.
+func StartExpiryScheduler(
+	interval time.Duration,
+	clk clock.Clock,
+	uow repos.UnitOfWork,
+	bus *events.Bus) (stop func()) {
+
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := ExpireDueContracts(clk.Now(), uow, bus)
+				if err != nil {
+					log.Printf("contract expiry failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("expired %d contracts", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/models"
+)
+
+func TestExpirySchedulerExpiresDueContracts(t *testing.T) {
+	m := newTestMarket(t)
+	clk := clock.NewFake(time.Now())
+	exerciseBy := clk.Now().Add(2 * time.Hour)
+	listing := m.listing(t, &ListingParams{SupplyLimit: 2, ExerciseBy: &exerciseBy})
+	m.buy(t, listing.ID, 2)
+
+	bus := events.NewBus()
+	expired := make(chan events.Event, 2)
+	bus.Subscribe(events.ContractExpired, func(ev events.Event) { expired <- ev })
+
+	n, err := ExpireDueContracts(clk.Now().Add(time.Hour), m.uow, bus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expired %d contracts an hour before their exercise-by, want none", n)
+	}
+
+	stop := StartExpiryScheduler(time.Minute, clk, m.uow, bus)
+	defer stop()
+	clk.Advance(2 * time.Hour)
+	for range 2 {
+		select {
+		case ev := <-expired:
+			if ev.UserID != m.buyer.ID || !ev.At.Equal(clk.Now()) {
+				t.Errorf("event %+v, want one for the buyer at %v", ev, clk.Now())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("scheduler did not expire the contracts")
+		}
+	}
+
+	states, err := m.uow.Repos().States.FindAllByOwnerID(m.buyer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range states {
+		if s.Status != models.StatusExpiryReached {
+			t.Errorf("contract %s is %s, want expired", s.HeaderID, s.Status)
+		}
+	}
+	history, err := m.uow.Repos().StateHistory.FindAllByHeaderID(states[0].HeaderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := history[len(history)-1]; last.ToStatus != models.StatusExpiryReached || last.Reason != "exercise-by reached" {
+		t.Errorf("last history row %+v, want the expiry", last)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/accesstoken"
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/gateway"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// datastreamUpstreams resolves gateway upstreams from the datastreams table.
+type datastreamUpstreams struct {
+	datastreamRepo repos.DatastreamRepository
+}
+
+func (u *datastreamUpstreams) Upstream(datastreamID uuid.UUID) (*url.URL, error) {
+	datastream, err := u.datastreamRepo.FindByID(datastreamID)
+	if err != nil {
+		return nil, err
+	}
+	if datastream.Status != models.DatastreamActive {
+		return nil, errors.New("datastream is " + datastream.Status.String())
+	}
+	if datastream.DeliveryEndpoint == "" {
+		return nil, errors.New("datastream has no delivery endpoint")
+	}
+	return url.Parse(datastream.DeliveryEndpoint)
+}
+
+// contractUsageSink records gateway usage on the contract's state and tells
+// the gateway to stop serving contracts that are spent or no longer usable.
+type contractUsageSink struct {
+	uow repos.UnitOfWork
+}
+
+func (s *contractUsageSink) Record(usage accesstoken.Usage) error {
+	rs := s.uow.Repos()
+	header, err := rs.Headers.FindByID(usage.ContractID)
+	if err != nil {
+		return err
+	}
+	overage := header.OverageReadPriceNanos > 0 && header.QuotaReads > 0
+	if err := rs.States.ChargeUsage(usage.ContractID, usage.Reads, usage.Bytes, overage); err != nil {
+		return err
+	}
+	// The usage is recorded now, so only a revocation is worth reporting:
+	// any other error would have the gateway record it again.
+	err = s.check(rs, header)
+	if err != nil && !errors.Is(err, gateway.ErrContractRevoked) {
+		log.Printf("gateway: checking contract %s after recording usage: %v", usage.ContractID, err)
+		return nil
+	}
+	return err
+}
+
+// Check tells the gateway whether a contract it has stopped serving may be
+// served again, such as after a renewal reset its quota.
+func (s *contractUsageSink) Check(contractID uuid.UUID) error {
+	rs := s.uow.Repos()
+	header, err := rs.Headers.FindByID(contractID)
+	if err != nil {
+		return err
+	}
+	return s.check(rs, header)
+}
+
+func (s *contractUsageSink) check(rs *repos.Repos, header *models.ContractHeader) error {
+	state, err := rs.States.FindByID(header.ID)
+	if err != nil {
+		return err
+	}
+	usable := false
+	for _, status := range lifecycle.UsableStatusesFor(header.ContractType) {
+		usable = usable || state.Status == status
+	}
+	exhausted := readsExhausted(header, state) ||
+		(header.ReadBytes > 0 && state.BytesRemaining == 0)
+	if !usable || exhausted {
+		return gateway.ErrContractRevoked
+	}
+	return nil
+}
+
+// gatewayVerifier takes the token verification key from
+// ACCESS_TOKEN_PUBLIC_KEY, or derives it from ACCESS_TOKEN_SIGNING_KEY.
+func gatewayVerifier() *accesstoken.Verifier {
+	if encoded := os.Getenv("ACCESS_TOKEN_PUBLIC_KEY"); encoded != "" {
+		key, err := accesstoken.ParsePublicKey(encoded)
+		if err != nil {
+			log.Fatalf("ACCESS_TOKEN_PUBLIC_KEY: %v", err)
+		}
+		return accesstoken.NewVerifier(key, clock.Real())
+	}
+	if os.Getenv("ACCESS_TOKEN_SIGNING_KEY") == "" {
+		log.Fatal("gateway needs ACCESS_TOKEN_PUBLIC_KEY or ACCESS_TOKEN_SIGNING_KEY")
+	}
+	return accesstoken.NewVerifier(NewAccessTokenSigner().PublicKey(), clock.Real())
+}
+
+// runGateway serves datastreams to token holders, e.g.
+//
+//	go run . gateway -addr=:8081 -flush=10s
+func runGateway(args []string) {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	addr := fs.String("addr", ":8081", "address to listen on")
+	flush := fs.Duration("flush", 10*time.Second, "how often to record metered usage")
+	_ = fs.Parse(args)
+
+	db := SetupDB()
+	uow := repos.NewUnitOfWork(db.DB)
+
+	gw := gateway.New(
+		gatewayVerifier(),
+		&datastreamUpstreams{datastreamRepo: uow.Repos().Datastreams},
+		&contractUsageSink{uow: uow},
+		clock.Real())
+
+	go func() {
+		ticker := time.NewTicker(*flush)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := gw.Flush(); err != nil {
+				log.Printf("gateway: recording usage failed: %v", err)
+			}
+		}
+	}()
+
+	srv := &http.Server{
+		Addr:        *addr,
+		Handler:     gw,
+		ReadTimeout: 60 * time.Second,
+	}
+	log.Printf("gateway listening on %s", *addr)
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,213 @@
+// Package gateway is a reverse proxy that serves datastreams to holders of
+// contract access tokens, metering every request and response byte against
+// the allowance in the token.
+package gateway
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"contract_market_demo/backend/accesstoken"
+	"contract_market_demo/backend/clock"
+
+	"github.com/google/uuid"
+)
+
+// ErrContractRevoked is returned by a UsageSink for a contract that may no
+// longer be used, such as one that has expired or run out of quota. The
+// gateway stops serving it.
+var ErrContractRevoked = errors.New("contract access revoked")
+
+// Upstreams resolves a datastream to the URL it is served from.
+type Upstreams interface {
+	Upstream(datastreamID uuid.UUID) (*url.URL, error)
+}
+
+// How long a revoked contract is refused before the gateway asks the sink
+// again, so contracts that are renewed or topped up are served again; and
+// how long a revoked contract nobody asks for is remembered at all.
+const (
+	revokedRecheckAfter = time.Minute
+	revokedForgetAfter  = time.Hour
+)
+
+// UsageSink receives usage the gateway has metered, to record it against
+// the contract. Record and Check return ErrContractRevoked if the contract
+// can no longer be used. Record returns any other error only if it did not
+// record the usage, which the gateway then offers it again.
+type UsageSink interface {
+	Record(usage accesstoken.Usage) error
+	Check(contractID uuid.UUID) error
+}
+
+type Gateway struct {
+	verifier  *accesstoken.Verifier
+	upstreams Upstreams
+	sink      UsageSink
+	meter     *accesstoken.LocalMeter
+	clk       clock.Clock
+
+	mu sync.RWMutex
+	// revoked holds when each revoked contract was last confirmed revoked
+	// by the sink.
+	revoked map[uuid.UUID]time.Time
+}
+
+func New(verifier *accesstoken.Verifier, upstreams Upstreams, sink UsageSink, clk clock.Clock) *Gateway {
+	return &Gateway{
+		verifier:  verifier,
+		upstreams: upstreams,
+		sink:      sink,
+		meter:     accesstoken.NewLocalMeter(),
+		clk:       clk,
+		revoked:   make(map[uuid.UUID]time.Time),
+	}
+}
+
+// ServeHTTP proxies the request to the upstream of the datastream named in
+// the bearer token, keeping the request path and query. Each request costs
+// one read, which is refused with 429 once the token's reads are spent.
+// Response bytes are counted as they are streamed; a response may take the
+// token over its byte allowance, after which further requests are refused.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	claims, err := g.verifier.Verify(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if g.isRevoked(claims.ContractID) {
+		http.Error(w, ErrContractRevoked.Error(), http.StatusForbidden)
+		return
+	}
+	if _, _, bytesLeft, limited := g.meter.Remaining(claims); limited && bytesLeft == 0 {
+		http.Error(w, accesstoken.ErrQuotaExhausted.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err := g.meter.Debit(claims, 1, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	target, err := g.upstreams.Upstream(claims.DatastreamID)
+	if err != nil {
+		log.Printf("gateway: datastream %s: %v", claims.DatastreamID, err)
+		http.Error(w, "datastream unavailable", http.StatusBadGateway)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Set("X-Contract-ID", claims.ContractID.String())
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Body = &countingBody{ReadCloser: resp.Body, meter: g.meter, claims: claims}
+			return nil
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// Flush hands usage metered since the last flush to the sink, and stops
+// serving contracts the sink reports revoked. Usage the sink fails to take
+// for any other reason is kept for the next flush, and the first such error
+// is returned for the caller to log. Revoked contracts no one has asked for
+// in a while are forgotten, as are expired tokens.
+func (g *Gateway) Flush() error {
+	g.forgetRevoked()
+
+	var firstErr error
+	for _, usage := range g.meter.Drain() {
+		err := g.sink.Record(usage)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrContractRevoked):
+			g.revoke(usage.ContractID)
+		default:
+			g.meter.Restore(usage)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	g.meter.Prune(g.clk.Now())
+	return firstErr
+}
+
+// isRevoked reports whether the contract is revoked. A revocation older
+// than revokedRecheckAfter is checked with the sink again first, and lifted
+// if the contract is usable once more.
+func (g *Gateway) isRevoked(contractID uuid.UUID) bool {
+	g.mu.RLock()
+	checked, ok := g.revoked[contractID]
+	g.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if g.clk.Now().Sub(checked) < revokedRecheckAfter {
+		return true
+	}
+
+	err := g.sink.Check(contractID)
+	switch {
+	case err == nil:
+		g.mu.Lock()
+		delete(g.revoked, contractID)
+		g.mu.Unlock()
+		return false
+	case errors.Is(err, ErrContractRevoked):
+		g.revoke(contractID)
+	default:
+		log.Printf("gateway: checking contract %s: %v", contractID, err)
+	}
+	return true
+}
+
+func (g *Gateway) revoke(contractID uuid.UUID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.revoked[contractID] = g.clk.Now()
+}
+
+// forgetRevoked drops revocations that have not been checked, and so not
+// asked for, within revokedForgetAfter. A forgotten contract that comes
+// back is served until the next flush revokes it again.
+func (g *Gateway) forgetRevoked() {
+	cutoff := g.clk.Now().Add(-revokedForgetAfter)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for contractID, checked := range g.revoked {
+		if checked.Before(cutoff) {
+			delete(g.revoked, contractID)
+		}
+	}
+}
+
+// countingBody charges bytes read from an upstream response to the token.
+type countingBody struct {
+	io.ReadCloser
+	meter  *accesstoken.LocalMeter
+	claims *accesstoken.Claims
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.meter.Charge(b.claims, 0, uint64(n))
+	}
+	return n, err
+}
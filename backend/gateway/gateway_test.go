@@ -0,0 +1,265 @@
+package gateway
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/accesstoken"
+	"contract_market_demo/backend/clock"
+
+	"github.com/google/uuid"
+)
+
+type fixedUpstream struct {
+	url *url.URL
+}
+
+func (u fixedUpstream) Upstream(uuid.UUID) (*url.URL, error) {
+	return u.url, nil
+}
+
+// switchSink reports every contract revoked until told otherwise.
+type switchSink struct {
+	mu      sync.Mutex
+	revoked bool
+	checks  int
+}
+
+func (s *switchSink) set(revoked bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked = revoked
+}
+
+func (s *switchSink) result() error {
+	if s.revoked {
+		return ErrContractRevoked
+	}
+	return nil
+}
+
+func (s *switchSink) Record(accesstoken.Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result()
+}
+
+func (s *switchSink) Check(uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks++
+	return s.result()
+}
+
+func TestRevokedContractIsRecheckedAndForgotten(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL)
+
+	clk := clock.NewFake(time.Now())
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := accesstoken.NewSigner(priv).Sign(&accesstoken.Claims{
+		TokenID:    uuid.New(),
+		ContractID: uuid.New(),
+		IssuedAt:   clk.Now().Unix(),
+		ExpiresAt:  clk.Now().Add(24 * time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &switchSink{revoked: true}
+	gw := New(accesstoken.NewVerifier(pub, clk), fixedUpstream{target}, sink, clk)
+	get := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	_ = gw.Flush()
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("after the sink revoked the contract: %d", code)
+	}
+	if sink.checks != 0 {
+		t.Fatalf("a fresh revocation was checked %d times", sink.checks)
+	}
+
+	// Still revoked when it is next checked: keep refusing.
+	clk.Advance(revokedRecheckAfter)
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("still revoked: %d", code)
+	}
+	if sink.checks != 1 {
+		t.Fatalf("checked %d times, want 1", sink.checks)
+	}
+
+	// Renewed: served again once the revocation is due for a check.
+	sink.set(false)
+	if code := get(); code != http.StatusForbidden {
+		t.Fatalf("checked again before revokedRecheckAfter: %d", code)
+	}
+	clk.Advance(revokedRecheckAfter)
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("after renewal: %d", code)
+	}
+
+	// A revocation no one asks about is dropped.
+	sink.set(true)
+	_ = gw.Flush()
+	clk.Advance(revokedForgetAfter + time.Second)
+	_ = gw.Flush()
+	if n := len(gw.revoked); n != 0 {
+		t.Fatalf("%d revocations remembered, want 0", n)
+	}
+}
+
+// flakySink fails Record with err until it is cleared, and totals the
+// usage it does take.
+type flakySink struct {
+	mu       sync.Mutex
+	err      error
+	recorded accesstoken.Usage
+}
+
+func (s *flakySink) Record(usage accesstoken.Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.recorded.Reads += usage.Reads
+	s.recorded.Bytes += usage.Bytes
+	return nil
+}
+
+func (s *flakySink) Check(uuid.UUID) error {
+	return nil
+}
+
+// testGateway serves "ok" for every request through a gateway on sink, and
+// signs tokens for it.
+type testGateway struct {
+	gw     *Gateway
+	clk    *clock.Fake
+	signer *accesstoken.Signer
+}
+
+func newTestGateway(t *testing.T, sink UsageSink) *testGateway {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	target, _ := url.Parse(upstream.URL)
+
+	clk := clock.NewFake(time.Now())
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testGateway{
+		gw:     New(accesstoken.NewVerifier(pub, clk), fixedUpstream{target}, sink, clk),
+		clk:    clk,
+		signer: accesstoken.NewSigner(priv),
+	}
+}
+
+// unlock signs a token for contractID allowing reads reads, as unlocking
+// the contract would.
+func (g *testGateway) unlock(t *testing.T, contractID uuid.UUID, reads uint64) string {
+	t.Helper()
+	token, err := g.signer.Sign(&accesstoken.Claims{
+		ContractID: contractID,
+		Reads:      &reads,
+		IssuedAt:   g.clk.Now().Unix(),
+		ExpiresAt:  g.clk.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func (g *testGateway) get(token string) int {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	g.gw.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestUnlockingAgainDoesNotRenewAllowance(t *testing.T) {
+	sink := &flakySink{}
+	g := newTestGateway(t, sink)
+	contractID := uuid.New()
+
+	first := g.unlock(t, contractID, 2)
+	for i := 0; i < 2; i++ {
+		if code := g.get(first); code != http.StatusOK {
+			t.Fatalf("read %d: %d", i+1, code)
+		}
+	}
+	// Unlocked again before the usage was flushed, so the new token still
+	// carries the full quota.
+	second := g.unlock(t, contractID, 2)
+	if code := g.get(second); code != http.StatusTooManyRequests {
+		t.Fatalf("read on a second token past the quota: %d", code)
+	}
+
+	// Once the usage is recorded, a token issued with what is left is
+	// charged only for reads after it.
+	if err := g.gw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	third := g.unlock(t, contractID, 1)
+	if code := g.get(third); code != http.StatusOK {
+		t.Fatalf("read on a token issued after the flush: %d", code)
+	}
+	if code := g.get(third); code != http.StatusTooManyRequests {
+		t.Fatalf("read past what the third token allows: %d", code)
+	}
+}
+
+func TestFailedFlushKeepsUsage(t *testing.T) {
+	sink := &flakySink{err: errors.New("database unavailable")}
+	g := newTestGateway(t, sink)
+	token := g.unlock(t, uuid.New(), 10)
+
+	for i := 0; i < 3; i++ {
+		if code := g.get(token); code != http.StatusOK {
+			t.Fatalf("read %d: %d", i+1, code)
+		}
+	}
+	if err := g.gw.Flush(); err == nil {
+		t.Fatal("flush reported no error from a failing sink")
+	}
+
+	sink.mu.Lock()
+	sink.err = nil
+	sink.mu.Unlock()
+	if code := g.get(token); code != http.StatusOK {
+		t.Fatalf("read after the failed flush: %d", code)
+	}
+	if err := g.gw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if sink.recorded.Reads != 4 {
+		t.Errorf("sink recorded %d reads, want 4", sink.recorded.Reads)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/mail"
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+)
+
+// custody returns the contract's state and ownership ledger.
+func (m *testMarket) custody(t *testing.T, headerID uuid.UUID) (*models.ContractState, []models.OwnershipEntry) {
+	t.Helper()
+	rs := m.uow.Repos()
+	state, err := rs.States.FindByID(headerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rs.Ownership.FindAllByHeaderID(headerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, entries
+}
+
+func TestOwnershipLedgerReplaysToOwner(t *testing.T) {
+	cases := []struct {
+		name string
+		// after changes hands the contract the buyer bought and returns
+		// who should hold it.
+		after   func(t *testing.T, m *testMarket, headerID uuid.UUID, purchase *models.TransactionRecord) *models.User
+		kinds   []models.OwnershipEventKind
+		revoked bool
+	}{
+		{
+			name: "bought",
+			after: func(t *testing.T, m *testMarket, _ uuid.UUID, _ *models.TransactionRecord) *models.User {
+				return m.buyer
+			},
+			kinds: []models.OwnershipEventKind{models.OwnershipIssued, models.OwnershipSold},
+		},
+		{
+			name: "resold",
+			after: func(t *testing.T, m *testMarket, headerID uuid.UUID, _ *models.TransactionRecord) *models.User {
+				m.resell(t, headerID, 2_000_000_000)
+				return m.user(t, "second buyer")
+			},
+			kinds: []models.OwnershipEventKind{models.OwnershipIssued, models.OwnershipSold, models.OwnershipSold},
+		},
+		{
+			name: "given away",
+			after: func(t *testing.T, m *testMarket, headerID uuid.UUID, _ *models.TransactionRecord) *models.User {
+				friend := m.user(t, "friend")
+				req := &TransferRequest{RecipientID: friend.ID.String()}
+				if _, _, err := StartTransfer(headerID, m.buyer.ID, req, time.Now(), m.provider, mail.NewFakeSender(), m.uow); err != nil {
+					t.Fatal(err)
+				}
+				return friend
+			},
+			kinds: []models.OwnershipEventKind{models.OwnershipIssued, models.OwnershipSold, models.OwnershipTransferred},
+		},
+		{
+			name: "refunded",
+			after: func(t *testing.T, m *testMarket, _ uuid.UUID, purchase *models.TransactionRecord) *models.User {
+				if _, err := RefundTransaction(purchase.ID, m.seller, 1, "test", m.provider, m.uow); err != nil {
+					t.Fatal(err)
+				}
+				return m.buyer
+			},
+			kinds:   []models.OwnershipEventKind{models.OwnershipIssued, models.OwnershipSold, models.OwnershipRevoked},
+			revoked: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMarket(t)
+			listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+			purchase := m.buy(t, listing.ID, 1)
+			headerID := m.owned(t, m.buyer)[0].HeaderID
+			owner := c.after(t, m, headerID, purchase)
+
+			state, entries := m.custody(t, headerID)
+			var kinds []models.OwnershipEventKind
+			for _, e := range entries {
+				kinds = append(kinds, e.Kind)
+			}
+			if !slices.Equal(kinds, c.kinds) {
+				t.Errorf("ledger %v, want %v", kinds, c.kinds)
+			}
+			replay, problems := lifecycle.ReplayOwnership(entries)
+			if len(problems) > 0 {
+				t.Fatalf("replay problems: %v", problems)
+			}
+			if replay.OwnerID != owner.ID || replay.Revoked != c.revoked {
+				t.Errorf("replay gives %s (revoked %v), want %s (revoked %v)", replay.OwnerID, replay.Revoked, owner.ID, c.revoked)
+			}
+			if problems := lifecycle.CheckOwnership(state, entries); len(problems) > 0 {
+				t.Errorf("ledger disagrees with the state: %v", problems)
+			}
+
+			r := as(httptest.NewRequest(http.MethodGet, "/v1/contracts/"+headerID.String()+"/custody", nil), m.seller)
+			r.SetPathValue("id", headerID.String())
+			w := httptest.NewRecorder()
+			ContractCustodyHandler(m.uow)(w, r)
+			var report CustodyReport
+			if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+				t.Fatalf("custody: %d %v", w.Code, err)
+			}
+			if !report.Consistent || report.OwnerID != owner.ID {
+				t.Errorf("custody report %+v, want it consistent for %s", report, owner.ID)
+			}
+		})
+	}
+}
+
+func TestCheckOwnershipFindsTampering(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(state *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry
+	}{
+		{
+			name: "owner changed without an entry",
+			tamper: func(state *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry {
+				state.OwnerID = uuid.New()
+				return entries
+			},
+		},
+		{
+			name: "acquired at a different time",
+			tamper: func(state *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry {
+				state.LastPurchaseAt = state.LastPurchaseAt.Add(time.Hour)
+				return entries
+			},
+		},
+		{
+			name: "last entry missing",
+			tamper: func(_ *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry {
+				return entries[:len(entries)-1]
+			},
+		},
+		{
+			name: "first entry missing",
+			tamper: func(_ *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry {
+				return entries[1:]
+			},
+		},
+		{
+			name: "seller changed",
+			tamper: func(_ *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry {
+				entries[1].FromOwnerID = uuid.New()
+				return entries
+			},
+		},
+		{
+			name: "issued twice",
+			tamper: func(_ *models.ContractState, entries []models.OwnershipEntry) []models.OwnershipEntry {
+				entries[1].Kind = models.OwnershipIssued
+				return entries
+			},
+		},
+		{
+			name: "empty",
+			tamper: func(_ *models.ContractState, _ []models.OwnershipEntry) []models.OwnershipEntry {
+				return nil
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMarket(t)
+			listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+			m.buy(t, listing.ID, 1)
+			state, entries := m.custody(t, m.owned(t, m.buyer)[0].HeaderID)
+			if problems := lifecycle.CheckOwnership(state, entries); len(problems) > 0 {
+				t.Fatalf("untouched ledger has problems: %v", problems)
+			}
+
+			entries = c.tamper(state, entries)
+			if problems := lifecycle.CheckOwnership(state, entries); len(problems) == 0 {
+				t.Error("tampered ledger has no problems")
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrIllegalTransition = errors.New("illegal status transition")
+	ErrGuardRejected     = errors.New("transition rejected by guard")
+)
+
+// SystemActor is the actor recorded for transitions nobody asked for, such
+// as expiry.
+var SystemActor = uuid.Nil
+
+// historyBatchSize matches the batch size contracts are issued with.
+const historyBatchSize = 1000
+
+// contractTransitions lists, for each status, the statuses a contract may
+// move to next. Anything not listed is illegal.
+var contractTransitions = map[models.ContractStatus][]models.ContractStatus{
+	models.StatusDraft:    {models.StatusListed},
+	models.StatusListed:   {models.StatusMatched, models.StatusOwned, models.StatusExpiryReached},
+	models.StatusMatched:  {models.StatusOwned, models.StatusListed, models.StatusExpiryReached},
+	models.StatusOwned:    {models.StatusListed, models.StatusMatched, models.StatusUnlocked, models.StatusExpiryReached, models.StatusFrozen, models.StatusRevoked},
+	models.StatusUnlocked: {models.StatusExpiryReached, models.StatusFrozen, models.StatusRevoked},
+	// A frozen contract goes back to where it was once its dispute is won.
+	models.StatusFrozen: {models.StatusOwned, models.StatusUnlocked, models.StatusRevoked},
+	// A subscription contract that lapsed comes back if a late renewal
+	// pays for a period that has not ended yet.
+	models.StatusExpiryReached: {models.StatusOwned},
+}
+
+// UsableStatuses are the statuses in which a contract's owner may consume
+// the datastream it grants access to.
+var UsableStatuses = []models.ContractStatus{models.StatusOwned, models.StatusUnlocked}
+
+// UsableStatusesFor is UsableStatuses for a contract of type t. An option
+// is only usable once it has been exercised.
+func UsableStatusesFor(t models.ContractType) []models.ContractStatus {
+	if t == models.ContractOption {
+		return []models.ContractStatus{models.StatusUnlocked}
+	}
+	return UsableStatuses
+}
+
+// ContractGuard vets a legal transition against the contract and the actor
+// requesting it. A non-nil error rejects the transition.
+type ContractGuard func(state *models.ContractState, to models.ContractStatus, actorID uuid.UUID) error
+
+type contractEdge struct {
+	from, to models.ContractStatus
+}
+
+var contractGuards = map[contractEdge][]ContractGuard{
+	{models.StatusOwned, models.StatusListed}:        {actorIsOwner, overageSettled},
+	{models.StatusOwned, models.StatusMatched}:       {actorIsOwner},
+	{models.StatusOwned, models.StatusUnlocked}:      {actorIsOwner},
+	{models.StatusExpiryReached, models.StatusOwned}: {actorIsSystem},
+}
+
+// actorIsOwner admits only the current owner, or the system acting on
+// their behalf.
+func actorIsOwner(state *models.ContractState, _ models.ContractStatus, actorID uuid.UUID) error {
+	if actorID != SystemActor && actorID != state.OwnerID {
+		return errors.New("only the owner may do this")
+	}
+	return nil
+}
+
+// actorIsSystem admits only the system.
+func actorIsSystem(_ *models.ContractState, _ models.ContractStatus, actorID uuid.UUID) error {
+	if actorID != SystemActor {
+		return errors.New("only the system may do this")
+	}
+	return nil
+}
+
+// overageSettled keeps a contract from changing hands while reads its owner
+// made past the quota are still to be billed to them.
+func overageSettled(state *models.ContractState, _ models.ContractStatus, _ uuid.UUID) error {
+	if state.OverageReads > state.OverageReadsBilled {
+		return errors.New("overage usage must be billed first")
+	}
+	return nil
+}
+
+// TransitionError reports a contract transition that was refused.
+type TransitionError struct {
+	HeaderID uuid.UUID
+	From     models.ContractStatus
+	To       models.ContractStatus
+	// Err is ErrIllegalTransition, or the guard's error wrapped with
+	// ErrGuardRejected.
+	Err error
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("contract %s: %s -> %s: %v", e.HeaderID, e.From, e.To, e.Err)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return e.Err
+}
+
+// CanTransitionContract reports whether from -> to is a legal edge.
+func CanTransitionContract(from, to models.ContractStatus) bool {
+	for _, next := range contractTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckContractTransition validates a transition without applying it.
+func CheckContractTransition(state *models.ContractState, to models.ContractStatus, actorID uuid.UUID) error {
+	if !CanTransitionContract(state.Status, to) {
+		return &TransitionError{HeaderID: state.HeaderID, From: state.Status, To: to, Err: ErrIllegalTransition}
+	}
+	for _, guard := range contractGuards[contractEdge{state.Status, to}] {
+		if err := guard(state, to, actorID); err != nil {
+			return &TransitionError{
+				HeaderID: state.HeaderID,
+				From:     state.Status,
+				To:       to,
+				Err:      fmt.Errorf("%w: %w", ErrGuardRejected, err),
+			}
+		}
+	}
+	return nil
+}
+
+// TransitionContract moves a contract to a new status and records it in
+// the contract's history. The write is conditional on the contract still
+// being in state.Status, so it fails with repos.ErrContractStatusConflict if
+// someone else moved it first. tx should be bound to a transaction.
+func TransitionContract(
+	tx *repos.Repos,
+	state *models.ContractState,
+	to models.ContractStatus,
+	actorID uuid.UUID,
+	reason string) error {
+
+	if err := CheckContractTransition(state, to, actorID); err != nil {
+		return err
+	}
+	if err := tx.States.UpdateStatus(state.HeaderID, state.Status, to); err != nil {
+		return err
+	}
+	if err := tx.StateHistory.Create(newHistory(state.HeaderID, state.Status, to, actorID, reason, time.Now())); err != nil {
+		return err
+	}
+
+	state.Status = to
+	return nil
+}
+
+// TransferContract is TransitionContract that also hands the contract to
+// conv.OwnerID and appends conv to its ownership ledger.
+func TransferContract(
+	tx *repos.Repos,
+	state *models.ContractState,
+	conv Conveyance,
+	to models.ContractStatus,
+	actorID uuid.UUID,
+	reason string) error {
+
+	if err := CheckContractTransition(state, to, actorID); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := tx.States.UpdateOwner(state.HeaderID, state.Status, conv.OwnerID, to, now); err != nil {
+		return err
+	}
+	if err := tx.StateHistory.Create(newHistory(state.HeaderID, state.Status, to, actorID, reason, now)); err != nil {
+		return err
+	}
+	if err := recordConveyance(tx, []*models.ContractState{state}, conv, now); err != nil {
+		return err
+	}
+
+	state.OwnerID = conv.OwnerID
+	state.LastPurchaseAt = now
+	state.Status = to
+	return nil
+}
+
+// TransferContractsInBatches is TransferContract for a lot of contracts that
+// all share a status, such as a freshly issued purchase.
+func TransferContractsInBatches(
+	tx *repos.Repos,
+	states []*models.ContractState,
+	conv Conveyance,
+	to models.ContractStatus,
+	actorID uuid.UUID,
+	reason string) error {
+
+	if len(states) == 0 {
+		return nil
+	}
+	from := states[0].Status
+	headerIDs := make([]uuid.UUID, len(states))
+	for i, state := range states {
+		if state.Status != from {
+			return fmt.Errorf("contract %s is %s, expected %s", state.HeaderID, state.Status, from)
+		}
+		if err := CheckContractTransition(state, to, actorID); err != nil {
+			return err
+		}
+		headerIDs[i] = state.HeaderID
+	}
+
+	now := time.Now()
+	err := tx.States.UpdateOwnerInBatches(headerIDs, from, conv.OwnerID, to, now, historyBatchSize)
+	if err != nil {
+		return err
+	}
+	if err := RecordTransitions(tx, states, from, to, actorID, reason, now); err != nil {
+		return err
+	}
+	if err := recordConveyance(tx, states, conv, now); err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		state.OwnerID = conv.OwnerID
+		state.LastPurchaseAt = now
+		state.Status = to
+	}
+	return nil
+}
+
+// RevokeContracts takes contracts back from their owner, who must be the
+// same for all of them. Each moves to StatusRevoked from whatever status it
+// is in and gets an OwnershipRevoked ledger entry naming transactionID, the
+// purchase being undone.
+func RevokeContracts(
+	tx *repos.Repos,
+	states []*models.ContractState,
+	transactionID uuid.UUID,
+	actorID uuid.UUID,
+	reason string) error {
+
+	if len(states) == 0 {
+		return nil
+	}
+	ownerID := states[0].OwnerID
+	for _, state := range states {
+		if state.OwnerID != ownerID {
+			return fmt.Errorf("contract %s is owned by %s, expected %s", state.HeaderID, state.OwnerID, ownerID)
+		}
+		if err := CheckContractTransition(state, models.StatusRevoked, actorID); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	entries := make([]*models.ContractStateHistory, len(states))
+	for i, state := range states {
+		if err := tx.States.UpdateStatus(state.HeaderID, state.Status, models.StatusRevoked); err != nil {
+			return err
+		}
+		entries[i] = newHistory(state.HeaderID, state.Status, models.StatusRevoked, actorID, reason, now)
+	}
+	if err := tx.StateHistory.CreateInBatches(entries, historyBatchSize); err != nil {
+		return err
+	}
+	conv := Conveyance{Kind: models.OwnershipRevoked, OwnerID: ownerID, TransactionID: transactionID}
+	if err := recordConveyance(tx, states, conv, now); err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		state.Status = models.StatusRevoked
+	}
+	return nil
+}
+
+// RecordTransitions writes history for transitions that were applied by
+// other means, such as contracts inserted directly in their first status.
+func RecordTransitions(
+	tx *repos.Repos,
+	states []*models.ContractState,
+	from models.ContractStatus,
+	to models.ContractStatus,
+	actorID uuid.UUID,
+	reason string,
+	at time.Time) error {
+
+	entries := make([]*models.ContractStateHistory, len(states))
+	for i, state := range states {
+		entries[i] = newHistory(state.HeaderID, from, to, actorID, reason, at)
+	}
+	return tx.StateHistory.CreateInBatches(entries, historyBatchSize)
+}
+
+func newHistory(
+	headerID uuid.UUID,
+	from, to models.ContractStatus,
+	actorID uuid.UUID,
+	reason string,
+	at time.Time) *models.ContractStateHistory {
+
+	return &models.ContractStateHistory{
+		ID:         uuid.New(),
+		HeaderID:   headerID,
+		FromStatus: from,
+		ToStatus:   to,
+		ActorID:    actorID,
+		Reason:     reason,
+		CreatedAt:  at,
+	}
+}
@@ -0,0 +1,123 @@
+package lifecycle
+
+import (
+	"errors"
+	"testing"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// fakeStates stands in for the state repository with the one status
+// TransitionContract writes to.
+type fakeStates struct {
+	repos.ContractStateRepository
+	status models.ContractStatus
+}
+
+func (r *fakeStates) UpdateStatus(_ uuid.UUID, from, to models.ContractStatus) error {
+	if r.status != from {
+		return repos.ErrContractStatusConflict
+	}
+	r.status = to
+	return nil
+}
+
+type fakeHistory struct {
+	repos.ContractStateHistoryRepository
+	entries []models.ContractStateHistory
+}
+
+func (r *fakeHistory) Create(entry *models.ContractStateHistory) error {
+	r.entries = append(r.entries, *entry)
+	return nil
+}
+
+func TestTransitionContract(t *testing.T) {
+	owner, stranger := uuid.New(), uuid.New()
+	cases := []struct {
+		name    string
+		from    models.ContractStatus
+		to      models.ContractStatus
+		actor   uuid.UUID
+		overage bool
+		// stored is the status the repository holds, if not from.
+		stored *models.ContractStatus
+		want   error
+	}{
+		{name: "owner lists", from: models.StatusOwned, to: models.StatusListed, actor: owner},
+		{name: "system lists for the owner", from: models.StatusOwned, to: models.StatusListed, actor: SystemActor},
+		{name: "owner unlocks", from: models.StatusOwned, to: models.StatusUnlocked, actor: owner},
+		{name: "checkout matches a listing", from: models.StatusListed, to: models.StatusMatched, actor: stranger},
+		{name: "won dispute unfreezes", from: models.StatusFrozen, to: models.StatusUnlocked, actor: SystemActor},
+		{name: "late renewal revives", from: models.StatusExpiryReached, to: models.StatusOwned, actor: SystemActor},
+		{name: "unlocked expires", from: models.StatusUnlocked, to: models.StatusExpiryReached, actor: SystemActor},
+
+		{name: "draft cannot be owned", from: models.StatusDraft, to: models.StatusOwned, actor: SystemActor, want: ErrIllegalTransition},
+		{name: "revoked is final", from: models.StatusRevoked, to: models.StatusOwned, actor: SystemActor, want: ErrIllegalTransition},
+		{name: "unlocked cannot be relisted", from: models.StatusUnlocked, to: models.StatusListed, actor: owner, want: ErrIllegalTransition},
+		{name: "expired cannot be listed", from: models.StatusExpiryReached, to: models.StatusListed, actor: owner, want: ErrIllegalTransition},
+		{name: "no transition to the same status", from: models.StatusOwned, to: models.StatusOwned, actor: owner, want: ErrIllegalTransition},
+
+		{name: "stranger cannot list", from: models.StatusOwned, to: models.StatusListed, actor: stranger, want: ErrGuardRejected},
+		{name: "stranger cannot unlock", from: models.StatusOwned, to: models.StatusUnlocked, actor: stranger, want: ErrGuardRejected},
+		{name: "unbilled overage blocks listing", from: models.StatusOwned, to: models.StatusListed, actor: owner, overage: true, want: ErrGuardRejected},
+		{name: "only the system revives", from: models.StatusExpiryReached, to: models.StatusOwned, actor: owner, want: ErrGuardRejected},
+
+		{
+			name:   "someone else moved it first",
+			from:   models.StatusOwned,
+			to:     models.StatusListed,
+			actor:  owner,
+			stored: ptr(models.StatusUnlocked),
+			want:   repos.ErrContractStatusConflict,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			state := &models.ContractState{HeaderID: uuid.New(), OwnerID: owner, Status: c.from}
+			if c.overage {
+				state.OverageReads = 1
+			}
+			states := &fakeStates{status: c.from}
+			if c.stored != nil {
+				states.status = *c.stored
+			}
+			history := &fakeHistory{}
+			tx := &repos.Repos{States: states, StateHistory: history}
+
+			err := TransitionContract(tx, state, c.to, c.actor, "test")
+			if !errors.Is(err, c.want) {
+				t.Fatalf("err = %v, want %v", err, c.want)
+			}
+			if c.want != nil {
+				if state.Status != c.from {
+					t.Errorf("refused transition left the contract %s, want %s", state.Status, c.from)
+				}
+				if len(history.entries) != 0 {
+					t.Errorf("refused transition wrote history %+v", history.entries)
+				}
+				return
+			}
+
+			if state.Status != c.to || states.status != c.to {
+				t.Errorf("contract is %s, stored %s, want %s", state.Status, states.status, c.to)
+			}
+			want := models.ContractStateHistory{HeaderID: state.HeaderID, FromStatus: c.from, ToStatus: c.to, ActorID: c.actor, Reason: "test"}
+			if len(history.entries) != 1 {
+				t.Fatalf("history %+v, want one row", history.entries)
+			}
+			got := history.entries[0]
+			got.ID, got.CreatedAt = uuid.Nil, want.CreatedAt
+			if got != want {
+				t.Errorf("history row %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
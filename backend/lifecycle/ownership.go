@@ -0,0 +1,131 @@
+package lifecycle
+
+import (
+	"fmt"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// Conveyance is a change of a contract's owner, as its ownership ledger
+// records it.
+type Conveyance struct {
+	Kind    models.OwnershipEventKind
+	OwnerID uuid.UUID
+	// TransactionID and PriceCents are set for sales; PriceCents is what
+	// was paid for each contract.
+	TransactionID uuid.UUID
+	PriceCents    int64
+}
+
+// RecordIssuance starts the ownership ledger of freshly issued contracts,
+// each owned by whoever its state names.
+func RecordIssuance(tx *repos.Repos, states []*models.ContractState, at time.Time) error {
+	entries := make([]*models.OwnershipEntry, len(states))
+	for i, state := range states {
+		entries[i] = &models.OwnershipEntry{
+			ID:        uuid.New(),
+			HeaderID:  state.HeaderID,
+			Seq:       1,
+			Kind:      models.OwnershipIssued,
+			ToOwnerID: state.OwnerID,
+			CreatedAt: at,
+		}
+	}
+	return tx.Ownership.CreateInBatches(entries, historyBatchSize)
+}
+
+// recordConveyance appends conv to the ledger of each contract, before
+// the states are updated to the new owner. Two writers racing to append
+// to the same contract collide on its (header, seq) index.
+func recordConveyance(tx *repos.Repos, states []*models.ContractState, conv Conveyance, at time.Time) error {
+	headerIDs := make([]uuid.UUID, len(states))
+	for i, state := range states {
+		headerIDs[i] = state.HeaderID
+	}
+	seqs, err := tx.Ownership.LastSeqs(headerIDs, historyBatchSize)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]*models.OwnershipEntry, len(states))
+	for i, state := range states {
+		entries[i] = &models.OwnershipEntry{
+			ID:            uuid.New(),
+			HeaderID:      state.HeaderID,
+			Seq:           seqs[state.HeaderID] + 1,
+			Kind:          conv.Kind,
+			FromOwnerID:   state.OwnerID,
+			ToOwnerID:     conv.OwnerID,
+			TransactionID: conv.TransactionID,
+			PriceCents:    conv.PriceCents,
+			CreatedAt:     at,
+		}
+	}
+	return tx.Ownership.CreateInBatches(entries, historyBatchSize)
+}
+
+// OwnershipReplay is what a contract's ownership ledger says about it.
+type OwnershipReplay struct {
+	OwnerID uuid.UUID
+	// AcquiredAt is when OwnerID came to hold the contract.
+	AcquiredAt time.Time
+	Revoked    bool
+}
+
+// ReplayOwnership folds a contract's ledger entries, in Seq order, into
+// the owner they lead to. Entries that do not follow on from the one
+// before are reported as problems and otherwise replayed as written.
+func ReplayOwnership(entries []models.OwnershipEntry) (*OwnershipReplay, []string) {
+	var problems []string
+	if len(entries) == 0 {
+		return nil, []string{"ledger is empty"}
+	}
+
+	replay := &OwnershipReplay{}
+	for i, entry := range entries {
+		if want := uint64(i + 1); entry.Seq != want {
+			problems = append(problems, fmt.Sprintf("entry %s has seq %d, expected %d", entry.ID, entry.Seq, want))
+		}
+		switch {
+		case i == 0 && entry.Kind != models.OwnershipIssued:
+			problems = append(problems, fmt.Sprintf("ledger starts with %s, not issuance", entry.Kind))
+		case i > 0 && entry.Kind == models.OwnershipIssued:
+			problems = append(problems, fmt.Sprintf("seq %d issues the contract again", entry.Seq))
+		}
+		if entry.FromOwnerID != replay.OwnerID {
+			problems = append(problems, fmt.Sprintf(
+				"seq %d moves the contract from %s, but %s held it", entry.Seq, entry.FromOwnerID, replay.OwnerID))
+		}
+		if entry.Kind != models.OwnershipRevoked || entry.ToOwnerID != replay.OwnerID {
+			// Revoking leaves the owner as they were, holding nothing.
+			replay.AcquiredAt = entry.CreatedAt
+		}
+		replay.OwnerID = entry.ToOwnerID
+		replay.Revoked = entry.Kind == models.OwnershipRevoked
+	}
+	return replay, problems
+}
+
+// CheckOwnership reports every way the contract's ledger disagrees with
+// its current state. No problems means replaying the ledger reproduces the
+// state's owner and the time they acquired it.
+func CheckOwnership(state *models.ContractState, entries []models.OwnershipEntry) []string {
+	replay, problems := ReplayOwnership(entries)
+	if replay == nil {
+		return problems
+	}
+	if replay.OwnerID != state.OwnerID {
+		problems = append(problems, fmt.Sprintf(
+			"ledger gives the contract to %s, but %s owns it", replay.OwnerID, state.OwnerID))
+	}
+	if !replay.AcquiredAt.Equal(state.LastPurchaseAt) {
+		problems = append(problems, fmt.Sprintf(
+			"ledger last moved the contract at %s, but it was acquired at %s",
+			replay.AcquiredAt.Format(time.RFC3339Nano), state.LastPurchaseAt.Format(time.RFC3339Nano)))
+	}
+	return problems
+}
@@ -0,0 +1,100 @@
+package lifecycle
+
+import (
+	"fmt"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// transactionTransitions lists, for each status, the statuses a transaction
+// may move to next. Refunded is terminal. A payment can still land after its
+// checkout expired, so Expired -> Paid is allowed. Money taken for a
+// purchase that failed can be refunded, as can a fulfilled purchase, which
+// may also be disputed and then either reinstated or refunded.
+var transactionTransitions = map[models.TransactionStatus][]models.TransactionStatus{
+	models.StatusPending:         {models.StatusRequiresPayment, models.StatusExpired, models.StatusFailed},
+	models.StatusRequiresPayment: {models.StatusPaid, models.StatusExpired, models.StatusFailed},
+	models.StatusExpired:         {models.StatusPaid},
+	models.StatusPaid:            {models.StatusFulfilled, models.StatusFailed},
+	models.StatusFulfilled:       {models.StatusRefunded, models.StatusDisputed},
+	models.StatusFailed:          {models.StatusRefunded},
+	models.StatusDisputed:        {models.StatusFulfilled, models.StatusRefunded},
+}
+
+// TransactionTransitionError reports a transaction transition that was
+// refused.
+type TransactionTransitionError struct {
+	TransactionID uuid.UUID
+	From          models.TransactionStatus
+	To            models.TransactionStatus
+	Err           error
+}
+
+func (e *TransactionTransitionError) Error() string {
+	return fmt.Sprintf("transaction %s: %s -> %s: %v", e.TransactionID, e.From, e.To, e.Err)
+}
+
+func (e *TransactionTransitionError) Unwrap() error {
+	return e.Err
+}
+
+// CanTransitionTransaction reports whether from -> to is a legal edge.
+func CanTransitionTransaction(from, to models.TransactionStatus) bool {
+	for _, next := range transactionTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionTransaction moves a transaction to a new status, stamping the
+// time it reached that stage, and writes the whole record. Other changes
+// made to record beforehand are saved along with it. The write is
+// conditional on the transaction still being in record.TransactionStatus,
+// so it fails with repos.ErrTransactionStatusConflict if someone else moved
+// it first. reason is kept as FailureReason when moving to Failed.
+//
+// On error the record is left as it was before the call.
+func TransitionTransaction(
+	repo repos.TransactionRepository,
+	record *models.TransactionRecord,
+	to models.TransactionStatus,
+	reason string) error {
+
+	from := record.TransactionStatus
+	if !CanTransitionTransaction(from, to) {
+		return &TransactionTransitionError{TransactionID: record.ID, From: from, To: to, Err: ErrIllegalTransition}
+	}
+
+	prev := *record
+	now := time.Now()
+	switch to {
+	case models.StatusPaid:
+		record.PaidAt = &now
+	case models.StatusFulfilled:
+		if from != models.StatusDisputed {
+			// A won dispute reinstates the purchase as it was.
+			record.FulfilledAt = &now
+		}
+		record.IsFulfilled = true
+	case models.StatusExpired:
+		record.ExpiredAt = &now
+	case models.StatusFailed:
+		record.FailedAt = &now
+		record.FailureReason = reason
+	case models.StatusRefunded:
+		record.RefundedAt = &now
+	}
+	record.TransactionStatus = to
+
+	if err := repo.UpdateFromStatus(record, from); err != nil {
+		*record = prev
+		return err
+	}
+	return nil
+}
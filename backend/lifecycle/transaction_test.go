@@ -0,0 +1,127 @@
+package lifecycle
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// fakeTransactions stands in for the transaction repository with the one
+// record TransitionTransaction writes.
+type fakeTransactions struct {
+	repos.TransactionRepository
+	stored models.TransactionRecord
+}
+
+func (r *fakeTransactions) UpdateFromStatus(record *models.TransactionRecord, from models.TransactionStatus) error {
+	if r.stored.TransactionStatus != from {
+		return repos.ErrTransactionStatusConflict
+	}
+	r.stored = *record
+	return nil
+}
+
+func TestTransitionTransaction(t *testing.T) {
+	fulfilledAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		from   models.TransactionStatus
+		to     models.TransactionStatus
+		stored *models.TransactionStatus
+		want   error
+		// check inspects a record that moved.
+		check func(t *testing.T, record *models.TransactionRecord)
+	}{
+		{name: "checkout opened", from: models.StatusPending, to: models.StatusRequiresPayment},
+		{
+			name: "paid", from: models.StatusRequiresPayment, to: models.StatusPaid,
+			check: func(t *testing.T, r *models.TransactionRecord) {
+				if r.PaidAt == nil {
+					t.Error("PaidAt not set")
+				}
+			},
+		},
+		{name: "paid after the checkout expired", from: models.StatusExpired, to: models.StatusPaid},
+		{
+			name: "fulfilled", from: models.StatusPaid, to: models.StatusFulfilled,
+			check: func(t *testing.T, r *models.TransactionRecord) {
+				if !r.IsFulfilled || r.FulfilledAt == nil || r.FulfilledAt.Equal(fulfilledAt) {
+					t.Errorf("IsFulfilled %v at %v, want fulfilled now", r.IsFulfilled, r.FulfilledAt)
+				}
+			},
+		},
+		{
+			name: "reinstated after a won dispute", from: models.StatusDisputed, to: models.StatusFulfilled,
+			check: func(t *testing.T, r *models.TransactionRecord) {
+				if !r.IsFulfilled || r.FulfilledAt == nil || !r.FulfilledAt.Equal(fulfilledAt) {
+					t.Errorf("IsFulfilled %v at %v, want fulfilled at the original time", r.IsFulfilled, r.FulfilledAt)
+				}
+			},
+		},
+		{
+			name: "failed after payment", from: models.StatusPaid, to: models.StatusFailed,
+			check: func(t *testing.T, r *models.TransactionRecord) {
+				if r.FailedAt == nil || r.FailureReason != "test" {
+					t.Errorf("failed at %v for %q, want now for the reason given", r.FailedAt, r.FailureReason)
+				}
+			},
+		},
+		{name: "refunded", from: models.StatusFulfilled, to: models.StatusRefunded},
+		{name: "disputed", from: models.StatusFulfilled, to: models.StatusDisputed},
+
+		{name: "fulfilled cannot require payment again", from: models.StatusFulfilled, to: models.StatusRequiresPayment, want: ErrIllegalTransition},
+		{name: "refunded is final", from: models.StatusRefunded, to: models.StatusFulfilled, want: ErrIllegalTransition},
+		{name: "not paid before checkout", from: models.StatusPending, to: models.StatusPaid, want: ErrIllegalTransition},
+		{name: "not fulfilled before payment", from: models.StatusRequiresPayment, to: models.StatusFulfilled, want: ErrIllegalTransition},
+
+		{
+			name:   "someone else moved it first",
+			from:   models.StatusPaid,
+			to:     models.StatusFulfilled,
+			stored: ptr(models.StatusFailed),
+			want:   repos.ErrTransactionStatusConflict,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			record := &models.TransactionRecord{ID: uuid.New(), TransactionStatus: c.from}
+			if c.from == models.StatusDisputed {
+				record.IsFulfilled = true
+				record.FulfilledAt = &fulfilledAt
+			}
+			repo := &fakeTransactions{stored: *record}
+			if c.stored != nil {
+				repo.stored.TransactionStatus = *c.stored
+			}
+			before := *record
+
+			err := TransitionTransaction(repo, record, c.to, "test")
+			if !errors.Is(err, c.want) {
+				t.Fatalf("err = %v, want %v", err, c.want)
+			}
+			if c.want != nil {
+				var transitionErr *TransactionTransitionError
+				if errors.Is(c.want, ErrIllegalTransition) && !errors.As(err, &transitionErr) {
+					t.Errorf("err = %T, want a TransactionTransitionError", err)
+				}
+				if !reflect.DeepEqual(*record, before) {
+					t.Errorf("refused transition changed the record to %+v", record)
+				}
+				return
+			}
+
+			if record.TransactionStatus != c.to || repo.stored.TransactionStatus != c.to {
+				t.Errorf("record is %s, stored %s, want %s", record.TransactionStatus, repo.stored.TransactionStatus, c.to)
+			}
+			if c.check != nil {
+				c.check(t, record)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package mail
+
+import (
+	"log"
+	"sync"
+)
+
+// FakeSender logs messages instead of sending them and keeps them for
+// tests to inspect.
+type FakeSender struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewFakeSender() *FakeSender {
+	return &FakeSender{}
+}
+
+func (f *FakeSender) Send(msg Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	log.Printf("fake mail to %s: %s", msg.To, msg.Subject)
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+// Sent returns every message sent so far, oldest first.
+func (f *FakeSender) Sent() []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Message(nil), f.sent...)
+}
@@ -0,0 +1,52 @@
+// Package mail sends the marketplace's email.
+package mail
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Sender interface {
+	Send(msg Message) error
+}
+
+// SMTPSender sends through an SMTP relay, authenticating with PLAIN when
+// given a username.
+type SMTPSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPSender(addr, username, password, from string) *SMTPSender {
+	s := &SMTPSender{addr: addr, from: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s *SMTPSender) Send(msg Message) error {
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("mail: header contains a line break")
+	}
+	body := strings.ReplaceAll(msg.Body, "\n", "\r\n")
+	data := "From: " + s.from + "\r\n" +
+		"To: " + msg.To + "\r\n" +
+		"Subject: " + msg.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, []byte(data))
+}
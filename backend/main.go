@@ -1,16 +1,24 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
+	"contract_market_demo/backend/accesstoken"
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/mail"
 	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
 	"contract_market_demo/backend/repos"
 
 	"github.com/clerk/clerk-sdk-go/v2"
@@ -22,11 +30,6 @@ import (
 	"gorm.io/gorm/logger"
 
 	"github.com/joho/godotenv"
-
-	"github.com/stripe/stripe-go/v82"
-	"github.com/stripe/stripe-go/v82/account"
-	"github.com/stripe/stripe-go/v82/accountlink"
-	"github.com/stripe/stripe-go/v82/checkout/session"
 )
 
 type Database struct {
@@ -74,33 +77,90 @@ func (db *Database) AutoMigrate() {
 		&models.ContractHeader{},
 		&models.ContractState{},
 		&models.TransactionRecord{},
+		&models.SupplyReservation{},
+		&models.ContractStateHistory{},
+		&models.Datastream{},
+		&models.ResaleListing{},
+		&models.BookOrder{},
+		&models.AskContract{},
+		&models.BookFill{},
+		&models.AuctionListing{},
+		&models.AuctionBid{},
+		&models.ContractTransfer{},
+		&models.OwnershipEntry{},
+		&models.Subscription{},
+		&models.OverageLine{},
+		&models.RefundRecord{},
+		&models.RefundRequest{},
+		&models.Notification{},
 	)
+
+	n, err := repos.NewOwnershipLedgerRepository(db.DB).Backfill()
+	if err != nil {
+		log.Fatalf("failed to backfill the ownership ledger: %v", err)
+	}
+	if n > 0 {
+		log.Printf("backfilled %d ownership ledger entries", n)
+	}
 	log.Println("Database migration complete")
 }
 
-func NewListing(
-	sellerID uuid.UUID,
-	listPriceNanos int64,
-	supplyLimit uint64) *models.ContractListing {
+// ListingParams are the terms a listing is created with, already checked.
+type ListingParams struct {
+	SellerID              uuid.UUID
+	DatastreamID          uuid.UUID
+	ListPriceNanos        int64
+	SupplyLimit           uint64
+	QuotaReads            uint64
+	ReadBytes             uint64
+	ExerciseBy            *time.Time
+	RoyaltyBps            int64
+	ContractType          models.ContractType
+	StrikePriceNanos      int64
+	AccessHours           int64
+	BillingInterval       models.BillingInterval
+	BillingIntervalCount  int64
+	OverageReadPriceNanos int64
+	RestockOnRefund       bool
+	RefundPolicy          models.RefundPolicy
+	RefundWindowHours     int64
+}
 
+func NewListing(p *ListingParams) *models.ContractListing {
 	return &models.ContractListing{
-		ID:              uuid.New(),
-		SellerID:        sellerID,
-		ListPriceNanos:  listPriceNanos,
-		SupplyLimit:     supplyLimit,
-		SupplyRemaining: supplyLimit,
-		CreatedAt:       time.Now(),
-		UpdatedAt:       time.Now(),
+		ID:                    uuid.New(),
+		SellerID:              p.SellerID,
+		DatastreamID:          p.DatastreamID,
+		ListPriceNanos:        p.ListPriceNanos,
+		SupplyLimit:           p.SupplyLimit,
+		SupplyRemaining:       p.SupplyLimit,
+		QuotaReads:            p.QuotaReads,
+		ReadBytes:             p.ReadBytes,
+		ExerciseBy:            p.ExerciseBy,
+		RoyaltyBps:            p.RoyaltyBps,
+		ContractType:          p.ContractType,
+		StrikePriceNanos:      p.StrikePriceNanos,
+		AccessHours:           p.AccessHours,
+		BillingInterval:       p.BillingInterval,
+		BillingIntervalCount:  p.BillingIntervalCount,
+		OverageReadPriceNanos: p.OverageReadPriceNanos,
+		RestockOnRefund:       p.RestockOnRefund,
+		RefundPolicy:          p.RefundPolicy,
+		RefundWindowHours:     p.RefundWindowHours,
+		CreatedAt:             time.Now(),
+		UpdatedAt:             time.Now(),
 	}
 }
 
 func NewHeader(
 	listingID uuid.UUID,
+	datastreamID uuid.UUID,
 ) *models.ContractHeader {
 	return &models.ContractHeader{
-		ID:        uuid.New(),
-		ListingID: listingID,
-		CreatedAt: time.Now(),
+		ID:           uuid.New(),
+		ListingID:    listingID,
+		DatastreamID: datastreamID,
+		CreatedAt:    time.Now(),
 	}
 }
 
@@ -117,16 +177,10 @@ func NewState(
 }
 
 func CreateListing(
-	sellerID uuid.UUID,
-	listPriceNanos int64,
-	supplyLimit uint64,
+	p *ListingParams,
 	listingRepo repos.ContractListingRepository,
 ) (*models.ContractListing, error) {
-	listing := NewListing(
-		sellerID,
-		listPriceNanos,
-		supplyLimit,
-	)
+	listing := NewListing(p)
 
 	err := listingRepo.Create(listing)
 	if err != nil {
@@ -157,15 +211,197 @@ func CurrentUser(r *http.Request, userRepo repos.UserRepository) (*models.User,
 	return userRepo.FindOrCreateByAuth("clerk", sub, "")
 }
 
-type ListingCreateRequest struct {
+// ListingTerms are what a seller sets on a listing, in ListingCreateRequest
+// and ListingUpdateRequest.
+type ListingTerms struct {
+	DatastreamID   string `json:"datastream_id"`
 	ListPriceNanos int64  `json:"list_price_nanos"`
 	SupplyLimit    uint64 `json:"supply_limit"`
+	QuotaReads     uint64 `json:"quota_reads"`
+	ReadBytes      uint64 `json:"read_bytes"`
+	// ExerciseBy is when the contracts expire, in RFC 3339. Omit it for
+	// contracts that never do.
+	ExerciseBy *time.Time `json:"exercise_by"`
+	// RoyaltyBps is the seller's cut of every resale, in basis points.
+	RoyaltyBps int64 `json:"royalty_bps"`
+	// ContractType is "standard", the default, "option" or
+	// "subscription". Options are sold at ListPriceNanos as a premium and
+	// need StrikePriceNanos and ExerciseBy; exercising one grants access
+	// for AccessHours, or until ExerciseBy if that is zero. Subscriptions charge
+	// ListPriceNanos every BillingIntervalCount BillingIntervals ("day",
+	// "week", "month" or "year"; monthly by default) until cancelled.
+	ContractType         string `json:"contract_type"`
+	StrikePriceNanos     int64  `json:"strike_price_nanos"`
+	AccessHours          int64  `json:"access_hours"`
+	BillingInterval      string `json:"billing_interval"`
+	BillingIntervalCount int64  `json:"billing_interval_count"`
+	// OverageReadPriceNanos, if set, lets owners read past QuotaReads at
+	// this price a read, up to a cap each owner chooses.
+	OverageReadPriceNanos int64 `json:"overage_read_price_nanos"`
+	// RestockOnRefund puts the units of refunded purchases back on sale.
+	RestockOnRefund bool `json:"restock_on_refund"`
+	// RefundPolicy is what buyers may ask to be refunded for:
+	// "before_unlock", the default, "anytime" or "none".
+	// RefundWindowHours, if set, is how long after a purchase they may ask.
+	RefundPolicy      string `json:"refund_policy"`
+	RefundWindowHours int64  `json:"refund_window_hours"`
 }
 
+type ListingCreateRequest struct {
+	ListingTerms
+}
+
+// ListingUpdateRequest changes the terms it gives and leaves the others as
+// they are.
 type ListingUpdateRequest struct {
-	ListingID      string `json:"listing_id"`
-	ListPriceNanos int64  `json:"list_price_nanos"`
-	SupplyLimit    uint64 `json:"supply_limit"`
+	ListingID string `json:"listing_id"`
+	ListingTerms
+}
+
+var errListingTermsLocked = errors.New("listing terms cannot change once contracts are issued or while an auction is running")
+
+// listingTermsOf is the ListingTerms a listing was created or last updated
+// with.
+func listingTermsOf(listing *models.ContractListing) ListingTerms {
+	terms := ListingTerms{
+		ListPriceNanos:        listing.ListPriceNanos,
+		SupplyLimit:           listing.SupplyLimit,
+		QuotaReads:            listing.QuotaReads,
+		ReadBytes:             listing.ReadBytes,
+		ExerciseBy:            listing.ExerciseBy,
+		RoyaltyBps:            listing.RoyaltyBps,
+		ContractType:          listing.ContractType.String(),
+		StrikePriceNanos:      listing.StrikePriceNanos,
+		AccessHours:           listing.AccessHours,
+		OverageReadPriceNanos: listing.OverageReadPriceNanos,
+		RestockOnRefund:       listing.RestockOnRefund,
+		RefundPolicy:          listing.RefundPolicy.String(),
+		RefundWindowHours:     listing.RefundWindowHours,
+	}
+	if listing.DatastreamID != uuid.Nil {
+		terms.DatastreamID = listing.DatastreamID.String()
+	}
+	if listing.ContractType == models.ContractSubscription {
+		terms.BillingInterval = listing.BillingInterval.String()
+		terms.BillingIntervalCount = listing.BillingIntervalCount
+	}
+	return terms
+}
+
+// params checks terms for a listing sold by sellerID.
+func (terms *ListingTerms) params(
+	sellerID uuid.UUID,
+	now time.Time,
+	datastreamRepo repos.DatastreamRepository) (*ListingParams, error) {
+
+	if terms.ExerciseBy != nil && !terms.ExerciseBy.After(now) {
+		return nil, errors.New("exercise_by must be in the future")
+	}
+	if err := validRoyaltyBps(terms.RoyaltyBps); err != nil {
+		return nil, err
+	}
+	if err := validOverageReadPrice(terms.OverageReadPriceNanos, terms.QuotaReads); err != nil {
+		return nil, err
+	}
+	refundPolicy, err := listingRefundPolicy(terms.RefundPolicy, terms.RefundWindowHours)
+	if err != nil {
+		return nil, err
+	}
+	contractType, err := listingContractType(terms.ContractType, terms.StrikePriceNanos, terms.AccessHours, terms.ExerciseBy)
+	if err != nil {
+		return nil, err
+	}
+	billingInterval, billingIntervalCount, err := listingBilling(
+		contractType, terms.BillingInterval, terms.BillingIntervalCount, terms.ExerciseBy)
+	if err != nil {
+		return nil, err
+	}
+	datastreamID, err := sellerDatastreamID(terms.DatastreamID, sellerID, datastreamRepo)
+	if err != nil {
+		return nil, fmt.Errorf("invalid datastream_id: %w", err)
+	}
+
+	return &ListingParams{
+		SellerID:              sellerID,
+		DatastreamID:          datastreamID,
+		ListPriceNanos:        terms.ListPriceNanos,
+		SupplyLimit:           terms.SupplyLimit,
+		QuotaReads:            terms.QuotaReads,
+		ReadBytes:             terms.ReadBytes,
+		ExerciseBy:            terms.ExerciseBy,
+		RoyaltyBps:            terms.RoyaltyBps,
+		ContractType:          contractType,
+		StrikePriceNanos:      terms.StrikePriceNanos,
+		AccessHours:           terms.AccessHours,
+		BillingInterval:       billingInterval,
+		BillingIntervalCount:  billingIntervalCount,
+		OverageReadPriceNanos: terms.OverageReadPriceNanos,
+		RestockOnRefund:       terms.RestockOnRefund,
+		RefundPolicy:          refundPolicy,
+		RefundWindowHours:     terms.RefundWindowHours,
+	}, nil
+}
+
+// lockedTermsChange names the first term p changes that buyers of the
+// listing rely on, or returns "" if it changes none of them. Price, supply
+// and restocking are the seller's own business and may change at any time.
+func lockedTermsChange(listing *models.ContractListing, p *ListingParams) string {
+	sameExerciseBy := (listing.ExerciseBy == nil) == (p.ExerciseBy == nil) &&
+		(listing.ExerciseBy == nil || listing.ExerciseBy.Equal(*p.ExerciseBy))
+	switch {
+	case listing.DatastreamID != p.DatastreamID:
+		return "datastream_id"
+	case listing.QuotaReads != p.QuotaReads:
+		return "quota_reads"
+	case listing.ReadBytes != p.ReadBytes:
+		return "read_bytes"
+	case !sameExerciseBy:
+		return "exercise_by"
+	case listing.RoyaltyBps != p.RoyaltyBps:
+		return "royalty_bps"
+	case listing.ContractType != p.ContractType:
+		return "contract_type"
+	case listing.StrikePriceNanos != p.StrikePriceNanos:
+		return "strike_price_nanos"
+	case listing.AccessHours != p.AccessHours:
+		return "access_hours"
+	case listing.BillingInterval != p.BillingInterval,
+		listing.BillingIntervalCount != p.BillingIntervalCount:
+		return "billing_interval"
+	case listing.OverageReadPriceNanos != p.OverageReadPriceNanos:
+		return "overage_read_price_nanos"
+	case listing.RefundPolicy != p.RefundPolicy:
+		return "refund_policy"
+	case listing.RefundWindowHours != p.RefundWindowHours:
+		return "refund_window_hours"
+	}
+	return ""
+}
+
+// checkListingUpdate refuses a change to terms buyers rely on once the
+// listing has issued contracts or while one of its auctions is open.
+func checkListingUpdate(
+	listing *models.ContractListing,
+	p *ListingParams,
+	headerRepo repos.ContractHeaderRepository,
+	auctionRepo repos.AuctionRepository) error {
+
+	term := lockedTermsChange(listing, p)
+	if term == "" {
+		return nil
+	}
+	issued, err := headerRepo.CountByListingID(listing.ID)
+	if err != nil {
+		return err
+	}
+	auctions, err := auctionRepo.FindAllOpenByListingID(listing.ID)
+	if err != nil {
+		return err
+	}
+	if issued > 0 || len(auctions) > 0 {
+		return fmt.Errorf("%w: %s", errListingTermsLocked, term)
+	}
+	return nil
 }
 
 type ListingGetRequest struct {
@@ -176,7 +412,10 @@ func HeaderListingHandler(
 	listingRepo repos.ContractListingRepository,
 	headerRepo repos.ContractHeaderRepository,
 	stateRepo repos.ContractStateRepository,
-	userRepo repos.UserRepository) http.HandlerFunc {
+	userRepo repos.UserRepository,
+	reservationRepo repos.ReservationRepository,
+	datastreamRepo repos.DatastreamRepository,
+	auctionRepo repos.AuctionRepository) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
@@ -191,13 +430,12 @@ func HeaderListingHandler(
 				http.Error(w, "unauthorized", http.StatusUnauthorized)
 				return
 			}
-			sellerID := u.ID
-			listing, err := CreateListing(
-				sellerID,
-				req.ListPriceNanos,
-				req.SupplyLimit,
-				listingRepo,
-			)
+			p, err := req.params(u.ID, time.Now(), datastreamRepo)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			listing, err := CreateListing(p, listingRepo)
 			if err != nil {
 				http.Error(w, "failed to create listing: "+err.Error(), http.StatusInternalServerError)
 				return
@@ -227,6 +465,10 @@ func HeaderListingHandler(
 					http.Error(w, "listing not found: "+err.Error(), http.StatusNotFound)
 					return
 				}
+				if err := FillSupplyAvailable(reservationRepo, listing); err != nil {
+					http.Error(w, "failed to compute available supply: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
 				w.Header().Set("Content-Type", "application/json")
 				_ = json.NewEncoder(w).Encode(listing)
 				return
@@ -236,13 +478,26 @@ func HeaderListingHandler(
 				http.Error(w, "failed to fetch listings: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
+			ptrs := make([]*models.ContractListing, len(listings))
+			for i := range listings {
+				ptrs[i] = &listings[i]
+			}
+			if err := FillSupplyAvailable(reservationRepo, ptrs...); err != nil {
+				http.Error(w, "failed to compute available supply: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			_ = json.NewEncoder(w).Encode(listings)
 			return
 		}
 		if r.Method == http.MethodPut {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
 			req := &ListingUpdateRequest{}
-			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			if err := json.Unmarshal(body, req); err != nil {
 				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
 				return
 			}
@@ -267,10 +522,48 @@ func HeaderListingHandler(
 				return
 			}
 
-			listing.ListPriceNanos = req.ListPriceNanos
-			listing.SupplyLimit = req.SupplyLimit
+			// Decode again over the listing's current terms, so the ones the
+			// request leaves out keep their values.
+			req.ListingTerms = listingTermsOf(listing)
+			if err := json.Unmarshal(body, req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			p, err := req.params(u.ID, time.Now(), datastreamRepo)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkListingUpdate(listing, p, headerRepo, auctionRepo); err != nil {
+				if errors.Is(err, errListingTermsLocked) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				http.Error(w, "failed to check listing: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			listing.DatastreamID = p.DatastreamID
+			listing.ListPriceNanos = p.ListPriceNanos
+			listing.SupplyLimit = p.SupplyLimit
+			listing.QuotaReads = p.QuotaReads
+			listing.ReadBytes = p.ReadBytes
+			listing.ExerciseBy = p.ExerciseBy
+			listing.RoyaltyBps = p.RoyaltyBps
+			listing.ContractType = p.ContractType
+			listing.StrikePriceNanos = p.StrikePriceNanos
+			listing.AccessHours = p.AccessHours
+			listing.BillingInterval = p.BillingInterval
+			listing.BillingIntervalCount = p.BillingIntervalCount
+			listing.OverageReadPriceNanos = p.OverageReadPriceNanos
+			listing.RestockOnRefund = p.RestockOnRefund
+			listing.RefundPolicy = p.RefundPolicy
+			listing.RefundWindowHours = p.RefundWindowHours
 			listing.UpdatedAt = time.Now()
 			if err := listingRepo.Update(listing); err != nil {
+				if errors.Is(err, repos.ErrListingVersionConflict) {
+					http.Error(w, "listing was modified concurrently, retry", http.StatusConflict)
+					return
+				}
 				http.Error(w, "failed to update listing: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -315,56 +608,105 @@ func HeaderListingHandler(
 	}
 }
 
+// issueBatchSize bounds the rows per INSERT or UPDATE when issuing contracts,
+// keeping large issues well under Postgres' 65535 bind parameter limit.
+const issueBatchSize = 1000
+
+// IssueFromListing takes issueQuantity units from the listing's supply and
+// stores a header and a listed state for each, owned by the seller. The
+// supply is decremented in a single conditional UPDATE, so concurrent
+// purchases can never oversell, and the contracts are written with batched
+// INSERTs. tx should be bound to a transaction so the decrement and the
+// inserts commit together; listing is refreshed from the database.
 func IssueFromListing(
 	listing *models.ContractListing,
 	issueQuantity int,
-	listingRepo repos.ContractListingRepository) ([]*models.ContractHeader, []*models.ContractState, error) {
+	tx *repos.Repos) ([]*models.ContractHeader, []*models.ContractState, error) {
 
-	if issueQuantity > int(listing.SupplyRemaining) {
-		return nil, nil, errors.New("not enough supply")
+	if issueQuantity <= 0 {
+		return nil, nil, errors.New("issue quantity must be positive")
 	}
 
-	listing.SupplyRemaining -= uint64(issueQuantity)
-	err := listingRepo.Update(listing)
+	err := tx.Listings.DecrementSupply(listing.ID, uint64(issueQuantity))
+	if err != nil {
+		return nil, nil, err
+	}
+	fresh, err := tx.Listings.FindByID(listing.ID)
 	if err != nil {
-		// listing.SupplyRemaining += uint64(issueQuantity)
 		return nil, nil, err
 	}
+	*listing = *fresh
 
+	now := time.Now()
 	headers := make([]*models.ContractHeader, issueQuantity)
 	states := make([]*models.ContractState, issueQuantity)
 	for i := 0; i < issueQuantity; i++ {
-		header := NewHeader(listing.ID)
+		header := NewHeader(listing.ID, listing.DatastreamID)
+		header.QuotaReads = listing.QuotaReads
+		header.ReadBytes = listing.ReadBytes
+		header.ExerciseBy = listing.ExerciseBy
+		header.ContractType = listing.ContractType
+		header.StrikePriceNanos = listing.StrikePriceNanos
+		header.AccessHours = listing.AccessHours
+		header.OverageReadPriceNanos = listing.OverageReadPriceNanos
 		headers[i] = header
 
 		state := &models.ContractState{
 			HeaderID:       header.ID,
-			LastPurchaseAt: time.Now(),
+			LastPurchaseAt: now,
 			OwnerID:        listing.SellerID,
 			Status:         models.StatusListed,
+			ReadsRemaining: listing.QuotaReads,
+			BytesRemaining: listing.ReadBytes,
 		}
 		states[i] = state
 	}
 
+	if err := tx.Headers.CreateInBatches(headers, issueBatchSize); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.States.CreateInBatches(states, issueBatchSize); err != nil {
+		return nil, nil, err
+	}
+	err = lifecycle.RecordTransitions(
+		tx, states, models.StatusDraft, models.StatusListed, lifecycle.SystemActor, "issued", now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := lifecycle.RecordIssuance(tx, states, now); err != nil {
+		return nil, nil, err
+	}
+
 	return headers, states, nil
 }
 
+// saleConveyance is the ledger entry for a contract bought in record.
+func saleConveyance(record *models.TransactionRecord) lifecycle.Conveyance {
+	conv := lifecycle.Conveyance{
+		Kind:          models.OwnershipSold,
+		OwnerID:       record.BuyerID,
+		TransactionID: record.ID,
+	}
+	if record.PurchaseQuantity > 0 {
+		conv.PriceCents = int64(record.PurchaseCents) / record.PurchaseQuantity
+	}
+	return conv
+}
+
+// TransferOwnership hands a contract to the buyer in record, returning
+// who owned it before.
 func TransferOwnership(
-	buyerID uuid.UUID,
+	record *models.TransactionRecord,
 	state *models.ContractState,
-	userRepo repos.UserRepository,
-	stateRepo repos.ContractStateRepository) (uuid.UUID, error) {
-	_, err := userRepo.FindByID(buyerID)
+	tx *repos.Repos) (uuid.UUID, error) {
+	_, err := tx.Users.FindByID(record.BuyerID)
 	if err != nil {
 		return uuid.Nil, err
 	}
 
 	prevOwner := state.OwnerID
-	state.OwnerID = buyerID
-	state.LastPurchaseAt = time.Now()
-	state.Status = models.StatusOwned
-
-	err = stateRepo.Update(state)
+	err = lifecycle.TransferContract(
+		tx, state, saleConveyance(record), models.StatusOwned, record.BuyerID, "purchase")
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -372,6 +714,21 @@ func TransferOwnership(
 	return prevOwner, nil
 }
 
+// TransferOwnershipInBatches is TransferOwnership for a freshly issued lot:
+// the buyer is checked once and the states are updated in batches.
+func TransferOwnershipInBatches(
+	record *models.TransactionRecord,
+	states []*models.ContractState,
+	tx *repos.Repos) error {
+	_, err := tx.Users.FindByID(record.BuyerID)
+	if err != nil {
+		return err
+	}
+
+	return lifecycle.TransferContractsInBatches(
+		tx, states, saleConveyance(record), models.StatusOwned, record.BuyerID, "purchase")
+}
+
 func SettleTransaction(record *models.TransactionRecord) (*models.TransactionRecord, error) {
 	// Settle the transaction and emit a transaction record.
 	// This function will be the main entrypoint to the
@@ -455,10 +812,13 @@ type ContractPurchaseRequest struct {
 }
 
 func CheckoutHandler(
-	userRepo repos.UserRepository,
-	transactionRepo repos.TransactionRepository,
-	listingRepo repos.ContractListingRepository,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
 ) http.HandlerFunc {
+	userRepo := uow.Repos().Users
+	listingRepo := uow.Repos().Listings
+	datastreamRepo := uow.Repos().Datastreams
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", 405)
@@ -491,87 +851,230 @@ func CheckoutHandler(
 			http.Error(w, "listing not found", 404)
 			return
 		}
+		if listing.ExerciseBy != nil && !listing.ExerciseBy.After(time.Now()) {
+			http.Error(w, "listing has expired", 409)
+			return
+		}
 		if listing.SupplyRemaining < uint64(req.PurchaseQuantity) {
 			http.Error(w, "purchase quantity exceeds available supply", 404)
 			return
 		}
 
-		seller, err := userRepo.FindByID(listing.SellerID)
-		if err != nil {
-			http.Error(w, "seller not found", 500)
+		seller, ok := payableSeller(w, userRepo, listing.SellerID)
+		if !ok {
 			return
 		}
-		if seller.StripeConnectAccountID == "" {
-			http.Error(w, "seller is not onboarded", 409)
+
+		productName, err := listingProductName(listing, datastreamRepo)
+		if errors.Is(err, errDatastreamInactive) {
+			http.Error(w, err.Error(), 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, "datastream not found", 500)
 			return
 		}
 
 		unitCents := (listing.ListPriceNanos + 5_000_000) / 10_000_000
-		totalCents := unitCents * int64(req.PurchaseQuantity)
-
-		feeBps := int64(0)
-		fmt.Sscanf(os.Getenv("PLATFORM_FEE_BPS"), "%d", &feeBps)
-		platformFee := (totalCents * feeBps) / 10_000
-
-		tr := &models.TransactionRecord{
-			ID:                uuid.New(),
-			InitiatedAt:       time.Now(),
-			ListingID:         listing.ID,
-			SellerID:          listing.SellerID,
-			BuyerID:           buyer.ID,
-			PurchaseQuantity:  int64(req.PurchaseQuantity),
-			PurchaseCents:     uint64(totalCents),
-			Currency:          os.Getenv("CURRENCY"),
-			PlatformFeeCents:  platformFee,
-			TransactionStatus: models.StatusRequiresPayment,
-		}
-		_ = transactionRepo.Create(tr)
-
-		params := &stripe.CheckoutSessionParams{
-			Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
-			SuccessURL: stripe.String(strings.ReplaceAll(os.Getenv("STRIPE_SUCCESS_URL"), "{TRANSACTION_ID}", tr.ID.String())),
-			CancelURL:  stripe.String(strings.ReplaceAll(os.Getenv("STRIPE_CANCEL_URL"), "{TRANSACTION_ID}", tr.ID.String())),
-			LineItems: []*stripe.CheckoutSessionLineItemParams{
-				{
-					Quantity: stripe.Int64(int64(req.PurchaseQuantity)),
-					PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
-						Currency:   stripe.String(os.Getenv("CURRENCY")),
-						UnitAmount: stripe.Int64(unitCents),
-						ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
-							Name: stripe.String("Data Contract"),
-						},
-					},
-				},
-			},
-			PaymentIntentData: &stripe.CheckoutSessionPaymentIntentDataParams{
-				ApplicationFeeAmount: stripe.Int64(platformFee),
-				TransferData: &stripe.CheckoutSessionPaymentIntentDataTransferDataParams{
-					Destination: stripe.String(seller.StripeConnectAccountID),
-				},
-				Metadata: map[string]string{
-					"transaction_id": tr.ID.String(),
-					"listing_id":     listing.ID.String(),
-					"buyer_id":       buyer.ID.String(),
-				},
-			},
-			ClientReferenceID: stripe.String(tr.ID.String()),
-		}
-		s, err := session.New(params)
+		tr := NewPrimaryTransaction(listing, buyer.ID, int64(req.PurchaseQuantity), unitCents)
+		var hold *models.SupplyReservation
+		err = uow.WithTx(func(tx *repos.Repos) error {
+			if err := tx.Transactions.Create(tr); err != nil {
+				return err
+			}
+			hold, err = tx.Reservations.Hold(listing.ID, tr.ID, uint64(req.PurchaseQuantity), time.Now().Add(ReservationTTL()))
+			return err
+		})
 		if err != nil {
-			http.Error(w, err.Error(), 500)
+			if errors.Is(err, repos.ErrInsufficientSupply) {
+				http.Error(w, "purchase quantity exceeds available supply", 409)
+				return
+			}
+			http.Error(w, "failed to reserve supply: "+err.Error(), 500)
 			return
 		}
 
-		tr.StripeCheckoutSessonID = s.ID
-		_ = transactionRepo.Update(tr)
+		openCheckout(w, provider, uow, &checkoutOrder{
+			record:      tr,
+			hold:        hold,
+			seller:      seller,
+			productName: productName,
+			unitCents:   unitCents,
+			recurring:   listingRecurring(listing),
+			metadata: map[string]string{
+				"transaction_id": tr.ID.String(),
+				"listing_id":     listing.ID.String(),
+				"buyer_id":       buyer.ID.String(),
+			},
+		})
+	}
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"transaction_id": tr.ID.String(),
-			"checkout_url":   s.URL,
+// NewPrimaryTransaction is a pending purchase of quantity contracts newly
+// issued from listing at unitCents each.
+func NewPrimaryTransaction(
+	listing *models.ContractListing,
+	buyerID uuid.UUID,
+	quantity int64,
+	unitCents int64) *models.TransactionRecord {
+
+	totalCents := unitCents * quantity
+	return &models.TransactionRecord{
+		ID:                uuid.New(),
+		InitiatedAt:       time.Now(),
+		ListingID:         listing.ID,
+		SellerID:          listing.SellerID,
+		BuyerID:           buyerID,
+		PurchaseQuantity:  quantity,
+		PurchaseCents:     uint64(totalCents),
+		Currency:          os.Getenv("CURRENCY"),
+		PlatformFeeCents:  platformFeeCents(totalCents),
+		TransactionStatus: models.StatusPending,
+	}
+}
+
+var errDatastreamInactive = errors.New("datastream is not active")
+
+// listingProductName is what the buyer sees they are paying for. Contracts
+// cannot be sold while the listing's datastream is paused or retired.
+func listingProductName(
+	listing *models.ContractListing,
+	datastreamRepo repos.DatastreamRepository) (string, error) {
+
+	if listing.DatastreamID == uuid.Nil {
+		return "Data Contract", nil
+	}
+	datastream, err := datastreamRepo.FindByID(listing.DatastreamID)
+	if err != nil {
+		return "", err
+	}
+	if datastream.Status != models.DatastreamActive {
+		return "", fmt.Errorf("%w: it is %s", errDatastreamInactive, datastream.Status)
+	}
+	return datastream.Name, nil
+}
+
+// payableSeller loads the user a checkout pays out to and checks they can
+// take payments. It writes the HTTP error itself and returns ok=false when
+// they cannot.
+func payableSeller(
+	w http.ResponseWriter,
+	userRepo repos.UserRepository,
+	sellerID uuid.UUID) (seller *models.User, ok bool) {
+
+	seller, err := userRepo.FindByID(sellerID)
+	if err != nil {
+		http.Error(w, "seller not found", 500)
+		return nil, false
+	}
+	if seller.StripeConnectAccountID == "" {
+		http.Error(w, "seller is not onboarded", 409)
+		return nil, false
+	}
+	if !seller.StripeChargesEnabled {
+		http.Error(w, "seller cannot accept payments yet", 409)
+		return nil, false
+	}
+	return seller, true
+}
+
+// platformFeeBps is the platform's cut of every sale, per PLATFORM_FEE_BPS.
+func platformFeeBps() int64 {
+	feeBps := int64(0)
+	fmt.Sscanf(os.Getenv("PLATFORM_FEE_BPS"), "%d", &feeBps)
+	return feeBps
+}
+
+// platformFeeCents is the platform's cut of totalCents.
+func platformFeeCents(totalCents int64) int64 {
+	return (totalCents * platformFeeBps()) / 10_000
+}
+
+// checkoutOrder is a pending transaction, with its hold already taken, that
+// the buyer is about to pay for.
+type checkoutOrder struct {
+	record      *models.TransactionRecord
+	hold        *models.SupplyReservation
+	seller      *models.User
+	productName string
+	unitCents   int64
+	// recurring is set when the order starts a subscription.
+	recurring *payments.Recurring
+	metadata  map[string]string
+	// bus hears about a fill put back on offer because no session could
+	// be opened for it.
+	bus *events.Bus
+}
+
+// openCheckout opens a payment session for order and answers the request
+// with where to pay.
+func openCheckout(
+	w http.ResponseWriter,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	order *checkoutOrder) {
+
+	s, err := startCheckout(provider, uow, order)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"transaction_id": order.record.ID.String(),
+		"checkout_url":   s.URL,
+		"expires_at":     order.hold.ExpiresAt,
+	})
+}
+
+// startCheckout opens a payment session for order and moves its transaction
+// to StatusRequiresPayment. If no session can be opened the hold is given
+// back and the transaction fails.
+func startCheckout(
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	order *checkoutOrder) (*payments.CheckoutSession, error) {
+
+	tr := order.record
+	// Any royalty is collected with the platform fee and paid on to the
+	// original seller by PayRoyalty once the sale is fulfilled.
+	s, err := provider.CreateCheckoutSession(&payments.CheckoutSessionParams{
+		ClientReferenceID:    tr.ID.String(),
+		ProductName:          order.productName,
+		Currency:             tr.Currency,
+		UnitAmountCents:      order.unitCents,
+		Quantity:             tr.PurchaseQuantity,
+		ApplicationFeeCents:  tr.PlatformFeeCents + tr.RoyaltyCents,
+		DestinationAccountID: order.seller.StripeConnectAccountID,
+		SuccessURL:           strings.ReplaceAll(os.Getenv("STRIPE_SUCCESS_URL"), "{TRANSACTION_ID}", tr.ID.String()),
+		CancelURL:            strings.ReplaceAll(os.Getenv("STRIPE_CANCEL_URL"), "{TRANSACTION_ID}", tr.ID.String()),
+		ExpiresAt:            order.hold.ExpiresAt,
+		Metadata:             order.metadata,
+		Recurring:            order.recurring,
+	})
+	if err != nil {
+		released := false
+		txErr := uow.WithTx(func(tx *repos.Repos) error {
+			var releaseErr error
+			if released, releaseErr = releaseHold(tr, tx); releaseErr != nil {
+				return releaseErr
+			}
+			return lifecycle.TransitionTransaction(tx.Transactions, tr, models.StatusFailed, "checkout session: "+err.Error())
 		})
+		if txErr == nil && released {
+			publishHoldReleased(order.bus, tr)
+		}
+		return nil, err
+	}
 
+	tr.StripeCheckoutSessonID = s.ID
+	err = lifecycle.TransitionTransaction(uow.Repos().Transactions, tr, models.StatusRequiresPayment, "")
+	if err != nil {
+		// The hold may have been swept already; the session is useless.
+		return nil, fmt.Errorf("failed to open checkout: %w", err)
 	}
+	return s, nil
 }
 
 // func ContractPurchaseHandler(
@@ -648,7 +1151,10 @@ func MeHandler(userRepo repos.UserRepository) http.HandlerFunc {
 	}
 }
 
-func ConnectOnboardHandler(userRepo repos.UserRepository) http.HandlerFunc {
+func ConnectOnboardHandler(
+	provider payments.PaymentProvider,
+	userRepo repos.UserRepository) http.HandlerFunc {
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -661,15 +1167,10 @@ func ConnectOnboardHandler(userRepo repos.UserRepository) http.HandlerFunc {
 		}
 
 		if u.StripeConnectAccountID == "" {
-			params := &stripe.AccountParams{
-				Type:    stripe.String(string(stripe.AccountTypeExpress)),
-				Country: stripe.String("US"),
-				Capabilities: &stripe.AccountCapabilitiesParams{
-					Transfers:    &stripe.AccountCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
-					CardPayments: &stripe.AccountCapabilitiesCardPaymentsParams{Requested: stripe.Bool(true)},
-				},
-			}
-			acct, err := account.New(params)
+			acct, err := provider.CreateConnectedAccount(&payments.AccountParams{
+				Country: "US",
+				Email:   u.Email,
+			})
 			if err != nil {
 				http.Error(w, err.Error(), 500)
 				return
@@ -679,11 +1180,10 @@ func ConnectOnboardHandler(userRepo repos.UserRepository) http.HandlerFunc {
 			_ = userRepo.Update(u)
 		}
 
-		al, err := accountlink.New(&stripe.AccountLinkParams{
-			Account:    stripe.String(u.StripeConnectAccountID),
-			Type:       stripe.String("account_onboarding"),
-			ReturnURL:  stripe.String(os.Getenv("CONNECT_RETURN_URL")),
-			RefreshURL: stripe.String(os.Getenv("CONNECT_REFRESH_URL")),
+		url, err := provider.CreateOnboardingLink(&payments.OnboardingLinkParams{
+			AccountID:  u.StripeConnectAccountID,
+			ReturnURL:  os.Getenv("CONNECT_RETURN_URL"),
+			RefreshURL: os.Getenv("CONNECT_REFRESH_URL"),
 		})
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -691,40 +1191,294 @@ func ConnectOnboardHandler(userRepo repos.UserRepository) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{"url": al.URL})
+		_ = json.NewEncoder(w).Encode(map[string]any{"url": url})
 	}
 }
 
+type ConnectStatusResponse struct {
+	AccountID        string `json:"account_id"`
+	ChargesEnabled   bool   `json:"charges_enabled"`
+	PayoutsEnabled   bool   `json:"payouts_enabled"`
+	DetailsSubmitted bool   `json:"details_submitted"`
+}
+
+// ConnectStatusHandler reports the caller's Connect capabilities, refreshing
+// them from the payment provider first so sellers do not have to wait for an
+// account.updated event after finishing onboarding.
+func ConnectStatusHandler(
+	provider payments.PaymentProvider,
+	userRepo repos.UserRepository) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		if u.StripeConnectAccountID != "" {
+			acct, err := provider.RetrieveAccount(u.StripeConnectAccountID)
+			if err != nil {
+				http.Error(w, "failed to refresh account: "+err.Error(), 502)
+				return
+			}
+			u, err = SyncConnectAccount(acct, userRepo)
+			if err != nil {
+				http.Error(w, "failed to store account status: "+err.Error(), 500)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(ConnectStatusResponse{
+			AccountID:        u.StripeConnectAccountID,
+			ChargesEnabled:   u.StripeChargesEnabled,
+			PayoutsEnabled:   u.StripePayoutsEnabled,
+			DetailsSubmitted: u.StripeDetailsSubmitted,
+		})
+	}
+}
+
+// NewPaymentProvider picks the payment backend from PAYMENTS_PROVIDER.
+// "fake" runs the whole purchase flow in memory; anything else talks to Stripe.
+func NewPaymentProvider() payments.PaymentProvider {
+	if os.Getenv("PAYMENTS_PROVIDER") == "fake" {
+		log.Println("using in-memory fake payment provider")
+		return payments.NewFakeProvider(os.Getenv("PUBLIC_BASE_URL"))
+	}
+	return payments.NewStripeProvider(
+		os.Getenv("STRIPE_SECRET_KEY"),
+		os.Getenv("STRIPE_WEBHOOK_SECRET"))
+}
+
+// NewMailer sends through the SMTP relay at SMTP_ADDR, as SMTP_FROM,
+// authenticating with SMTP_USERNAME and SMTP_PASSWORD if set. Without a
+// relay, mail is only logged.
+func NewMailer() mail.Sender {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Println("SMTP_ADDR not set; logging mail instead of sending it")
+		return mail.NewFakeSender()
+	}
+	return mail.NewSMTPSender(
+		addr,
+		os.Getenv("SMTP_USERNAME"),
+		os.Getenv("SMTP_PASSWORD"),
+		os.Getenv("SMTP_FROM"))
+}
+
+// NewAccessTokenSigner loads the unlock token key from
+// ACCESS_TOKEN_SIGNING_KEY, a base64 Ed25519 seed. Without one it makes up
+// a key, which is fine for development but means tokens stop verifying on
+// restart.
+func NewAccessTokenSigner() *accesstoken.Signer {
+	if encoded := os.Getenv("ACCESS_TOKEN_SIGNING_KEY"); encoded != "" {
+		key, err := accesstoken.ParsePrivateKey(encoded)
+		if err != nil {
+			log.Fatalf("ACCESS_TOKEN_SIGNING_KEY: %v", err)
+		}
+		return accesstoken.NewSigner(key)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		log.Fatalf("generate access token key: %v", err)
+	}
+	log.Println("ACCESS_TOKEN_SIGNING_KEY not set; using an ephemeral key")
+	return accesstoken.NewSigner(key)
+}
+
 func main() {
 	_ = godotenv.Load()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gateway":
+			runGateway(os.Args[2:])
+			return
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+	}
+
 	clerk.SetKey(os.Getenv("CLERK_SECRET_KEY"))
-	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+	provider := NewPaymentProvider()
+	signer := NewAccessTokenSigner()
+	mailer := NewMailer()
 
 	db := SetupDB()
 	db.AutoMigrate()
 
-	userRepo := repos.NewUserRepository(db.DB)
-	transactionRepo := repos.NewTransactionRepository(db.DB)
-	listingRepo := repos.NewContractListingRepository(db.DB)
-	headerRepo := repos.NewContractHeaderRepository(db.DB)
-	stateRepo := repos.NewContractStateRepository(db.DB)
+	uow := repos.NewUnitOfWork(db.DB)
+	userRepo := uow.Repos().Users
+	listingRepo := uow.Repos().Listings
+	headerRepo := uow.Repos().Headers
+	stateRepo := uow.Repos().States
+	reservationRepo := uow.Repos().Reservations
+	datastreamRepo := uow.Repos().Datastreams
+
+	bus := events.NewBus()
+	bus.SubscribeAll(func(ev events.Event) {
+		log.Printf("event %s: contract=%s transaction=%s user=%s %s",
+			ev.Type, ev.ContractID, ev.TransactionID, ev.UserID, ev.Reason)
+	})
+	bus.SubscribeAll(StoreNotifications(uow))
+
+	market := NewMarket(uow, provider)
+	bus.Subscribe(events.ContractExpired, market.OnContractExpired)
+
+	bus.Subscribe(events.FillReleased, market.OnFillReleased)
+	bus.Subscribe(events.ContractFrozen, market.OnContractFrozen)
+
+	stopSweeper := StartReservationSweeper(defaultReservationSweepTick, uow, bus)
+	defer stopSweeper()
+	stopExpiry := StartExpiryScheduler(defaultExpiryTick, clock.Real(), uow, bus)
+	defer stopExpiry()
+	stopAuctions := StartAuctionScheduler(defaultAuctionTick, clock.Real(), provider, uow)
+	defer stopAuctions()
+	stopRoyalties := StartRoyaltyPayer(defaultRoyaltyTick, clock.Real(), provider, uow)
+	defer stopRoyalties()
+	stopTransfers := StartTransferSweeper(defaultTransferSweepTick, clock.Real(), uow)
+	defer stopTransfers()
+	stopSubscriptions := StartSubscriptionSweeper(defaultSubscriptionSweepTick, clock.Real(), provider, uow)
+	defer stopSubscriptions()
+	stopOverage := StartOverageBiller(OverageBillingInterval(), clock.Real(), provider, uow)
+	defer stopOverage()
+	stopRefundRequests := StartRefundRequestSweeper(defaultRefundRequestSweepTick, clock.Real(), provider, uow, bus)
+	defer stopRefundRequests()
 
 	mux := http.NewServeMux()
 
 	mux.Handle("/v1/listings", clerkhttp.WithHeaderAuthorization()(
 		HeaderListingHandler(
-			listingRepo, headerRepo, stateRepo, userRepo)))
-
-	mux.Handle("/v1/contracts", clerkhttp.RequireHeaderAuthorization()(
-		ContractPurchaseHandler(
-			userRepo, transactionRepo, listingRepo, headerRepo, stateRepo)))
+			listingRepo, headerRepo, stateRepo, userRepo, reservationRepo, datastreamRepo,
+			uow.Repos().Auctions)))
+
+	mux.Handle("/v1/datastreams", clerkhttp.RequireHeaderAuthorization()(
+		DatastreamsHandler(datastreamRepo, userRepo)))
+	mux.Handle("/v1/datastreams/{id}", clerkhttp.RequireHeaderAuthorization()(
+		DatastreamHandler(datastreamRepo, listingRepo, userRepo)))
+
+	mux.Handle("/v1/checkout", clerkhttp.RequireHeaderAuthorization()(
+		CheckoutHandler(
+			provider, uow)))
+
+	mux.Handle("/v1/stripe/webhook",
+		StripeWebhookHandler(
+			provider, uow, bus))
+
+	mux.Handle("GET /v1/contracts/{id}/history", clerkhttp.RequireHeaderAuthorization()(
+		ContractHistoryHandler(uow)))
+	mux.Handle("POST /v1/contracts/{id}/exercise", clerkhttp.RequireHeaderAuthorization()(
+		ExerciseHandler(provider, uow)))
+	mux.Handle("GET /v1/contracts/{id}/custody", clerkhttp.RequireHeaderAuthorization()(
+		ContractCustodyHandler(uow)))
+
+	mux.Handle("GET /v1/contracts/{id}/usage", clerkhttp.RequireHeaderAuthorization()(
+		ContractUsageHandler(uow)))
+	mux.Handle("POST /v1/contracts/{id}/usage", clerkhttp.RequireHeaderAuthorization()(
+		ContractMeterHandler(uow)))
+
+	mux.Handle("PUT /v1/contracts/{id}/overage", clerkhttp.RequireHeaderAuthorization()(
+		ContractOverageCapHandler(uow)))
+	mux.Handle("GET /v1/overage/invoices", clerkhttp.RequireHeaderAuthorization()(
+		OverageInvoicesHandler(uow)))
+
+	mux.Handle("POST /v1/contracts/{id}/unlock", clerkhttp.RequireHeaderAuthorization()(
+		ContractUnlockHandler(uow, signer)))
+	mux.Handle("POST /v1/contracts/{id}/transfer", clerkhttp.RequireHeaderAuthorization()(
+		ContractTransferHandler(provider, mailer, uow)))
+	mux.Handle("GET /v1/contracts/{id}/transfers", clerkhttp.RequireHeaderAuthorization()(
+		ContractTransfersHandler(uow)))
+	mux.Handle("GET /v1/transfers", clerkhttp.RequireHeaderAuthorization()(
+		TransfersHandler(uow)))
+	mux.Handle("POST /v1/transfers/claim", clerkhttp.RequireHeaderAuthorization()(
+		TransferClaimHandler(ClerkVerifiedEmails, uow)))
+	mux.Handle("POST /v1/transfers/{id}/accept", clerkhttp.RequireHeaderAuthorization()(
+		TransferResponseHandler(true, uow)))
+	mux.Handle("POST /v1/transfers/{id}/decline", clerkhttp.RequireHeaderAuthorization()(
+		TransferResponseHandler(false, uow)))
+	mux.Handle("DELETE /v1/transfers/{id}", clerkhttp.RequireHeaderAuthorization()(
+		CancelTransferHandler(uow)))
+	mux.Handle("GET /v1/access-tokens/key", AccessTokenKeyHandler(signer))
+
+	mux.Handle("/v1/resale", clerkhttp.RequireHeaderAuthorization()(
+		ResaleListingsHandler(provider, uow)))
+	mux.Handle("/v1/resale/{id}", clerkhttp.RequireHeaderAuthorization()(
+		ResaleListingHandler(uow)))
+	mux.Handle("POST /v1/resale/{id}/checkout", clerkhttp.RequireHeaderAuthorization()(
+		ResaleCheckoutHandler(provider, uow)))
+
+	mux.Handle("GET /v1/listings/{id}/book", clerkhttp.RequireHeaderAuthorization()(
+		OrderBookHandler(market)))
+	mux.Handle("POST /v1/listings/{id}/orders", clerkhttp.RequireHeaderAuthorization()(
+		PlaceOrderHandler(market, userRepo)))
+	mux.Handle("GET /v1/orders", clerkhttp.RequireHeaderAuthorization()(
+		OrdersHandler(uow.Repos().Orders, userRepo)))
+	mux.Handle("DELETE /v1/orders/{id}", clerkhttp.RequireHeaderAuthorization()(
+		CancelOrderHandler(market, userRepo)))
+	mux.Handle("GET /v1/fills", clerkhttp.RequireHeaderAuthorization()(
+		FillsHandler(uow.Repos().Fills, userRepo)))
+	mux.Handle("POST /v1/fills/{id}/checkout", clerkhttp.RequireHeaderAuthorization()(
+		FillCheckoutHandler(provider, uow, bus)))
+
+	mux.Handle("/v1/auctions", clerkhttp.RequireHeaderAuthorization()(
+		AuctionsHandler(uow)))
+	mux.Handle("GET /v1/auctions/bids", clerkhttp.RequireHeaderAuthorization()(
+		AuctionBidsHandler(uow)))
+	mux.Handle("/v1/auctions/{id}", clerkhttp.RequireHeaderAuthorization()(
+		AuctionHandler(uow)))
+	mux.Handle("POST /v1/auctions/{id}/bids", clerkhttp.RequireHeaderAuthorization()(
+		AuctionBidHandler(provider, uow)))
+
+	mux.Handle("GET /v1/subscriptions", clerkhttp.RequireHeaderAuthorization()(
+		SubscriptionsHandler(uow)))
+	mux.Handle("POST /v1/subscriptions/{id}/cancel", clerkhttp.RequireHeaderAuthorization()(
+		CancelSubscriptionHandler(provider, uow)))
+
+	mux.Handle("POST /v1/transactions/{id}/refund", clerkhttp.RequireHeaderAuthorization()(
+		RefundHandler(provider, uow)))
+	mux.Handle("POST /v1/transactions/{id}/refund-requests", clerkhttp.RequireHeaderAuthorization()(
+		TransactionRefundRequestHandler(uow, bus)))
+	mux.Handle("GET /v1/refund-requests", clerkhttp.RequireHeaderAuthorization()(
+		RefundRequestsHandler(uow)))
+	mux.Handle("POST /v1/refund-requests/{id}/approve", clerkhttp.RequireHeaderAuthorization()(
+		RefundRequestResponseHandler(true, provider, uow, bus)))
+	mux.Handle("POST /v1/refund-requests/{id}/deny", clerkhttp.RequireHeaderAuthorization()(
+		RefundRequestResponseHandler(false, provider, uow, bus)))
+	mux.Handle("DELETE /v1/refund-requests/{id}", clerkhttp.RequireHeaderAuthorization()(
+		WithdrawRefundRequestHandler(uow, bus)))
+
+	mux.Handle("GET /v1/notifications", clerkhttp.RequireHeaderAuthorization()(
+		NotificationsHandler(uow)))
+	mux.Handle("POST /v1/notifications/{id}/read", clerkhttp.RequireHeaderAuthorization()(
+		NotificationReadHandler(uow)))
+
+	mux.Handle("GET /v1/royalties", clerkhttp.RequireHeaderAuthorization()(
+		RoyaltiesHandler(uow)))
 
 	mux.Handle("/v1/me", clerkhttp.RequireHeaderAuthorization()(
 		MeHandler(userRepo)))
 
 	mux.Handle("/v1/connect/onboard", clerkhttp.RequireHeaderAuthorization()(
-		ConnectOnboardHandler(userRepo)))
+		ConnectOnboardHandler(provider, userRepo)))
+	mux.Handle("POST /v1/me/payment-method", clerkhttp.RequireHeaderAuthorization()(
+		PaymentMethodSetupHandler(provider, userRepo)))
+
+	mux.Handle("/v1/connect/status", clerkhttp.RequireHeaderAuthorization()(
+		ConnectStatusHandler(provider, userRepo)))
+
+	if fake, ok := provider.(*payments.FakeProvider); ok {
+		fake.OnEvent(func(ev *payments.Event) error {
+			return HandlePaymentEvent(
+				ev, provider, uow, bus)
+		})
+		mux.Handle("/fake/", fake.CheckoutPageHandler())
+	}
 
 	srv := &http.Server{
 		Addr:         ":8080",
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newPostgresTestMarket is a testMarket on the Postgres database named by
+// TEST_DATABASE_URL, a DSN such as "host=localhost user=postgres
+// dbname=market_test sslmode=disable". Tests using it are skipped without
+// one. Unlike the in-memory store, Postgres runs transactions
+// concurrently, so races between them are real.
+func newPostgresTestMarket(t *testing.T) *testMarket {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stay under the server's default connection limit.
+	sqlDB.SetMaxOpenConns(20)
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	(&Database{DB: db}).AutoMigrate()
+	return newTestMarketOn(t, repos.NewUnitOfWork(db), uuid.NewString()+"/")
+}
+
+var concurrentBuyerCases = []struct {
+	name   string
+	buyers int
+	supply uint64
+}{
+	{"more buyers than supply", 200, 50},
+	{"supply for everyone", 50, 50},
+	{"spare supply", 20, 50},
+}
+
+// TestIssueFromListingConcurrentBuyers races buyers, each buying one
+// contract from its own stale copy of the listing, as concurrent requests
+// would. The in-memory store runs transactions one at a time, so this
+// checks the bookkeeping; TestIssueFromListingConcurrentBuyersPostgres
+// races them for real.
+func TestIssueFromListingConcurrentBuyers(t *testing.T) {
+	for _, c := range concurrentBuyerCases {
+		t.Run(c.name, func(t *testing.T) {
+			raceIssueFromListing(t, newTestMarket(t), c.buyers, c.supply)
+		})
+	}
+}
+
+func TestIssueFromListingConcurrentBuyersPostgres(t *testing.T) {
+	for _, c := range concurrentBuyerCases {
+		t.Run(c.name, func(t *testing.T) {
+			raceIssueFromListing(t, newPostgresTestMarket(t), c.buyers, c.supply)
+		})
+	}
+}
+
+func raceIssueFromListing(t *testing.T, m *testMarket, buyers int, supply uint64) {
+	t.Helper()
+	listing := m.listing(t, &ListingParams{SupplyLimit: supply})
+
+	var issued, soldOut atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mine := *listing
+			<-start
+			err := m.uow.WithTx(func(tx *repos.Repos) error {
+				_, _, err := IssueFromListing(&mine, 1, tx)
+				return err
+			})
+			switch {
+			case err == nil:
+				issued.Add(1)
+			case errors.Is(err, repos.ErrInsufficientSupply):
+				soldOut.Add(1)
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	want := min(uint64(buyers), supply)
+	if got := uint64(issued.Load()); got != want {
+		t.Errorf("issued %d, want %d", got, want)
+	}
+	if got := uint64(soldOut.Load()); got != uint64(buyers)-want {
+		t.Errorf("%d buyers turned away, want %d", got, uint64(buyers)-want)
+	}
+	m.checkIssued(t, listing.ID, supply, want)
+}
+
+// checkIssued fails the test unless exactly issued contracts of supply
+// were stored for the listing and the rest are still for sale.
+func (m *testMarket) checkIssued(t *testing.T, listingID uuid.UUID, supply, issued uint64) {
+	t.Helper()
+	if got := m.supplyRemaining(t, listingID); got != supply-issued {
+		t.Errorf("supply remaining %d, want %d", got, supply-issued)
+	}
+	headers, err := m.uow.Repos().Headers.CountByListingID(listingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(headers) != issued {
+		t.Errorf("%d contracts stored, want %d", headers, issued)
+	}
+}
+
+// TestCheckoutConcurrentBuyersPostgres has buyers check out the same
+// listing at once through the API and then all pay, against Postgres.
+func TestCheckoutConcurrentBuyersPostgres(t *testing.T) {
+	const buyers, supply = 60, 20
+	m := newPostgresTestMarket(t)
+	m.deliverInProcess()
+	listing := m.listing(t, &ListingParams{SupplyLimit: supply})
+	users := make([]*models.User, buyers)
+	for i := range users {
+		users[i] = m.user(t, uuid.NewString())
+	}
+
+	var mu sync.Mutex
+	var sessions []string
+	var soldOut int
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for _, u := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := json.Marshal(ContractPurchaseRequest{ListingID: listing.ID.String(), PurchaseQuantity: 1})
+			r := as(httptest.NewRequest(http.MethodPost, "/v1/checkout", bytes.NewReader(body)), u)
+			w := httptest.NewRecorder()
+			<-start
+			CheckoutHandler(m.provider, m.uow)(w, r)
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch w.Code {
+			case http.StatusOK:
+				var resp struct {
+					TransactionID string `json:"transaction_id"`
+				}
+				if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+					t.Error(err)
+					return
+				}
+				tr, err := m.uow.Repos().Transactions.FindByID(uuid.MustParse(resp.TransactionID))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				sessions = append(sessions, tr.StripeCheckoutSessonID)
+			case http.StatusNotFound, http.StatusConflict:
+				soldOut++
+			default:
+				t.Errorf("checkout: %d %s", w.Code, w.Body)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if len(sessions) != supply || soldOut != buyers-supply {
+		t.Fatalf("%d checkouts and %d turned away, want %d and %d", len(sessions), soldOut, supply, buyers-supply)
+	}
+
+	for _, id := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := m.provider.CompleteCheckoutSession(id); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	m.checkIssued(t, listing.ID, supply, supply)
+}
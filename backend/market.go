@@ -0,0 +1,826 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/orderbook"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// A bid holds the seller's contracts for up to ReservationTTL without the
+// buyer paying anything, so a buyer with maxUnpaidFills fills awaiting
+// payment, or lapsed unpaid within unpaidFillWindow, may not bid.
+const (
+	maxUnpaidFills   = 3
+	unpaidFillWindow = 24 * time.Hour
+)
+
+var (
+	errSellerNotPayable   = errors.New("seller cannot accept payments yet")
+	errFillReleased       = errors.New("fill was released before it was paid for")
+	errTooManyUnpaidFills = errors.New("too many order book fills left unpaid; pay for or wait out earlier fills before bidding again")
+)
+
+// Market runs an order book per listing for trading contracts already
+// sold. Books live in memory and are rebuilt from the open orders in the
+// database the first time a listing is traded after a restart.
+//
+// Every change is matched against a copy of the book and only swapped in
+// once its database transaction has committed. Market assumes it is the
+// only process trading; running two would let their books drift apart.
+type Market struct {
+	uow      repos.UnitOfWork
+	provider payments.PaymentProvider
+
+	mu    sync.Mutex
+	books map[uuid.UUID]*orderbook.Book
+}
+
+func NewMarket(uow repos.UnitOfWork, provider payments.PaymentProvider) *Market {
+	return &Market{uow: uow, provider: provider, books: make(map[uuid.UUID]*orderbook.Book)}
+}
+
+// book returns the listing's book, loading it if need be. m.mu must be held.
+func (m *Market) book(listingID uuid.UUID) (*orderbook.Book, error) {
+	if book, ok := m.books[listingID]; ok {
+		return book, nil
+	}
+	orders, err := m.uow.Repos().Orders.FindAllOpenByListingID(listingID)
+	if err != nil {
+		return nil, err
+	}
+	book := orderbook.NewBook()
+	for i := range orders {
+		book.Restore(toBookOrder(&orders[i]))
+	}
+	m.books[listingID] = book
+	return book, nil
+}
+
+func toBookOrder(o *models.BookOrder) *orderbook.Order {
+	side := orderbook.Bid
+	if o.Side == models.OrderAsk {
+		side = orderbook.Ask
+	}
+	return &orderbook.Order{
+		ID:         o.ID,
+		Side:       side,
+		TraderID:   o.TraderID,
+		PriceNanos: o.PriceNanos,
+		Remaining:  o.Remaining,
+		Seq:        o.Seq,
+	}
+}
+
+// PlaceBid offers to buy quantity contracts of a listing at up to
+// priceNanos each.
+func (m *Market) PlaceBid(
+	traderID, listingID uuid.UUID,
+	priceNanos int64,
+	quantity uint64) (*models.BookOrder, []*models.BookFill, error) {
+
+	if quantity == 0 {
+		return nil, nil, errors.New("quantity must be positive")
+	}
+	unpaid, err := m.uow.Repos().Transactions.CountUnpaidFillsByBuyerID(traderID, time.Now().Add(-unpaidFillWindow))
+	if err != nil {
+		return nil, nil, err
+	}
+	if unpaid >= maxUnpaidFills {
+		return nil, nil, errTooManyUnpaidFills
+	}
+	return m.place(traderID, listingID, models.OrderBid, priceNanos, quantity, nil)
+}
+
+// PlaceAsk offers contracts the trader owns, all issued from listingID, for
+// at least priceNanos each. They move to StatusListed while on offer.
+func (m *Market) PlaceAsk(
+	traderID, listingID uuid.UUID,
+	priceNanos int64,
+	headerIDs []uuid.UUID) (*models.BookOrder, []*models.BookFill, error) {
+
+	if len(headerIDs) == 0 {
+		return nil, nil, errors.New("an ask must offer at least one contract")
+	}
+	seller, err := m.uow.Repos().Users.FindByID(traderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if seller.StripeConnectAccountID == "" || !seller.StripeChargesEnabled {
+		return nil, nil, errSellerNotPayable
+	}
+	if err := BillOverageBeforeListing(traderID, headerIDs, m.provider, m.uow); err != nil {
+		return nil, nil, err
+	}
+	return m.place(traderID, listingID, models.OrderAsk, priceNanos, uint64(len(headerIDs)), headerIDs)
+}
+
+func (m *Market) place(
+	traderID, listingID uuid.UUID,
+	side models.OrderSide,
+	priceNanos int64,
+	quantity uint64,
+	headerIDs []uuid.UUID) (*models.BookOrder, []*models.BookFill, error) {
+
+	if priceNanos <= 0 {
+		return nil, nil, errors.New("price must be positive")
+	}
+	listing, err := m.uow.Repos().Listings.FindByID(listingID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if listing.ContractType == models.ContractSubscription {
+		return nil, nil, errors.New("subscription contracts cannot be traded")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	book, err := m.book(listingID)
+	if err != nil {
+		return nil, nil, err
+	}
+	work := book.Clone()
+
+	now := time.Now()
+	order := &models.BookOrder{
+		ID:         uuid.New(),
+		ListingID:  listingID,
+		TraderID:   traderID,
+		Side:       side,
+		PriceNanos: priceNanos,
+		Quantity:   quantity,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	incoming := toBookOrder(order)
+	incoming.Remaining = quantity
+	matches := work.Place(incoming)
+	order.Seq = incoming.Seq
+	order.Remaining = incoming.Remaining
+	if order.Remaining == 0 {
+		order.Status = models.OrderFilled
+	}
+
+	var fills []*models.BookFill
+	err = m.uow.WithTx(func(tx *repos.Repos) error {
+		if side == models.OrderAsk {
+			if err := offerContracts(tx, traderID, listingID, headerIDs); err != nil {
+				return err
+			}
+		}
+		if err := tx.Orders.Create(order); err != nil {
+			return err
+		}
+		if side == models.OrderAsk {
+			if err := tx.Orders.AddAskContracts(order.ID, headerIDs); err != nil {
+				return err
+			}
+		}
+
+		for _, match := range matches {
+			resting := match.AskID
+			if side == models.OrderAsk {
+				resting = match.BidID
+			}
+			left, _ := work.Order(resting)
+			if err := tx.Orders.SetRemaining(resting, left.Remaining); err != nil {
+				return err
+			}
+
+			fill, err := recordFill(tx, listingID, match)
+			if err != nil {
+				return err
+			}
+			fills = append(fills, fill)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m.books[listingID] = work
+	return order, fills, nil
+}
+
+// offerContracts checks the trader may offer the contracts on the
+// listing's book and moves them to StatusListed.
+func offerContracts(tx *repos.Repos, traderID, listingID uuid.UUID, headerIDs []uuid.UUID) error {
+	now := time.Now()
+	for _, id := range headerIDs {
+		header, err := tx.Headers.FindByID(id)
+		if err != nil {
+			return err
+		}
+		if header.ListingID != listingID {
+			return fmt.Errorf("contract %s was not issued from this listing", id)
+		}
+		if header.ExerciseBy != nil && !header.ExerciseBy.After(now) {
+			return fmt.Errorf("contract %s has expired", id)
+		}
+		state, err := tx.States.FindByID(id)
+		if err != nil {
+			return err
+		}
+		if state.OwnerID != traderID {
+			return fmt.Errorf("contract %s: %w", id, errNotParticipant)
+		}
+		err = lifecycle.TransitionContract(tx, state, models.StatusListed, traderID, "offered on order book")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordFill saves a match and sets it up for payment: the contracts it
+// covers move to StatusMatched and a pending transaction holds them for
+// the buyer until ReservationTTL runs out.
+func recordFill(tx *repos.Repos, listingID uuid.UUID, match orderbook.Fill) (*models.BookFill, error) {
+	offered, err := tx.Orders.FindUnmatchedAskContracts(match.AskID, int(match.Quantity))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(offered)) != match.Quantity {
+		return nil, fmt.Errorf("ask %s offers %d contracts, %d matched", match.AskID, len(offered), match.Quantity)
+	}
+
+	now := time.Now()
+	unitCents := (match.PriceNanos + 5_000_000) / 10_000_000
+	totalCents := unitCents * int64(match.Quantity)
+	fill := &models.BookFill{
+		ID:            uuid.New(),
+		ListingID:     listingID,
+		BidOrderID:    match.BidID,
+		AskOrderID:    match.AskID,
+		BuyerID:       match.BuyerID,
+		SellerID:      match.SellerID,
+		PriceNanos:    match.PriceNanos,
+		Quantity:      match.Quantity,
+		TransactionID: uuid.New(),
+		CreatedAt:     now,
+	}
+	record := &models.TransactionRecord{
+		ID:                fill.TransactionID,
+		InitiatedAt:       now,
+		ListingID:         listingID,
+		SellerID:          match.SellerID,
+		BuyerID:           match.BuyerID,
+		PurchaseQuantity:  int64(match.Quantity),
+		PurchaseCents:     uint64(totalCents),
+		Currency:          os.Getenv("CURRENCY"),
+		PlatformFeeCents:  platformFeeCents(totalCents),
+		TransactionStatus: models.StatusPending,
+		Kind:              models.KindOrderFill,
+		FillID:            fill.ID,
+	}
+	hold := &models.SupplyReservation{
+		ID:            uuid.New(),
+		Kind:          models.KindOrderFill,
+		ListingID:     fill.ID,
+		TransactionID: record.ID,
+		Quantity:      match.Quantity,
+		Status:        models.ReservationActive,
+		ExpiresAt:     now.Add(ReservationTTL()),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	if err := applyRoyalty(record, tx.Listings); err != nil {
+		return nil, err
+	}
+	if err := tx.Fills.Create(fill); err != nil {
+		return nil, err
+	}
+	if err := tx.Transactions.Create(record); err != nil {
+		return nil, err
+	}
+	if err := tx.Reservations.Create(hold); err != nil {
+		return nil, err
+	}
+
+	headerIDs := make([]uuid.UUID, len(offered))
+	for i, row := range offered {
+		headerIDs[i] = row.HeaderID
+	}
+	if err := tx.Orders.MatchAskContracts(headerIDs, fill.ID); err != nil {
+		return nil, err
+	}
+	for _, id := range headerIDs {
+		state, err := tx.States.FindByID(id)
+		if err != nil {
+			return nil, err
+		}
+		err = lifecycle.TransitionContract(tx, state, models.StatusMatched, match.BuyerID, "matched on order book")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fill, nil
+}
+
+// Cancel withdraws what is left of a trader's order. Contracts an ask still
+// offers go back to StatusOwned.
+func (m *Market) Cancel(traderID, orderID uuid.UUID) error {
+	order, err := m.uow.Repos().Orders.FindByID(orderID)
+	if err != nil {
+		return err
+	}
+	if order.TraderID != traderID {
+		return errNotParticipant
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err = m.uow.WithTx(func(tx *repos.Repos) error {
+		if err := tx.Orders.Cancel(orderID); err != nil {
+			return err
+		}
+		if order.Side != models.OrderAsk {
+			return nil
+		}
+		return withdrawContracts(tx, orderID, traderID, "order cancelled")
+	})
+	if err != nil {
+		return err
+	}
+
+	if book, ok := m.books[order.ListingID]; ok {
+		book.Cancel(orderID)
+	}
+	return nil
+}
+
+// withdrawContracts takes the unmatched contracts of an ask off the market.
+func withdrawContracts(tx *repos.Repos, orderID, actorID uuid.UUID, reason string) error {
+	offered, err := tx.Orders.FindUnmatchedAskContracts(orderID, -1)
+	if err != nil {
+		return err
+	}
+	headerIDs := make([]uuid.UUID, len(offered))
+	for i, row := range offered {
+		headerIDs[i] = row.HeaderID
+		state, err := tx.States.FindByID(row.HeaderID)
+		if err != nil {
+			return err
+		}
+		if state.Status != models.StatusListed {
+			continue
+		}
+		if err := lifecycle.TransitionContract(tx, state, models.StatusOwned, actorID, reason); err != nil {
+			return err
+		}
+	}
+	return tx.Orders.RemoveAskContracts(headerIDs)
+}
+
+// Depth returns the listing's book aggregated by price.
+func (m *Market) Depth(listingID uuid.UUID) (bids, asks []orderbook.Level, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	book, err := m.book(listingID)
+	if err != nil {
+		return nil, nil, err
+	}
+	bids, asks = book.Depth()
+	return bids, asks, nil
+}
+
+// OnContractExpired takes an expired contract out of the ask offering it.
+// Subscribe it to events.ContractExpired.
+func (m *Market) OnContractExpired(ev events.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row, err := m.uow.Repos().Orders.FindAskContractByHeaderID(ev.ContractID)
+	if errors.Is(err, repos.ErrAskContractNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("market: contract %s expired: %v", ev.ContractID, err)
+		return
+	}
+	if row.FillID != nil {
+		// Already matched; settling the fill will fail and refund.
+		return
+	}
+
+	var order *models.BookOrder
+	err = m.uow.WithTx(func(tx *repos.Repos) error {
+		order, err = tx.Orders.FindByID(row.OrderID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Orders.RemoveAskContracts([]uuid.UUID{row.HeaderID}); err != nil {
+			return err
+		}
+		if order.Status != models.OrderOpen || order.Remaining == 0 {
+			return nil
+		}
+		return tx.Orders.SetRemaining(order.ID, order.Remaining-1)
+	})
+	if err != nil {
+		log.Printf("market: contract %s expired: %v", ev.ContractID, err)
+		return
+	}
+	if book, ok := m.books[order.ListingID]; ok {
+		book.Reduce(order.ID, 1)
+	}
+}
+
+// OnContractFrozen drops the cached book of a frozen contract's listing,
+// since FreezeDisputed may have taken the contract out of an ask, so the
+// book is loaded again from the database when next used. Subscribe it to
+// events.ContractFrozen.
+func (m *Market) OnContractFrozen(ev events.Event) {
+	header, err := m.uow.Repos().Headers.FindByID(ev.ContractID)
+	if err != nil {
+		log.Printf("market: contract %s frozen: %v", ev.ContractID, err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.books, header.ListingID)
+}
+
+// OnFillReleased puts the quantity of an unpaid fill back on its ask in the
+// book, as releaseFill has already done in the database. Subscribe it to
+// events.FillReleased.
+func (m *Market) OnFillReleased(ev events.Event) {
+	rs := m.uow.Repos()
+	record, err := rs.Transactions.FindByID(ev.TransactionID)
+	if err != nil {
+		log.Printf("market: fill for transaction %s released: %v", ev.TransactionID, err)
+		return
+	}
+	fill, err := rs.Fills.FindByID(record.FillID)
+	if err != nil {
+		log.Printf("market: fill %s released: %v", record.FillID, err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	book, ok := m.books[fill.ListingID]
+	if !ok {
+		// Loaded from the database, with the ask as it is now, when next
+		// traded.
+		return
+	}
+	ask, err := rs.Orders.FindByID(fill.AskOrderID)
+	if err != nil {
+		log.Printf("market: fill %s released: %v", fill.ID, err)
+		return
+	}
+	book.Cancel(ask.ID)
+	if ask.Status == models.OrderOpen && ask.Remaining > 0 {
+		book.Restore(toBookOrder(ask))
+	}
+}
+
+// releaseFill puts the contracts of an unpaid fill back on offer in the ask
+// they were matched from, which is reopened for them if it had filled. If
+// the ask has been cancelled meanwhile they go back to the seller instead.
+// Contracts that are no longer StatusMatched, such as ones that expired
+// while the fill awaited payment, are taken out of the ask.
+func releaseFill(fillID uuid.UUID, tx *repos.Repos) error {
+	fill, err := tx.Fills.FindByID(fillID)
+	if err != nil {
+		return err
+	}
+	matched, err := tx.Orders.FindAskContractsByFillID(fillID)
+	if err != nil {
+		return err
+	}
+	var states []*models.ContractState
+	var gone []uuid.UUID
+	for _, row := range matched {
+		state, err := tx.States.FindByID(row.HeaderID)
+		if err != nil {
+			return err
+		}
+		if state.Status != models.StatusMatched {
+			gone = append(gone, row.HeaderID)
+			continue
+		}
+		states = append(states, state)
+	}
+	if err := tx.Orders.RemoveAskContracts(gone); err != nil {
+		return err
+	}
+	if len(states) == 0 {
+		return nil
+	}
+
+	to := models.StatusListed
+	err = tx.Orders.Reopen(fill.AskOrderID, uint64(len(states)))
+	if errors.Is(err, repos.ErrBookOrderNotOpen) {
+		to = models.StatusOwned
+	} else if err != nil {
+		return err
+	}
+
+	headerIDs := make([]uuid.UUID, len(states))
+	for i, state := range states {
+		headerIDs[i] = state.HeaderID
+		err = lifecycle.TransitionContract(tx, state, to, lifecycle.SystemActor, "fill not paid for")
+		if err != nil {
+			return err
+		}
+	}
+	if to == models.StatusOwned {
+		return tx.Orders.RemoveAskContracts(headerIDs)
+	}
+	return tx.Orders.UnmatchAskContracts(headerIDs)
+}
+
+// settleFill hands the contracts of a paid fill to the buyer. A fill whose
+// hold has already been released cannot be settled, and errFillReleased is
+// returned so the payment can be refunded.
+func settleFill(record *models.TransactionRecord, tx *repos.Repos) error {
+	reservation, err := tx.Reservations.FindByTransactionID(record.ID)
+	if err != nil {
+		return err
+	}
+	err = tx.Reservations.Convert(reservation.ID)
+	if errors.Is(err, repos.ErrReservationNotActive) {
+		return errFillReleased
+	}
+	if err != nil {
+		return err
+	}
+
+	matched, err := tx.Orders.FindAskContractsByFillID(record.FillID)
+	if err != nil {
+		return err
+	}
+	states := make([]*models.ContractState, len(matched))
+	headerIDs := make([]uuid.UUID, len(matched))
+	for i, row := range matched {
+		headerIDs[i] = row.HeaderID
+		states[i], err = tx.States.FindByID(row.HeaderID)
+		if err != nil {
+			return err
+		}
+	}
+	if err := TransferOwnershipInBatches(record, states, tx); err != nil {
+		return err
+	}
+	return tx.Orders.RemoveAskContracts(headerIDs)
+}
+
+type PlaceOrderRequest struct {
+	// Side is "bid" or "ask".
+	Side       string `json:"side"`
+	PriceNanos int64  `json:"price_nanos"`
+	// Quantity is for bids; an ask's quantity is the number of contracts
+	// it offers.
+	Quantity    uint64   `json:"quantity"`
+	ContractIDs []string `json:"contract_ids"`
+}
+
+type PlaceOrderResponse struct {
+	Order *models.BookOrder  `json:"order"`
+	Fills []*models.BookFill `json:"fills"`
+}
+
+// OrderBookHandler serves GET /v1/listings/{id}/book: the listing's bids and
+// asks aggregated by price.
+func OrderBookHandler(market *Market) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		listingID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid listing id", http.StatusBadRequest)
+			return
+		}
+		bids, asks, err := market.Depth(listingID)
+		if err != nil {
+			http.Error(w, "failed to load order book: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"bids": bids, "asks": asks})
+	}
+}
+
+// PlaceOrderHandler serves POST /v1/listings/{id}/orders. The order is
+// matched straight away; any fills come back with it, each with a pending
+// transaction the buyer pays through POST /v1/fills/{id}/checkout.
+func PlaceOrderHandler(market *Market, userRepo repos.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		listingID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid listing id", http.StatusBadRequest)
+			return
+		}
+		req := &PlaceOrderRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var order *models.BookOrder
+		var fills []*models.BookFill
+		switch req.Side {
+		case "bid":
+			order, fills, err = market.PlaceBid(u.ID, listingID, req.PriceNanos, req.Quantity)
+		case "ask":
+			headerIDs := make([]uuid.UUID, len(req.ContractIDs))
+			for i, id := range req.ContractIDs {
+				headerIDs[i], err = uuid.Parse(id)
+				if err != nil {
+					http.Error(w, "invalid contract id: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			order, fills, err = market.PlaceAsk(u.ID, listingID, req.PriceNanos, headerIDs)
+		default:
+			http.Error(w, `side must be "bid" or "ask"`, http.StatusBadRequest)
+			return
+		}
+		switch {
+		case errors.Is(err, repos.ErrListingNotFound):
+			http.Error(w, "listing not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errSellerNotPayable):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errTooManyUnpaidFills):
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, errOverageUnpaid):
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		case errors.Is(err, errNotParticipant):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, lifecycle.ErrIllegalTransition), errors.Is(err, repos.ErrContractStatusConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, "failed to place order: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&PlaceOrderResponse{Order: order, Fills: fills})
+	}
+}
+
+// OrdersHandler serves GET /v1/orders, the caller's orders newest first.
+func OrdersHandler(orderRepo repos.BookOrderRepository, userRepo repos.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		orders, err := orderRepo.FindAllByTraderID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch orders: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(orders)
+	}
+}
+
+// CancelOrderHandler serves DELETE /v1/orders/{id}.
+func CancelOrderHandler(market *Market, userRepo repos.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		orderID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid order id", http.StatusBadRequest)
+			return
+		}
+
+		err = market.Cancel(u.ID, orderID)
+		switch {
+		case errors.Is(err, repos.ErrBookOrderNotFound):
+			http.Error(w, "order not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errNotParticipant):
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		case errors.Is(err, repos.ErrBookOrderNotOpen):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, "failed to cancel order: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// FillsHandler serves GET /v1/fills, the fills the caller bought or sold in.
+func FillsHandler(fillRepo repos.BookFillRepository, userRepo repos.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fills, err := fillRepo.FindAllByTraderID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch fills: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(fills)
+	}
+}
+
+// FillCheckoutHandler serves POST /v1/fills/{id}/checkout, where the buyer
+// of a fill pays for it before its hold runs out.
+func FillCheckoutHandler(provider payments.PaymentProvider, uow repos.UnitOfWork, bus *events.Bus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		buyer, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "not authorized", 401)
+			return
+		}
+		fillID, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid fill id", 400)
+			return
+		}
+		fill, err := rs.Fills.FindByID(fillID)
+		if err != nil {
+			http.Error(w, "fill not found", 404)
+			return
+		}
+		if fill.BuyerID != buyer.ID {
+			http.Error(w, "forbidden", 403)
+			return
+		}
+		tr, err := rs.Transactions.FindByID(fill.TransactionID)
+		if err != nil {
+			http.Error(w, "transaction not found", 500)
+			return
+		}
+		if tr.TransactionStatus != models.StatusPending {
+			http.Error(w, "fill is "+tr.TransactionStatus.String(), 409)
+			return
+		}
+		hold, err := rs.Reservations.FindByTransactionID(tr.ID)
+		if err != nil || hold.Status != models.ReservationActive || !hold.ExpiresAt.After(time.Now()) {
+			http.Error(w, errFillReleased.Error(), 409)
+			return
+		}
+
+		seller, ok := payableSeller(w, rs.Users, fill.SellerID)
+		if !ok {
+			return
+		}
+		productName := "Data Contract (resale)"
+		if listing, err := rs.Listings.FindByID(fill.ListingID); err == nil && listing.DatastreamID != uuid.Nil {
+			if datastream, err := rs.Datastreams.FindByID(listing.DatastreamID); err == nil {
+				productName = datastream.Name + " (resale)"
+			}
+		}
+
+		openCheckout(w, provider, uow, &checkoutOrder{
+			record:      tr,
+			hold:        hold,
+			seller:      seller,
+			productName: productName,
+			unitCents:   (fill.PriceNanos + 5_000_000) / 10_000_000,
+			metadata: map[string]string{
+				"transaction_id": tr.ID.String(),
+				"fill_id":        fill.ID.String(),
+				"buyer_id":       buyer.ID.String(),
+			},
+			bus: bus,
+		})
+	}
+}
@@ -0,0 +1,1430 @@
+package main
+
+import (
+	"math/big"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// The repositories below keep their rows in maps so that tests can run the
+// marketplace without a database. Each embeds the interface it stands in
+// for and implements only what the tests reach; calling anything else
+// panics on the nil embedded value, which points straight at the method to
+// add. WithTx works on a copy of every table and keeps it only if fn
+// succeeds, so rollbacks behave as they do in Postgres. Transactions run
+// one at a time.
+
+type memTable[T any] struct {
+	rows  map[uuid.UUID]T
+	order []uuid.UUID
+}
+
+func newMemTable[T any]() *memTable[T] {
+	return &memTable[T]{rows: map[uuid.UUID]T{}}
+}
+
+func (t *memTable[T]) clone() *memTable[T] {
+	c := &memTable[T]{rows: make(map[uuid.UUID]T, len(t.rows)), order: append([]uuid.UUID(nil), t.order...)}
+	for id, row := range t.rows {
+		c.rows[id] = row
+	}
+	return c
+}
+
+func (t *memTable[T]) get(id uuid.UUID) (T, bool) {
+	row, ok := t.rows[id]
+	return row, ok
+}
+
+func (t *memTable[T]) put(id uuid.UUID, row T) {
+	if _, ok := t.rows[id]; !ok {
+		t.order = append(t.order, id)
+	}
+	t.rows[id] = row
+}
+
+func (t *memTable[T]) delete(id uuid.UUID) bool {
+	if _, ok := t.rows[id]; !ok {
+		return false
+	}
+	delete(t.rows, id)
+	for i, o := range t.order {
+		if o == id {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// where returns the rows keep accepts, in insertion order.
+func (t *memTable[T]) where(keep func(*T) bool) []T {
+	var out []T
+	for _, id := range t.order {
+		row := t.rows[id]
+		if keep == nil || keep(&row) {
+			out = append(out, row)
+		}
+	}
+	return out
+}
+
+type memData struct {
+	users          *memTable[models.User]
+	listings       *memTable[models.ContractListing]
+	transactions   *memTable[models.TransactionRecord]
+	reservations   *memTable[models.SupplyReservation]
+	headers        *memTable[models.ContractHeader]
+	states         *memTable[models.ContractState]
+	history        *memTable[models.ContractStateHistory]
+	ownership      *memTable[models.OwnershipEntry]
+	overageLines   *memTable[models.OverageLine]
+	resales        *memTable[models.ResaleListing]
+	refunds        *memTable[models.RefundRecord]
+	refundRequests *memTable[models.RefundRequest]
+	notifications  *memTable[models.Notification]
+	subscriptions  *memTable[models.Subscription]
+	transfers      *memTable[models.ContractTransfer]
+	auctions       *memTable[models.AuctionListing]
+	auctionBids    *memTable[models.AuctionBid]
+	datastreams    *memTable[models.Datastream]
+}
+
+func newMemData() *memData {
+	return &memData{
+		users:          newMemTable[models.User](),
+		listings:       newMemTable[models.ContractListing](),
+		transactions:   newMemTable[models.TransactionRecord](),
+		reservations:   newMemTable[models.SupplyReservation](),
+		headers:        newMemTable[models.ContractHeader](),
+		states:         newMemTable[models.ContractState](),
+		history:        newMemTable[models.ContractStateHistory](),
+		ownership:      newMemTable[models.OwnershipEntry](),
+		overageLines:   newMemTable[models.OverageLine](),
+		resales:        newMemTable[models.ResaleListing](),
+		refunds:        newMemTable[models.RefundRecord](),
+		refundRequests: newMemTable[models.RefundRequest](),
+		notifications:  newMemTable[models.Notification](),
+		subscriptions:  newMemTable[models.Subscription](),
+		transfers:      newMemTable[models.ContractTransfer](),
+		auctions:       newMemTable[models.AuctionListing](),
+		auctionBids:    newMemTable[models.AuctionBid](),
+		datastreams:    newMemTable[models.Datastream](),
+	}
+}
+
+func (d *memData) clone() *memData {
+	return &memData{
+		users:          d.users.clone(),
+		listings:       d.listings.clone(),
+		transactions:   d.transactions.clone(),
+		reservations:   d.reservations.clone(),
+		headers:        d.headers.clone(),
+		states:         d.states.clone(),
+		history:        d.history.clone(),
+		ownership:      d.ownership.clone(),
+		overageLines:   d.overageLines.clone(),
+		resales:        d.resales.clone(),
+		refunds:        d.refunds.clone(),
+		refundRequests: d.refundRequests.clone(),
+		notifications:  d.notifications.clone(),
+		subscriptions:  d.subscriptions.clone(),
+		transfers:      d.transfers.clone(),
+		auctions:       d.auctions.clone(),
+		auctionBids:    d.auctionBids.clone(),
+		datastreams:    d.datastreams.clone(),
+	}
+}
+
+// memDB is either the committed store or the copy a transaction works on.
+// Only the committed store takes the lock; a transaction holds it
+// throughout.
+type memDB struct {
+	mu   *sync.Mutex
+	data *memData
+	inTx bool
+}
+
+func (db *memDB) do(fn func(d *memData) error) error {
+	if !db.inTx {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+	return fn(db.data)
+}
+
+type memUnitOfWork struct {
+	db    *memDB
+	repos *repos.Repos
+}
+
+func newMemUnitOfWork() *memUnitOfWork {
+	db := &memDB{mu: &sync.Mutex{}, data: newMemData()}
+	return &memUnitOfWork{db: db, repos: newMemRepos(db)}
+}
+
+func (u *memUnitOfWork) Repos() *repos.Repos {
+	return u.repos
+}
+
+func (u *memUnitOfWork) WithTx(fn func(tx *repos.Repos) error) error {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	tx := &memDB{mu: u.db.mu, data: u.db.data.clone(), inTx: true}
+	if err := fn(newMemRepos(tx)); err != nil {
+		return err
+	}
+	u.db.data = tx.data
+	return nil
+}
+
+func newMemRepos(db *memDB) *repos.Repos {
+	return &repos.Repos{
+		Users:          &memUsers{db: db},
+		Transactions:   &memTransactions{db: db},
+		Listings:       &memListings{db: db},
+		Headers:        &memHeaders{db: db},
+		States:         &memStates{db: db},
+		StateHistory:   &memStateHistory{db: db},
+		Reservations:   &memReservations{db: db},
+		Ownership:      &memOwnership{db: db},
+		OverageLines:   &memOverageLines{db: db},
+		Resales:        &memResales{db: db},
+		Refunds:        &memRefunds{db: db},
+		RefundRequests: &memRefundRequests{db: db},
+		Notifications:  &memNotifications{db: db},
+		Subscriptions:  &memSubscriptions{db: db},
+		Transfers:      &memTransfers{db: db},
+		Auctions:       &memAuctions{db: db},
+		Datastreams:    &memDatastreams{db: db},
+	}
+}
+
+type memUsers struct {
+	repos.UserRepository
+	db *memDB
+}
+
+func (r *memUsers) FindByID(id uuid.UUID) (*models.User, error) {
+	var out *models.User
+	err := r.db.do(func(d *memData) error {
+		u, ok := d.users.get(id)
+		if !ok {
+			return repos.ErrUserNotFound
+		}
+		out = &u
+		return nil
+	})
+	return out, err
+}
+
+func (r *memUsers) Create(u *models.User) error {
+	return r.db.do(func(d *memData) error {
+		if u.ID == uuid.Nil {
+			u.ID = uuid.New()
+		}
+		d.users.put(u.ID, *u)
+		return nil
+	})
+}
+
+func (r *memUsers) Update(u *models.User) error {
+	return r.db.do(func(d *memData) error {
+		d.users.put(u.ID, *u)
+		return nil
+	})
+}
+
+func (r *memUsers) FindByAuth(provider, subject string) (*models.User, error) {
+	var out *models.User
+	err := r.db.do(func(d *memData) error {
+		found := d.users.where(func(u *models.User) bool {
+			return u.AuthProvider == provider && u.AuthSubject == subject
+		})
+		if len(found) == 0 {
+			return repos.ErrUserNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memUsers) FindOrCreateByAuth(provider, subject, email string) (*models.User, error) {
+	if u, err := r.FindByAuth(provider, subject); err == nil {
+		return u, nil
+	}
+	u := &models.User{ID: uuid.New(), AuthProvider: provider, AuthSubject: subject, Email: email}
+	return u, r.Create(u)
+}
+
+func (r *memUsers) FindByStripeConnectAccountID(accountID string) (*models.User, error) {
+	var out *models.User
+	err := r.db.do(func(d *memData) error {
+		found := d.users.where(func(u *models.User) bool { return u.StripeConnectAccountID == accountID })
+		if len(found) == 0 {
+			return repos.ErrUserNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memUsers) FindByStripeCustomerID(customerID string) (*models.User, error) {
+	var out *models.User
+	err := r.db.do(func(d *memData) error {
+		found := d.users.where(func(u *models.User) bool { return u.StripeCustomerID == customerID })
+		if len(found) == 0 {
+			return repos.ErrUserNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+type memListings struct {
+	repos.ContractListingRepository
+	db *memDB
+}
+
+func (r *memListings) FindByID(id uuid.UUID) (*models.ContractListing, error) {
+	var out *models.ContractListing
+	err := r.db.do(func(d *memData) error {
+		l, ok := d.listings.get(id)
+		if !ok {
+			return repos.ErrListingNotFound
+		}
+		out = &l
+		return nil
+	})
+	return out, err
+}
+
+func (r *memListings) Create(l *models.ContractListing) error {
+	return r.db.do(func(d *memData) error {
+		d.listings.put(l.ID, *l)
+		return nil
+	})
+}
+
+func (r *memListings) Update(l *models.ContractListing) error {
+	return r.db.do(func(d *memData) error {
+		stored, ok := d.listings.get(l.ID)
+		if !ok {
+			return repos.ErrListingNotFound
+		}
+		if stored.Version != l.Version {
+			return repos.ErrListingVersionConflict
+		}
+		l.Version++
+		d.listings.put(l.ID, *l)
+		return nil
+	})
+}
+
+func (r *memListings) DecrementSupply(id uuid.UUID, quantity uint64) error {
+	return r.db.do(func(d *memData) error {
+		l, ok := d.listings.get(id)
+		if !ok {
+			return repos.ErrListingNotFound
+		}
+		if l.SupplyRemaining < quantity {
+			return repos.ErrInsufficientSupply
+		}
+		l.SupplyRemaining -= quantity
+		l.Version++
+		d.listings.put(id, l)
+		return nil
+	})
+}
+
+func (r *memListings) RestoreSupply(id uuid.UUID, quantity uint64) error {
+	return r.db.do(func(d *memData) error {
+		l, ok := d.listings.get(id)
+		if !ok {
+			return repos.ErrListingNotFound
+		}
+		l.SupplyRemaining += quantity
+		l.Version++
+		d.listings.put(id, l)
+		return nil
+	})
+}
+
+type memTransactions struct {
+	repos.TransactionRepository
+	db *memDB
+}
+
+func (r *memTransactions) FindByID(id uuid.UUID) (*models.TransactionRecord, error) {
+	var out *models.TransactionRecord
+	err := r.db.do(func(d *memData) error {
+		tr, ok := d.transactions.get(id)
+		if !ok {
+			return repos.ErrTransactionNotFound
+		}
+		out = &tr
+		return nil
+	})
+	return out, err
+}
+
+func (r *memTransactions) findOne(keep func(*models.TransactionRecord) bool) (*models.TransactionRecord, error) {
+	var out *models.TransactionRecord
+	err := r.db.do(func(d *memData) error {
+		found := d.transactions.where(keep)
+		if len(found) == 0 {
+			return repos.ErrTransactionNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memTransactions) FindByCheckoutSessionID(sessionID string) (*models.TransactionRecord, error) {
+	return r.findOne(func(tr *models.TransactionRecord) bool { return tr.StripeCheckoutSessonID == sessionID })
+}
+
+func (r *memTransactions) FindByStripePaymentIntentID(paymentIntentID string) (*models.TransactionRecord, error) {
+	return r.findOne(func(tr *models.TransactionRecord) bool {
+		return paymentIntentID != "" && tr.StripePaymentIntentID == paymentIntentID
+	})
+}
+
+func (r *memTransactions) Create(tr *models.TransactionRecord) error {
+	return r.db.do(func(d *memData) error {
+		d.transactions.put(tr.ID, *tr)
+		return nil
+	})
+}
+
+func (r *memTransactions) Update(tr *models.TransactionRecord) error {
+	return r.db.do(func(d *memData) error {
+		d.transactions.put(tr.ID, *tr)
+		return nil
+	})
+}
+
+func (r *memTransactions) UpdateFromStatus(tr *models.TransactionRecord, from models.TransactionStatus) error {
+	return r.db.do(func(d *memData) error {
+		stored, ok := d.transactions.get(tr.ID)
+		if !ok {
+			return repos.ErrTransactionNotFound
+		}
+		if stored.TransactionStatus != from {
+			return repos.ErrTransactionStatusConflict
+		}
+		d.transactions.put(tr.ID, *tr)
+		return nil
+	})
+}
+
+func (r *memTransactions) UpdateFromRefunded(
+	tr *models.TransactionRecord,
+	from models.TransactionStatus,
+	fromRefundedCents int64) error {
+
+	return r.db.do(func(d *memData) error {
+		stored, ok := d.transactions.get(tr.ID)
+		if !ok {
+			return repos.ErrTransactionNotFound
+		}
+		if stored.TransactionStatus != from || stored.RefundedCents != fromRefundedCents {
+			return repos.ErrTransactionStatusConflict
+		}
+		d.transactions.put(tr.ID, *tr)
+		return nil
+	})
+}
+
+func (r *memTransactions) FindOpenByResaleListingID(resaleListingID uuid.UUID) (*models.TransactionRecord, error) {
+	return r.findOne(func(tr *models.TransactionRecord) bool {
+		return tr.Kind == models.KindResale && tr.ResaleListingID == resaleListingID &&
+			(tr.TransactionStatus == models.StatusPending || tr.TransactionStatus == models.StatusRequiresPayment)
+	})
+}
+
+func (r *memTransactions) FindAllByKindAndStatus(
+	kind models.TransactionKind,
+	status models.TransactionStatus,
+	limit int) ([]models.TransactionRecord, error) {
+
+	var out []models.TransactionRecord
+	err := r.db.do(func(d *memData) error {
+		out = d.transactions.where(func(tr *models.TransactionRecord) bool {
+			return tr.Kind == kind && tr.TransactionStatus == status
+		})
+		return nil
+	})
+	return out[:min(len(out), limit)], err
+}
+
+type memReservations struct {
+	repos.ReservationRepository
+	db *memDB
+}
+
+func (r *memReservations) FindByTransactionID(transactionID uuid.UUID) (*models.SupplyReservation, error) {
+	var out *models.SupplyReservation
+	err := r.db.do(func(d *memData) error {
+		found := d.reservations.where(func(s *models.SupplyReservation) bool { return s.TransactionID == transactionID })
+		if len(found) == 0 {
+			return repos.ErrReservationNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memReservations) FindAllExpired(now time.Time) ([]models.SupplyReservation, error) {
+	var out []models.SupplyReservation
+	err := r.db.do(func(d *memData) error {
+		out = d.reservations.where(func(s *models.SupplyReservation) bool {
+			return s.Status == models.ReservationActive && !s.ExpiresAt.After(now)
+		})
+		return nil
+	})
+	return out, err
+}
+
+func heldSupply(d *memData, listingID uuid.UUID, now time.Time) uint64 {
+	var held uint64
+	for _, s := range d.reservations.where(nil) {
+		if s.Kind == models.KindPrimary && s.ListingID == listingID &&
+			s.Status == models.ReservationActive && s.ExpiresAt.After(now) {
+			held += s.Quantity
+		}
+	}
+	return held
+}
+
+func (r *memReservations) SumActive(now time.Time, listingIDs ...uuid.UUID) (map[uuid.UUID]uint64, error) {
+	out := map[uuid.UUID]uint64{}
+	err := r.db.do(func(d *memData) error {
+		for _, id := range listingIDs {
+			out[id] = heldSupply(d, id, now)
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (r *memReservations) Hold(
+	listingID, transactionID uuid.UUID,
+	quantity uint64,
+	expiresAt time.Time) (*models.SupplyReservation, error) {
+
+	reservation := &models.SupplyReservation{
+		ID:            uuid.New(),
+		ListingID:     listingID,
+		TransactionID: transactionID,
+		Quantity:      quantity,
+		Status:        models.ReservationActive,
+		ExpiresAt:     expiresAt,
+	}
+	err := r.db.do(func(d *memData) error {
+		listing, ok := d.listings.get(listingID)
+		if !ok {
+			return repos.ErrListingNotFound
+		}
+		if listing.SupplyRemaining < heldSupply(d, listingID, time.Now())+quantity {
+			return repos.ErrInsufficientSupply
+		}
+		d.reservations.put(reservation.ID, *reservation)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (r *memReservations) Create(reservation *models.SupplyReservation) error {
+	return r.db.do(func(d *memData) error {
+		d.reservations.put(reservation.ID, *reservation)
+		return nil
+	})
+}
+
+func (r *memReservations) setStatus(id uuid.UUID, status models.ReservationStatus) error {
+	return r.db.do(func(d *memData) error {
+		s, ok := d.reservations.get(id)
+		if !ok || s.Status != models.ReservationActive {
+			return repos.ErrReservationNotActive
+		}
+		s.Status = status
+		d.reservations.put(id, s)
+		return nil
+	})
+}
+
+func (r *memReservations) Convert(id uuid.UUID) error {
+	return r.setStatus(id, models.ReservationConverted)
+}
+
+func (r *memReservations) Release(id uuid.UUID) error {
+	return r.setStatus(id, models.ReservationReleased)
+}
+
+type memHeaders struct {
+	repos.ContractHeaderRepository
+	db *memDB
+}
+
+func (r *memHeaders) FindByID(id uuid.UUID) (*models.ContractHeader, error) {
+	var out *models.ContractHeader
+	err := r.db.do(func(d *memData) error {
+		h, ok := d.headers.get(id)
+		if !ok {
+			return repos.ErrContractHeaderNotFound
+		}
+		out = &h
+		return nil
+	})
+	return out, err
+}
+
+func (r *memHeaders) Update(h *models.ContractHeader) error {
+	return r.db.do(func(d *memData) error {
+		d.headers.put(h.ID, *h)
+		return nil
+	})
+}
+
+func (r *memHeaders) AttachSubscription(headerIDs []uuid.UUID, subscriptionID uuid.UUID, exerciseBy time.Time, batchSize int) error {
+	return r.db.do(func(d *memData) error {
+		for _, id := range headerIDs {
+			h, ok := d.headers.get(id)
+			if !ok {
+				continue
+			}
+			h.SubscriptionID = subscriptionID
+			h.ExerciseBy = &exerciseBy
+			d.headers.put(id, h)
+		}
+		return nil
+	})
+}
+
+func (r *memHeaders) CreateInBatches(headers []*models.ContractHeader, batchSize int) error {
+	return r.db.do(func(d *memData) error {
+		for _, h := range headers {
+			d.headers.put(h.ID, *h)
+		}
+		return nil
+	})
+}
+
+func (r *memHeaders) FindAllByListingID(listingID uuid.UUID) ([]models.ContractHeader, error) {
+	var out []models.ContractHeader
+	err := r.db.do(func(d *memData) error {
+		out = d.headers.where(func(h *models.ContractHeader) bool { return h.ListingID == listingID })
+		return nil
+	})
+	return out, err
+}
+
+func (r *memHeaders) CountByListingID(listingID uuid.UUID) (int64, error) {
+	headers, err := r.FindAllByListingID(listingID)
+	return int64(len(headers)), err
+}
+
+type memStates struct {
+	repos.ContractStateRepository
+	db *memDB
+}
+
+func (r *memStates) FindByID(id uuid.UUID) (*models.ContractState, error) {
+	var out *models.ContractState
+	err := r.db.do(func(d *memData) error {
+		s, ok := d.states.get(id)
+		if !ok {
+			return repos.ErrContractStateNotFound
+		}
+		out = &s
+		return nil
+	})
+	return out, err
+}
+
+func (r *memStates) FindAllByOwnerID(ownerID uuid.UUID) ([]models.ContractState, error) {
+	var out []models.ContractState
+	err := r.db.do(func(d *memData) error {
+		out = d.states.where(func(s *models.ContractState) bool { return s.OwnerID == ownerID })
+		return nil
+	})
+	return out, err
+}
+
+func (r *memStates) Update(s *models.ContractState) error {
+	return r.db.do(func(d *memData) error {
+		d.states.put(s.HeaderID, *s)
+		return nil
+	})
+}
+
+func (r *memStates) CreateInBatches(states []*models.ContractState, batchSize int) error {
+	return r.db.do(func(d *memData) error {
+		for _, s := range states {
+			d.states.put(s.HeaderID, *s)
+		}
+		return nil
+	})
+}
+
+// update applies fn to a contract that is still in from.
+func (r *memStates) update(contractID uuid.UUID, from models.ContractStatus, fn func(s *models.ContractState)) error {
+	return r.db.do(func(d *memData) error {
+		s, ok := d.states.get(contractID)
+		if !ok {
+			return repos.ErrContractStateNotFound
+		}
+		if s.Status != from {
+			return repos.ErrContractStatusConflict
+		}
+		fn(&s)
+		d.states.put(contractID, s)
+		return nil
+	})
+}
+
+func (r *memStates) UpdateStatus(contractID uuid.UUID, from, to models.ContractStatus) error {
+	return r.update(contractID, from, func(s *models.ContractState) { s.Status = to })
+}
+
+func setMemOwner(s *models.ContractState, ownerID uuid.UUID, to models.ContractStatus, purchasedAt time.Time) {
+	s.OwnerID = ownerID
+	s.Status = to
+	s.LastPurchaseAt = purchasedAt
+	s.OverageReads = 0
+	s.OverageReadsBilled = 0
+	s.OverageCapCents = 0
+}
+
+func (r *memStates) UpdateOwner(
+	contractID uuid.UUID,
+	from models.ContractStatus,
+	ownerID uuid.UUID,
+	to models.ContractStatus,
+	purchasedAt time.Time) error {
+
+	return r.update(contractID, from, func(s *models.ContractState) { setMemOwner(s, ownerID, to, purchasedAt) })
+}
+
+func (r *memStates) UpdateOwnerInBatches(
+	headerIDs []uuid.UUID,
+	from models.ContractStatus,
+	ownerID uuid.UUID,
+	to models.ContractStatus,
+	purchasedAt time.Time,
+	batchSize int) error {
+
+	for _, id := range headerIDs {
+		err := r.UpdateOwner(id, from, ownerID, to, purchasedAt)
+		if err != nil {
+			return repos.ErrContractStatusConflict
+		}
+	}
+	return nil
+}
+
+func (r *memStates) FindAllUnbilledOverage(afterID uuid.UUID, limit int) ([]models.ContractState, error) {
+	var out []models.ContractState
+	err := r.db.do(func(d *memData) error {
+		out = d.states.where(func(s *models.ContractState) bool {
+			return s.OverageReads > s.OverageReadsBilled && s.HeaderID.String() > afterID.String()
+		})
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].HeaderID.String() < out[j].HeaderID.String() })
+	return out[:min(len(out), limit)], err
+}
+
+func (r *memStates) MarkOverageBilled(contractID uuid.UUID, from, to uint64) error {
+	return r.db.do(func(d *memData) error {
+		s, ok := d.states.get(contractID)
+		if !ok {
+			return repos.ErrContractStateNotFound
+		}
+		if s.OverageReadsBilled != from {
+			return repos.ErrOverageBillingConflict
+		}
+		s.OverageReadsBilled = to
+		d.states.put(contractID, s)
+		return nil
+	})
+}
+
+type memStateHistory struct {
+	repos.ContractStateHistoryRepository
+	db *memDB
+}
+
+func (r *memStateHistory) Create(entry *models.ContractStateHistory) error {
+	return r.db.do(func(d *memData) error {
+		if entry.ID == uuid.Nil {
+			entry.ID = uuid.New()
+		}
+		d.history.put(entry.ID, *entry)
+		return nil
+	})
+}
+
+func (r *memStateHistory) CreateInBatches(entries []*models.ContractStateHistory, batchSize int) error {
+	for _, entry := range entries {
+		if err := r.Create(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memStateHistory) FindAllByHeaderID(headerID uuid.UUID) ([]models.ContractStateHistory, error) {
+	var out []models.ContractStateHistory
+	err := r.db.do(func(d *memData) error {
+		out = d.history.where(func(h *models.ContractStateHistory) bool { return h.HeaderID == headerID })
+		return nil
+	})
+	return out, err
+}
+
+type memOwnership struct {
+	repos.OwnershipLedgerRepository
+	db *memDB
+}
+
+func (r *memOwnership) Create(entry *models.OwnershipEntry) error {
+	return r.db.do(func(d *memData) error {
+		if entry.ID == uuid.Nil {
+			entry.ID = uuid.New()
+		}
+		d.ownership.put(entry.ID, *entry)
+		return nil
+	})
+}
+
+func (r *memOwnership) CreateInBatches(entries []*models.OwnershipEntry, batchSize int) error {
+	for _, entry := range entries {
+		if err := r.Create(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *memOwnership) FindAllByHeaderID(headerID uuid.UUID) ([]models.OwnershipEntry, error) {
+	var out []models.OwnershipEntry
+	err := r.db.do(func(d *memData) error {
+		out = d.ownership.where(func(e *models.OwnershipEntry) bool { return e.HeaderID == headerID })
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out, err
+}
+
+func (r *memOwnership) FindAllByTransactionID(
+	transactionID uuid.UUID,
+	kind models.OwnershipEventKind) ([]models.OwnershipEntry, error) {
+
+	var out []models.OwnershipEntry
+	err := r.db.do(func(d *memData) error {
+		out = d.ownership.where(func(e *models.OwnershipEntry) bool {
+			return e.TransactionID == transactionID && e.Kind == kind
+		})
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].HeaderID.String() < out[j].HeaderID.String() })
+	return out, err
+}
+
+func (r *memOwnership) LastSeqs(headerIDs []uuid.UUID, batchSize int) (map[uuid.UUID]uint64, error) {
+	seqs := map[uuid.UUID]uint64{}
+	err := r.db.do(func(d *memData) error {
+		wanted := map[uuid.UUID]bool{}
+		for _, id := range headerIDs {
+			wanted[id] = true
+		}
+		for _, e := range d.ownership.where(nil) {
+			if wanted[e.HeaderID] && e.Seq >= seqs[e.HeaderID] {
+				seqs[e.HeaderID] = e.Seq
+			}
+		}
+		return nil
+	})
+	return seqs, err
+}
+
+type memOverageLines struct {
+	repos.OverageLineRepository
+	db *memDB
+}
+
+func (r *memOverageLines) CreateInBatches(lines []*models.OverageLine, batchSize int) error {
+	return r.db.do(func(d *memData) error {
+		for _, line := range lines {
+			d.overageLines.put(line.ID, *line)
+		}
+		return nil
+	})
+}
+
+func (r *memOverageLines) FindAllByTransactionIDs(transactionIDs []uuid.UUID) ([]models.OverageLine, error) {
+	var out []models.OverageLine
+	err := r.db.do(func(d *memData) error {
+		out = d.overageLines.where(func(line *models.OverageLine) bool {
+			for _, id := range transactionIDs {
+				if line.TransactionID == id {
+					return true
+				}
+			}
+			return false
+		})
+		return nil
+	})
+	return out, err
+}
+
+type memResales struct {
+	repos.ResaleListingRepository
+	db *memDB
+}
+
+func (r *memResales) FindByID(id uuid.UUID) (*models.ResaleListing, error) {
+	var out *models.ResaleListing
+	err := r.db.do(func(d *memData) error {
+		resale, ok := d.resales.get(id)
+		if !ok {
+			return repos.ErrResaleListingNotFound
+		}
+		out = &resale
+		return nil
+	})
+	return out, err
+}
+
+func (r *memResales) FindOpenByHeaderID(headerID uuid.UUID) (*models.ResaleListing, error) {
+	var out *models.ResaleListing
+	err := r.db.do(func(d *memData) error {
+		found := d.resales.where(func(resale *models.ResaleListing) bool {
+			return resale.HeaderID == headerID && resale.Status == models.ResaleOpen
+		})
+		if len(found) == 0 {
+			return repos.ErrResaleListingNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memResales) Create(resale *models.ResaleListing) error {
+	return r.db.do(func(d *memData) error {
+		d.resales.put(resale.ID, *resale)
+		return nil
+	})
+}
+
+func (r *memResales) Close(id uuid.UUID, status models.ResaleStatus) error {
+	return r.db.do(func(d *memData) error {
+		resale, ok := d.resales.get(id)
+		if !ok {
+			return repos.ErrResaleListingNotFound
+		}
+		if resale.Status != models.ResaleOpen {
+			return repos.ErrResaleListingNotOpen
+		}
+		resale.Status = status
+		d.resales.put(id, resale)
+		return nil
+	})
+}
+
+type memRefunds struct {
+	repos.RefundRepository
+	db *memDB
+}
+
+func (r *memRefunds) Create(record *models.RefundRecord) error {
+	return r.db.do(func(d *memData) error {
+		d.refunds.put(record.ID, *record)
+		return nil
+	})
+}
+
+func (r *memRefunds) FindAllByTransactionID(transactionID uuid.UUID) ([]models.RefundRecord, error) {
+	var out []models.RefundRecord
+	err := r.db.do(func(d *memData) error {
+		out = d.refunds.where(func(rr *models.RefundRecord) bool { return rr.TransactionID == transactionID })
+		return nil
+	})
+	return out, err
+}
+
+type memRefundRequests struct {
+	repos.RefundRequestRepository
+	db *memDB
+}
+
+func (r *memRefundRequests) FindByID(id uuid.UUID) (*models.RefundRequest, error) {
+	var out *models.RefundRequest
+	err := r.db.do(func(d *memData) error {
+		req, ok := d.refundRequests.get(id)
+		if !ok {
+			return repos.ErrRefundRequestNotFound
+		}
+		out = &req
+		return nil
+	})
+	return out, err
+}
+
+func (r *memRefundRequests) Create(req *models.RefundRequest) error {
+	return r.db.do(func(d *memData) error {
+		d.refundRequests.put(req.ID, *req)
+		return nil
+	})
+}
+
+func (r *memRefundRequests) FindPendingByTransactionID(transactionID uuid.UUID) (*models.RefundRequest, error) {
+	var out *models.RefundRequest
+	err := r.db.do(func(d *memData) error {
+		found := d.refundRequests.where(func(req *models.RefundRequest) bool {
+			return req.TransactionID == transactionID &&
+				(req.Status == models.RefundRequestPending || req.Status == models.RefundRequestRefunding)
+		})
+		if len(found) == 0 {
+			return repos.ErrRefundRequestNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memRefundRequests) FindAllPendingDue(now time.Time, limit int) ([]models.RefundRequest, error) {
+	var out []models.RefundRequest
+	err := r.db.do(func(d *memData) error {
+		out = d.refundRequests.where(func(req *models.RefundRequest) bool {
+			return req.Status == models.RefundRequestPending && !req.RespondBy.After(now)
+		})
+		return nil
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+func (r *memRefundRequests) FindAllRefundingSince(before time.Time, limit int) ([]models.RefundRequest, error) {
+	var out []models.RefundRequest
+	err := r.db.do(func(d *memData) error {
+		out = d.refundRequests.where(func(req *models.RefundRequest) bool {
+			return req.Status == models.RefundRequestRefunding && !req.UpdatedAt.After(before)
+		})
+		return nil
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+func (r *memRefundRequests) UpdateFromStatus(req *models.RefundRequest, from models.RefundRequestStatus) error {
+	return r.db.do(func(d *memData) error {
+		stored, ok := d.refundRequests.get(req.ID)
+		if !ok {
+			return repos.ErrRefundRequestNotFound
+		}
+		if stored.Status != from {
+			return repos.ErrRefundRequestStatusConflict
+		}
+		d.refundRequests.put(req.ID, *req)
+		return nil
+	})
+}
+
+type memNotifications struct {
+	repos.NotificationRepository
+	db *memDB
+}
+
+func (r *memNotifications) Create(notification *models.Notification) error {
+	return r.db.do(func(d *memData) error {
+		d.notifications.put(notification.ID, *notification)
+		return nil
+	})
+}
+
+func (r *memNotifications) FindAllByUserID(userID uuid.UUID, limit int) ([]models.Notification, error) {
+	var out []models.Notification
+	err := r.db.do(func(d *memData) error {
+		out = d.notifications.where(func(n *models.Notification) bool { return n.UserID == userID })
+		return nil
+	})
+	sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, err
+}
+
+type memSubscriptions struct {
+	repos.SubscriptionRepository
+	db *memDB
+}
+
+func (r *memSubscriptions) Create(sub *models.Subscription) error {
+	return r.db.do(func(d *memData) error {
+		d.subscriptions.put(sub.ID, *sub)
+		return nil
+	})
+}
+
+type memTransfers struct {
+	repos.ContractTransferRepository
+	db *memDB
+}
+
+func (r *memTransfers) FindByID(id uuid.UUID) (*models.ContractTransfer, error) {
+	var out *models.ContractTransfer
+	err := r.db.do(func(d *memData) error {
+		transfer, ok := d.transfers.get(id)
+		if !ok {
+			return repos.ErrContractTransferNotFound
+		}
+		out = &transfer
+		return nil
+	})
+	return out, err
+}
+
+func (r *memTransfers) FindByClaimCodeHash(hash string) (*models.ContractTransfer, error) {
+	var out *models.ContractTransfer
+	err := r.db.do(func(d *memData) error {
+		found := d.transfers.where(func(t *models.ContractTransfer) bool { return t.ClaimCodeHash == hash })
+		if len(found) == 0 {
+			return repos.ErrContractTransferNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memTransfers) Create(transfer *models.ContractTransfer) error {
+	return r.db.do(func(d *memData) error {
+		d.transfers.put(transfer.ID, *transfer)
+		return nil
+	})
+}
+
+// update applies fn to a pending transfer that keep accepts.
+func (r *memTransfers) update(id uuid.UUID, keep func(t *models.ContractTransfer) bool, fn func(t *models.ContractTransfer)) error {
+	return r.db.do(func(d *memData) error {
+		transfer, ok := d.transfers.get(id)
+		if !ok {
+			return repos.ErrContractTransferNotFound
+		}
+		if transfer.Status != models.TransferPending || !keep(&transfer) {
+			return repos.ErrContractTransferNotPending
+		}
+		fn(&transfer)
+		d.transfers.put(id, transfer)
+		return nil
+	})
+}
+
+func (r *memTransfers) Claim(id, recipientID uuid.UUID) error {
+	unclaimed := func(t *models.ContractTransfer) bool { return t.RecipientID == uuid.Nil }
+	return r.update(id, unclaimed, func(t *models.ContractTransfer) {
+		t.RecipientID = recipientID
+	})
+}
+
+func (r *memTransfers) Close(id uuid.UUID, status models.TransferStatus, at time.Time) error {
+	all := func(*models.ContractTransfer) bool { return true }
+	return r.update(id, all, func(t *models.ContractTransfer) {
+		t.Status = status
+		if status == models.TransferCompleted {
+			t.CompletedAt = &at
+		}
+		t.UpdatedAt = at
+	})
+}
+
+type memAuctions struct {
+	repos.AuctionRepository
+	db *memDB
+}
+
+func (r *memAuctions) FindByID(id uuid.UUID) (*models.AuctionListing, error) {
+	var out *models.AuctionListing
+	err := r.db.do(func(d *memData) error {
+		auction, ok := d.auctions.get(id)
+		if !ok {
+			return repos.ErrAuctionNotFound
+		}
+		out = &auction
+		return nil
+	})
+	return out, err
+}
+
+func (r *memAuctions) Create(auction *models.AuctionListing) error {
+	return r.db.do(func(d *memData) error {
+		d.auctions.put(auction.ID, *auction)
+		return nil
+	})
+}
+
+func (r *memAuctions) Update(auction *models.AuctionListing) error {
+	return r.db.do(func(d *memData) error {
+		stored, ok := d.auctions.get(auction.ID)
+		if !ok {
+			return repos.ErrAuctionNotFound
+		}
+		if stored.Version != auction.Version {
+			return repos.ErrAuctionVersionConflict
+		}
+		auction.Version++
+		d.auctions.put(auction.ID, *auction)
+		return nil
+	})
+}
+
+func (r *memAuctions) FindBidsByAuctionID(auctionID uuid.UUID) ([]models.AuctionBid, error) {
+	var out []models.AuctionBid
+	err := r.db.do(func(d *memData) error {
+		out = d.auctionBids.where(func(b *models.AuctionBid) bool { return b.AuctionID == auctionID })
+		return nil
+	})
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].PriceNanos != out[j].PriceNanos {
+			return out[i].PriceNanos > out[j].PriceNanos
+		}
+		return out[i].PlacedAt.Before(out[j].PlacedAt)
+	})
+	return out, err
+}
+
+func (r *memAuctions) FindBid(auctionID, bidderID uuid.UUID) (*models.AuctionBid, error) {
+	var out *models.AuctionBid
+	err := r.db.do(func(d *memData) error {
+		found := d.auctionBids.where(func(b *models.AuctionBid) bool {
+			return b.AuctionID == auctionID && b.BidderID == bidderID
+		})
+		if len(found) == 0 {
+			return repos.ErrAuctionBidNotFound
+		}
+		out = &found[0]
+		return nil
+	})
+	return out, err
+}
+
+func (r *memAuctions) SaveBid(bid *models.AuctionBid) error {
+	return r.db.do(func(d *memData) error {
+		d.auctionBids.put(bid.ID, *bid)
+		return nil
+	})
+}
+
+func (r *memStates) FindAllDueForExpiry(now time.Time, statuses []models.ContractStatus, limit int) ([]models.ContractState, error) {
+	type due struct {
+		state models.ContractState
+		at    time.Time
+	}
+	var found []due
+	err := r.db.do(func(d *memData) error {
+		for _, s := range d.states.where(func(s *models.ContractState) bool { return slices.Contains(statuses, s.Status) }) {
+			header, ok := d.headers.get(s.HeaderID)
+			if end := header.AccessEnd(); ok && end != nil && !end.After(now) {
+				found = append(found, due{state: s, at: *end})
+			}
+		}
+		return nil
+	})
+	sort.SliceStable(found, func(i, j int) bool { return found[i].at.Before(found[j].at) })
+	var out []models.ContractState
+	for _, f := range found[:min(len(found), limit)] {
+		out = append(out, f.state)
+	}
+	return out, err
+}
+
+func (r *memTransactions) FindAllPayableRoyalties(afterID uuid.UUID, limit int) ([]models.TransactionRecord, error) {
+	var out []models.TransactionRecord
+	err := r.db.do(func(d *memData) error {
+		out = d.transactions.where(func(tr *models.TransactionRecord) bool {
+			recipient, ok := d.users.get(tr.RoyaltyRecipientID)
+			return tr.RoyaltyCents > 0 && tr.RoyaltyTransferID == "" &&
+				tr.TransactionStatus == models.StatusFulfilled &&
+				ok && recipient.StripeConnectAccountID != ""
+		})
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].ID.String() < out[j].ID.String() })
+	i := sort.Search(len(out), func(i int) bool { return out[i].ID.String() > afterID.String() })
+	out = out[i:]
+	return out[:min(len(out), limit)], err
+}
+
+func (r *memTransactions) MarkRoyaltyPaid(id uuid.UUID, transferID string, paidAt time.Time) error {
+	return r.db.do(func(d *memData) error {
+		tr, ok := d.transactions.get(id)
+		if !ok {
+			return repos.ErrTransactionNotFound
+		}
+		if tr.RoyaltyTransferID == "" {
+			tr.RoyaltyTransferID = transferID
+			tr.RoyaltyPaidAt = &paidAt
+			d.transactions.put(id, tr)
+		}
+		return nil
+	})
+}
+
+// usable fetches a contract for a debit, failing as the SQL does when it
+// is not in one of the usable statuses.
+func usable(d *memData, contractID uuid.UUID, statuses []models.ContractStatus) (models.ContractState, error) {
+	s, ok := d.states.get(contractID)
+	if !ok {
+		return s, repos.ErrContractStateNotFound
+	}
+	if !slices.Contains(statuses, s.Status) {
+		return s, repos.ErrContractNotUsable
+	}
+	return s, nil
+}
+
+func (r *memStates) DebitUsage(
+	contractID uuid.UUID,
+	reads, bytes uint64,
+	limitReads, limitBytes bool,
+	statuses []models.ContractStatus) error {
+
+	return r.db.do(func(d *memData) error {
+		s, err := usable(d, contractID, statuses)
+		if err != nil {
+			return err
+		}
+		if (limitReads && s.ReadsRemaining < reads) || (limitBytes && s.BytesRemaining < bytes) {
+			return repos.ErrQuotaExhausted
+		}
+		if limitReads {
+			s.ReadsRemaining -= reads
+		}
+		if limitBytes {
+			s.BytesRemaining -= bytes
+		}
+		s.ReadsUsed += reads
+		s.BytesUsed += bytes
+		d.states.put(contractID, s)
+		return nil
+	})
+}
+
+func (r *memStates) DebitUsageWithOverage(
+	contractID uuid.UUID,
+	reads, bytes uint64,
+	limitBytes bool,
+	overagePriceNanos int64,
+	statuses []models.ContractStatus) error {
+
+	return r.db.do(func(d *memData) error {
+		s, err := usable(d, contractID, statuses)
+		if err != nil {
+			return err
+		}
+		overage := reads - min(reads, s.ReadsRemaining)
+		unbilled := new(big.Int).SetUint64(s.OverageReads - s.OverageReadsBilled + overage)
+		cost := unbilled.Mul(unbilled, big.NewInt(overagePriceNanos))
+		limit := new(big.Int).Mul(big.NewInt(s.OverageCapCents), big.NewInt(10_000_000))
+		if (limitBytes && s.BytesRemaining < bytes) || cost.Cmp(limit) > 0 {
+			if (limitBytes && s.BytesRemaining < bytes) || s.OverageCapCents == 0 {
+				return repos.ErrQuotaExhausted
+			}
+			return repos.ErrOverageCapReached
+		}
+		if limitBytes {
+			s.BytesRemaining -= bytes
+		}
+		s.ReadsRemaining -= reads - overage
+		s.OverageReads += overage
+		s.ReadsUsed += reads
+		s.BytesUsed += bytes
+		d.states.put(contractID, s)
+		return nil
+	})
+}
+
+type memDatastreams struct {
+	repos.DatastreamRepository
+	db *memDB
+}
+
+func (r *memDatastreams) FindByID(id uuid.UUID) (*models.Datastream, error) {
+	var out *models.Datastream
+	err := r.db.do(func(d *memData) error {
+		ds, ok := d.datastreams.get(id)
+		if !ok {
+			return repos.ErrDatastreamNotFound
+		}
+		out = &ds
+		return nil
+	})
+	return out, err
+}
+
+func (r *memDatastreams) FindAllByOwnerID(ownerID uuid.UUID) ([]models.Datastream, error) {
+	var out []models.Datastream
+	err := r.db.do(func(d *memData) error {
+		out = d.datastreams.where(func(ds *models.Datastream) bool { return ds.OwnerID == ownerID })
+		return nil
+	})
+	return out, err
+}
+
+func (r *memDatastreams) Create(ds *models.Datastream) error {
+	return r.db.do(func(d *memData) error {
+		d.datastreams.put(ds.ID, *ds)
+		return nil
+	})
+}
+
+func (r *memDatastreams) Update(ds *models.Datastream) error {
+	return r.db.do(func(d *memData) error {
+		d.datastreams.put(ds.ID, *ds)
+		return nil
+	})
+}
+
+func (r *memDatastreams) Delete(id uuid.UUID) error {
+	return r.db.do(func(d *memData) error {
+		if !d.datastreams.delete(id) {
+			return repos.ErrDatastreamNotFound
+		}
+		return nil
+	})
+}
+
+func (r *memListings) FindAllByDatastreamID(datastreamID uuid.UUID) ([]models.ContractListing, error) {
+	var out []models.ContractListing
+	err := r.db.do(func(d *memData) error {
+		out = d.listings.where(func(l *models.ContractListing) bool { return l.DatastreamID == datastreamID })
+		return nil
+	})
+	return out, err
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuctionKind uint8
+
+const (
+	// AuctionEnglish takes ascending bids until it closes; the highest
+	// bidders win and pay what they bid.
+	AuctionEnglish AuctionKind = iota
+	// AuctionDutch starts high and lowers its price on a schedule; the
+	// first buyers to accept the current price win at that price.
+	AuctionDutch
+)
+
+var auctionKindNames = [...]string{
+	AuctionEnglish: "english",
+	AuctionDutch:   "dutch",
+}
+
+func (k AuctionKind) String() string {
+	if int(k) < len(auctionKindNames) {
+		return auctionKindNames[k]
+	}
+	return fmt.Sprintf("AuctionKind(%d)", uint8(k))
+}
+
+// ParseAuctionKind is the inverse of AuctionKind.String.
+func ParseAuctionKind(name string) (AuctionKind, error) {
+	for k, n := range auctionKindNames {
+		if n == name {
+			return AuctionKind(k), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown auction kind %q", name)
+}
+
+type AuctionStatus uint8
+
+const (
+	AuctionOpen AuctionStatus = iota
+	AuctionClosed
+	AuctionCancelled
+)
+
+var auctionStatusNames = [...]string{
+	AuctionOpen:      "open",
+	AuctionClosed:    "closed",
+	AuctionCancelled: "cancelled",
+}
+
+func (s AuctionStatus) String() string {
+	if int(s) < len(auctionStatusNames) {
+		return auctionStatusNames[s]
+	}
+	return fmt.Sprintf("AuctionStatus(%d)", uint8(s))
+}
+
+// AuctionListing sells Quantity units of a listing's supply by auction
+// instead of at its list price. The units are taken out of the listing's
+// SupplyRemaining while the auction runs and whatever is not won goes back
+// when it ends.
+type AuctionListing struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	ListingID uuid.UUID `gorm:"type:uuid;index"`
+	SellerID  uuid.UUID `gorm:"type:uuid;index"`
+	Kind      AuctionKind
+	Quantity  uint64
+	// Remaining is how many units a Dutch auction has left to sell. An
+	// English auction keeps it at Quantity until it closes.
+	Remaining uint64
+
+	// ReservePriceNanos is the lowest price per unit the seller accepts:
+	// no English bid may be below it and a Dutch price never drops under it.
+	ReservePriceNanos int64
+	// BidIncrementNanos is how much an English bid must beat the lowest
+	// winning bid by once every unit is bid for.
+	BidIncrementNanos int64
+	// ExtendWindow is the English anti-sniping window: a bid placed less
+	// than this long before EndsAt pushes EndsAt out to this long after
+	// the bid.
+	ExtendWindow time.Duration
+
+	// A Dutch auction opens at StartPriceNanos and drops by PriceStepNanos
+	// every PriceStepEvery, down to ReservePriceNanos.
+	StartPriceNanos int64
+	PriceStepNanos  int64
+	PriceStepEvery  time.Duration
+
+	StartsAt time.Time
+	EndsAt   time.Time     `gorm:"index"`
+	Status   AuctionStatus `gorm:"index"`
+	// Version is bumped on every write so concurrent bids can be detected.
+	Version   uint64 `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PriceAt is the Dutch price per unit at t. For an English auction it is
+// the reserve.
+func (a *AuctionListing) PriceAt(t time.Time) int64 {
+	if a.Kind != AuctionDutch {
+		return a.ReservePriceNanos
+	}
+	if a.PriceStepNanos <= 0 || a.PriceStepEvery <= 0 || !t.After(a.StartsAt) {
+		return a.StartPriceNanos
+	}
+	steps := int64(t.Sub(a.StartsAt) / a.PriceStepEvery)
+	if steps > (a.StartPriceNanos-a.ReservePriceNanos)/a.PriceStepNanos {
+		return a.ReservePriceNanos
+	}
+	return a.StartPriceNanos - steps*a.PriceStepNanos
+}
+
+// AuctionBid is one bidder's standing bid in an English auction, or one
+// purchase in a Dutch auction. An English bidder has at most one bid per
+// auction, which they may raise.
+type AuctionBid struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey"`
+	AuctionID  uuid.UUID `gorm:"type:uuid;index"`
+	BidderID   uuid.UUID `gorm:"type:uuid;index"`
+	PriceNanos int64
+	Quantity   uint64
+	// PlacedAt is when the bid was last raised; earlier bids win ties.
+	PlacedAt time.Time
+
+	// WonQuantity, TransactionID and CheckoutURL are set once the bid wins,
+	// which may be fewer units than bid for at the margin.
+	WonQuantity   uint64
+	TransactionID uuid.UUID `gorm:"type:uuid;index"`
+	CheckoutURL   string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
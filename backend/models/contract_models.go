@@ -1,6 +1,7 @@
 package models
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,8 +16,102 @@ const (
 	StatusOwned
 	StatusUnlocked
 	StatusExpiryReached
+	// StatusFrozen holds a contract whose purchase is disputed until the
+	// dispute is settled.
+	StatusFrozen
+	// StatusRevoked is a contract taken back from its owner because its
+	// purchase was refunded.
+	StatusRevoked
 )
 
+var contractStatusNames = [...]string{
+	StatusDraft:         "draft",
+	StatusListed:        "listed",
+	StatusMatched:       "matched",
+	StatusOwned:         "owned",
+	StatusUnlocked:      "unlocked",
+	StatusExpiryReached: "expiry_reached",
+	StatusFrozen:        "frozen",
+	StatusRevoked:       "revoked",
+}
+
+func (s ContractStatus) String() string {
+	if int(s) < len(contractStatusNames) {
+		return contractStatusNames[s]
+	}
+	return fmt.Sprintf("ContractStatus(%d)", uint8(s))
+}
+
+type ContractType uint8
+
+const (
+	// ContractStandard grants its owner access to the listing's datastream.
+	ContractStandard ContractType = iota
+	// ContractOption is bought for a premium and grants only the right to
+	// buy that access at a strike price before the contract's exercise-by
+	// time. Unexercised options lapse when it passes.
+	ContractOption
+	// ContractSubscription grants access for one billing period at a time
+	// and is renewed, and paid for, every period until cancelled.
+	ContractSubscription
+)
+
+var contractTypeNames = [...]string{
+	ContractStandard:     "standard",
+	ContractOption:       "option",
+	ContractSubscription: "subscription",
+}
+
+func (t ContractType) String() string {
+	if int(t) < len(contractTypeNames) {
+		return contractTypeNames[t]
+	}
+	return fmt.Sprintf("ContractType(%d)", uint8(t))
+}
+
+// ParseContractType is the inverse of ContractType.String.
+func ParseContractType(name string) (ContractType, error) {
+	for t, n := range contractTypeNames {
+		if n == name {
+			return ContractType(t), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown contract type %q", name)
+}
+
+type BillingInterval uint8
+
+const (
+	BillingMonth BillingInterval = iota
+	BillingDay
+	BillingWeek
+	BillingYear
+)
+
+var billingIntervalNames = [...]string{
+	BillingMonth: "month",
+	BillingDay:   "day",
+	BillingWeek:  "week",
+	BillingYear:  "year",
+}
+
+func (i BillingInterval) String() string {
+	if int(i) < len(billingIntervalNames) {
+		return billingIntervalNames[i]
+	}
+	return fmt.Sprintf("BillingInterval(%d)", uint8(i))
+}
+
+// ParseBillingInterval is the inverse of BillingInterval.String.
+func ParseBillingInterval(name string) (BillingInterval, error) {
+	for i, n := range billingIntervalNames {
+		if n == name {
+			return BillingInterval(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown billing interval %q", name)
+}
+
 type TransactionStatus uint8
 
 const (
@@ -26,33 +121,171 @@ const (
 	StatusFulfilled
 	StatusExpired
 	StatusFailed
+	// StatusRefunded is a payment the buyer got all of back, by a refund
+	// or by winning a dispute.
+	StatusRefunded
+	// StatusDisputed is a fulfilled payment the buyer's bank is disputing.
+	StatusDisputed
+)
+
+var transactionStatusNames = [...]string{
+	StatusPending:         "pending",
+	StatusRequiresPayment: "requires_payment",
+	StatusPaid:            "paid",
+	StatusFulfilled:       "fulfilled",
+	StatusExpired:         "expired",
+	StatusFailed:          "failed",
+	StatusRefunded:        "refunded",
+	StatusDisputed:        "disputed",
+}
+
+func (s TransactionStatus) String() string {
+	if int(s) < len(transactionStatusNames) {
+		return transactionStatusNames[s]
+	}
+	return fmt.Sprintf("TransactionStatus(%d)", uint8(s))
+}
+
+type TransactionKind uint8
+
+const (
+	// KindPrimary buys newly issued contracts from a listing.
+	KindPrimary TransactionKind = iota
+	// KindResale buys one contract from its current owner.
+	KindResale
+	// KindOrderFill pays for contracts matched on a listing's order book.
+	KindOrderFill
+	// KindExercise pays the strike price of an option contract.
+	KindExercise
+	// KindRenewal is a subscription's payment for another billing period.
+	KindRenewal
+	// KindOverage charges a buyer's saved payment method for reads past
+	// their contracts' quotas; its OverageLines break it down by contract.
+	KindOverage
+)
+
+type ResaleStatus uint8
+
+const (
+	ResaleOpen ResaleStatus = iota
+	ResaleSold
+	ResaleCancelled
+)
+
+type ReservationStatus uint8
+
+const (
+	ReservationActive ReservationStatus = iota
+	ReservationConverted
+	ReservationReleased
 )
 
 type ContractListing struct {
 	ID              uuid.UUID
 	SellerID        uuid.UUID
+	DatastreamID    uuid.UUID `gorm:"type:uuid;index"`
 	ListPriceNanos  int64
 	SupplyLimit     uint64
 	SupplyRemaining uint64
-	CreatedAt       time.Time
-	UpdatedAt       time.Time
+	// QuotaReads and ReadBytes are the reads and bytes each contract issued
+	// from the listing may consume. Zero means unlimited.
+	QuotaReads uint64
+	ReadBytes  uint64
+	// ExerciseBy is when contracts issued from the listing expire, and when
+	// the listing stops selling. Nil means never.
+	ExerciseBy *time.Time `gorm:"index"`
+	// RoyaltyBps is the share of every resale of the listing's contracts,
+	// in basis points, paid to SellerID.
+	RoyaltyBps int64
+	// ContractType is what the listing issues. For options ListPriceNanos
+	// is the premium and StrikePriceNanos what exercising costs.
+	ContractType     ContractType
+	StrikePriceNanos int64
+	// AccessHours is how long exercising an option grants access for. Zero
+	// grants it until ExerciseBy.
+	AccessHours int64
+	// For subscriptions ListPriceNanos is charged per contract every
+	// BillingIntervalCount BillingIntervals.
+	BillingInterval      BillingInterval
+	BillingIntervalCount int64
+	// OverageReadPriceNanos is charged per read past QuotaReads. Zero
+	// means the quota is a hard limit.
+	OverageReadPriceNanos int64
+	// RestockOnRefund gives the units of refunded purchases back to
+	// SupplyRemaining, so they can be sold again.
+	RestockOnRefund bool
+	// RefundPolicy is what buyers may ask to be refunded for, and
+	// RefundWindowHours how long after the purchase they may ask. Zero
+	// hours means there is no time limit.
+	RefundPolicy      RefundPolicy
+	RefundWindowHours int64
+	// Version is bumped on every write so concurrent updates can be detected.
+	Version   uint64 `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// SupplyAvailable is SupplyRemaining less the units held by open
+	// checkouts. It is computed on read and never stored.
+	SupplyAvailable uint64 `gorm:"-"`
 }
 
 type ContractHeader struct {
-	ID        uuid.UUID
-	ListingID uuid.UUID
-	CreatedAt time.Time
+	ID           uuid.UUID
+	ListingID    uuid.UUID
+	DatastreamID uuid.UUID `gorm:"type:uuid;index"`
+	// QuotaReads and ReadBytes are copied from the listing at issue time,
+	// so later listing edits do not change contracts already sold.
+	QuotaReads       uint64
+	ReadBytes        uint64
+	ExerciseBy       *time.Time `gorm:"index"`
+	ContractType     ContractType
+	StrikePriceNanos int64
+	AccessHours      int64
+	// AccessUntil is set when an option is exercised, to when the access
+	// it bought ends; ExerciseBy is then only the exercise deadline.
+	AccessUntil *time.Time `gorm:"index"`
+	// SubscriptionID is set for subscription contracts, whose ExerciseBy
+	// moves as the subscription renews.
+	SubscriptionID        uuid.UUID `gorm:"type:uuid;index"`
+	OverageReadPriceNanos int64
+	CreatedAt             time.Time
+}
+
+// AccessEnd is when the contract stops granting access: AccessUntil for an
+// exercised option, ExerciseBy otherwise. Nil means never.
+func (h *ContractHeader) AccessEnd() *time.Time {
+	if h.AccessUntil != nil {
+		return h.AccessUntil
+	}
+	return h.ExerciseBy
 }
 
 type ContractState struct {
-	HeaderID       uuid.UUID
+	HeaderID       uuid.UUID `gorm:"type:uuid;primaryKey"`
 	LastPurchaseAt time.Time
 	OwnerID        uuid.UUID
 	Status         ContractStatus
+
+	// ReadsRemaining and BytesRemaining count down from the header's quotas
+	// and are only meaningful where that quota is non-zero. ReadsUsed and
+	// BytesUsed are kept either way.
+	ReadsRemaining uint64
+	BytesRemaining uint64
+	ReadsUsed      uint64
+	BytesUsed      uint64
+
+	// OverageReads counts reads past the header's quota, of which
+	// OverageReadsBilled have been put on a KindOverage transaction. The
+	// owner allows unbilled overage reads only up to OverageCapCents, so
+	// the cap applies afresh to each billing period; the cap and both
+	// counters start again from zero with every new owner.
+	OverageReads       uint64
+	OverageReadsBilled uint64
+	OverageCapCents    int64
 }
 
 type TransactionRecord struct {
-	ID				  uuid.UUID
+	ID                uuid.UUID
 	InitiatedAt       time.Time
 	ListingID         uuid.UUID
 	SellerID          uuid.UUID
@@ -60,6 +293,18 @@ type TransactionRecord struct {
 	PurchaseQuantity  int64
 	PurchaseCents     uint64
 	TransactionStatus TransactionStatus
+	Kind              TransactionKind
+	// ResaleListingID is set for KindResale; ListingID is then the
+	// contract's original listing.
+	ResaleListingID uuid.UUID `gorm:"type:uuid;index"`
+	// FillID is set for KindOrderFill.
+	FillID uuid.UUID `gorm:"type:uuid;index"`
+	// HeaderID is set for KindExercise, the option being exercised.
+	HeaderID uuid.UUID `gorm:"type:uuid;index"`
+	// StripeSubscriptionID is set for purchases and renewals of
+	// subscription contracts; StripeInvoiceID for renewals.
+	StripeSubscriptionID string `gorm:"index"`
+	StripeInvoiceID      string `gorm:"index"`
 
 	StripeCheckoutSessonID string
 	StripePaymentIntentID  string
@@ -68,4 +313,121 @@ type TransactionRecord struct {
 	FulfilledAt            *time.Time
 	IsFulfilled            bool
 	StripeEventLastID      string
+
+	PaidAt        *time.Time
+	FailedAt      *time.Time
+	ExpiredAt     *time.Time
+	FailureReason string
+
+	// RoyaltyCents is owed to RoyaltyRecipientID, the original seller, on a
+	// secondary sale. It is collected with the platform fee and transferred
+	// on once the sale is fulfilled; RoyaltyTransferID is set when it is.
+	RoyaltyCents       int64
+	RoyaltyRecipientID uuid.UUID `gorm:"type:uuid;index"`
+	RoyaltyTransferID  string
+	RoyaltyPaidAt      *time.Time
+
+	// RefundedCents and RefundedQuantity are how much of the purchase has
+	// been given back so far; each refund is kept as a RefundRecord.
+	RefundedCents    int64
+	RefundedQuantity int64
+	RefundedAt       *time.Time
+	// StripeDisputeID is set once the buyer's bank disputes the payment.
+	StripeDisputeID string `gorm:"index"`
+}
+
+// ResaleListing offers one contract for sale by its current owner.
+type ResaleListing struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey"`
+	HeaderID   uuid.UUID `gorm:"type:uuid;index"`
+	SellerID   uuid.UUID `gorm:"type:uuid;index"`
+	PriceNanos int64
+	Status     ResaleStatus `gorm:"index"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// SupplyReservation holds units of a listing for one checkout until the
+// buyer pays or the hold expires. Kind is the kind of the transaction the
+// hold is for, and says what ListingID names: the listing for KindPrimary,
+// the resale listing for KindResale, the fill for KindOrderFill and the
+// contract for KindExercise. Only KindPrimary holds count against a
+// listing's supply.
+type SupplyReservation struct {
+	ID            uuid.UUID
+	Kind          TransactionKind
+	ListingID     uuid.UUID `gorm:"type:uuid;index"`
+	TransactionID uuid.UUID `gorm:"type:uuid;uniqueIndex"`
+	Quantity      uint64
+	Status        ReservationStatus `gorm:"index"`
+	ExpiresAt     time.Time         `gorm:"index"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// ContractStateHistory is one status change of one contract. Rows are only
+// ever appended.
+type ContractStateHistory struct {
+	ID         uuid.UUID
+	HeaderID   uuid.UUID `gorm:"type:uuid;index"`
+	FromStatus ContractStatus
+	ToStatus   ContractStatus
+	// ActorID is the user who caused the change, or uuid.Nil for the system.
+	ActorID   uuid.UUID `gorm:"type:uuid"`
+	Reason    string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func (ContractStateHistory) TableName() string {
+	return "contract_state_history"
+}
+
+type OwnershipEventKind uint8
+
+const (
+	// OwnershipIssued creates a contract, owned by its listing's seller.
+	OwnershipIssued OwnershipEventKind = iota
+	// OwnershipSold hands a contract to a buyer who paid for it.
+	OwnershipSold
+	// OwnershipTransferred hands a contract to someone for nothing.
+	OwnershipTransferred
+	// OwnershipRevoked takes a contract back from its owner.
+	OwnershipRevoked
+)
+
+var ownershipEventKindNames = [...]string{
+	OwnershipIssued:      "issued",
+	OwnershipSold:        "sold",
+	OwnershipTransferred: "transferred",
+	OwnershipRevoked:     "revoked",
+}
+
+func (k OwnershipEventKind) String() string {
+	if int(k) < len(ownershipEventKindNames) {
+		return ownershipEventKindNames[k]
+	}
+	return fmt.Sprintf("OwnershipEventKind(%d)", uint8(k))
+}
+
+// OwnershipEntry is one change of hands of one contract. Rows are only ever
+// appended. Seq numbers a contract's entries from 1 with no gaps, so
+// replaying them in order gives the contract's current owner.
+type OwnershipEntry struct {
+	ID       uuid.UUID
+	HeaderID uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_ownership_header_seq"`
+	Seq      uint64    `gorm:"uniqueIndex:idx_ownership_header_seq"`
+	Kind     OwnershipEventKind
+	// FromOwnerID is uuid.Nil for issuance. ToOwnerID is whoever holds the
+	// contract afterwards, which for a revocation may not have changed.
+	FromOwnerID uuid.UUID `gorm:"type:uuid;index"`
+	ToOwnerID   uuid.UUID `gorm:"type:uuid;index"`
+	// TransactionID is the sale that moved the contract, if there was one,
+	// and PriceCents what was paid for this one contract.
+	TransactionID uuid.UUID `gorm:"type:uuid;index"`
+	PriceCents    int64
+	CreatedAt     time.Time `gorm:"index"`
+}
+
+func (OwnershipEntry) TableName() string {
+	return "contract_ownership_ledger"
 }
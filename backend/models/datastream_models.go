@@ -0,0 +1,57 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DatastreamStatus uint8
+
+const (
+	DatastreamActive DatastreamStatus = iota
+	DatastreamPaused
+	DatastreamRetired
+)
+
+var datastreamStatusNames = [...]string{
+	DatastreamActive:  "active",
+	DatastreamPaused:  "paused",
+	DatastreamRetired: "retired",
+}
+
+func (s DatastreamStatus) String() string {
+	if int(s) < len(datastreamStatusNames) {
+		return datastreamStatusNames[s]
+	}
+	return fmt.Sprintf("DatastreamStatus(%d)", uint8(s))
+}
+
+// ParseDatastreamStatus is the inverse of DatastreamStatus.String.
+func ParseDatastreamStatus(name string) (DatastreamStatus, error) {
+	for s, n := range datastreamStatusNames {
+		if n == name {
+			return DatastreamStatus(s), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown datastream status %q", name)
+}
+
+// Datastream is a data feed registered by a seller. Contracts sold from a
+// listing grant access to the listing's datastream.
+type Datastream struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey"`
+	OwnerID     uuid.UUID `gorm:"type:uuid;index"`
+	Name        string    `gorm:"not null"`
+	Description string
+	// Schema describes the records the feed delivers, typically as JSON
+	// Schema. It is stored as given.
+	Schema string
+	// DeliveryEndpoint is the URL the feed is served from. Only the owner
+	// gets to see it.
+	DeliveryEndpoint string
+	Status           DatastreamStatus `gorm:"index"`
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
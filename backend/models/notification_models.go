@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Notification is an event kept for the user it concerns, so they can see
+// it later. Type is the events.Type and the IDs are uuid.Nil where the
+// event did not name one.
+type Notification struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID        uuid.UUID `gorm:"type:uuid;index"`
+	Type          string
+	ContractID    uuid.UUID `gorm:"type:uuid"`
+	TransactionID uuid.UUID `gorm:"type:uuid"`
+	Reason        string
+	ReadAt        *time.Time
+	CreatedAt     time.Time `gorm:"index"`
+}
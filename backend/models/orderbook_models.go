@@ -0,0 +1,63 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type OrderSide uint8
+
+const (
+	OrderBid OrderSide = iota
+	OrderAsk
+)
+
+type OrderStatus uint8
+
+const (
+	OrderOpen OrderStatus = iota
+	OrderFilled
+	OrderCancelled
+)
+
+// BookOrder is a limit order on a listing's secondary market. Bids are
+// placed by buyers; asks offer contracts of the listing the trader owns,
+// which are tracked as AskContracts.
+type BookOrder struct {
+	ID         uuid.UUID `gorm:"type:uuid;primaryKey"`
+	ListingID  uuid.UUID `gorm:"type:uuid;index"`
+	TraderID   uuid.UUID `gorm:"type:uuid;index"`
+	Side       OrderSide
+	PriceNanos int64
+	Quantity   uint64
+	Remaining  uint64
+	// Seq is the order's time priority within its listing's book.
+	Seq       uint64
+	Status    OrderStatus `gorm:"index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// AskContract is a contract offered by an ask. FillID is set once the
+// contract has been matched to a buyer.
+type AskContract struct {
+	HeaderID uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	OrderID  uuid.UUID  `gorm:"type:uuid;index"`
+	FillID   *uuid.UUID `gorm:"type:uuid;index"`
+}
+
+// BookFill is a trade between a bid and an ask. The buyer pays for it
+// through TransactionID.
+type BookFill struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey"`
+	ListingID     uuid.UUID `gorm:"type:uuid;index"`
+	BidOrderID    uuid.UUID `gorm:"type:uuid;index"`
+	AskOrderID    uuid.UUID `gorm:"type:uuid;index"`
+	BuyerID       uuid.UUID `gorm:"type:uuid;index"`
+	SellerID      uuid.UUID `gorm:"type:uuid;index"`
+	PriceNanos    int64
+	Quantity      uint64
+	TransactionID uuid.UUID `gorm:"type:uuid;uniqueIndex"`
+	CreatedAt     time.Time
+}
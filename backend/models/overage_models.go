@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OverageLine is one contract's share of a KindOverage transaction: the
+// reads past its quota being billed, at the overage price its header
+// carries.
+type OverageLine struct {
+	ID             uuid.UUID `gorm:"type:uuid;primaryKey"`
+	TransactionID  uuid.UUID `gorm:"type:uuid;index"`
+	HeaderID       uuid.UUID `gorm:"type:uuid;index"`
+	Reads          uint64
+	UnitPriceNanos int64
+	AmountCents    int64
+	CreatedAt      time.Time
+}
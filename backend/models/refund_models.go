@@ -0,0 +1,162 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefundRecord is one refund of part or all of a transaction. Rows are
+// only ever appended.
+type RefundRecord struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey"`
+	TransactionID uuid.UUID `gorm:"type:uuid;index"`
+	// ProviderRefundID is empty for money returned by a lost dispute.
+	ProviderRefundID string `gorm:"index"`
+	Quantity         int64
+	AmountCents      int64
+	// Revoked counts the contracts taken back, which is fewer than
+	// Quantity if the buyer no longer held them all. Each has an
+	// OwnershipRevoked ledger entry naming the transaction.
+	Revoked   int64
+	Restocked bool
+	// ActorID is the seller or admin who refunded, or uuid.Nil for the
+	// system acting on a payment event.
+	ActorID   uuid.UUID `gorm:"type:uuid"`
+	Reason    string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// RefundPolicy is what a listing lets buyers ask to be refunded for.
+// Sellers can refund anything themselves regardless.
+type RefundPolicy uint8
+
+const (
+	// RefundsBeforeUnlock, the default, covers contracts the buyer has
+	// neither unlocked nor used.
+	RefundsBeforeUnlock RefundPolicy = iota
+	// RefundsAnytime covers every contract the buyer still holds.
+	RefundsAnytime
+	// RefundsNone takes no refund requests.
+	RefundsNone
+)
+
+var refundPolicyNames = [...]string{
+	RefundsBeforeUnlock: "before_unlock",
+	RefundsAnytime:      "anytime",
+	RefundsNone:         "none",
+}
+
+func (p RefundPolicy) String() string {
+	if int(p) < len(refundPolicyNames) {
+		return refundPolicyNames[p]
+	}
+	return fmt.Sprintf("RefundPolicy(%d)", uint8(p))
+}
+
+// ParseRefundPolicy is the inverse of RefundPolicy.String.
+func ParseRefundPolicy(name string) (RefundPolicy, error) {
+	for p, n := range refundPolicyNames {
+		if n == name {
+			return RefundPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown refund policy %q", name)
+}
+
+type RefundReason uint8
+
+const (
+	RefundReasonOther RefundReason = iota
+	RefundReasonNotAsDescribed
+	RefundReasonDataUnavailable
+	RefundReasonDuplicate
+	RefundReasonUnauthorized
+)
+
+var refundReasonNames = [...]string{
+	RefundReasonOther:           "other",
+	RefundReasonNotAsDescribed:  "not_as_described",
+	RefundReasonDataUnavailable: "data_unavailable",
+	RefundReasonDuplicate:       "duplicate",
+	RefundReasonUnauthorized:    "unauthorized",
+}
+
+func (r RefundReason) String() string {
+	if int(r) < len(refundReasonNames) {
+		return refundReasonNames[r]
+	}
+	return fmt.Sprintf("RefundReason(%d)", uint8(r))
+}
+
+// ParseRefundReason is the inverse of RefundReason.String.
+func ParseRefundReason(name string) (RefundReason, error) {
+	for r, n := range refundReasonNames {
+		if n == name {
+			return RefundReason(r), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown refund reason %q", name)
+}
+
+type RefundRequestStatus uint8
+
+const (
+	RefundRequestPending RefundRequestStatus = iota
+	RefundRequestApproved
+	RefundRequestDenied
+	RefundRequestWithdrawn
+	// RefundRequestFailed was approved, but the refund could not be made,
+	// such as because the buyer no longer held the contracts.
+	RefundRequestFailed
+	// RefundRequestRefunding is approved and its refund being made. One
+	// left refunding, such as by a crash, is finished by the sweeper.
+	RefundRequestRefunding
+)
+
+var refundRequestStatusNames = [...]string{
+	RefundRequestPending:   "pending",
+	RefundRequestApproved:  "approved",
+	RefundRequestDenied:    "denied",
+	RefundRequestWithdrawn: "withdrawn",
+	RefundRequestFailed:    "failed",
+	RefundRequestRefunding: "refunding",
+}
+
+func (s RefundRequestStatus) String() string {
+	if int(s) < len(refundRequestStatusNames) {
+		return refundRequestStatusNames[s]
+	}
+	return fmt.Sprintf("RefundRequestStatus(%d)", uint8(s))
+}
+
+// RefundRequest is a buyer asking the seller of a purchase for their money
+// back. The seller approves or denies it by RespondBy; if they do neither
+// it is approved for them.
+type RefundRequest struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey"`
+	TransactionID uuid.UUID `gorm:"type:uuid;index"`
+	BuyerID       uuid.UUID `gorm:"type:uuid;index"`
+	SellerID      uuid.UUID `gorm:"type:uuid;index"`
+	// Quantity is how many units the buyer wants refunded.
+	Quantity int64
+	Reason   RefundReason
+	Evidence string
+	Status   RefundRequestStatus `gorm:"index"`
+	// RespondBy is when the request is approved if the seller has not
+	// answered it.
+	RespondBy time.Time `gorm:"index"`
+	// SellerNote is the seller's answer, and FailureReason why an
+	// approved refund could not be made.
+	SellerNote    string
+	AutoApproved  bool
+	FailureReason string
+	// RefundFromCents is how much of the transaction had been refunded
+	// when the request's refund began, so a retry can tell whether it was
+	// made.
+	RefundFromCents int64
+	RespondedAt     *time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type SubscriptionStatus uint8
+
+const (
+	SubscriptionActive SubscriptionStatus = iota
+	// SubscriptionPastDue failed to renew and is in its grace period.
+	SubscriptionPastDue
+	// SubscriptionCancelled will not renew, but runs to the end of the
+	// period already paid for.
+	SubscriptionCancelled
+	SubscriptionEnded
+)
+
+var subscriptionStatusNames = [...]string{
+	SubscriptionActive:    "active",
+	SubscriptionPastDue:   "past_due",
+	SubscriptionCancelled: "cancelled",
+	SubscriptionEnded:     "ended",
+}
+
+func (s SubscriptionStatus) String() string {
+	if int(s) < len(subscriptionStatusNames) {
+		return subscriptionStatusNames[s]
+	}
+	return fmt.Sprintf("SubscriptionStatus(%d)", uint8(s))
+}
+
+// Subscription pays for a lot of subscription contracts, issued together
+// from one listing, a billing period at a time. The contracts' ExerciseBy
+// follows CurrentPeriodEnd, plus the grace period while renewals go on.
+type Subscription struct {
+	ID            uuid.UUID `gorm:"type:uuid;primaryKey"`
+	ListingID     uuid.UUID `gorm:"type:uuid;index"`
+	SellerID      uuid.UUID `gorm:"type:uuid;index"`
+	SubscriberID  uuid.UUID `gorm:"type:uuid;index"`
+	TransactionID uuid.UUID `gorm:"type:uuid;uniqueIndex"`
+	// ProviderSubscriptionID is the payment provider's subscription.
+	ProviderSubscriptionID string `gorm:"uniqueIndex"`
+	Quantity               int64
+	Status                 SubscriptionStatus `gorm:"index"`
+	CurrentPeriodEnd       time.Time
+	// GraceUntil is set while past due: the contracts expire, and the
+	// subscription is ended, if no renewal is paid by then.
+	GraceUntil *time.Time `gorm:"index"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
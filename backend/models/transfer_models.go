@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type TransferStatus uint8
+
+const (
+	TransferPending TransferStatus = iota
+	TransferCompleted
+	TransferDeclined
+	TransferCancelled
+	TransferExpired
+)
+
+var transferStatusNames = [...]string{
+	TransferPending:   "pending",
+	TransferCompleted: "completed",
+	TransferDeclined:  "declined",
+	TransferCancelled: "cancelled",
+	TransferExpired:   "expired",
+}
+
+func (s TransferStatus) String() string {
+	if int(s) < len(transferStatusNames) {
+		return transferStatusNames[s]
+	}
+	return fmt.Sprintf("TransferStatus(%d)", uint8(s))
+}
+
+// ContractTransfer is an owner giving a contract to someone else for
+// nothing. While it is pending the contract is StatusListed, so it can be
+// neither used nor sold, and it goes back to the sender if the transfer is
+// declined, cancelled or lapses.
+type ContractTransfer struct {
+	ID       uuid.UUID `gorm:"type:uuid;primaryKey"`
+	HeaderID uuid.UUID `gorm:"type:uuid;index"`
+	SenderID uuid.UUID `gorm:"type:uuid;index"`
+	// RecipientID is uuid.Nil until an email invitation is claimed.
+	RecipientID uuid.UUID `gorm:"type:uuid;index"`
+	// RecipientEmail is where an email invitation was sent. Only a user
+	// who has verified that address may claim it.
+	RecipientEmail string
+	// ClaimCodeHash is the SHA-256 of the code that claims an email
+	// invitation. The code itself is only ever mailed to the recipient
+	// and shown to the sender.
+	ClaimCodeHash string `gorm:"index" json:"-"`
+	// RequireAcceptance keeps a transfer to a known user pending until
+	// they accept it. Email invitations always wait to be claimed.
+	RequireAcceptance bool
+	Note              string
+	Status            TransferStatus `gorm:"index"`
+	ExpiresAt         time.Time      `gorm:"index"`
+	CompletedAt       *time.Time
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
@@ -17,10 +17,15 @@ type User struct {
 	CreatedAt time.Time
 	UpdatedAt time.Time
 
-	StripeConnectAccountID string
+	StripeConnectAccountID string `gorm:"index"`
 	StripeChargesEnabled   bool
 	StripePayoutsEnabled   bool
 	StripeDetailsSubmitted bool
+
+	// StripeCustomerID and StripePaymentMethodID are the buyer's saved
+	// payment method, charged for overage.
+	StripeCustomerID      string `gorm:"index"`
+	StripePaymentMethodID string
 }
 
 // type PaymentsAccount struct {
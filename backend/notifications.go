@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const notificationPageSize = 100
+
+// StoreNotifications returns an events.Handler that keeps every event
+// naming a user as a notification for them. Subscribe it with
+// Bus.SubscribeAll.
+func StoreNotifications(uow repos.UnitOfWork) events.Handler {
+	return func(ev events.Event) {
+		if ev.UserID == uuid.Nil {
+			return
+		}
+		err := uow.Repos().Notifications.Create(&models.Notification{
+			ID:            uuid.New(),
+			UserID:        ev.UserID,
+			Type:          string(ev.Type),
+			ContractID:    ev.ContractID,
+			TransactionID: ev.TransactionID,
+			Reason:        ev.Reason,
+			CreatedAt:     ev.At,
+		})
+		if err != nil {
+			log.Printf("notifications: store %s for user %s: %v", ev.Type, ev.UserID, err)
+		}
+	}
+}
+
+// NotificationsHandler serves GET /v1/notifications, the caller's most
+// recent notifications, newest first.
+func NotificationsHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		notifications, err := rs.Notifications.FindAllByUserID(u.ID, notificationPageSize)
+		if err != nil {
+			http.Error(w, "failed to fetch notifications: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(notifications)
+	}
+}
+
+// NotificationReadHandler serves POST /v1/notifications/{id}/read.
+func NotificationReadHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid notification id", http.StatusBadRequest)
+			return
+		}
+		err = rs.Notifications.MarkRead(id, u.ID, time.Now())
+		if errors.Is(err, repos.ErrNotificationNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to mark notification read: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
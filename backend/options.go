@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+var errOptionNotExercisable = errors.New("option can no longer be exercised")
+
+// listingContractType checks the contract type a listing asks for against
+// its strike, access period and exercise-by time. An empty name is a
+// standard listing.
+func listingContractType(name string, strikePriceNanos, accessHours int64, exerciseBy *time.Time) (models.ContractType, error) {
+	contractType := models.ContractStandard
+	if name != "" {
+		var err error
+		contractType, err = models.ParseContractType(name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	switch contractType {
+	case models.ContractOption:
+		if strikePriceNanos <= 0 {
+			return 0, errors.New("strike_price_nanos must be positive for an option")
+		}
+		if exerciseBy == nil {
+			return 0, errors.New("exercise_by is required for an option")
+		}
+		if accessHours < 0 {
+			return 0, errors.New("access_hours cannot be negative")
+		}
+	default:
+		if strikePriceNanos != 0 {
+			return 0, errors.New("strike_price_nanos is only for options")
+		}
+		if accessHours != 0 {
+			return 0, errors.New("access_hours is only for options")
+		}
+	}
+	return contractType, nil
+}
+
+// checkExercisable checks that ownerID may exercise the option now: it is
+// theirs, unexercised, not on offer and not past its exercise-by time.
+func checkExercisable(
+	header *models.ContractHeader,
+	state *models.ContractState,
+	ownerID uuid.UUID,
+	now time.Time) error {
+
+	if header.ContractType != models.ContractOption {
+		return fmt.Errorf("%w: it is not an option", errOptionNotExercisable)
+	}
+	if state.OwnerID != ownerID {
+		return errNotParticipant
+	}
+	if header.ExerciseBy != nil && !header.ExerciseBy.After(now) {
+		return fmt.Errorf("%w: it has expired", errOptionNotExercisable)
+	}
+	switch state.Status {
+	case models.StatusOwned:
+		return nil
+	case models.StatusUnlocked:
+		return fmt.Errorf("%w: it has already been exercised", errOptionNotExercisable)
+	case models.StatusMatched:
+		return fmt.Errorf("%w: a checkout for it is in progress", errOptionNotExercisable)
+	case models.StatusListed:
+		return fmt.Errorf("%w: it is on offer; withdraw it first", errOptionNotExercisable)
+	default:
+		return fmt.Errorf("%w: it is %s", errOptionNotExercisable, state.Status)
+	}
+}
+
+// ExerciseHandler serves POST /v1/contracts/{id}/exercise. The owner of an
+// option pays its strike price to the listing's seller; the contract is
+// held in StatusMatched while the checkout is open and unlocked once the
+// payment lands. The premium paid for the option is the seller's either way.
+func ExerciseHandler(provider payments.PaymentProvider, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, header, state, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		if err := checkExercisable(header, state, u.ID, now); err != nil {
+			if errors.Is(err, errNotParticipant) {
+				http.Error(w, "only the owner may exercise this contract", http.StatusForbidden)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		rs := uow.Repos()
+		listing, err := rs.Listings.FindByID(header.ListingID)
+		if err != nil {
+			http.Error(w, "option writer's listing is gone", http.StatusConflict)
+			return
+		}
+		if listing.SellerID == u.ID {
+			http.Error(w, "cannot exercise an option you wrote", http.StatusConflict)
+			return
+		}
+		seller, ok := payableSeller(w, rs.Users, listing.SellerID)
+		if !ok {
+			return
+		}
+		productName := "Data Contract (option exercise)"
+		if header.DatastreamID != uuid.Nil {
+			datastream, err := rs.Datastreams.FindByID(header.DatastreamID)
+			if err != nil {
+				http.Error(w, "datastream not found", http.StatusInternalServerError)
+				return
+			}
+			if datastream.Status != models.DatastreamActive {
+				http.Error(w, "datastream is "+datastream.Status.String(), http.StatusConflict)
+				return
+			}
+			productName = datastream.Name + " (option exercise)"
+		}
+
+		unitCents := (header.StrikePriceNanos + 5_000_000) / 10_000_000
+		tr := &models.TransactionRecord{
+			ID:                uuid.New(),
+			InitiatedAt:       now,
+			ListingID:         header.ListingID,
+			SellerID:          listing.SellerID,
+			BuyerID:           u.ID,
+			PurchaseQuantity:  1,
+			PurchaseCents:     uint64(unitCents),
+			Currency:          os.Getenv("CURRENCY"),
+			PlatformFeeCents:  platformFeeCents(unitCents),
+			TransactionStatus: models.StatusPending,
+			Kind:              models.KindExercise,
+			HeaderID:          header.ID,
+		}
+		hold := &models.SupplyReservation{
+			ID:            uuid.New(),
+			Kind:          models.KindExercise,
+			ListingID:     header.ID,
+			TransactionID: tr.ID,
+			Quantity:      1,
+			Status:        models.ReservationActive,
+			ExpiresAt:     now.Add(ReservationTTL()),
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		err = uow.WithTx(func(tx *repos.Repos) error {
+			state, err := tx.States.FindByID(header.ID)
+			if err != nil {
+				return err
+			}
+			if err := checkExercisable(header, state, u.ID, now); err != nil {
+				return err
+			}
+			err = lifecycle.TransitionContract(tx, state, models.StatusMatched, u.ID, "exercise checkout")
+			if err != nil {
+				return err
+			}
+			if err := tx.Transactions.Create(tr); err != nil {
+				return err
+			}
+			return tx.Reservations.Create(hold)
+		})
+		if errors.Is(err, errOptionNotExercisable) || errors.Is(err, errNotParticipant) ||
+			errors.Is(err, repos.ErrContractStatusConflict) {
+			http.Error(w, "contract changed concurrently: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to hold contract: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		openCheckout(w, provider, uow, &checkoutOrder{
+			record:      tr,
+			hold:        hold,
+			seller:      seller,
+			productName: productName,
+			unitCents:   unitCents,
+			metadata: map[string]string{
+				"transaction_id": tr.ID.String(),
+				"contract_id":    header.ID.String(),
+				"buyer_id":       u.ID.String(),
+			},
+		})
+	}
+}
+
+// releaseExercise gives an option whose exercise checkout was abandoned
+// back to its owner, still unexercised.
+func releaseExercise(headerID uuid.UUID, tx *repos.Repos) error {
+	state, err := tx.States.FindByID(headerID)
+	if err != nil {
+		return err
+	}
+	if state.Status != models.StatusMatched {
+		return nil
+	}
+	return lifecycle.TransitionContract(tx, state, models.StatusOwned, lifecycle.SystemActor, "exercise checkout released")
+}
+
+// settleExercise unlocks a paid-for option. A payment that arrives after
+// its checkout expired still exercises the option if the payer owns it and
+// it has not lapsed; otherwise errOptionNotExercisable is returned so the
+// payment can be refunded.
+func settleExercise(record *models.TransactionRecord, tx *repos.Repos) error {
+	header, err := tx.Headers.FindByID(record.HeaderID)
+	if err != nil {
+		return err
+	}
+	state, err := tx.States.FindByID(record.HeaderID)
+	if err != nil {
+		return err
+	}
+
+	held := false
+	reservation, err := tx.Reservations.FindByTransactionID(record.ID)
+	switch {
+	case err == nil:
+		err = tx.Reservations.Convert(reservation.ID)
+		if err == nil {
+			held = true
+		} else if !errors.Is(err, repos.ErrReservationNotActive) {
+			return err
+		}
+	case !errors.Is(err, repos.ErrReservationNotFound):
+		return err
+	}
+
+	if held && state.Status == models.StatusMatched {
+		err := lifecycle.TransitionContract(tx, state, models.StatusOwned, record.BuyerID, "exercise paid")
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	err = checkExercisable(header, state, record.BuyerID, now)
+	if errors.Is(err, errNotParticipant) {
+		return fmt.Errorf("%w: the payer no longer owns it", errOptionNotExercisable)
+	}
+	if err != nil {
+		return err
+	}
+
+	header.AccessUntil = optionAccessUntil(header, now)
+	if err := tx.Headers.Update(header); err != nil {
+		return err
+	}
+	return lifecycle.TransitionContract(tx, state, models.StatusUnlocked, record.BuyerID, "option exercised")
+}
+
+// optionAccessUntil is when the access bought by exercising the option at
+// exercisedAt ends: AccessHours later, or at ExerciseBy for an option whose
+// listing set no access period.
+func optionAccessUntil(header *models.ContractHeader, exercisedAt time.Time) *time.Time {
+	if header.AccessHours <= 0 {
+		return header.ExerciseBy
+	}
+	until := exercisedAt.Add(time.Duration(header.AccessHours) * time.Hour)
+	return &until
+}
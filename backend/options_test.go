@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+)
+
+func TestCheckExercisable(t *testing.T) {
+	now := time.Now()
+	owner := uuid.New()
+	cases := []struct {
+		name       string
+		typ        models.ContractType
+		status     models.ContractStatus
+		exerciseBy time.Time
+		exerciser  uuid.UUID
+		want       error
+	}{
+		{name: "owned option", typ: models.ContractOption, status: models.StatusOwned, exerciseBy: now.Add(time.Hour), exerciser: owner},
+		{name: "not an option", typ: models.ContractStandard, status: models.StatusOwned, exerciseBy: now.Add(time.Hour), exerciser: owner, want: errOptionNotExercisable},
+		{name: "someone else's", typ: models.ContractOption, status: models.StatusOwned, exerciseBy: now.Add(time.Hour), exerciser: uuid.New(), want: errNotParticipant},
+		{name: "at its exercise-by", typ: models.ContractOption, status: models.StatusOwned, exerciseBy: now, exerciser: owner, want: errOptionNotExercisable},
+		{name: "already exercised", typ: models.ContractOption, status: models.StatusUnlocked, exerciseBy: now.Add(time.Hour), exerciser: owner, want: errOptionNotExercisable},
+		{name: "being exercised", typ: models.ContractOption, status: models.StatusMatched, exerciseBy: now.Add(time.Hour), exerciser: owner, want: errOptionNotExercisable},
+		{name: "on offer", typ: models.ContractOption, status: models.StatusListed, exerciseBy: now.Add(time.Hour), exerciser: owner, want: errOptionNotExercisable},
+		{name: "frozen", typ: models.ContractOption, status: models.StatusFrozen, exerciseBy: now.Add(time.Hour), exerciser: owner, want: errOptionNotExercisable},
+		{name: "lapsed", typ: models.ContractOption, status: models.StatusExpiryReached, exerciseBy: now.Add(time.Hour), exerciser: owner, want: errOptionNotExercisable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := &models.ContractHeader{ContractType: c.typ, ExerciseBy: &c.exerciseBy}
+			state := &models.ContractState{OwnerID: owner, Status: c.status}
+			if err := checkExercisable(header, state, c.exerciser, now); !errors.Is(err, c.want) {
+				t.Errorf("err = %v, want %v", err, c.want)
+			}
+		})
+	}
+}
+
+// exercise pays the strike price of the buyer's option through the API.
+func (m *testMarket) exercise(t *testing.T, headerID uuid.UUID) {
+	t.Helper()
+	r := as(httptest.NewRequest(http.MethodPost, "/v1/contracts/"+headerID.String()+"/exercise", nil), m.buyer)
+	r.SetPathValue("id", headerID.String())
+	w := httptest.NewRecorder()
+	ExerciseHandler(m.provider, m.uow)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("exercise: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	tr := m.transaction(t, uuid.MustParse(resp.TransactionID))
+	if _, err := m.provider.CompleteCheckoutSession(tr.StripeCheckoutSessonID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptionsLapse(t *testing.T) {
+	m := newTestMarket(t)
+	now := time.Now()
+	exerciseBy := now.Add(24 * time.Hour)
+	listing := m.listing(t, &ListingParams{
+		SupplyLimit:      2,
+		ContractType:     models.ContractOption,
+		StrikePriceNanos: 5_000_000_000,
+		AccessHours:      1,
+		ExerciseBy:       &exerciseBy,
+	})
+	m.buy(t, listing.ID, 2)
+	options := m.owned(t, m.buyer)
+	exercised, unexercised := options[0].HeaderID, options[1].HeaderID
+	m.exercise(t, exercised)
+
+	steps := []struct {
+		name        string
+		at          time.Duration
+		exercised   models.ContractStatus
+		unexercised models.ContractStatus
+	}{
+		{"within the access period", 30 * time.Minute, models.StatusUnlocked, models.StatusOwned},
+		{"after the access period", 2 * time.Hour, models.StatusExpiryReached, models.StatusOwned},
+		{"at the exercise-by", 24 * time.Hour, models.StatusExpiryReached, models.StatusExpiryReached},
+	}
+	for _, step := range steps {
+		if _, err := ExpireDueContracts(now.Add(step.at), m.uow, nil); err != nil {
+			t.Fatal(err)
+		}
+		for id, want := range map[uuid.UUID]models.ContractStatus{exercised: step.exercised, unexercised: step.unexercised} {
+			state, _ := m.custody(t, id)
+			if state.Status != want {
+				t.Errorf("%s: option %s is %s, want %s", step.name, id, state.Status, want)
+			}
+		}
+	}
+}
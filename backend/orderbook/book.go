@@ -0,0 +1,235 @@
+// Package orderbook matches limit orders for one listing with price-time
+// priority. It knows nothing about contracts or persistence; callers turn
+// fills into transactions and save the book's orders themselves.
+package orderbook
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+type Side uint8
+
+const (
+	Bid Side = iota
+	Ask
+)
+
+func (s Side) String() string {
+	if s == Bid {
+		return "bid"
+	}
+	return "ask"
+}
+
+// Order is a limit order. Seq orders orders that share a price: the lower
+// one arrived first and fills first.
+type Order struct {
+	ID         uuid.UUID
+	Side       Side
+	TraderID   uuid.UUID
+	PriceNanos int64
+	Remaining  uint64
+	Seq        uint64
+}
+
+// Fill is a trade between a bid and an ask, at the resting order's price.
+type Fill struct {
+	BidID      uuid.UUID
+	AskID      uuid.UUID
+	BuyerID    uuid.UUID
+	SellerID   uuid.UUID
+	PriceNanos int64
+	Quantity   uint64
+}
+
+// Level is the total quantity resting at one price.
+type Level struct {
+	PriceNanos int64  `json:"price_nanos"`
+	Quantity   uint64 `json:"quantity"`
+	Orders     int    `json:"orders"`
+}
+
+// Book holds the resting orders of one listing. It is not safe for
+// concurrent use.
+type Book struct {
+	// bids are best (highest) price first, asks best (lowest) first; ties
+	// by Seq.
+	bids    []*Order
+	asks    []*Order
+	nextSeq uint64
+}
+
+func NewBook() *Book {
+	return &Book{nextSeq: 1}
+}
+
+// Clone returns a deep copy, so a caller can match against the copy and
+// throw it away if persisting the result fails.
+func (b *Book) Clone() *Book {
+	c := &Book{nextSeq: b.nextSeq}
+	for _, o := range b.bids {
+		cp := *o
+		c.bids = append(c.bids, &cp)
+	}
+	for _, o := range b.asks {
+		cp := *o
+		c.asks = append(c.asks, &cp)
+	}
+	return c
+}
+
+// Place matches an incoming order against the opposite side for as long as
+// prices cross, then rests whatever is left. It assigns o.Seq, updates
+// o.Remaining and the Remaining of every resting order it trades with, and
+// returns the fills in the order they happened. A trader's own resting
+// orders are skipped rather than traded against.
+func (b *Book) Place(o *Order) []Fill {
+	o.Seq = b.nextSeq
+	b.nextSeq++
+
+	var fills []Fill
+	opposite := &b.asks
+	if o.Side == Ask {
+		opposite = &b.bids
+	}
+
+	kept := (*opposite)[:0]
+	for i, resting := range *opposite {
+		if o.Remaining == 0 || !crosses(o, resting) {
+			kept = append(kept, (*opposite)[i:]...)
+			break
+		}
+		if resting.TraderID == o.TraderID {
+			kept = append(kept, resting)
+			continue
+		}
+
+		qty := min(o.Remaining, resting.Remaining)
+		o.Remaining -= qty
+		resting.Remaining -= qty
+		fills = append(fills, newFill(o, resting, qty))
+		if resting.Remaining > 0 {
+			kept = append(kept, resting)
+		}
+	}
+	*opposite = kept
+
+	if o.Remaining > 0 {
+		b.rest(o)
+	}
+	return fills
+}
+
+// Restore rests an order without matching it, for rebuilding a book from
+// storage. Orders must keep the Seq they were given by Place.
+func (b *Book) Restore(o *Order) {
+	if o.Seq >= b.nextSeq {
+		b.nextSeq = o.Seq + 1
+	}
+	b.rest(o)
+}
+
+// Cancel removes a resting order, reporting whether it was there.
+func (b *Book) Cancel(id uuid.UUID) (*Order, bool) {
+	for _, side := range []*[]*Order{&b.bids, &b.asks} {
+		for i, o := range *side {
+			if o.ID == id {
+				*side = append((*side)[:i], (*side)[i+1:]...)
+				return o, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Reduce takes quantity off a resting order, removing it once nothing is
+// left. It reports whether the order was there.
+func (b *Book) Reduce(id uuid.UUID, quantity uint64) bool {
+	for _, side := range []*[]*Order{&b.bids, &b.asks} {
+		for i, o := range *side {
+			if o.ID != id {
+				continue
+			}
+			if quantity >= o.Remaining {
+				*side = append((*side)[:i], (*side)[i+1:]...)
+			} else {
+				o.Remaining -= quantity
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Order returns a copy of a resting order, reporting whether it is in the
+// book. An order that has been filled completely is not.
+func (b *Book) Order(id uuid.UUID) (Order, bool) {
+	for _, side := range [][]*Order{b.bids, b.asks} {
+		for _, o := range side {
+			if o.ID == id {
+				return *o, true
+			}
+		}
+	}
+	return Order{}, false
+}
+
+// Depth aggregates each side by price, best price first.
+func (b *Book) Depth() (bids, asks []Level) {
+	return depth(b.bids), depth(b.asks)
+}
+
+func (b *Book) rest(o *Order) {
+	side := &b.bids
+	better := func(x, y *Order) bool {
+		return x.PriceNanos > y.PriceNanos || (x.PriceNanos == y.PriceNanos && x.Seq < y.Seq)
+	}
+	if o.Side == Ask {
+		side = &b.asks
+		better = func(x, y *Order) bool {
+			return x.PriceNanos < y.PriceNanos || (x.PriceNanos == y.PriceNanos && x.Seq < y.Seq)
+		}
+	}
+
+	i := sort.Search(len(*side), func(i int) bool { return better(o, (*side)[i]) })
+	*side = append(*side, nil)
+	copy((*side)[i+1:], (*side)[i:])
+	(*side)[i] = o
+}
+
+func crosses(incoming, resting *Order) bool {
+	if incoming.Side == Bid {
+		return incoming.PriceNanos >= resting.PriceNanos
+	}
+	return incoming.PriceNanos <= resting.PriceNanos
+}
+
+func newFill(incoming, resting *Order, qty uint64) Fill {
+	bid, ask := incoming, resting
+	if incoming.Side == Ask {
+		bid, ask = resting, incoming
+	}
+	return Fill{
+		BidID:      bid.ID,
+		AskID:      ask.ID,
+		BuyerID:    bid.TraderID,
+		SellerID:   ask.TraderID,
+		PriceNanos: resting.PriceNanos,
+		Quantity:   qty,
+	}
+}
+
+func depth(orders []*Order) []Level {
+	var levels []Level
+	for _, o := range orders {
+		if n := len(levels); n > 0 && levels[n-1].PriceNanos == o.PriceNanos {
+			levels[n-1].Quantity += o.Remaining
+			levels[n-1].Orders++
+			continue
+		}
+		levels = append(levels, Level{PriceNanos: o.PriceNanos, Quantity: o.Remaining, Orders: 1})
+	}
+	return levels
+}
@@ -0,0 +1,251 @@
+package orderbook
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// names gives each order and trader named in a test a stable ID, and turns
+// IDs back into names so failures read like the test case.
+type names map[string]uuid.UUID
+
+func (n names) id(name string) uuid.UUID {
+	if id, ok := n[name]; ok {
+		return id
+	}
+	id := uuid.New()
+	n[name] = id
+	return id
+}
+
+func (n names) name(id uuid.UUID) string {
+	for name, v := range n {
+		if v == id {
+			return name
+		}
+	}
+	return id.String()
+}
+
+type order struct {
+	name   string
+	side   Side
+	trader string
+	price  int64
+	qty    uint64
+}
+
+func (n names) order(o order) *Order {
+	return &Order{ID: n.id(o.name), Side: o.side, TraderID: n.id(o.trader), PriceNanos: o.price, Remaining: o.qty}
+}
+
+type fill struct {
+	bid, ask string
+	price    int64
+	qty      uint64
+}
+
+func (n names) fills(fills []Fill) []fill {
+	var out []fill
+	for _, f := range fills {
+		out = append(out, fill{bid: n.name(f.BidID), ask: n.name(f.AskID), price: f.PriceNanos, qty: f.Quantity})
+	}
+	return out
+}
+
+func TestPlace(t *testing.T) {
+	cases := []struct {
+		name       string
+		orders     []order
+		want       []fill
+		bids, asks []Level
+	}{
+		{
+			name: "better price fills first",
+			orders: []order{
+				{"a1", Ask, "s1", 110, 1},
+				{"a2", Ask, "s2", 100, 1},
+				{"b", Bid, "buyer", 120, 2},
+			},
+			want: []fill{{"b", "a2", 100, 1}, {"b", "a1", 110, 1}},
+		},
+		{
+			name: "earlier order fills first at the same price",
+			orders: []order{
+				{"a1", Ask, "s1", 100, 1},
+				{"a2", Ask, "s2", 100, 1},
+				{"b", Bid, "buyer", 100, 1},
+			},
+			want: []fill{{"b", "a1", 100, 1}},
+			asks: []Level{{PriceNanos: 100, Quantity: 1, Orders: 1}},
+		},
+		{
+			name: "prices that do not cross both rest",
+			orders: []order{
+				{"a", Ask, "seller", 110, 1},
+				{"b", Bid, "buyer", 100, 1},
+			},
+			bids: []Level{{PriceNanos: 100, Quantity: 1, Orders: 1}},
+			asks: []Level{{PriceNanos: 110, Quantity: 1, Orders: 1}},
+		},
+		{
+			name: "resting order filled in part keeps the rest",
+			orders: []order{
+				{"a", Ask, "seller", 100, 5},
+				{"b", Bid, "buyer", 100, 2},
+			},
+			want: []fill{{"b", "a", 100, 2}},
+			asks: []Level{{PriceNanos: 100, Quantity: 3, Orders: 1}},
+		},
+		{
+			name: "incoming order filled in part rests the rest",
+			orders: []order{
+				{"a", Ask, "seller", 100, 2},
+				{"b", Bid, "buyer", 105, 5},
+			},
+			want: []fill{{"b", "a", 100, 2}},
+			bids: []Level{{PriceNanos: 105, Quantity: 3, Orders: 1}},
+		},
+		{
+			name: "incoming ask trades at the resting bid's price",
+			orders: []order{
+				{"b", Bid, "buyer", 120, 1},
+				{"a", Ask, "seller", 100, 1},
+			},
+			want: []fill{{"b", "a", 120, 1}},
+		},
+		{
+			name: "own resting orders are skipped",
+			orders: []order{
+				{"own", Ask, "trader", 100, 1},
+				{"other", Ask, "seller", 101, 1},
+				{"b", Bid, "trader", 105, 1},
+			},
+			want: []fill{{"b", "other", 101, 1}},
+			asks: []Level{{PriceNanos: 100, Quantity: 1, Orders: 1}},
+		},
+		{
+			name: "order crossing only its own rests beside it",
+			orders: []order{
+				{"a", Ask, "trader", 100, 1},
+				{"b", Bid, "trader", 100, 1},
+			},
+			bids: []Level{{PriceNanos: 100, Quantity: 1, Orders: 1}},
+			asks: []Level{{PriceNanos: 100, Quantity: 1, Orders: 1}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := names{}
+			b := NewBook()
+			var got []fill
+			for _, o := range c.orders {
+				got = append(got, n.fills(b.Place(n.order(o)))...)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("fills = %v, want %v", got, c.want)
+			}
+			bids, asks := b.Depth()
+			if !reflect.DeepEqual(bids, c.bids) || !reflect.DeepEqual(asks, c.asks) {
+				t.Errorf("depth = %v / %v, want %v / %v", bids, asks, c.bids, c.asks)
+			}
+		})
+	}
+}
+
+func TestCancelAndReduce(t *testing.T) {
+	cases := []struct {
+		name       string
+		op         func(b *Book, n names) bool
+		found      bool
+		bids, asks []Level
+	}{
+		{
+			name:  "cancel a bid",
+			op:    func(b *Book, n names) bool { _, ok := b.Cancel(n.id("b")); return ok },
+			found: true,
+			asks:  []Level{{PriceNanos: 110, Quantity: 3, Orders: 1}},
+		},
+		{
+			name: "cancel an unknown order",
+			op:   func(b *Book, n names) bool { _, ok := b.Cancel(n.id("unknown")); return ok },
+			bids: []Level{{PriceNanos: 100, Quantity: 5, Orders: 1}},
+			asks: []Level{{PriceNanos: 110, Quantity: 3, Orders: 1}},
+		},
+		{
+			name:  "reduce an ask in part",
+			op:    func(b *Book, n names) bool { return b.Reduce(n.id("a"), 1) },
+			found: true,
+			bids:  []Level{{PriceNanos: 100, Quantity: 5, Orders: 1}},
+			asks:  []Level{{PriceNanos: 110, Quantity: 2, Orders: 1}},
+		},
+		{
+			name:  "reduce an ask to nothing",
+			op:    func(b *Book, n names) bool { return b.Reduce(n.id("a"), 3) },
+			found: true,
+			bids:  []Level{{PriceNanos: 100, Quantity: 5, Orders: 1}},
+		},
+		{
+			name:  "reduce by more than is left",
+			op:    func(b *Book, n names) bool { return b.Reduce(n.id("b"), 9) },
+			found: true,
+			asks:  []Level{{PriceNanos: 110, Quantity: 3, Orders: 1}},
+		},
+		{
+			name: "reduce an unknown order",
+			op:   func(b *Book, n names) bool { return b.Reduce(n.id("unknown"), 1) },
+			bids: []Level{{PriceNanos: 100, Quantity: 5, Orders: 1}},
+			asks: []Level{{PriceNanos: 110, Quantity: 3, Orders: 1}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := names{}
+			b := NewBook()
+			b.Place(n.order(order{"b", Bid, "buyer", 100, 5}))
+			b.Place(n.order(order{"a", Ask, "seller", 110, 3}))
+
+			if found := c.op(b, n); found != c.found {
+				t.Errorf("found = %v, want %v", found, c.found)
+			}
+			bids, asks := b.Depth()
+			if !reflect.DeepEqual(bids, c.bids) || !reflect.DeepEqual(asks, c.asks) {
+				t.Errorf("depth = %v / %v, want %v / %v", bids, asks, c.bids, c.asks)
+			}
+		})
+	}
+}
+
+func TestPlaceAfterRestore(t *testing.T) {
+	cases := []struct {
+		name  string
+		seqs  []uint64
+		first string
+	}{
+		{"restored in sequence order", []uint64{3, 7}, "a3"},
+		{"restored out of sequence order", []uint64{7, 3}, "a3"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			n := names{}
+			b := NewBook()
+			for _, seq := range c.seqs {
+				o := n.order(order{fmt.Sprintf("a%d", seq), Ask, "seller", 100, 1})
+				o.Seq = seq
+				b.Restore(o)
+			}
+
+			bid := n.order(order{"b", Bid, "buyer", 100, 1})
+			fills := n.fills(b.Place(bid))
+			if bid.Seq != 8 {
+				t.Errorf("order placed after restoring seqs %v got seq %d, want 8", c.seqs, bid.Seq)
+			}
+			if len(fills) != 1 || fills[0].ask != c.first {
+				t.Errorf("fills = %v, want the ask %s first", fills, c.first)
+			}
+		})
+	}
+}
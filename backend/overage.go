@@ -0,0 +1,694 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultOverageBillingInterval = 24 * time.Hour
+	overageBillingBatchSize       = 500
+	// minOverageChargeCents is the smallest overage bill worth a charge;
+	// less is carried over to the next run, or charged when the owner
+	// offers the contract to someone else.
+	minOverageChargeCents = 50
+	// maxOverageCapCents keeps a cap, and so any overage bill within it,
+	// representable in nanos as an int64.
+	maxOverageCapCents = math.MaxInt64 / 10_000_000
+)
+
+var (
+	errNoPaymentMethod = errors.New("save a payment method before allowing overage")
+	errOverageUnpaid   = errors.New("overage on the contract could not be charged to your saved payment method")
+)
+
+// OverageBillingInterval reads how often overage is billed from
+// OVERAGE_BILLING_INTERVAL.
+func OverageBillingInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("OVERAGE_BILLING_INTERVAL"))
+	if err != nil || interval <= 0 {
+		return defaultOverageBillingInterval
+	}
+	return interval
+}
+
+// validOverageReadPrice checks a listing's overage price has a read quota
+// to go past.
+func validOverageReadPrice(priceNanos int64, quotaReads uint64) error {
+	if priceNanos < 0 {
+		return errors.New("overage_read_price_nanos cannot be negative")
+	}
+	if priceNanos > 0 && quotaReads == 0 {
+		return errors.New("overage_read_price_nanos needs a quota_reads to go past")
+	}
+	return nil
+}
+
+// overageReadsLeft is how many more reads past the quota the owner's cap
+// allows before the overage already read is billed.
+func overageReadsLeft(header *models.ContractHeader, state *models.ContractState) uint64 {
+	if header.OverageReadPriceNanos <= 0 || state.OverageCapCents <= 0 {
+		return 0
+	}
+	price := uint64(header.OverageReadPriceNanos)
+	affordable := uint64(math.MaxUint64)
+	if hi, lo := bits.Mul64(uint64(state.OverageCapCents), 10_000_000); hi < price {
+		affordable, _ = bits.Div64(hi, lo, price)
+	}
+	unbilled := state.OverageReads - state.OverageReadsBilled
+	if affordable <= unbilled {
+		return 0
+	}
+	return affordable - unbilled
+}
+
+// readsExhausted reports whether the contract can serve no more reads,
+// within its quota or as overage.
+func readsExhausted(header *models.ContractHeader, state *models.ContractState) bool {
+	return header.QuotaReads > 0 && state.ReadsRemaining == 0 && overageReadsLeft(header, state) == 0
+}
+
+// overageCents is what reads past the quota cost at priceNanos each.
+func overageCents(reads uint64, priceNanos int64) int64 {
+	return (int64(reads)*priceNanos + 5_000_000) / 10_000_000
+}
+
+// overageBill is the unbilled overage of one buyer on one listing's
+// contracts, which is charged as a single transaction.
+type overageBill struct {
+	buyerID   uuid.UUID
+	listingID uuid.UUID
+	states    []*models.ContractState
+	headers   []*models.ContractHeader
+}
+
+// BillOverage charges every buyer for the overage reads on their contracts
+// that have not been billed yet, one transaction per buyer and listing
+// with a line for each contract. Charges left unresolved by an earlier run
+// are retried first. It returns how many charges succeeded.
+func BillOverage(provider payments.PaymentProvider, uow repos.UnitOfWork) (int, error) {
+	charged, err := retryOverageCharges(provider, uow)
+	if err != nil {
+		return charged, err
+	}
+
+	rs := uow.Repos()
+	bills := map[[2]uuid.UUID]*overageBill{}
+	var order [][2]uuid.UUID
+	after := uuid.Nil
+	for {
+		states, err := rs.States.FindAllUnbilledOverage(after, overageBillingBatchSize)
+		if err != nil {
+			return charged, err
+		}
+		for i := range states {
+			state := &states[i]
+			header, err := rs.Headers.FindByID(state.HeaderID)
+			if err != nil {
+				return charged, err
+			}
+			key := [2]uuid.UUID{state.OwnerID, header.ListingID}
+			bill, ok := bills[key]
+			if !ok {
+				bill = &overageBill{buyerID: state.OwnerID, listingID: header.ListingID}
+				bills[key] = bill
+				order = append(order, key)
+			}
+			bill.states = append(bill.states, state)
+			bill.headers = append(bill.headers, header)
+		}
+		if len(states) < overageBillingBatchSize {
+			break
+		}
+		after = states[len(states)-1].HeaderID
+	}
+
+	for _, key := range order {
+		ok, err := chargeOverage(bills[key], minOverageChargeCents, provider, uow)
+		if err != nil {
+			log.Printf("overage for buyer %s on listing %s: %v", key[0], key[1], err)
+			continue
+		}
+		if ok {
+			charged++
+		}
+	}
+	return charged, nil
+}
+
+// BillOverageBeforeListing charges the owner for any overage still
+// unbilled on the contracts, however little, so they can be offered to
+// someone else. It fails with errOverageUnpaid if the charge is declined.
+func BillOverageBeforeListing(
+	ownerID uuid.UUID,
+	headerIDs []uuid.UUID,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) error {
+
+	rs := uow.Repos()
+	bills := map[uuid.UUID]*overageBill{}
+	var order []uuid.UUID
+	for _, id := range headerIDs {
+		state, err := rs.States.FindByID(id)
+		if err != nil {
+			return err
+		}
+		if state.OwnerID != ownerID || state.OverageReads <= state.OverageReadsBilled {
+			continue
+		}
+		header, err := rs.Headers.FindByID(id)
+		if err != nil {
+			return err
+		}
+		bill, ok := bills[header.ListingID]
+		if !ok {
+			bill = &overageBill{buyerID: ownerID, listingID: header.ListingID}
+			bills[header.ListingID] = bill
+			order = append(order, header.ListingID)
+		}
+		bill.states = append(bill.states, state)
+		bill.headers = append(bill.headers, header)
+	}
+
+	for _, listingID := range order {
+		bill := bills[listingID]
+		if _, err := chargeOverage(bill, 0, provider, uow); err != nil {
+			return err
+		}
+		for _, state := range bill.states {
+			state, err := rs.States.FindByID(state.HeaderID)
+			if err != nil {
+				return err
+			}
+			if state.OverageReads > state.OverageReadsBilled {
+				return errOverageUnpaid
+			}
+		}
+	}
+	return nil
+}
+
+// chargeOverage records bill as a KindOverage transaction, marks its reads
+// billed and charges the buyer's saved payment method. It reports false,
+// and charges nothing, when the bill comes to less than minCents. A bill
+// too small to cost a cent is marked billed without a charge.
+func chargeOverage(
+	bill *overageBill,
+	minCents int64,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (bool, error) {
+
+	rs := uow.Repos()
+	buyer, err := rs.Users.FindByID(bill.buyerID)
+	if err != nil {
+		return false, err
+	}
+	if buyer.StripeCustomerID == "" || buyer.StripePaymentMethodID == "" {
+		return false, errNoPaymentMethod
+	}
+	listing, err := rs.Listings.FindByID(bill.listingID)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	tr := &models.TransactionRecord{
+		ID:                uuid.New(),
+		InitiatedAt:       now,
+		ListingID:         listing.ID,
+		SellerID:          listing.SellerID,
+		BuyerID:           buyer.ID,
+		Currency:          os.Getenv("CURRENCY"),
+		TransactionStatus: models.StatusPending,
+		Kind:              models.KindOverage,
+	}
+	lines := make([]*models.OverageLine, len(bill.states))
+	var totalCents int64
+	for i, state := range bill.states {
+		header := bill.headers[i]
+		reads := state.OverageReads - state.OverageReadsBilled
+		lines[i] = &models.OverageLine{
+			ID:             uuid.New(),
+			TransactionID:  tr.ID,
+			HeaderID:       header.ID,
+			Reads:          reads,
+			UnitPriceNanos: header.OverageReadPriceNanos,
+			AmountCents:    overageCents(reads, header.OverageReadPriceNanos),
+			CreatedAt:      now,
+		}
+		tr.PurchaseQuantity += int64(reads)
+		totalCents += lines[i].AmountCents
+	}
+	if totalCents < minCents {
+		return false, nil
+	}
+	if totalCents == 0 {
+		err := uow.WithTx(func(tx *repos.Repos) error {
+			return markOverageBilled(bill.states, tx)
+		})
+		if errors.Is(err, repos.ErrOverageBillingConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+	tr.PurchaseCents = uint64(totalCents)
+	tr.PlatformFeeCents = platformFeeCents(totalCents)
+
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		if err := tx.Transactions.Create(tr); err != nil {
+			return err
+		}
+		if err := tx.OverageLines.CreateInBatches(lines, issueBatchSize); err != nil {
+			return err
+		}
+		if err := markOverageBilled(bill.states, tx); err != nil {
+			return err
+		}
+		// The charge is made outside this transaction; until it settles
+		// the record waits in RequiresPayment.
+		return lifecycle.TransitionTransaction(tx.Transactions, tr, models.StatusRequiresPayment, "")
+	})
+	if errors.Is(err, repos.ErrOverageBillingConflict) {
+		// Another biller got there first.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := settleOverageCharge(tr, provider, uow); err != nil {
+		return false, err
+	}
+	return tr.TransactionStatus == models.StatusFulfilled, nil
+}
+
+// markOverageBilled marks every overage read on the contracts billed.
+func markOverageBilled(states []*models.ContractState, tx *repos.Repos) error {
+	for _, state := range states {
+		err := tx.States.MarkOverageBilled(state.HeaderID, state.OverageReadsBilled, state.OverageReads)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryOverageCharges settles overage transactions whose charge was left
+// unresolved, such as by a network error. The charge is retried with the
+// same idempotency key, so a charge that did go through is not repeated.
+func retryOverageCharges(provider payments.PaymentProvider, uow repos.UnitOfWork) (int, error) {
+	pending, err := uow.Repos().Transactions.FindAllByKindAndStatus(
+		models.KindOverage, models.StatusRequiresPayment, overageBillingBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	charged := 0
+	for i := range pending {
+		tr := &pending[i]
+		if tr.StripePaymentIntentID != "" {
+			// The charge went through and is still settling; the webhook
+			// finishes it.
+			continue
+		}
+		if err := settleOverageCharge(tr, provider, uow); err != nil {
+			log.Printf("overage transaction %s: %v", tr.ID, err)
+			continue
+		}
+		if tr.TransactionStatus == models.StatusFulfilled {
+			charged++
+		}
+	}
+	return charged, nil
+}
+
+// settleOverageCharge charges the buyer for an overage transaction in
+// RequiresPayment. A declined charge fails the transaction and puts its
+// reads back to unbilled, so they are charged again on the next run and
+// the contracts cannot change hands meanwhile. A charge that is still
+// settling leaves the transaction waiting for SettleOverageCharge. Any
+// other error leaves the transaction for retryOverageCharges.
+func settleOverageCharge(tr *models.TransactionRecord, provider payments.PaymentProvider, uow repos.UnitOfWork) error {
+	rs := uow.Repos()
+	buyer, err := rs.Users.FindByID(tr.BuyerID)
+	if err != nil {
+		return err
+	}
+	seller, err := rs.Users.FindByID(tr.SellerID)
+	if err != nil {
+		return err
+	}
+
+	p, err := provider.ChargeSavedPaymentMethod(&payments.SavedPaymentParams{
+		CustomerID:           buyer.StripeCustomerID,
+		PaymentMethodID:      buyer.StripePaymentMethodID,
+		AmountCents:          int64(tr.PurchaseCents),
+		Currency:             tr.Currency,
+		Description:          fmt.Sprintf("Overage: %d reads", tr.PurchaseQuantity),
+		ApplicationFeeCents:  tr.PlatformFeeCents,
+		DestinationAccountID: seller.StripeConnectAccountID,
+		IdempotencyKey:       "overage-" + tr.ID.String(),
+		Metadata: map[string]string{
+			"transaction_id": tr.ID.String(),
+			"buyer_id":       tr.BuyerID.String(),
+		},
+	})
+	if errors.Is(err, payments.ErrPaymentDeclined) {
+		return failOverageCharge(tr, err.Error(), uow)
+	}
+	if err != nil {
+		return err
+	}
+	if p.Status != payments.PaymentStatusSucceeded {
+		// Record the payment so it is not charged again while it settles.
+		tr.StripePaymentIntentID = p.ID
+		err := uow.Repos().Transactions.UpdateFromStatus(tr, models.StatusRequiresPayment)
+		if errors.Is(err, repos.ErrTransactionStatusConflict) {
+			// The webhook settled it first.
+			return nil
+		}
+		return err
+	}
+	return completeOverageCharge(tr, p.ID, uow)
+}
+
+// SettleOverageCharge finishes an overage charge that was still settling
+// when it was made, from its payment_intent.succeeded or
+// payment_intent.payment_failed event. Payments that are not overage
+// charges, and charges already settled, are ignored.
+func SettleOverageCharge(p *payments.Payment, succeeded bool, uow repos.UnitOfWork) error {
+	rs := uow.Repos()
+	var tr *models.TransactionRecord
+	var err error
+	if id, parseErr := uuid.Parse(p.Metadata["transaction_id"]); parseErr == nil {
+		tr, err = rs.Transactions.FindByID(id)
+	} else {
+		tr, err = rs.Transactions.FindByStripePaymentIntentID(p.ID)
+	}
+	if errors.Is(err, repos.ErrTransactionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if tr.Kind != models.KindOverage || tr.TransactionStatus != models.StatusRequiresPayment {
+		return nil
+	}
+
+	if succeeded {
+		err = completeOverageCharge(tr, p.ID, uow)
+	} else {
+		reason := p.FailureMessage
+		if reason == "" {
+			reason = payments.ErrPaymentDeclined.Error()
+		}
+		err = failOverageCharge(tr, reason, uow)
+	}
+	if errors.Is(err, repos.ErrTransactionStatusConflict) {
+		return nil
+	}
+	return err
+}
+
+// completeOverageCharge records the payment that paid for an overage
+// transaction.
+func completeOverageCharge(tr *models.TransactionRecord, paymentIntentID string, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		tr.StripePaymentIntentID = paymentIntentID
+		if err := lifecycle.TransitionTransaction(tx.Transactions, tr, models.StatusPaid, ""); err != nil {
+			return err
+		}
+		return lifecycle.TransitionTransaction(tx.Transactions, tr, models.StatusFulfilled, "")
+	})
+}
+
+// failOverageCharge fails an overage transaction whose charge was
+// declined and puts its reads back to unbilled.
+func failOverageCharge(tr *models.TransactionRecord, reason string, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		if err := unbillOverage(tr.ID, tx); err != nil {
+			return err
+		}
+		return lifecycle.TransitionTransaction(tx.Transactions, tr, models.StatusFailed, reason)
+	})
+}
+
+// unbillOverage puts the reads on a failed overage transaction back to
+// unbilled. Contracts that have since started again with a new owner are
+// left alone.
+func unbillOverage(transactionID uuid.UUID, tx *repos.Repos) error {
+	lines, err := tx.OverageLines.FindAllByTransactionIDs([]uuid.UUID{transactionID})
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		state, err := tx.States.FindByID(line.HeaderID)
+		if err != nil {
+			return err
+		}
+		if state.OverageReadsBilled < line.Reads {
+			continue
+		}
+		err = tx.States.MarkOverageBilled(state.HeaderID, state.OverageReadsBilled, state.OverageReadsBilled-line.Reads)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartOverageBiller runs BillOverage on every tick of clk until the
+// returned stop function is called.
+func StartOverageBiller(
+	interval time.Duration,
+	clk clock.Clock,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (stop func()) {
+
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := BillOverage(provider, uow)
+				if err != nil {
+					log.Printf("overage billing failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("charged overage to %d buyers", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// OverageInvoice is an overage charge broken down by contract.
+type OverageInvoice struct {
+	TransactionID    uuid.UUID                `json:"transaction_id"`
+	ListingID        uuid.UUID                `json:"listing_id"`
+	SellerID         uuid.UUID                `json:"seller_id"`
+	Status           models.TransactionStatus `json:"status"`
+	Currency         string                   `json:"currency"`
+	Reads            int64                    `json:"reads"`
+	TotalCents       uint64                   `json:"total_cents"`
+	PlatformFeeCents int64                    `json:"platform_fee_cents"`
+	Lines            []models.OverageLine     `json:"lines"`
+	IssuedAt         time.Time                `json:"issued_at"`
+	PaidAt           *time.Time               `json:"paid_at,omitempty"`
+	FailureReason    string                   `json:"failure_reason,omitempty"`
+}
+
+func NewOverageInvoice(tr *models.TransactionRecord, lines []models.OverageLine) *OverageInvoice {
+	if lines == nil {
+		lines = []models.OverageLine{}
+	}
+	return &OverageInvoice{
+		TransactionID:    tr.ID,
+		ListingID:        tr.ListingID,
+		SellerID:         tr.SellerID,
+		Status:           tr.TransactionStatus,
+		Currency:         tr.Currency,
+		Reads:            tr.PurchaseQuantity,
+		TotalCents:       tr.PurchaseCents,
+		PlatformFeeCents: tr.PlatformFeeCents,
+		Lines:            lines,
+		IssuedAt:         tr.InitiatedAt,
+		PaidAt:           tr.PaidAt,
+		FailureReason:    tr.FailureReason,
+	}
+}
+
+// OverageInvoicesHandler serves GET /v1/overage/invoices, the caller's
+// overage charges newest first.
+func OverageInvoicesHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		records, err := rs.Transactions.FindAllByBuyerIDAndKind(u.ID, models.KindOverage)
+		if err != nil {
+			http.Error(w, "failed to fetch invoices: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids := make([]uuid.UUID, len(records))
+		for i := range records {
+			ids[i] = records[i].ID
+		}
+		lines, err := rs.OverageLines.FindAllByTransactionIDs(ids)
+		if err != nil {
+			http.Error(w, "failed to fetch invoice lines: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byTransaction := map[uuid.UUID][]models.OverageLine{}
+		for _, line := range lines {
+			byTransaction[line.TransactionID] = append(byTransaction[line.TransactionID], line)
+		}
+
+		invoices := make([]*OverageInvoice, len(records))
+		for i := range records {
+			invoices[i] = NewOverageInvoice(&records[i], byTransaction[records[i].ID])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(invoices)
+	}
+}
+
+type OverageCapRequest struct {
+	// CapCents is the most the owner will pay for reads past the quota in
+	// one overage billing period. Zero turns overage off.
+	CapCents int64 `json:"cap_cents"`
+}
+
+// ContractOverageCapHandler serves PUT /v1/contracts/{id}/overage, where
+// the owner sets their overage spending cap, and answers with the updated
+// usage.
+func ContractOverageCapHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, header, state, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+		if state.OwnerID != u.ID {
+			http.Error(w, "only the owner may set the overage cap", http.StatusForbidden)
+			return
+		}
+
+		req := &OverageCapRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.CapCents < 0 || req.CapCents > maxOverageCapCents {
+			http.Error(w, fmt.Sprintf("cap_cents must be between 0 and %d", maxOverageCapCents), http.StatusBadRequest)
+			return
+		}
+		if header.OverageReadPriceNanos <= 0 {
+			http.Error(w, "contract has no overage price", http.StatusConflict)
+			return
+		}
+		if req.CapCents > 0 && (u.StripeCustomerID == "" || u.StripePaymentMethodID == "") {
+			http.Error(w, errNoPaymentMethod.Error(), http.StatusConflict)
+			return
+		}
+
+		rs := uow.Repos()
+		err := rs.States.SetOverageCap(header.ID, u.ID, req.CapCents)
+		if errors.Is(err, repos.ErrContractStatusConflict) {
+			http.Error(w, "contract changed hands concurrently", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to set overage cap: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		state, err = rs.States.FindByID(header.ID)
+		if err != nil {
+			http.Error(w, "contract not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(NewUsageReport(header, state))
+	}
+}
+
+// PaymentMethodSetupHandler serves POST /v1/me/payment-method. It answers
+// with a page where the caller saves the payment method overage is charged
+// to, replacing any saved before.
+func PaymentMethodSetupHandler(provider payments.PaymentProvider, userRepo repos.UserRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, userRepo)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if u.StripeCustomerID == "" {
+			c, err := provider.CreateCustomer(&payments.CustomerParams{
+				Email:    u.Email,
+				Metadata: map[string]string{"user_id": u.ID.String()},
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			u.StripeCustomerID = c.ID
+			if err := userRepo.Update(u); err != nil {
+				http.Error(w, "failed to store customer: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		s, err := provider.CreateSetupSession(&payments.SetupSessionParams{
+			CustomerID:        u.StripeCustomerID,
+			Currency:          os.Getenv("CURRENCY"),
+			ClientReferenceID: u.ID.String(),
+			SuccessURL:        os.Getenv("STRIPE_SETUP_SUCCESS_URL"),
+			CancelURL:         os.Getenv("STRIPE_SETUP_CANCEL_URL"),
+			Metadata:          map[string]string{"user_id": u.ID.String()},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"url": s.URL})
+	}
+}
+
+// SavePaymentMethod stores the payment method a completed setup session
+// saved as its customer's method for overage charges.
+func SavePaymentMethod(s *payments.CheckoutSession, userRepo repos.UserRepository) error {
+	if s.PaymentMethodID == "" {
+		return nil
+	}
+	u, err := userRepo.FindByStripeCustomerID(s.CustomerID)
+	if err != nil {
+		return err
+	}
+	u.StripePaymentMethodID = s.PaymentMethodID
+	return userRepo.Update(u)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+
+	"github.com/google/uuid"
+)
+
+// overageContract sells the buyer one contract with a 1 cent overage price
+// and a saved payment method, and records reads of overage on it.
+func (m *testMarket) overageContract(t *testing.T, reads uint64) *models.ContractState {
+	t.Helper()
+	listing := m.listing(t, &ListingParams{SupplyLimit: 1, QuotaReads: 10, OverageReadPriceNanos: 10_000_000})
+	m.buy(t, listing.ID, 1)
+
+	customer, err := m.provider.CreateCustomer(&payments.CustomerParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.buyer.StripeCustomerID = customer.ID
+	if err := m.uow.Repos().Users.Update(m.buyer); err != nil {
+		t.Fatal(err)
+	}
+	session, err := m.provider.CreateSetupSession(&payments.SetupSessionParams{CustomerID: customer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.provider.CompleteCheckoutSession(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	m.buyer = m.user(t, "buyer")
+
+	state := &m.owned(t, m.buyer)[0]
+	state.OverageReads = reads
+	if err := m.uow.Repos().States.Update(state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func (m *testMarket) overageTransactions(t *testing.T) []models.TransactionRecord {
+	t.Helper()
+	records, err := m.uow.Repos().Transactions.FindAllByKindAndStatus(
+		models.KindOverage, models.StatusRequiresPayment, overageBillingBatchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func (m *testMarket) state(t *testing.T, state *models.ContractState) *models.ContractState {
+	t.Helper()
+	state, err := m.uow.Repos().States.FindByID(state.HeaderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestSmallOverageChargedBeforeListing(t *testing.T) {
+	m := newTestMarket(t)
+	state := m.overageContract(t, 3)
+
+	if n, err := BillOverage(m.provider, m.uow); err != nil || n != 0 {
+		t.Fatalf("BillOverage charged %d (%v) for 3 cents of overage", n, err)
+	}
+
+	m.provider.DeclinePaymentMethod(m.buyer.StripePaymentMethodID, true)
+	err := BillOverageBeforeListing(m.buyer.ID, []uuid.UUID{state.HeaderID}, m.provider, m.uow)
+	if !errors.Is(err, errOverageUnpaid) {
+		t.Fatalf("declined card: %v", err)
+	}
+	if s := m.state(t, state); s.OverageReadsBilled != 0 {
+		t.Fatalf("%d reads billed after a declined charge", s.OverageReadsBilled)
+	}
+
+	m.provider.DeclinePaymentMethod(m.buyer.StripePaymentMethodID, false)
+	if err := BillOverageBeforeListing(m.buyer.ID, []uuid.UUID{state.HeaderID}, m.provider, m.uow); err != nil {
+		t.Fatal(err)
+	}
+	charges := m.provider.Charges()
+	if len(charges) != 1 || charges[0].AmountCents != 3 {
+		t.Fatalf("charges %+v, want one of 3 cents", charges)
+	}
+	if s := m.state(t, state); s.OverageReadsBilled != 3 {
+		t.Fatalf("%d reads billed, want 3", s.OverageReadsBilled)
+	}
+}
+
+func TestProcessingOverageChargeSettledByWebhook(t *testing.T) {
+	for _, succeeded := range []bool{true, false} {
+		m := newTestMarket(t)
+		state := m.overageContract(t, 100)
+		m.provider.DelayPaymentMethod(m.buyer.StripePaymentMethodID, true)
+
+		if _, err := BillOverage(m.provider, m.uow); err != nil {
+			t.Fatal(err)
+		}
+		pending := m.overageTransactions(t)
+		if len(pending) != 1 || pending[0].StripePaymentIntentID == "" {
+			t.Fatalf("processing charge left %+v", pending)
+		}
+		// The next run must not charge again while the first settles.
+		if _, err := BillOverage(m.provider, m.uow); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(m.provider.Charges()); n != 1 {
+			t.Fatalf("%d charges while the first was processing", n)
+		}
+
+		if _, err := m.provider.SettlePayment(pending[0].StripePaymentIntentID, succeeded); err != nil {
+			t.Fatal(err)
+		}
+		tr := m.transaction(t, pending[0].ID)
+		billed := m.state(t, state).OverageReadsBilled
+		switch {
+		case succeeded && (tr.TransactionStatus != models.StatusFulfilled || billed != 100):
+			t.Errorf("settled charge: transaction %s, %d reads billed", tr.TransactionStatus, billed)
+		case !succeeded && (tr.TransactionStatus != models.StatusFailed || billed != 0):
+			t.Errorf("failed charge: transaction %s, %d reads billed", tr.TransactionStatus, billed)
+		}
+	}
+}
+
+func TestOverageReadsLeftCountsUnbilledReadsOnly(t *testing.T) {
+	cases := []struct {
+		name                string
+		capCents            int64
+		priceNanos          int64
+		reads, billed, want uint64
+	}{
+		{"cap reached", 100, 10_000_000, 100, 0, 0},
+		{"cap reached then billed", 100, 10_000_000, 100, 100, 100},
+		{"part of the next period used", 100, 10_000_000, 150, 100, 50},
+		{"no cap", 0, 10_000_000, 0, 0, 0},
+		{"cap too large to count", math.MaxInt64, 1, 5, 0, math.MaxUint64 - 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			header := &models.ContractHeader{OverageReadPriceNanos: c.priceNanos}
+			state := &models.ContractState{OverageCapCents: c.capCents, OverageReads: c.reads, OverageReadsBilled: c.billed}
+			if got := overageReadsLeft(header, state); got != c.want {
+				t.Errorf("overageReadsLeft = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,756 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const FakeWebhookSecret = "whsec_fake"
+
+// FakeProvider is an in-memory PaymentProvider. IDs are handed out from a
+// single counter, so the same sequence of calls always yields the same IDs.
+// Simulated webhook events are passed to the function registered with
+// OnEvent, and can also be encoded with SignedPayload for delivery over HTTP.
+type FakeProvider struct {
+	mu sync.Mutex
+
+	seq     int
+	baseURL string
+
+	sessions       map[string]*CheckoutSession
+	sessionParams  map[string]*CheckoutSessionParams
+	accounts       map[string]*Account
+	paymentIntents map[string]int64
+	// amounts is what each payment intent took, before any refunds.
+	amounts       map[string]int64
+	refunds       []*Refund
+	refundKeys    map[string]*Refund
+	disputes      map[string]*Dispute
+	transfers     []*Transfer
+	transferKeys  map[string]*Transfer
+	subscriptions map[string]*fakeSubscription
+	// customers maps each customer to its saved payment method, if any.
+	customers  map[string]string
+	declined   map[string]bool
+	delayed    map[string]bool
+	charges    []*Payment
+	chargeKeys map[string]*Payment
+
+	onEvent func(*Event) error
+}
+
+// NewFakeProvider builds a fake whose checkout URLs point at baseURL, where
+// CheckoutPageHandler can be mounted to complete sessions from a browser.
+func NewFakeProvider(baseURL string) *FakeProvider {
+	return &FakeProvider{
+		baseURL:        strings.TrimSuffix(baseURL, "/"),
+		sessions:       map[string]*CheckoutSession{},
+		sessionParams:  map[string]*CheckoutSessionParams{},
+		accounts:       map[string]*Account{},
+		paymentIntents: map[string]int64{},
+		amounts:        map[string]int64{},
+		refundKeys:     map[string]*Refund{},
+		disputes:       map[string]*Dispute{},
+		transferKeys:   map[string]*Transfer{},
+		subscriptions:  map[string]*fakeSubscription{},
+		customers:      map[string]string{},
+		declined:       map[string]bool{},
+		delayed:        map[string]bool{},
+		chargeKeys:     map[string]*Payment{},
+	}
+}
+
+// fakeSubscription is a subscription and the checkout that started it,
+// which sets what each renewal charges.
+type fakeSubscription struct {
+	sub    *Subscription
+	params *CheckoutSessionParams
+}
+
+// OnEvent registers the receiver for simulated webhook events.
+func (f *FakeProvider) OnEvent(fn func(*Event) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onEvent = fn
+}
+
+func (f *FakeProvider) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%06d", prefix, f.seq)
+}
+
+func (f *FakeProvider) CreateCheckoutSession(params *CheckoutSessionParams) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID("cs")
+	s := &CheckoutSession{
+		ID:                id,
+		URL:               f.baseURL + "/fake/checkout/" + id,
+		ClientReferenceID: params.ClientReferenceID,
+		Status:            "open",
+		AmountTotalCents:  params.UnitAmountCents * params.Quantity,
+		Metadata:          params.Metadata,
+	}
+	f.sessions[id] = s
+	f.sessionParams[id] = params
+
+	out := *s
+	return &out, nil
+}
+
+func (f *FakeProvider) RetrieveCheckoutSession(id string) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, ErrCheckoutSessionNotFound
+	}
+	out := *s
+	return &out, nil
+}
+
+// CheckoutSessionParams returns the parameters a session was created with.
+func (f *FakeProvider) CheckoutSessionParams(id string) (*CheckoutSessionParams, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	params, ok := f.sessionParams[id]
+	if !ok {
+		return nil, ErrCheckoutSessionNotFound
+	}
+	return params, nil
+}
+
+func (f *FakeProvider) CreateConnectedAccount(params *AccountParams) (*Account, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	acct := &Account{ID: f.nextID("acct")}
+	f.accounts[acct.ID] = acct
+
+	out := *acct
+	return &out, nil
+}
+
+func (f *FakeProvider) RetrieveAccount(id string) (*Account, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	acct, ok := f.accounts[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	out := *acct
+	return &out, nil
+}
+
+func (f *FakeProvider) CreateOnboardingLink(params *OnboardingLinkParams) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.accounts[params.AccountID]; !ok {
+		return "", ErrAccountNotFound
+	}
+	return f.baseURL + "/fake/onboard/" + params.AccountID, nil
+}
+
+func (f *FakeProvider) Refund(params *RefundParams) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.refund(params)
+}
+
+func (f *FakeProvider) refund(params *RefundParams) (*Refund, error) {
+	if re, ok := f.refundKeys[params.IdempotencyKey]; ok {
+		out := *re
+		return &out, nil
+	}
+	for _, d := range f.disputes {
+		// The disputed funds are already on their way back to the buyer.
+		if d.PaymentIntentID == params.PaymentIntentID && d.Status != DisputeStatusWon &&
+			d.Status != DisputeStatusWarningClosed {
+			return nil, fmt.Errorf("payment %s is disputed", params.PaymentIntentID)
+		}
+	}
+	paid, ok := f.paymentIntents[params.PaymentIntentID]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	amount := params.AmountCents
+	if amount == 0 {
+		amount = paid
+	}
+	if amount > paid {
+		return nil, fmt.Errorf("refund of %d exceeds remaining %d", amount, paid)
+	}
+	f.paymentIntents[params.PaymentIntentID] = paid - amount
+
+	re := &Refund{
+		ID:              f.nextID("re"),
+		PaymentIntentID: params.PaymentIntentID,
+		AmountCents:     amount,
+		Status:          "succeeded",
+	}
+	f.refunds = append(f.refunds, re)
+	if params.IdempotencyKey != "" {
+		f.refundKeys[params.IdempotencyKey] = re
+	}
+
+	out := *re
+	return &out, nil
+}
+
+// Refunds lists every refund issued so far, oldest first.
+func (f *FakeProvider) Refunds() []Refund {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]Refund, len(f.refunds))
+	for i, re := range f.refunds {
+		out[i] = *re
+	}
+	return out
+}
+
+func (f *FakeProvider) CreateTransfer(params *TransferParams) (*Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if tr, ok := f.transferKeys[params.IdempotencyKey]; ok {
+		out := *tr
+		return &out, nil
+	}
+	if _, ok := f.accounts[params.DestinationAccountID]; !ok {
+		return nil, ErrAccountNotFound
+	}
+	if params.AmountCents <= 0 {
+		return nil, fmt.Errorf("transfer amount must be positive, got %d", params.AmountCents)
+	}
+
+	tr := &Transfer{
+		ID:                   f.nextID("tr"),
+		AmountCents:          params.AmountCents,
+		DestinationAccountID: params.DestinationAccountID,
+	}
+	f.transfers = append(f.transfers, tr)
+	if params.IdempotencyKey != "" {
+		f.transferKeys[params.IdempotencyKey] = tr
+	}
+
+	out := *tr
+	return &out, nil
+}
+
+// Transfers lists every transfer made so far, oldest first.
+func (f *FakeProvider) Transfers() []Transfer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]Transfer, len(f.transfers))
+	for i, tr := range f.transfers {
+		out[i] = *tr
+	}
+	return out
+}
+
+func (f *FakeProvider) RetrieveSubscription(id string) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, ok := f.subscriptions[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	out := *fs.sub
+	return &out, nil
+}
+
+func (f *FakeProvider) CancelSubscription(id string, atPeriodEnd bool) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs, ok := f.subscriptions[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	if atPeriodEnd {
+		fs.sub.CancelAtPeriodEnd = true
+	} else {
+		fs.sub.Status = "canceled"
+	}
+	out := *fs.sub
+	return &out, nil
+}
+
+func (f *FakeProvider) CreateCustomer(params *CustomerParams) (*Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := &Customer{ID: f.nextID("cus")}
+	f.customers[c.ID] = ""
+	return c, nil
+}
+
+func (f *FakeProvider) CreateSetupSession(params *SetupSessionParams) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.customers[params.CustomerID]; !ok {
+		return nil, ErrCustomerNotFound
+	}
+	id := f.nextID("cs")
+	s := &CheckoutSession{
+		ID:                id,
+		URL:               f.baseURL + "/fake/checkout/" + id,
+		ClientReferenceID: params.ClientReferenceID,
+		Status:            "open",
+		Metadata:          params.Metadata,
+		Mode:              CheckoutModeSetup,
+		CustomerID:        params.CustomerID,
+	}
+	f.sessions[id] = s
+
+	out := *s
+	return &out, nil
+}
+
+func (f *FakeProvider) ChargeSavedPaymentMethod(params *SavedPaymentParams) (*Payment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p, ok := f.chargeKeys[params.IdempotencyKey]; ok {
+		out := *p
+		return &out, nil
+	}
+	saved, ok := f.customers[params.CustomerID]
+	if !ok {
+		return nil, ErrCustomerNotFound
+	}
+	if saved == "" || saved != params.PaymentMethodID {
+		return nil, fmt.Errorf("payment method %s is not saved to customer %s", params.PaymentMethodID, params.CustomerID)
+	}
+	if _, ok := f.accounts[params.DestinationAccountID]; !ok {
+		return nil, ErrAccountNotFound
+	}
+	if params.AmountCents <= 0 {
+		return nil, fmt.Errorf("charge amount must be positive, got %d", params.AmountCents)
+	}
+	if f.declined[params.PaymentMethodID] {
+		return nil, fmt.Errorf("%w: your card was declined", ErrPaymentDeclined)
+	}
+
+	p := &Payment{
+		ID:          f.nextID("pi"),
+		AmountCents: params.AmountCents,
+		Status:      PaymentStatusSucceeded,
+		Metadata:    params.Metadata,
+	}
+	if f.delayed[params.PaymentMethodID] {
+		p.Status = "processing"
+	} else {
+		f.paymentIntents[p.ID] = p.AmountCents
+		f.amounts[p.ID] = p.AmountCents
+	}
+	f.charges = append(f.charges, p)
+	if params.IdempotencyKey != "" {
+		f.chargeKeys[params.IdempotencyKey] = p
+	}
+
+	out := *p
+	return &out, nil
+}
+
+// Charges lists every charge of a saved payment method so far, oldest
+// first.
+func (f *FakeProvider) Charges() []Payment {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]Payment, len(f.charges))
+	for i, p := range f.charges {
+		out[i] = *p
+	}
+	return out
+}
+
+// DeclinePaymentMethod makes every later charge of a saved payment method
+// fail, or succeed again when declined is false.
+func (f *FakeProvider) DeclinePaymentMethod(id string, declined bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.declined[id] = declined
+}
+
+// DelayPaymentMethod leaves every later charge of a saved payment method
+// processing until SettlePayment, or goes back to charging at once when
+// delayed is false.
+func (f *FakeProvider) DelayPaymentMethod(id string, delayed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.delayed[id] = delayed
+}
+
+// SettlePayment finishes a processing charge, either way, and emits
+// payment_intent.succeeded or payment_intent.payment_failed.
+func (f *FakeProvider) SettlePayment(paymentIntentID string, succeeded bool) (*Event, error) {
+	f.mu.Lock()
+	var p *Payment
+	for _, c := range f.charges {
+		if c.ID == paymentIntentID {
+			p = c
+		}
+	}
+	if p == nil {
+		f.mu.Unlock()
+		return nil, ErrPaymentNotFound
+	}
+	if p.Status != "processing" {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("payment %s is %s", paymentIntentID, p.Status)
+	}
+	ev := &Event{ID: f.nextID("evt"), Type: EventPaymentIntentSucceeded}
+	if succeeded {
+		p.Status = PaymentStatusSucceeded
+		f.paymentIntents[p.ID] = p.AmountCents
+		f.amounts[p.ID] = p.AmountCents
+	} else {
+		p.Status = "requires_payment_method"
+		p.FailureMessage = "your card was declined"
+		ev.Type = EventPaymentIntentPaymentFailed
+	}
+	snapshot := *p
+	ev.PaymentIntent = &snapshot
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+func (f *FakeProvider) ConstructEvent(payload []byte, signature string) (*Event, error) {
+	if !hmac.Equal([]byte(signature), []byte(fakeSignature(payload))) {
+		return nil, ErrInvalidSignature
+	}
+	var ev Event
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// SignedPayload encodes ev the way the fake expects to receive it in
+// ConstructEvent, returning the body and the signature header value.
+func (f *FakeProvider) SignedPayload(ev *Event) ([]byte, string, error) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, fakeSignature(payload), nil
+}
+
+func fakeSignature(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(FakeWebhookSecret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CompleteCheckoutSession pays for an open session, or saves a payment
+// method for a setup session, and emits checkout.session.completed.
+func (f *FakeProvider) CompleteCheckoutSession(id string) (*Event, error) {
+	f.mu.Lock()
+	s, ok := f.sessions[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrCheckoutSessionNotFound
+	}
+	if s.Status != "open" {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("checkout session %s is %s", id, s.Status)
+	}
+	s.Status = "complete"
+	params := f.sessionParams[id]
+	switch {
+	case s.Mode == CheckoutModeSetup:
+		s.PaymentMethodID = f.nextID("pm")
+		f.customers[s.CustomerID] = s.PaymentMethodID
+	case params != nil && params.Recurring != nil:
+		// As with Stripe, the session of a subscription has no payment
+		// intent; the one paying the first invoice is on the subscription.
+		s.Paid = true
+		sub := &Subscription{
+			ID:                    f.nextID("sub"),
+			Status:                "active",
+			CurrentPeriodEnd:      params.Recurring.PeriodEnd(time.Now()),
+			LatestPaymentIntentID: f.nextID("pi"),
+		}
+		f.paymentIntents[sub.LatestPaymentIntentID] = s.AmountTotalCents
+		f.amounts[sub.LatestPaymentIntentID] = s.AmountTotalCents
+		f.subscriptions[sub.ID] = &fakeSubscription{sub: sub, params: params}
+		s.SubscriptionID = sub.ID
+	default:
+		s.Paid = true
+		s.PaymentIntentID = f.nextID("pi")
+		f.paymentIntents[s.PaymentIntentID] = s.AmountTotalCents
+		f.amounts[s.PaymentIntentID] = s.AmountTotalCents
+	}
+
+	snapshot := *s
+	ev := &Event{ID: f.nextID("evt"), Type: EventCheckoutSessionCompleted, CheckoutSession: &snapshot}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// ExpireCheckoutSession abandons an open session and emits
+// checkout.session.expired.
+func (f *FakeProvider) ExpireCheckoutSession(id string) (*Event, error) {
+	f.mu.Lock()
+	s, ok := f.sessions[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrCheckoutSessionNotFound
+	}
+	if s.Status != "open" {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("checkout session %s is %s", id, s.Status)
+	}
+	s.Status = "expired"
+
+	snapshot := *s
+	ev := &Event{ID: f.nextID("evt"), Type: EventCheckoutSessionExpired, CheckoutSession: &snapshot}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// UpdateAccount changes a connected account's capabilities and emits
+// account.updated.
+func (f *FakeProvider) UpdateAccount(id string, chargesEnabled, payoutsEnabled, detailsSubmitted bool) (*Event, error) {
+	f.mu.Lock()
+	acct, ok := f.accounts[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrAccountNotFound
+	}
+	acct.ChargesEnabled = chargesEnabled
+	acct.PayoutsEnabled = payoutsEnabled
+	acct.DetailsSubmitted = detailsSubmitted
+
+	snapshot := *acct
+	ev := &Event{ID: f.nextID("evt"), Type: EventAccountUpdated, Account: &snapshot}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// RenewSubscription bills an active subscription for its next period and
+// emits invoice.paid. A subscription set to cancel at the end of its
+// period ends instead, emitting customer.subscription.deleted.
+func (f *FakeProvider) RenewSubscription(id string) (*Event, error) {
+	f.mu.Lock()
+	fs, ok := f.subscriptions[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrSubscriptionNotFound
+	}
+	if fs.sub.Status != "active" && fs.sub.Status != "past_due" {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("subscription %s is %s", id, fs.sub.Status)
+	}
+	if fs.sub.CancelAtPeriodEnd {
+		f.mu.Unlock()
+		return f.EndSubscription(id)
+	}
+
+	fs.sub.Status = "active"
+	fs.sub.CurrentPeriodEnd = fs.params.Recurring.PeriodEnd(fs.sub.CurrentPeriodEnd)
+	fs.sub.LatestPaymentIntentID = f.nextID("pi")
+	f.paymentIntents[fs.sub.LatestPaymentIntentID] = fs.params.UnitAmountCents * fs.params.Quantity
+	f.amounts[fs.sub.LatestPaymentIntentID] = fs.params.UnitAmountCents * fs.params.Quantity
+	inv := &Invoice{
+		ID:              f.nextID("in"),
+		SubscriptionID:  id,
+		BillingReason:   "subscription_cycle",
+		Currency:        fs.params.Currency,
+		AmountPaidCents: fs.params.UnitAmountCents * fs.params.Quantity,
+		PeriodEnd:       fs.sub.CurrentPeriodEnd,
+	}
+	ev := &Event{ID: f.nextID("evt"), Type: EventInvoicePaid, Invoice: inv}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// FailSubscriptionRenewal fails to bill an active subscription for its
+// next period and emits invoice.payment_failed.
+func (f *FakeProvider) FailSubscriptionRenewal(id string) (*Event, error) {
+	f.mu.Lock()
+	fs, ok := f.subscriptions[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrSubscriptionNotFound
+	}
+	if fs.sub.Status != "active" && fs.sub.Status != "past_due" {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("subscription %s is %s", id, fs.sub.Status)
+	}
+
+	fs.sub.Status = "past_due"
+	inv := &Invoice{
+		ID:             f.nextID("in"),
+		SubscriptionID: id,
+		BillingReason:  "subscription_cycle",
+		Currency:       fs.params.Currency,
+		PeriodEnd:      fs.params.Recurring.PeriodEnd(fs.sub.CurrentPeriodEnd),
+	}
+	ev := &Event{ID: f.nextID("evt"), Type: EventInvoicePaymentFailed, Invoice: inv}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// EndSubscription ends a subscription and emits
+// customer.subscription.deleted.
+func (f *FakeProvider) EndSubscription(id string) (*Event, error) {
+	f.mu.Lock()
+	fs, ok := f.subscriptions[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrSubscriptionNotFound
+	}
+	fs.sub.Status = "canceled"
+
+	snapshot := *fs.sub
+	ev := &Event{ID: f.nextID("evt"), Type: EventSubscriptionDeleted, Subscription: &snapshot}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// RefundPayment refunds amountCents of a payment, or all that is left of
+// it for zero, the way a refund from the dashboard would, and emits
+// charge.refunded.
+func (f *FakeProvider) RefundPayment(paymentIntentID string, amountCents int64) (*Event, error) {
+	f.mu.Lock()
+	_, err := f.refund(&RefundParams{PaymentIntentID: paymentIntentID, AmountCents: amountCents})
+	if err != nil {
+		f.mu.Unlock()
+		return nil, err
+	}
+	ev := &Event{ID: f.nextID("evt"), Type: EventChargeRefunded, Charge: f.charge(paymentIntentID)}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// charge describes a payment intent as the charge it made.
+func (f *FakeProvider) charge(paymentIntentID string) *Charge {
+	return &Charge{
+		ID:                  "ch" + strings.TrimPrefix(paymentIntentID, "pi"),
+		PaymentIntentID:     paymentIntentID,
+		AmountCents:         f.amounts[paymentIntentID],
+		AmountRefundedCents: f.amounts[paymentIntentID] - f.paymentIntents[paymentIntentID],
+	}
+}
+
+// OpenDispute has the buyer's bank dispute a payment and emits
+// charge.dispute.created.
+func (f *FakeProvider) OpenDispute(paymentIntentID, reason string) (*Event, error) {
+	f.mu.Lock()
+	remaining, ok := f.paymentIntents[paymentIntentID]
+	if !ok {
+		f.mu.Unlock()
+		return nil, ErrPaymentNotFound
+	}
+	d := &Dispute{
+		ID:              f.nextID("dp"),
+		ChargeID:        f.charge(paymentIntentID).ID,
+		PaymentIntentID: paymentIntentID,
+		AmountCents:     remaining,
+		Reason:          reason,
+		Status:          "needs_response",
+	}
+	f.disputes[d.ID] = d
+
+	snapshot := *d
+	ev := &Event{ID: f.nextID("evt"), Type: EventChargeDisputeCreated, Dispute: &snapshot}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// CloseDispute settles an open dispute for or against the seller and
+// emits charge.dispute.closed. A payment that lost its dispute can no
+// longer be refunded.
+func (f *FakeProvider) CloseDispute(id string, won bool) (*Event, error) {
+	f.mu.Lock()
+	d, ok := f.disputes[id]
+	if !ok {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("dispute %s not found", id)
+	}
+	if d.Status == DisputeStatusWon || d.Status == DisputeStatusLost {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("dispute %s is %s", id, d.Status)
+	}
+	if won {
+		d.Status = DisputeStatusWon
+	} else {
+		d.Status = DisputeStatusLost
+	}
+
+	snapshot := *d
+	ev := &Event{ID: f.nextID("evt"), Type: EventChargeDisputeClosed, Dispute: &snapshot}
+	f.mu.Unlock()
+
+	return ev, f.emit(ev)
+}
+
+// Redeliver sends an already emitted event again, the way Stripe retries
+// deliveries it did not see acknowledged.
+func (f *FakeProvider) Redeliver(ev *Event) error {
+	return f.emit(ev)
+}
+
+func (f *FakeProvider) emit(ev *Event) error {
+	f.mu.Lock()
+	fn := f.onEvent
+	f.mu.Unlock()
+
+	if fn == nil {
+		return nil
+	}
+	return fn(ev)
+}
+
+// CheckoutPageHandler stands in for the hosted checkout page: visiting a
+// session URL completes the payment, and onboarding URLs enable the account.
+func (f *FakeProvider) CheckoutPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/fake/checkout/"):
+			_, err = f.CompleteCheckoutSession(strings.TrimPrefix(r.URL.Path, "/fake/checkout/"))
+		case strings.HasPrefix(r.URL.Path, "/fake/onboard/"):
+			_, err = f.UpdateAccount(strings.TrimPrefix(r.URL.Path, "/fake/onboard/"), true, true, true)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,298 @@
+package payments
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrCheckoutSessionNotFound = errors.New("checkout session not found")
+	ErrAccountNotFound         = errors.New("connected account not found")
+	ErrPaymentNotFound         = errors.New("payment not found")
+	ErrSubscriptionNotFound    = errors.New("subscription not found")
+	ErrCustomerNotFound        = errors.New("customer not found")
+	ErrPaymentDeclined         = errors.New("payment declined")
+	ErrInvalidSignature        = errors.New("invalid webhook signature")
+)
+
+const (
+	EventCheckoutSessionCompleted             = "checkout.session.completed"
+	EventCheckoutSessionAsyncPaymentSucceeded = "checkout.session.async_payment_succeeded"
+	EventCheckoutSessionExpired               = "checkout.session.expired"
+	EventAccountUpdated                       = "account.updated"
+	EventInvoicePaid                          = "invoice.paid"
+	EventInvoicePaymentFailed                 = "invoice.payment_failed"
+	EventSubscriptionDeleted                  = "customer.subscription.deleted"
+	EventChargeRefunded                       = "charge.refunded"
+	EventChargeDisputeCreated                 = "charge.dispute.created"
+	EventChargeDisputeClosed                  = "charge.dispute.closed"
+	EventPaymentIntentSucceeded               = "payment_intent.succeeded"
+	EventPaymentIntentPaymentFailed           = "payment_intent.payment_failed"
+)
+
+// PaymentStatusSucceeded is the status of a payment that has gone
+// through. Any other status on a charge that did not fail is still
+// settling, and ends in a payment_intent.succeeded or
+// payment_intent.payment_failed event.
+const PaymentStatusSucceeded = "succeeded"
+
+// Dispute statuses a closed dispute ends in. A warning_closed inquiry
+// never became a chargeback, so it counts as won.
+const (
+	DisputeStatusWon           = "won"
+	DisputeStatusLost          = "lost"
+	DisputeStatusWarningClosed = "warning_closed"
+)
+
+// CheckoutModeSetup marks a checkout session that saves a payment method
+// for later instead of taking a payment.
+const CheckoutModeSetup = "setup"
+
+// BillingReasonSubscriptionCreate marks the invoice for a subscription's
+// first period, which is paid through its checkout session.
+const BillingReasonSubscriptionCreate = "subscription_create"
+
+// PaymentProvider is everything the marketplace needs from a payment
+// processor. Handlers depend on this rather than on the Stripe SDK so the
+// purchase flow can run against FakeProvider without network access.
+type PaymentProvider interface {
+	CreateCheckoutSession(params *CheckoutSessionParams) (*CheckoutSession, error)
+	RetrieveCheckoutSession(id string) (*CheckoutSession, error)
+
+	CreateConnectedAccount(params *AccountParams) (*Account, error)
+	RetrieveAccount(id string) (*Account, error)
+	CreateOnboardingLink(params *OnboardingLinkParams) (string, error)
+
+	Refund(params *RefundParams) (*Refund, error)
+	// CreateTransfer moves funds from the platform balance to a connected
+	// account.
+	CreateTransfer(params *TransferParams) (*Transfer, error)
+	// RetrieveSubscription looks up a subscription, along with the payment
+	// intent that paid its latest invoice.
+	RetrieveSubscription(id string) (*Subscription, error)
+	// CancelSubscription stops a subscription from renewing, either once
+	// its current period ends or at once.
+	CancelSubscription(id string, atPeriodEnd bool) (*Subscription, error)
+
+	CreateCustomer(params *CustomerParams) (*Customer, error)
+	// CreateSetupSession opens a checkout session that saves a payment
+	// method to a customer without charging it. The method is on the
+	// session in the checkout.session.completed event.
+	CreateSetupSession(params *SetupSessionParams) (*CheckoutSession, error)
+	// ChargeSavedPaymentMethod charges a saved payment method while the
+	// customer is away. A charge the card issuer refuses, or that needs the
+	// customer to authenticate, fails with ErrPaymentDeclined. A charge that
+	// is still settling is returned with its status instead.
+	ChargeSavedPaymentMethod(params *SavedPaymentParams) (*Payment, error)
+
+	// ConstructEvent verifies a webhook delivery and decodes it.
+	ConstructEvent(payload []byte, signature string) (*Event, error)
+}
+
+type CheckoutSessionParams struct {
+	ClientReferenceID    string
+	ProductName          string
+	Currency             string
+	UnitAmountCents      int64
+	Quantity             int64
+	ApplicationFeeCents  int64
+	DestinationAccountID string
+	SuccessURL           string
+	CancelURL            string
+	// ExpiresAt, when set, abandons the session at that time.
+	ExpiresAt time.Time
+	Metadata  map[string]string
+	// Recurring, when set, starts a subscription that charges the same
+	// amount every period instead of taking a one-off payment.
+	Recurring *Recurring
+}
+
+// Recurring bills every IntervalCount Intervals, where Interval is "day",
+// "week", "month" or "year".
+type Recurring struct {
+	Interval      string
+	IntervalCount int64
+}
+
+// PeriodEnd is when a billing period starting at start ends.
+func (r *Recurring) PeriodEnd(start time.Time) time.Time {
+	n := int(max(r.IntervalCount, 1))
+	switch r.Interval {
+	case "day":
+		return start.AddDate(0, 0, n)
+	case "week":
+		return start.AddDate(0, 0, 7*n)
+	case "year":
+		return start.AddDate(n, 0, 0)
+	default:
+		return start.AddDate(0, n, 0)
+	}
+}
+
+type CheckoutSession struct {
+	ID                string            `json:"id"`
+	URL               string            `json:"url"`
+	ClientReferenceID string            `json:"client_reference_id"`
+	PaymentIntentID   string            `json:"payment_intent_id"`
+	SubscriptionID    string            `json:"subscription_id,omitempty"`
+	Paid              bool              `json:"paid"`
+	Status            string            `json:"status"`
+	AmountTotalCents  int64             `json:"amount_total_cents"`
+	Metadata          map[string]string `json:"metadata"`
+	// Mode is CheckoutModeSetup for setup sessions, which save
+	// PaymentMethodID to CustomerID.
+	Mode            string `json:"mode,omitempty"`
+	CustomerID      string `json:"customer_id,omitempty"`
+	PaymentMethodID string `json:"payment_method_id,omitempty"`
+}
+
+type AccountParams struct {
+	Country string
+	Email   string
+}
+
+type Account struct {
+	ID               string `json:"id"`
+	ChargesEnabled   bool   `json:"charges_enabled"`
+	PayoutsEnabled   bool   `json:"payouts_enabled"`
+	DetailsSubmitted bool   `json:"details_submitted"`
+}
+
+type OnboardingLinkParams struct {
+	AccountID  string
+	ReturnURL  string
+	RefreshURL string
+}
+
+type RefundParams struct {
+	PaymentIntentID string
+	// AmountCents of zero refunds the whole payment.
+	AmountCents          int64
+	RefundApplicationFee bool
+	ReverseTransfer      bool
+	// IdempotencyKey makes retries of the same refund safe.
+	IdempotencyKey string
+	Metadata       map[string]string
+}
+
+type Refund struct {
+	ID              string `json:"id"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	AmountCents     int64  `json:"amount_cents"`
+	Status          string `json:"status"`
+}
+
+type TransferParams struct {
+	AmountCents          int64
+	Currency             string
+	DestinationAccountID string
+	// TransferGroup ties the transfer to the payment that funded it.
+	TransferGroup string
+	// IdempotencyKey makes retries of the same transfer safe.
+	IdempotencyKey string
+	Metadata       map[string]string
+}
+
+type Transfer struct {
+	ID                   string `json:"id"`
+	AmountCents          int64  `json:"amount_cents"`
+	DestinationAccountID string `json:"destination_account_id"`
+}
+
+type CustomerParams struct {
+	Email    string
+	Metadata map[string]string
+}
+
+type Customer struct {
+	ID string `json:"id"`
+}
+
+type SetupSessionParams struct {
+	CustomerID        string
+	Currency          string
+	ClientReferenceID string
+	SuccessURL        string
+	CancelURL         string
+	Metadata          map[string]string
+}
+
+type SavedPaymentParams struct {
+	CustomerID           string
+	PaymentMethodID      string
+	AmountCents          int64
+	Currency             string
+	Description          string
+	ApplicationFeeCents  int64
+	DestinationAccountID string
+	// IdempotencyKey makes retries of the same charge safe.
+	IdempotencyKey string
+	Metadata       map[string]string
+}
+
+type Payment struct {
+	// ID is the payment intent, which is what refunds are made against.
+	ID          string            `json:"id"`
+	AmountCents int64             `json:"amount_cents"`
+	Status      string            `json:"status"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// FailureMessage says why the last attempt at the payment failed.
+	FailureMessage string `json:"failure_message,omitempty"`
+}
+
+type Subscription struct {
+	ID                string    `json:"id"`
+	Status            string    `json:"status"`
+	CancelAtPeriodEnd bool      `json:"cancel_at_period_end"`
+	CurrentPeriodEnd  time.Time `json:"current_period_end"`
+	// LatestPaymentIntentID is the payment intent that paid the latest
+	// invoice. RetrieveSubscription fills it in; other calls may not. A
+	// subscription-mode checkout session has no payment intent of its own,
+	// so this is how the first payment is found.
+	LatestPaymentIntentID string `json:"latest_payment_intent_id,omitempty"`
+}
+
+// Invoice is one period's bill for a subscription.
+type Invoice struct {
+	ID              string `json:"id"`
+	SubscriptionID  string `json:"subscription_id"`
+	BillingReason   string `json:"billing_reason"`
+	Currency        string `json:"currency"`
+	AmountPaidCents int64  `json:"amount_paid_cents"`
+	// PeriodEnd is when the period the invoice pays for ends.
+	PeriodEnd time.Time `json:"period_end"`
+}
+
+// Charge is a payment as refunds see it. AmountRefundedCents is the total
+// refunded so far, however it was refunded.
+type Charge struct {
+	ID                  string `json:"id"`
+	PaymentIntentID     string `json:"payment_intent_id"`
+	AmountCents         int64  `json:"amount_cents"`
+	AmountRefundedCents int64  `json:"amount_refunded_cents"`
+}
+
+// Dispute is a chargeback, or an inquiry that may become one, raised by
+// the buyer's bank against a payment.
+type Dispute struct {
+	ID              string `json:"id"`
+	ChargeID        string `json:"charge_id"`
+	PaymentIntentID string `json:"payment_intent_id"`
+	AmountCents     int64  `json:"amount_cents"`
+	Reason          string `json:"reason"`
+	Status          string `json:"status"`
+}
+
+// Event is a provider-neutral webhook event. Exactly one of the object
+// fields is set, depending on Type.
+type Event struct {
+	ID              string           `json:"id"`
+	Type            string           `json:"type"`
+	CheckoutSession *CheckoutSession `json:"checkout_session,omitempty"`
+	Account         *Account         `json:"account,omitempty"`
+	Invoice         *Invoice         `json:"invoice,omitempty"`
+	Subscription    *Subscription    `json:"subscription,omitempty"`
+	Charge          *Charge          `json:"charge,omitempty"`
+	Dispute         *Dispute         `json:"dispute,omitempty"`
+	PaymentIntent   *Payment         `json:"payment_intent,omitempty"`
+}
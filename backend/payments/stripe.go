@@ -0,0 +1,540 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v82"
+	"github.com/stripe/stripe-go/v82/webhook"
+)
+
+type StripeProvider struct {
+	client        *stripe.Client
+	webhookSecret string
+}
+
+func NewStripeProvider(secretKey, webhookSecret string) *StripeProvider {
+	return &StripeProvider{
+		client:        stripe.NewClient(secretKey),
+		webhookSecret: webhookSecret,
+	}
+}
+
+func (p *StripeProvider) CreateCheckoutSession(params *CheckoutSessionParams) (*CheckoutSession, error) {
+	if params.Recurring != nil {
+		return p.createSubscriptionCheckoutSession(params)
+	}
+	create := &stripe.CheckoutSessionCreateParams{
+		Mode:       stripe.String(string(stripe.CheckoutSessionModePayment)),
+		SuccessURL: stripe.String(params.SuccessURL),
+		CancelURL:  stripe.String(params.CancelURL),
+		LineItems: []*stripe.CheckoutSessionCreateLineItemParams{
+			{
+				Quantity: stripe.Int64(params.Quantity),
+				PriceData: &stripe.CheckoutSessionCreateLineItemPriceDataParams{
+					Currency:   stripe.String(params.Currency),
+					UnitAmount: stripe.Int64(params.UnitAmountCents),
+					ProductData: &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
+						Name: stripe.String(params.ProductName),
+					},
+				},
+			},
+		},
+		PaymentIntentData: &stripe.CheckoutSessionCreatePaymentIntentDataParams{
+			ApplicationFeeAmount: stripe.Int64(params.ApplicationFeeCents),
+			TransferData: &stripe.CheckoutSessionCreatePaymentIntentDataTransferDataParams{
+				Destination: stripe.String(params.DestinationAccountID),
+			},
+			Metadata: params.Metadata,
+		},
+		ClientReferenceID: stripe.String(params.ClientReferenceID),
+		Metadata:          params.Metadata,
+	}
+	if !params.ExpiresAt.IsZero() {
+		create.ExpiresAt = stripe.Int64(params.ExpiresAt.Unix())
+	}
+
+	s, err := p.client.V1CheckoutSessions.Create(context.Background(), create)
+	if err != nil {
+		return nil, err
+	}
+	return fromStripeCheckoutSession(s), nil
+}
+
+// createSubscriptionCheckoutSession is CreateCheckoutSession in
+// subscription mode. Stripe only takes a percentage application fee on
+// subscriptions, so the fee is converted to one.
+func (p *StripeProvider) createSubscriptionCheckoutSession(params *CheckoutSessionParams) (*CheckoutSession, error) {
+	feePercent := 0.0
+	if total := params.UnitAmountCents * params.Quantity; total > 0 {
+		feePercent = math.Round(float64(params.ApplicationFeeCents)*10_000/float64(total)) / 100
+	}
+	create := &stripe.CheckoutSessionCreateParams{
+		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		SuccessURL: stripe.String(params.SuccessURL),
+		CancelURL:  stripe.String(params.CancelURL),
+		LineItems: []*stripe.CheckoutSessionCreateLineItemParams{
+			{
+				Quantity: stripe.Int64(params.Quantity),
+				PriceData: &stripe.CheckoutSessionCreateLineItemPriceDataParams{
+					Currency:   stripe.String(params.Currency),
+					UnitAmount: stripe.Int64(params.UnitAmountCents),
+					ProductData: &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
+						Name: stripe.String(params.ProductName),
+					},
+					Recurring: &stripe.CheckoutSessionCreateLineItemPriceDataRecurringParams{
+						Interval:      stripe.String(params.Recurring.Interval),
+						IntervalCount: stripe.Int64(max(params.Recurring.IntervalCount, 1)),
+					},
+				},
+			},
+		},
+		SubscriptionData: &stripe.CheckoutSessionCreateSubscriptionDataParams{
+			ApplicationFeePercent: stripe.Float64(feePercent),
+			TransferData: &stripe.CheckoutSessionCreateSubscriptionDataTransferDataParams{
+				Destination: stripe.String(params.DestinationAccountID),
+			},
+			Metadata: params.Metadata,
+		},
+		ClientReferenceID: stripe.String(params.ClientReferenceID),
+		Metadata:          params.Metadata,
+	}
+	if !params.ExpiresAt.IsZero() {
+		create.ExpiresAt = stripe.Int64(params.ExpiresAt.Unix())
+	}
+
+	s, err := p.client.V1CheckoutSessions.Create(context.Background(), create)
+	if err != nil {
+		return nil, err
+	}
+	return fromStripeCheckoutSession(s), nil
+}
+
+func (p *StripeProvider) RetrieveCheckoutSession(id string) (*CheckoutSession, error) {
+	s, err := p.client.V1CheckoutSessions.Retrieve(context.Background(), id, nil)
+	if err != nil {
+		if isStripeNotFound(err) {
+			return nil, ErrCheckoutSessionNotFound
+		}
+		return nil, err
+	}
+	return fromStripeCheckoutSession(s), nil
+}
+
+func (p *StripeProvider) CreateConnectedAccount(params *AccountParams) (*Account, error) {
+	create := &stripe.AccountCreateParams{
+		Type:    stripe.String(string(stripe.AccountTypeExpress)),
+		Country: stripe.String(params.Country),
+		Capabilities: &stripe.AccountCreateCapabilitiesParams{
+			Transfers:    &stripe.AccountCreateCapabilitiesTransfersParams{Requested: stripe.Bool(true)},
+			CardPayments: &stripe.AccountCreateCapabilitiesCardPaymentsParams{Requested: stripe.Bool(true)},
+		},
+	}
+	if params.Email != "" {
+		create.Email = stripe.String(params.Email)
+	}
+
+	acct, err := p.client.V1Accounts.Create(context.Background(), create)
+	if err != nil {
+		return nil, err
+	}
+	return fromStripeAccount(acct), nil
+}
+
+func (p *StripeProvider) RetrieveAccount(id string) (*Account, error) {
+	acct, err := p.client.V1Accounts.GetByID(context.Background(), id, nil)
+	if err != nil {
+		if isStripeNotFound(err) {
+			return nil, ErrAccountNotFound
+		}
+		return nil, err
+	}
+	return fromStripeAccount(acct), nil
+}
+
+func (p *StripeProvider) CreateOnboardingLink(params *OnboardingLinkParams) (string, error) {
+	al, err := p.client.V1AccountLinks.Create(context.Background(), &stripe.AccountLinkCreateParams{
+		Account:    stripe.String(params.AccountID),
+		Type:       stripe.String("account_onboarding"),
+		ReturnURL:  stripe.String(params.ReturnURL),
+		RefreshURL: stripe.String(params.RefreshURL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return al.URL, nil
+}
+
+func (p *StripeProvider) Refund(params *RefundParams) (*Refund, error) {
+	create := &stripe.RefundCreateParams{
+		PaymentIntent:        stripe.String(params.PaymentIntentID),
+		RefundApplicationFee: stripe.Bool(params.RefundApplicationFee),
+		ReverseTransfer:      stripe.Bool(params.ReverseTransfer),
+		Metadata:             params.Metadata,
+	}
+	if params.AmountCents > 0 {
+		create.Amount = stripe.Int64(params.AmountCents)
+	}
+	if params.IdempotencyKey != "" {
+		create.SetIdempotencyKey(params.IdempotencyKey)
+	}
+
+	re, err := p.client.V1Refunds.Create(context.Background(), create)
+	if err != nil {
+		if isStripeNotFound(err) {
+			return nil, ErrPaymentNotFound
+		}
+		return nil, err
+	}
+	return &Refund{
+		ID:              re.ID,
+		PaymentIntentID: params.PaymentIntentID,
+		AmountCents:     re.Amount,
+		Status:          string(re.Status),
+	}, nil
+}
+
+func (p *StripeProvider) CreateTransfer(params *TransferParams) (*Transfer, error) {
+	create := &stripe.TransferCreateParams{
+		Amount:      stripe.Int64(params.AmountCents),
+		Currency:    stripe.String(params.Currency),
+		Destination: stripe.String(params.DestinationAccountID),
+		Metadata:    params.Metadata,
+	}
+	if params.TransferGroup != "" {
+		create.TransferGroup = stripe.String(params.TransferGroup)
+	}
+	if params.IdempotencyKey != "" {
+		create.SetIdempotencyKey(params.IdempotencyKey)
+	}
+
+	tr, err := p.client.V1Transfers.Create(context.Background(), create)
+	if err != nil {
+		return nil, err
+	}
+	return &Transfer{
+		ID:                   tr.ID,
+		AmountCents:          tr.Amount,
+		DestinationAccountID: params.DestinationAccountID,
+	}, nil
+}
+
+func (p *StripeProvider) RetrieveSubscription(id string) (*Subscription, error) {
+	params := &stripe.SubscriptionRetrieveParams{}
+	params.AddExpand("latest_invoice.payments")
+	sub, err := p.client.V1Subscriptions.Retrieve(context.Background(), id, params)
+	if err != nil {
+		if isStripeNotFound(err) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, err
+	}
+	return fromStripeSubscription(sub), nil
+}
+
+func (p *StripeProvider) CancelSubscription(id string, atPeriodEnd bool) (*Subscription, error) {
+	var sub *stripe.Subscription
+	var err error
+	if atPeriodEnd {
+		sub, err = p.client.V1Subscriptions.Update(context.Background(), id, &stripe.SubscriptionUpdateParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+	} else {
+		sub, err = p.client.V1Subscriptions.Cancel(context.Background(), id, nil)
+	}
+	if err != nil {
+		if isStripeNotFound(err) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, err
+	}
+	return fromStripeSubscription(sub), nil
+}
+
+func (p *StripeProvider) CreateCustomer(params *CustomerParams) (*Customer, error) {
+	create := &stripe.CustomerCreateParams{
+		Metadata: params.Metadata,
+	}
+	if params.Email != "" {
+		create.Email = stripe.String(params.Email)
+	}
+
+	c, err := p.client.V1Customers.Create(context.Background(), create)
+	if err != nil {
+		return nil, err
+	}
+	return &Customer{ID: c.ID}, nil
+}
+
+func (p *StripeProvider) CreateSetupSession(params *SetupSessionParams) (*CheckoutSession, error) {
+	create := &stripe.CheckoutSessionCreateParams{
+		Mode:              stripe.String(string(stripe.CheckoutSessionModeSetup)),
+		Customer:          stripe.String(params.CustomerID),
+		Currency:          stripe.String(params.Currency),
+		SuccessURL:        stripe.String(params.SuccessURL),
+		CancelURL:         stripe.String(params.CancelURL),
+		ClientReferenceID: stripe.String(params.ClientReferenceID),
+		SetupIntentData: &stripe.CheckoutSessionCreateSetupIntentDataParams{
+			Metadata: params.Metadata,
+		},
+		Metadata: params.Metadata,
+	}
+
+	s, err := p.client.V1CheckoutSessions.Create(context.Background(), create)
+	if err != nil {
+		if isStripeNotFound(err) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	return fromStripeCheckoutSession(s), nil
+}
+
+func (p *StripeProvider) ChargeSavedPaymentMethod(params *SavedPaymentParams) (*Payment, error) {
+	create := &stripe.PaymentIntentCreateParams{
+		Amount:               stripe.Int64(params.AmountCents),
+		Currency:             stripe.String(params.Currency),
+		Customer:             stripe.String(params.CustomerID),
+		PaymentMethod:        stripe.String(params.PaymentMethodID),
+		Confirm:              stripe.Bool(true),
+		OffSession:           stripe.Bool(true),
+		ApplicationFeeAmount: stripe.Int64(params.ApplicationFeeCents),
+		TransferData: &stripe.PaymentIntentCreateTransferDataParams{
+			Destination: stripe.String(params.DestinationAccountID),
+		},
+		Metadata: params.Metadata,
+	}
+	if params.Description != "" {
+		create.Description = stripe.String(params.Description)
+	}
+	if params.IdempotencyKey != "" {
+		create.SetIdempotencyKey(params.IdempotencyKey)
+	}
+
+	pi, err := p.client.V1PaymentIntents.Create(context.Background(), create)
+	if err != nil {
+		var serr *stripe.Error
+		if errors.As(err, &serr) && serr.Type == stripe.ErrorTypeCard {
+			return nil, fmt.Errorf("%w: %s", ErrPaymentDeclined, serr.Msg)
+		}
+		if isStripeNotFound(err) {
+			return nil, ErrCustomerNotFound
+		}
+		return nil, err
+	}
+	// Anything but a card error may yet go through, such as a payment
+	// that is still processing; it settles through the webhook.
+	return fromStripePaymentIntent(pi), nil
+}
+
+func (p *StripeProvider) ConstructEvent(payload []byte, signature string) (*Event, error) {
+	se, err := webhook.ConstructEventWithOptions(
+		payload,
+		signature,
+		p.webhookSecret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true},
+	)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	ev := &Event{ID: se.ID, Type: string(se.Type)}
+	switch ev.Type {
+	case EventCheckoutSessionCompleted,
+		EventCheckoutSessionAsyncPaymentSucceeded,
+		EventCheckoutSessionExpired:
+		var s stripe.CheckoutSession
+		if err := json.Unmarshal(se.Data.Raw, &s); err != nil {
+			return nil, err
+		}
+		ev.CheckoutSession = fromStripeCheckoutSession(&s)
+		if ev.CheckoutSession.Mode == CheckoutModeSetup && ev.CheckoutSession.PaymentMethodID == "" &&
+			s.SetupIntent != nil {
+			// Events carry the setup intent unexpanded.
+			si, err := p.client.V1SetupIntents.Retrieve(context.Background(), s.SetupIntent.ID, nil)
+			if err != nil {
+				return nil, err
+			}
+			if si.PaymentMethod != nil {
+				ev.CheckoutSession.PaymentMethodID = si.PaymentMethod.ID
+			}
+		}
+	case EventAccountUpdated:
+		var acct stripe.Account
+		if err := json.Unmarshal(se.Data.Raw, &acct); err != nil {
+			return nil, err
+		}
+		ev.Account = fromStripeAccount(&acct)
+	case EventInvoicePaid, EventInvoicePaymentFailed:
+		var inv stripe.Invoice
+		if err := json.Unmarshal(se.Data.Raw, &inv); err != nil {
+			return nil, err
+		}
+		ev.Invoice = fromStripeInvoice(&inv)
+	case EventSubscriptionDeleted:
+		var sub stripe.Subscription
+		if err := json.Unmarshal(se.Data.Raw, &sub); err != nil {
+			return nil, err
+		}
+		ev.Subscription = fromStripeSubscription(&sub)
+	case EventChargeRefunded:
+		var ch stripe.Charge
+		if err := json.Unmarshal(se.Data.Raw, &ch); err != nil {
+			return nil, err
+		}
+		ev.Charge = fromStripeCharge(&ch)
+	case EventChargeDisputeCreated, EventChargeDisputeClosed:
+		var d stripe.Dispute
+		if err := json.Unmarshal(se.Data.Raw, &d); err != nil {
+			return nil, err
+		}
+		ev.Dispute = fromStripeDispute(&d)
+	case EventPaymentIntentSucceeded, EventPaymentIntentPaymentFailed:
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(se.Data.Raw, &pi); err != nil {
+			return nil, err
+		}
+		ev.PaymentIntent = fromStripePaymentIntent(&pi)
+	}
+	return ev, nil
+}
+
+func fromStripePaymentIntent(pi *stripe.PaymentIntent) *Payment {
+	out := &Payment{
+		ID:          pi.ID,
+		AmountCents: pi.Amount,
+		Status:      string(pi.Status),
+		Metadata:    pi.Metadata,
+	}
+	if pi.LastPaymentError != nil {
+		out.FailureMessage = pi.LastPaymentError.Msg
+	}
+	return out
+}
+
+func fromStripeCharge(ch *stripe.Charge) *Charge {
+	out := &Charge{
+		ID:                  ch.ID,
+		AmountCents:         ch.Amount,
+		AmountRefundedCents: ch.AmountRefunded,
+	}
+	if ch.PaymentIntent != nil {
+		out.PaymentIntentID = ch.PaymentIntent.ID
+	}
+	return out
+}
+
+func fromStripeDispute(d *stripe.Dispute) *Dispute {
+	out := &Dispute{
+		ID:          d.ID,
+		AmountCents: d.Amount,
+		Reason:      string(d.Reason),
+		Status:      string(d.Status),
+	}
+	if d.Charge != nil {
+		out.ChargeID = d.Charge.ID
+	}
+	if d.PaymentIntent != nil {
+		out.PaymentIntentID = d.PaymentIntent.ID
+	}
+	return out
+}
+
+func fromStripeCheckoutSession(s *stripe.CheckoutSession) *CheckoutSession {
+	cs := &CheckoutSession{
+		ID:                s.ID,
+		URL:               s.URL,
+		ClientReferenceID: s.ClientReferenceID,
+		Paid:              s.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid,
+		Status:            string(s.Status),
+		AmountTotalCents:  s.AmountTotal,
+		Metadata:          s.Metadata,
+		Mode:              string(s.Mode),
+	}
+	if s.Customer != nil {
+		cs.CustomerID = s.Customer.ID
+	}
+	if s.SetupIntent != nil && s.SetupIntent.PaymentMethod != nil {
+		cs.PaymentMethodID = s.SetupIntent.PaymentMethod.ID
+	}
+	if s.PaymentIntent != nil {
+		cs.PaymentIntentID = s.PaymentIntent.ID
+	}
+	if s.Subscription != nil {
+		cs.SubscriptionID = s.Subscription.ID
+	}
+	return cs
+}
+
+func fromStripeSubscription(sub *stripe.Subscription) *Subscription {
+	out := &Subscription{
+		ID:                sub.ID,
+		Status:            string(sub.Status),
+		CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+	}
+	// Periods are tracked per item; every item here shares one price.
+	if sub.Items != nil {
+		for _, item := range sub.Items.Data {
+			if end := time.Unix(item.CurrentPeriodEnd, 0); end.After(out.CurrentPeriodEnd) {
+				out.CurrentPeriodEnd = end
+			}
+		}
+	}
+	// An invoice's payments are only there when expanded, as
+	// RetrieveSubscription does.
+	if inv := sub.LatestInvoice; inv != nil && inv.Payments != nil {
+		for _, payment := range inv.Payments.Data {
+			if payment.Payment != nil && payment.Payment.PaymentIntent != nil {
+				out.LatestPaymentIntentID = payment.Payment.PaymentIntent.ID
+				if payment.Status == "paid" {
+					break
+				}
+			}
+		}
+	}
+	return out
+}
+
+func fromStripeInvoice(inv *stripe.Invoice) *Invoice {
+	out := &Invoice{
+		ID:              inv.ID,
+		BillingReason:   string(inv.BillingReason),
+		Currency:        string(inv.Currency),
+		AmountPaidCents: inv.AmountPaid,
+	}
+	if inv.Parent != nil && inv.Parent.SubscriptionDetails != nil && inv.Parent.SubscriptionDetails.Subscription != nil {
+		out.SubscriptionID = inv.Parent.SubscriptionDetails.Subscription.ID
+	}
+	// The invoice's own period is the one before it; its lines carry the
+	// period being paid for.
+	if inv.Lines != nil {
+		for _, line := range inv.Lines.Data {
+			if line.Period == nil {
+				continue
+			}
+			if end := time.Unix(line.Period.End, 0); end.After(out.PeriodEnd) {
+				out.PeriodEnd = end
+			}
+		}
+	}
+	return out
+}
+
+func fromStripeAccount(acct *stripe.Account) *Account {
+	return &Account{
+		ID:               acct.ID,
+		ChargesEnabled:   acct.ChargesEnabled,
+		PayoutsEnabled:   acct.PayoutsEnabled,
+		DetailsSubmitted: acct.DetailsSubmitted,
+	}
+}
+
+func isStripeNotFound(err error) bool {
+	var serr *stripe.Error
+	return errors.As(err, &serr) && serr.HTTPStatusCode == http.StatusNotFound
+}
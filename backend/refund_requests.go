@@ -0,0 +1,655 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRefundResponseWindow   = 72 * time.Hour
+	defaultRefundRequestSweepTick = time.Minute
+	refundRequestSweepBatchSize   = 100
+	maxRefundEvidenceLength       = 4096
+	// stuckRefundAfter is how long a request may be Refunding before the
+	// sweeper takes it to have been abandoned and finishes its refund.
+	stuckRefundAfter = 10 * time.Minute
+)
+
+var (
+	errRefundPolicy      = errors.New("the listing's refund policy does not allow this refund")
+	errRefundRequestOpen = errors.New("transaction already has a pending refund request")
+)
+
+// RefundResponseWindow reads how long a seller has to answer a refund
+// request from REFUND_RESPONSE_WINDOW.
+func RefundResponseWindow() time.Duration {
+	window, err := time.ParseDuration(os.Getenv("REFUND_RESPONSE_WINDOW"))
+	if err != nil || window <= 0 {
+		return defaultRefundResponseWindow
+	}
+	return window
+}
+
+type BuyerRefundRequest struct {
+	// Quantity is how many units to ask back; zero asks for all that is
+	// left to refund.
+	Quantity int64 `json:"quantity"`
+	// Reason is "not_as_described", "data_unavailable", "duplicate",
+	// "unauthorized" or "other"; Evidence backs it up in the buyer's words.
+	Reason   string `json:"reason"`
+	Evidence string `json:"evidence"`
+}
+
+type RefundResponseRequest struct {
+	// Note is the seller's answer to the buyer, required to deny.
+	Note string `json:"note"`
+}
+
+// listingRefundPolicy checks the refund policy a listing asks for. An empty
+// name is RefundsBeforeUnlock.
+func listingRefundPolicy(name string, windowHours int64) (models.RefundPolicy, error) {
+	if windowHours < 0 {
+		return 0, errors.New("refund_window_hours must not be negative")
+	}
+	if name == "" {
+		return models.RefundsBeforeUnlock, nil
+	}
+	return models.ParseRefundPolicy(name)
+}
+
+// checkRefundPolicy checks that the refund policy of tr's listing lets its
+// buyer ask for quantity units back at now. Resales and order fills follow
+// the policy of the contract's original listing.
+func checkRefundPolicy(
+	tr *models.TransactionRecord,
+	quantity int64,
+	now time.Time,
+	rs *repos.Repos) error {
+
+	listing, err := rs.Listings.FindByID(tr.ListingID)
+	if err != nil {
+		return err
+	}
+	if listing.RefundPolicy == models.RefundsNone {
+		return fmt.Errorf("%w: the listing does not give refunds", errRefundPolicy)
+	}
+	if listing.RefundWindowHours > 0 && tr.FulfilledAt != nil {
+		closes := tr.FulfilledAt.Add(time.Duration(listing.RefundWindowHours) * time.Hour)
+		if !now.Before(closes) {
+			return fmt.Errorf("%w: refunds closed at %s", errRefundPolicy, closes.Format(time.RFC3339))
+		}
+	}
+
+	statuses := []models.ContractStatus{models.StatusOwned, models.StatusUnlocked}
+	if listing.RefundPolicy == models.RefundsBeforeUnlock {
+		statuses = statuses[:1]
+	}
+	held, err := heldContracts(tr, rs, statuses...)
+	if err != nil {
+		return err
+	}
+	if int64(len(held)) < quantity {
+		if listing.RefundPolicy == models.RefundsBeforeUnlock {
+			return fmt.Errorf("%w: only %d of the contracts have not been unlocked", errRefundPolicy, len(held))
+		}
+		return fmt.Errorf("%w: the buyer holds only %d of its contracts", errRefundPolicy, len(held))
+	}
+	return nil
+}
+
+// notifyRefundRequest tells both the buyer and the seller about a change
+// to req.
+func notifyRefundRequest(bus *events.Bus, t events.Type, req *models.RefundRequest, reason string, at time.Time) {
+	for _, userID := range []uuid.UUID{req.BuyerID, req.SellerID} {
+		bus.Publish(events.Event{
+			Type:          t,
+			At:            at,
+			TransactionID: req.TransactionID,
+			UserID:        userID,
+			Reason:        reason,
+		})
+	}
+}
+
+// RequestRefund opens a refund request from the buyer of a fulfilled
+// purchase. The seller has RefundResponseWindow to answer it before it is
+// approved for them. A transaction has at most one pending request.
+func RequestRefund(
+	transactionID uuid.UUID,
+	buyerID uuid.UUID,
+	body *BuyerRefundRequest,
+	now time.Time,
+	uow repos.UnitOfWork,
+	bus *events.Bus) (*models.RefundRequest, error) {
+
+	reason, err := models.ParseRefundReason(body.Reason)
+	if err != nil {
+		return nil, err
+	}
+	if len(body.Evidence) > maxRefundEvidenceLength {
+		return nil, fmt.Errorf("evidence must be at most %d bytes", maxRefundEvidenceLength)
+	}
+
+	var req *models.RefundRequest
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		tr, err := tx.Transactions.FindByID(transactionID)
+		if err != nil {
+			return err
+		}
+		if tr.BuyerID != buyerID {
+			return errNotParticipant
+		}
+		switch tr.Kind {
+		case models.KindPrimary, models.KindResale, models.KindOrderFill:
+		default:
+			return fmt.Errorf("%w: only purchases of contracts are refunded", errNotRefundable)
+		}
+		if tr.TransactionStatus != models.StatusFulfilled {
+			return fmt.Errorf("%w: it is %s", errNotRefundable, tr.TransactionStatus)
+		}
+		if tr.StripePaymentIntentID == "" || tr.PurchaseCents == 0 {
+			return fmt.Errorf("%w: nothing was paid", errNotRefundable)
+		}
+
+		remaining := tr.PurchaseQuantity - tr.RefundedQuantity
+		quantity := body.Quantity
+		if quantity == 0 {
+			quantity = remaining
+		}
+		if quantity <= 0 || quantity > remaining {
+			return fmt.Errorf("%w: %d of %d units are left", errRefundTooLarge, remaining, tr.PurchaseQuantity)
+		}
+		if tr.StripeSubscriptionID != "" && quantity != remaining {
+			return fmt.Errorf("%w: a subscription purchase is refunded in full or not at all", errNotRefundable)
+		}
+
+		_, err = tx.RefundRequests.FindPendingByTransactionID(tr.ID)
+		if err == nil {
+			return errRefundRequestOpen
+		}
+		if !errors.Is(err, repos.ErrRefundRequestNotFound) {
+			return err
+		}
+		if err := checkRefundPolicy(tr, quantity, now, tx); err != nil {
+			return err
+		}
+
+		req = &models.RefundRequest{
+			ID:            uuid.New(),
+			TransactionID: tr.ID,
+			BuyerID:       tr.BuyerID,
+			SellerID:      tr.SellerID,
+			Quantity:      quantity,
+			Reason:        reason,
+			Evidence:      body.Evidence,
+			Status:        models.RefundRequestPending,
+			RespondBy:     now.Add(RefundResponseWindow()),
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		return tx.RefundRequests.Create(req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	notifyRefundRequest(bus, events.RefundRequested, req, req.Reason.String(), now)
+	return req, nil
+}
+
+// refundFailedForGood reports whether err means an approved refund can
+// never be made, rather than that it might work if tried again.
+func refundFailedForGood(err error) bool {
+	return errors.Is(err, errNotRefundable) ||
+		errors.Is(err, errRefundTooLarge) ||
+		errors.Is(err, errNotRefunder) ||
+		errors.Is(err, errRefundPolicy) ||
+		errors.Is(err, repos.ErrTransactionNotFound) ||
+		errors.Is(err, payments.ErrPaymentNotFound)
+}
+
+// approveRefundRequest approves a pending request and makes the refund on
+// the seller's behalf. A request approved because the seller did not
+// answer in time is checked against the refund policy again, since the
+// buyer may have used the contracts since asking.
+//
+// The request is Refunding while the refund is made and Approved once it
+// has been. If the refund can never be made the request is marked Failed
+// and the reason returned; if it might work later the request goes back to
+// Pending, so it is retried by the sweeper or approved again.
+func approveRefundRequest(
+	req *models.RefundRequest,
+	auto bool,
+	note string,
+	now time.Time,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) error {
+
+	rs := uow.Repos()
+	tr, err := rs.Transactions.FindByID(req.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	req.Status = models.RefundRequestRefunding
+	req.AutoApproved = auto
+	req.SellerNote = note
+	req.RefundFromCents = tr.RefundedCents
+	req.RespondedAt = &now
+	req.UpdatedAt = now
+	if err := rs.RefundRequests.UpdateFromStatus(req, models.RefundRequestPending); err != nil {
+		return err
+	}
+
+	if auto {
+		if err := checkRefundPolicy(tr, req.Quantity, now, rs); err != nil {
+			return settleRefundApproval(req, err, now, rs, bus)
+		}
+	}
+	return makeApprovedRefund(req, now, provider, uow, bus)
+}
+
+// makeApprovedRefund refunds the buyer of a Refunding request, unless the
+// transaction has been refunded since the request's refund began, which
+// means an earlier attempt got as far as making it.
+func makeApprovedRefund(
+	req *models.RefundRequest,
+	now time.Time,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) error {
+
+	rs := uow.Repos()
+	tr, err := rs.Transactions.FindByID(req.TransactionID)
+	if err != nil {
+		return settleRefundApproval(req, err, now, rs, bus)
+	}
+	if tr.RefundedCents > req.RefundFromCents {
+		return settleRefundApproval(req, nil, now, rs, bus)
+	}
+	seller, err := rs.Users.FindByID(req.SellerID)
+	if err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("refund request %s: %s", req.ID, req.Reason)
+	_, err = RefundTransaction(req.TransactionID, seller, req.Quantity, reason, provider, uow)
+	return settleRefundApproval(req, err, now, rs, bus)
+}
+
+// settleRefundApproval records how the refund of a Refunding request went.
+func settleRefundApproval(
+	req *models.RefundRequest,
+	refundErr error,
+	now time.Time,
+	rs *repos.Repos,
+	bus *events.Bus) error {
+
+	switch {
+	case refundErr == nil:
+		req.Status = models.RefundRequestApproved
+		req.UpdatedAt = now
+		if err := rs.RefundRequests.UpdateFromStatus(req, models.RefundRequestRefunding); err != nil {
+			return err
+		}
+		notifyRefundRequest(bus, events.RefundApproved, req, req.SellerNote, now)
+		return nil
+	case refundFailedForGood(refundErr):
+		req.Status = models.RefundRequestFailed
+		req.FailureReason = refundErr.Error()
+		req.UpdatedAt = now
+		if err := rs.RefundRequests.UpdateFromStatus(req, models.RefundRequestRefunding); err != nil {
+			return err
+		}
+		notifyRefundRequest(bus, events.RefundFailed, req, req.FailureReason, now)
+		return refundErr
+	default:
+		req.Status = models.RefundRequestPending
+		req.AutoApproved = false
+		req.SellerNote = ""
+		req.RespondedAt = nil
+		req.UpdatedAt = now
+		if err := rs.RefundRequests.UpdateFromStatus(req, models.RefundRequestRefunding); err != nil {
+			log.Printf("refund request %s: reopen after failed refund: %v", req.ID, err)
+		}
+		return refundErr
+	}
+}
+
+// pendingRefundRequest loads a request that is still waiting on its seller.
+func pendingRefundRequest(rs *repos.Repos, id uuid.UUID) (*models.RefundRequest, error) {
+	req, err := rs.RefundRequests.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if req.Status != models.RefundRequestPending {
+		return nil, repos.ErrRefundRequestStatusConflict
+	}
+	return req, nil
+}
+
+// RespondToRefundRequest approves or denies a request made to sellerID.
+// Approving refunds the buyer at once; denying needs a note saying why.
+func RespondToRefundRequest(
+	id, sellerID uuid.UUID,
+	approve bool,
+	note string,
+	now time.Time,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) (*models.RefundRequest, error) {
+
+	rs := uow.Repos()
+	req, err := pendingRefundRequest(rs, id)
+	if err != nil {
+		return nil, err
+	}
+	if req.SellerID != sellerID {
+		return nil, errNotParticipant
+	}
+
+	if approve {
+		if err := approveRefundRequest(req, false, note, now, provider, uow, bus); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
+	if note == "" {
+		return nil, errors.New("a note is required to deny a refund request")
+	}
+	req.Status = models.RefundRequestDenied
+	req.SellerNote = note
+	req.RespondedAt = &now
+	req.UpdatedAt = now
+	if err := rs.RefundRequests.UpdateFromStatus(req, models.RefundRequestPending); err != nil {
+		return nil, err
+	}
+	notifyRefundRequest(bus, events.RefundDenied, req, note, now)
+	return req, nil
+}
+
+// WithdrawRefundRequest lets the buyer take back a request the seller has
+// not answered.
+func WithdrawRefundRequest(id, buyerID uuid.UUID, now time.Time, uow repos.UnitOfWork, bus *events.Bus) error {
+	rs := uow.Repos()
+	req, err := pendingRefundRequest(rs, id)
+	if err != nil {
+		return err
+	}
+	if req.BuyerID != buyerID {
+		return errNotParticipant
+	}
+
+	req.Status = models.RefundRequestWithdrawn
+	req.UpdatedAt = now
+	if err := rs.RefundRequests.UpdateFromStatus(req, models.RefundRequestPending); err != nil {
+		return err
+	}
+	notifyRefundRequest(bus, events.RefundWithdrawn, req, "", now)
+	return nil
+}
+
+// ApproveOverdueRefundRequests approves every pending request whose seller
+// did not answer by its RespondBy. A refund that fails and might work later
+// leaves its request pending for the next run.
+func ApproveOverdueRefundRequests(
+	now time.Time,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) (int, error) {
+
+	approved := 0
+	for {
+		due, err := uow.Repos().RefundRequests.FindAllPendingDue(now, refundRequestSweepBatchSize)
+		if err != nil {
+			return approved, err
+		}
+
+		progressed := false
+		for i := range due {
+			req := &due[i]
+			err := approveRefundRequest(req, true, "", now, provider, uow, bus)
+			switch {
+			case err == nil:
+				approved++
+				progressed = true
+			case errors.Is(err, repos.ErrRefundRequestStatusConflict):
+			case refundFailedForGood(err):
+				progressed = true
+			default:
+				log.Printf("refund request %s: auto-approval failed: %v", req.ID, err)
+			}
+		}
+
+		if len(due) < refundRequestSweepBatchSize || !progressed {
+			return approved, nil
+		}
+	}
+}
+
+// FinishStuckRefunds finishes the refunds of requests left Refunding for
+// stuckRefundAfter, such as by a crash between approving a request and
+// recording its refund. It returns how many were approved.
+func FinishStuckRefunds(
+	now time.Time,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) (int, error) {
+
+	stuck, err := uow.Repos().RefundRequests.FindAllRefundingSince(now.Add(-stuckRefundAfter), refundRequestSweepBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	finished := 0
+	for i := range stuck {
+		req := &stuck[i]
+		// Claim the request, so a concurrent sweep leaves it alone.
+		req.UpdatedAt = now
+		err := uow.Repos().RefundRequests.UpdateFromStatus(req, models.RefundRequestRefunding)
+		if errors.Is(err, repos.ErrRefundRequestStatusConflict) {
+			continue
+		}
+		if err != nil {
+			return finished, err
+		}
+		err = makeApprovedRefund(req, now, provider, uow, bus)
+		switch {
+		case err == nil:
+			finished++
+		case refundFailedForGood(err):
+		default:
+			log.Printf("refund request %s: finishing refund failed: %v", req.ID, err)
+		}
+	}
+	return finished, nil
+}
+
+// StartRefundRequestSweeper runs FinishStuckRefunds and
+// ApproveOverdueRefundRequests on every tick of clk until the returned
+// stop function is called.
+func StartRefundRequestSweeper(
+	interval time.Duration,
+	clk clock.Clock,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) (stop func()) {
+
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := FinishStuckRefunds(clk.Now(), provider, uow, bus)
+				if err != nil {
+					log.Printf("stuck refund sweep failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("finished %d stuck refunds", n)
+				}
+				n, err = ApproveOverdueRefundRequests(clk.Now(), provider, uow, bus)
+				if err != nil {
+					log.Printf("refund request sweep failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("auto-approved %d refund requests", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func refundRequestError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repos.ErrTransactionNotFound),
+		errors.Is(err, repos.ErrRefundRequestNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, errNotParticipant):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, errNotRefundable),
+		errors.Is(err, errRefundPolicy),
+		errors.Is(err, errRefundRequestOpen),
+		errors.Is(err, repos.ErrRefundRequestStatusConflict),
+		errors.Is(err, repos.ErrTransactionStatusConflict),
+		errors.Is(err, repos.ErrContractStatusConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, payments.ErrPaymentNotFound):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// TransactionRefundRequestHandler serves POST
+// /v1/transactions/{id}/refund-requests, where the buyer asks the seller
+// for their money back.
+func TransactionRefundRequestHandler(uow repos.UnitOfWork, bus *events.Bus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid transaction id", http.StatusBadRequest)
+			return
+		}
+		body := &BuyerRefundRequest{}
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body.Quantity < 0 {
+			http.Error(w, "quantity must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		req, err := RequestRefund(id, u.ID, body, time.Now(), uow, bus)
+		if err != nil {
+			refundRequestError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(req)
+	}
+}
+
+// RefundRequestsHandler serves GET /v1/refund-requests, the requests the
+// caller made as a buyer or received as a seller.
+func RefundRequestsHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		requests, err := rs.RefundRequests.FindAllByUserID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch refund requests: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(requests)
+	}
+}
+
+// RefundRequestResponseHandler serves POST /v1/refund-requests/{id}/approve
+// and /deny for the seller.
+func RefundRequestResponseHandler(
+	approve bool,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid refund request id", http.StatusBadRequest)
+			return
+		}
+		body := &RefundResponseRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		req, err := RespondToRefundRequest(id, u.ID, approve, body.Note, time.Now(), provider, uow, bus)
+		if err != nil {
+			refundRequestError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(req)
+	}
+}
+
+// WithdrawRefundRequestHandler serves DELETE /v1/refund-requests/{id},
+// where the buyer withdraws a request that is still pending.
+func WithdrawRefundRequestHandler(uow repos.UnitOfWork, bus *events.Bus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid refund request id", http.StatusBadRequest)
+			return
+		}
+		if err := WithdrawRefundRequest(id, u.ID, time.Now(), uow, bus); err != nil {
+			refundRequestError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/models"
+)
+
+// stuckRefundRequest opens a refund request for purchase and leaves it
+// Refunding at now, as an approval that crashed part way would.
+func (m *testMarket) stuckRefundRequest(t *testing.T, purchase *models.TransactionRecord, now time.Time) *models.RefundRequest {
+	t.Helper()
+	req, err := RequestRefund(purchase.ID, m.buyer.ID, &BuyerRefundRequest{Reason: "other"}, now, m.uow, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Status = models.RefundRequestRefunding
+	req.RefundFromCents = purchase.RefundedCents
+	req.RespondedAt = &now
+	if err := m.uow.Repos().RefundRequests.UpdateFromStatus(req, models.RefundRequestPending); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestStuckRefundRequestsAreFinished(t *testing.T) {
+	for _, refunded := range []bool{false, true} {
+		name := "crashed before refunding"
+		if refunded {
+			name = "crashed after refunding"
+		}
+		t.Run(name, func(t *testing.T) {
+			m := newTestMarket(t)
+			listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+			purchase := m.buy(t, listing.ID, 1)
+			now := time.Now()
+			req := m.stuckRefundRequest(t, purchase, now)
+			if refunded {
+				if _, err := RefundTransaction(purchase.ID, m.seller, req.Quantity, "refund request", m.provider, m.uow); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := FinishStuckRefunds(now.Add(time.Minute), m.provider, m.uow, nil); err != nil {
+				t.Fatal(err)
+			}
+			before := 0
+			if refunded {
+				before = 1
+			}
+			if got := len(m.provider.Refunds()); got != before {
+				t.Fatalf("%d refunds before the request was stuck long enough, want %d", got, before)
+			}
+
+			n, err := FinishStuckRefunds(now.Add(stuckRefundAfter+time.Minute), m.provider, m.uow, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("finished %d stuck refunds, want 1", n)
+			}
+			req, err = m.uow.Repos().RefundRequests.FindByID(req.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.Status != models.RefundRequestApproved {
+				t.Errorf("stuck request is %s, want approved", req.Status)
+			}
+			if got := len(m.provider.Refunds()); got != 1 {
+				t.Errorf("buyer was refunded %d times, want once", got)
+			}
+			if got := m.transaction(t, purchase.ID).TransactionStatus; got != models.StatusRefunded {
+				t.Errorf("purchase is %s, want refunded", got)
+			}
+		})
+	}
+}
+
+func TestRefundRequestNotifiesBothSides(t *testing.T) {
+	m := newTestMarket(t)
+	bus := events.NewBus()
+	bus.SubscribeAll(StoreNotifications(m.uow))
+	listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+	purchase := m.buy(t, listing.ID, 1)
+
+	if _, err := RequestRefund(purchase.ID, m.buyer.ID, &BuyerRefundRequest{Reason: "other"}, time.Now(), m.uow, bus); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, u := range []*models.User{m.buyer, m.seller} {
+		r := as(httptest.NewRequest(http.MethodGet, "/v1/notifications", nil), u)
+		w := httptest.NewRecorder()
+		NotificationsHandler(m.uow)(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("notifications: %d %s", w.Code, w.Body)
+		}
+		var got []models.Notification
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].Type != string(events.RefundRequested) || got[0].TransactionID != purchase.ID {
+			t.Errorf("%s has notifications %+v, want the refund request", u.AuthSubject, got)
+		}
+	}
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errNotRefunder    = errors.New("only the seller or an admin may refund this transaction")
+	errNotRefundable  = errors.New("transaction cannot be refunded")
+	errRefundTooLarge = errors.New("refund is for more than is left to refund")
+)
+
+// isAdmin reports whether u is one of the platform admins listed, by user
+// ID, in ADMIN_USER_IDS.
+func isAdmin(u *models.User) bool {
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if strings.TrimSpace(id) == u.ID.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// unitsCents is what the first quantity units of tr cost. Refunding units
+// from..to gives back unitsCents(to) - unitsCents(from), so refunds add up
+// to exactly PurchaseCents however the purchase is split.
+func unitsCents(tr *models.TransactionRecord, quantity int64) int64 {
+	if tr.PurchaseQuantity == 0 {
+		return 0
+	}
+	return int64(tr.PurchaseCents) * quantity / tr.PurchaseQuantity
+}
+
+// unitsCovered is the most units of tr whose unitsCents is at most cents.
+func unitsCovered(tr *models.TransactionRecord, cents int64) int64 {
+	if tr.PurchaseCents == 0 || cents >= int64(tr.PurchaseCents) {
+		return tr.PurchaseQuantity
+	}
+	return ((cents+1)*tr.PurchaseQuantity - 1) / int64(tr.PurchaseCents)
+}
+
+// heldContracts returns the contracts tr sold that its buyer still holds
+// in one of statuses. For an exercise that is the option exercised.
+func heldContracts(
+	tr *models.TransactionRecord,
+	rs *repos.Repos,
+	statuses ...models.ContractStatus) ([]*models.ContractState, error) {
+
+	var headerIDs []uuid.UUID
+	if tr.Kind == models.KindExercise {
+		headerIDs = []uuid.UUID{tr.HeaderID}
+	} else {
+		entries, err := rs.Ownership.FindAllByTransactionID(tr.ID, models.OwnershipSold)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			headerIDs = append(headerIDs, entry.HeaderID)
+		}
+	}
+
+	var held []*models.ContractState
+	for _, id := range headerIDs {
+		state, err := rs.States.FindByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if state.OwnerID != tr.BuyerID {
+			continue
+		}
+		for _, status := range statuses {
+			if state.Status == status {
+				held = append(held, state)
+				break
+			}
+		}
+	}
+	return held, nil
+}
+
+// RefundTransaction refunds quantity units of a purchase, or everything
+// not yet refunded for zero, and takes back as many of the contracts it
+// sold. Only the seller or an admin may refund. The refund reverses the
+// seller's share and the platform fee in proportion; a royalty already paid
+// to the original seller is not clawed back. Cancelling the subscription a
+// purchase started is part of refunding it, so those are refunded whole.
+//
+// The money goes back first. Should recording the refund then fail, the
+// charge.refunded event that follows records it instead.
+func RefundTransaction(
+	id uuid.UUID,
+	actor *models.User,
+	quantity int64,
+	reason string,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (*models.TransactionRecord, error) {
+
+	rs := uow.Repos()
+	tr, err := rs.Transactions.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if tr.SellerID != actor.ID && !isAdmin(actor) {
+		return nil, errNotRefunder
+	}
+	switch tr.Kind {
+	case models.KindPrimary, models.KindResale, models.KindOrderFill:
+	default:
+		return nil, fmt.Errorf("%w: only purchases of contracts are refunded here", errNotRefundable)
+	}
+	if tr.TransactionStatus != models.StatusFulfilled && tr.TransactionStatus != models.StatusFailed {
+		return nil, fmt.Errorf("%w: it is %s", errNotRefundable, tr.TransactionStatus)
+	}
+	if tr.StripePaymentIntentID == "" || tr.PurchaseCents == 0 {
+		return nil, fmt.Errorf("%w: nothing was paid", errNotRefundable)
+	}
+
+	remaining := tr.PurchaseQuantity - tr.RefundedQuantity
+	if quantity == 0 {
+		quantity = remaining
+	}
+	if quantity <= 0 || quantity > remaining {
+		return nil, fmt.Errorf("%w: %d of %d units are left", errRefundTooLarge, remaining, tr.PurchaseQuantity)
+	}
+	if tr.StripeSubscriptionID != "" && quantity != remaining {
+		return nil, fmt.Errorf("%w: a subscription purchase is refunded in full or not at all", errNotRefundable)
+	}
+	if tr.TransactionStatus == models.StatusFulfilled {
+		held, err := heldContracts(tr, rs, models.StatusOwned, models.StatusUnlocked)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(held)) < quantity {
+			return nil, fmt.Errorf("%w: the buyer holds only %d of its contracts", errNotRefundable, len(held))
+		}
+	}
+	amount := unitsCents(tr, tr.RefundedQuantity+quantity) - unitsCents(tr, tr.RefundedQuantity)
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: %d units come to less than a cent", errNotRefundable, quantity)
+	}
+
+	re, err := provider.Refund(&payments.RefundParams{
+		PaymentIntentID:      tr.StripePaymentIntentID,
+		AmountCents:          amount,
+		RefundApplicationFee: true,
+		ReverseTransfer:      true,
+		// Keyed on what was refunded before, so a retried request cannot
+		// refund twice.
+		IdempotencyKey: fmt.Sprintf("refund-%s-%d", tr.ID, tr.RefundedCents),
+		Metadata: map[string]string{
+			"transaction_id": tr.ID.String(),
+			"actor_id":       actor.ID.String(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		fresh, err := tx.Transactions.FindByID(tr.ID)
+		if err != nil {
+			return err
+		}
+		if fresh.RefundedCents >= tr.RefundedCents+amount {
+			// charge.refunded got here first.
+			return nil
+		}
+		var held []*models.ContractState
+		if fresh.TransactionStatus == models.StatusFulfilled {
+			held, err = heldContracts(fresh, tx, models.StatusOwned, models.StatusUnlocked)
+			if err != nil {
+				return err
+			}
+			// Take back contracts that were never unlocked first, which is
+			// what a refund under RefundsBeforeUnlock was granted for.
+			sort.SliceStable(held, func(i, j int) bool {
+				return held[i].Status == models.StatusOwned && held[j].Status != models.StatusOwned
+			})
+			held = held[:min(int64(len(held)), quantity)]
+		}
+		return recordRefund(tx, fresh, held, amount, quantity, re.ID, actor.ID, reason)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tr.StripeSubscriptionID != "" {
+		_, err := provider.CancelSubscription(tr.StripeSubscriptionID, false)
+		if err != nil && !errors.Is(err, payments.ErrSubscriptionNotFound) {
+			log.Printf("transaction %s: cancel subscription %s: %v", tr.ID, tr.StripeSubscriptionID, err)
+		}
+	}
+	return rs.Transactions.FindByID(tr.ID)
+}
+
+// recordRefund records amountCents of tr, covering quantity units, as
+// refunded and revokes held. A primary purchase's revoked units go back on
+// sale if its listing restocks on refund. Once everything is refunded the
+// transaction moves to Refunded. tr must have been read inside tx.
+func recordRefund(
+	tx *repos.Repos,
+	tr *models.TransactionRecord,
+	held []*models.ContractState,
+	amountCents, quantity int64,
+	providerRefundID string,
+	actorID uuid.UUID,
+	reason string) error {
+
+	if err := lifecycle.RevokeContracts(tx, held, tr.ID, actorID, reason); err != nil {
+		return err
+	}
+	restocked := false
+	if tr.Kind == models.KindPrimary && len(held) > 0 {
+		listing, err := tx.Listings.FindByID(tr.ListingID)
+		if err != nil {
+			return err
+		}
+		if listing.RestockOnRefund {
+			if err := tx.Listings.RestoreSupply(listing.ID, uint64(len(held))); err != nil {
+				return err
+			}
+			restocked = true
+		}
+	}
+
+	from, fromCents := tr.TransactionStatus, tr.RefundedCents
+	if left := int64(tr.PurchaseCents) - fromCents; tr.RoyaltyTransferID == "" && left > 0 {
+		// An unpaid royalty shrinks with what is left of the sale.
+		tr.RoyaltyCents = tr.RoyaltyCents * max(left-amountCents, 0) / left
+	}
+	tr.RefundedCents += amountCents
+	tr.RefundedQuantity = min(tr.RefundedQuantity+quantity, tr.PurchaseQuantity)
+	if err := tx.Transactions.UpdateFromRefunded(tr, from, fromCents); err != nil {
+		return err
+	}
+	if tr.RefundedCents >= int64(tr.PurchaseCents) {
+		if err := lifecycle.TransitionTransaction(tx.Transactions, tr, models.StatusRefunded, ""); err != nil {
+			return err
+		}
+	}
+
+	return tx.Refunds.Create(&models.RefundRecord{
+		ID:               uuid.New(),
+		TransactionID:    tr.ID,
+		ProviderRefundID: providerRefundID,
+		Quantity:         quantity,
+		AmountCents:      amountCents,
+		Revoked:          int64(len(held)),
+		Restocked:        restocked,
+		ActorID:          actorID,
+		Reason:           reason,
+		CreatedAt:        time.Now(),
+	})
+}
+
+// ReconcileRefund brings a transaction up to date with a charge.refunded
+// event. Refunds made through RefundTransaction are normally recorded
+// already; anything more, such as a refund from the Stripe dashboard,
+// revokes as many units as the extra money covers.
+func ReconcileRefund(ch *payments.Charge, uow repos.UnitOfWork) error {
+	tr, err := uow.Repos().Transactions.FindByStripePaymentIntentID(ch.PaymentIntentID)
+	if errors.Is(err, repos.ErrTransactionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return uow.WithTx(func(tx *repos.Repos) error {
+		fresh, err := tx.Transactions.FindByID(tr.ID)
+		if err != nil {
+			return err
+		}
+		amount := ch.AmountRefundedCents - fresh.RefundedCents
+		if amount <= 0 {
+			return nil
+		}
+		switch fresh.TransactionStatus {
+		case models.StatusFulfilled, models.StatusFailed, models.StatusDisputed:
+		default:
+			log.Printf("transaction %s: refund of %d cents while %s", fresh.ID, amount, fresh.TransactionStatus)
+			return nil
+		}
+
+		quantity := unitsCovered(fresh, ch.AmountRefundedCents) - fresh.RefundedQuantity
+		var held []*models.ContractState
+		if fresh.TransactionStatus != models.StatusFailed && quantity > 0 {
+			held, err = heldContracts(fresh, tx, models.StatusOwned, models.StatusUnlocked, models.StatusFrozen)
+			if err != nil {
+				return err
+			}
+			held = held[:min(int64(len(held)), quantity)]
+		}
+		return recordRefund(
+			tx, fresh, held, amount, max(quantity, 0), "", lifecycle.SystemActor, "refunded outside the marketplace")
+	})
+}
+
+// FreezeDisputed freezes the contracts of a disputed purchase that its
+// buyer still holds, so they cannot be used or passed on until the dispute
+// is settled. Contracts the buyer has on offer are taken off it first, and
+// checkouts holding them are released. An events.ContractFrozen event is
+// published for each contract once the freeze has committed.
+func FreezeDisputed(d *payments.Dispute, uow repos.UnitOfWork, bus *events.Bus) error {
+	tr, err := uow.Repos().Transactions.FindByStripePaymentIntentID(d.PaymentIntentID)
+	if errors.Is(err, repos.ErrTransactionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var frozen []*models.ContractState
+	var released []*models.TransactionRecord
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		frozen, released = nil, nil
+		fresh, err := tx.Transactions.FindByID(tr.ID)
+		if err != nil {
+			return err
+		}
+		if fresh.TransactionStatus != models.StatusFulfilled {
+			if fresh.StripeDisputeID != d.ID {
+				log.Printf("transaction %s: dispute %s while %s", fresh.ID, d.ID, fresh.TransactionStatus)
+			}
+			return nil
+		}
+
+		held, err := heldContracts(
+			fresh, tx, models.StatusOwned, models.StatusUnlocked, models.StatusListed, models.StatusMatched)
+		if err != nil {
+			return err
+		}
+		for _, state := range held {
+			record, err := releaseOffer(state, tx)
+			if err != nil {
+				return err
+			}
+			if record != nil {
+				released = append(released, record)
+			}
+			if state, err = tx.States.FindByID(state.HeaderID); err != nil {
+				return err
+			}
+			err = lifecycle.TransitionContract(
+				tx, state, models.StatusFrozen, lifecycle.SystemActor, "payment disputed: "+d.Reason)
+			if err != nil {
+				return err
+			}
+			frozen = append(frozen, state)
+		}
+		fresh.StripeDisputeID = d.ID
+		return lifecycle.TransitionTransaction(tx.Transactions, fresh, models.StatusDisputed, "")
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range released {
+		publishHoldReleased(bus, record)
+	}
+	for _, state := range frozen {
+		bus.Publish(events.Event{
+			Type:          events.ContractFrozen,
+			At:            time.Now(),
+			ContractID:    state.HeaderID,
+			TransactionID: tr.ID,
+			UserID:        state.OwnerID,
+			Reason:        "payment disputed: " + d.Reason,
+		})
+	}
+	return nil
+}
+
+// releaseOffer takes a contract its owner has on offer back to
+// StatusOwned: a checkout holding it in StatusMatched is released and
+// expired, and then an open resale listing or pending transfer of it is
+// cancelled, or its ask gives it up. It returns the checkout it released,
+// if any. Contracts not on offer are left alone.
+func releaseOffer(state *models.ContractState, tx *repos.Repos) (*models.TransactionRecord, error) {
+	var released *models.TransactionRecord
+	if state.Status == models.StatusMatched {
+		record, err := checkoutHolding(state.HeaderID, tx)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := releaseHold(record, tx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			released = record
+		}
+		if lifecycle.CanTransitionTransaction(record.TransactionStatus, models.StatusExpired) {
+			err := lifecycle.TransitionTransaction(tx.Transactions, record, models.StatusExpired, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		if state, err = tx.States.FindByID(state.HeaderID); err != nil {
+			return nil, err
+		}
+	}
+	if state.Status != models.StatusListed {
+		return released, nil
+	}
+
+	resale, err := tx.Resales.FindOpenByHeaderID(state.HeaderID)
+	switch {
+	case err == nil:
+		if err := tx.Resales.Close(resale.ID, models.ResaleCancelled); err != nil {
+			return nil, err
+		}
+		return released, lifecycle.TransitionContract(
+			tx, state, models.StatusOwned, lifecycle.SystemActor, "resale withdrawn: payment disputed")
+	case !errors.Is(err, repos.ErrResaleListingNotFound):
+		return nil, err
+	}
+
+	row, err := tx.Orders.FindAskContractByHeaderID(state.HeaderID)
+	switch {
+	case err == nil:
+		order, err := tx.Orders.FindByID(row.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Orders.RemoveAskContracts([]uuid.UUID{row.HeaderID}); err != nil {
+			return nil, err
+		}
+		if order.Status == models.OrderOpen && order.Remaining > 0 {
+			if err := tx.Orders.SetRemaining(order.ID, order.Remaining-1); err != nil {
+				return nil, err
+			}
+		}
+		return released, lifecycle.TransitionContract(
+			tx, state, models.StatusOwned, lifecycle.SystemActor, "ask withdrawn: payment disputed")
+	case !errors.Is(err, repos.ErrAskContractNotFound):
+		return nil, err
+	}
+
+	transfers, err := tx.Transfers.FindAllByHeaderID(state.HeaderID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range transfers {
+		if transfers[i].Status == models.TransferPending {
+			return released, returnTransfer(
+				tx, &transfers[i], models.TransferCancelled, lifecycle.SystemActor, time.Now())
+		}
+	}
+	return nil, fmt.Errorf("contract %s is listed but not on offer anywhere", state.HeaderID)
+}
+
+// checkoutHolding finds the checkout that holds a contract in
+// StatusMatched: an order book fill, a resale or an option exercise.
+func checkoutHolding(headerID uuid.UUID, tx *repos.Repos) (*models.TransactionRecord, error) {
+	if resale, err := tx.Resales.FindOpenByHeaderID(headerID); err == nil {
+		return tx.Transactions.FindOpenByResaleListingID(resale.ID)
+	} else if !errors.Is(err, repos.ErrResaleListingNotFound) {
+		return nil, err
+	}
+
+	row, err := tx.Orders.FindAskContractByHeaderID(headerID)
+	switch {
+	case err == nil && row.FillID != nil:
+		fill, err := tx.Fills.FindByID(*row.FillID)
+		if err != nil {
+			return nil, err
+		}
+		return tx.Transactions.FindByID(fill.TransactionID)
+	case err != nil && !errors.Is(err, repos.ErrAskContractNotFound):
+		return nil, err
+	}
+
+	return tx.Transactions.FindOpenExerciseByHeaderID(headerID)
+}
+
+// SettleDispute applies the outcome of a closed dispute. A won dispute
+// reinstates the purchase and thaws its contracts; a lost one counts the
+// disputed amount as refunded and revokes the contracts it covers.
+func SettleDispute(d *payments.Dispute, uow repos.UnitOfWork) error {
+	tr, err := uow.Repos().Transactions.FindByStripePaymentIntentID(d.PaymentIntentID)
+	if errors.Is(err, repos.ErrTransactionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return uow.WithTx(func(tx *repos.Repos) error {
+		fresh, err := tx.Transactions.FindByID(tr.ID)
+		if err != nil {
+			return err
+		}
+		if fresh.TransactionStatus != models.StatusDisputed || fresh.StripeDisputeID != d.ID {
+			return nil
+		}
+		frozen, err := heldContracts(fresh, tx, models.StatusFrozen)
+		if err != nil {
+			return err
+		}
+
+		switch d.Status {
+		case payments.DisputeStatusWon, payments.DisputeStatusWarningClosed:
+		case payments.DisputeStatusLost:
+			amount := min(d.AmountCents, int64(fresh.PurchaseCents)-fresh.RefundedCents)
+			quantity := unitsCovered(fresh, fresh.RefundedCents+amount) - fresh.RefundedQuantity
+			n := min(int64(len(frozen)), max(quantity, 0))
+			err := recordRefund(
+				tx, fresh, frozen[:n], amount, max(quantity, 0), "", lifecycle.SystemActor, "dispute lost")
+			if err != nil {
+				return err
+			}
+			frozen = frozen[n:]
+		default:
+			return fmt.Errorf("dispute %s closed as %s", d.ID, d.Status)
+		}
+
+		for _, state := range frozen {
+			to, err := statusBeforeFreeze(state.HeaderID, tx)
+			if err != nil {
+				return err
+			}
+			if err := lifecycle.TransitionContract(tx, state, to, lifecycle.SystemActor, "dispute "+d.Status); err != nil {
+				return err
+			}
+		}
+		if fresh.TransactionStatus == models.StatusDisputed {
+			return lifecycle.TransitionTransaction(tx.Transactions, fresh, models.StatusFulfilled, "")
+		}
+		return nil
+	})
+}
+
+// statusBeforeFreeze is the status a frozen contract was in when it was
+// frozen, according to its history.
+func statusBeforeFreeze(headerID uuid.UUID, tx *repos.Repos) (models.ContractStatus, error) {
+	history, err := tx.StateHistory.FindAllByHeaderID(headerID)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].ToStatus == models.StatusFrozen {
+			return history[i].FromStatus, nil
+		}
+	}
+	return models.StatusOwned, nil
+}
+
+type RefundRequest struct {
+	// Quantity is how many units to refund; zero refunds all that is left.
+	Quantity int64  `json:"quantity"`
+	Reason   string `json:"reason"`
+}
+
+// TransactionRefunds is a transaction and every refund made of it.
+type TransactionRefunds struct {
+	Transaction *models.TransactionRecord `json:"transaction"`
+	Refunds     []models.RefundRecord     `json:"refunds"`
+}
+
+// RefundHandler serves POST /v1/transactions/{id}/refund, where the seller
+// or an admin refunds a purchase in full or by the unit.
+func RefundHandler(provider payments.PaymentProvider, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid transaction id", http.StatusBadRequest)
+			return
+		}
+		req := &RefundRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Quantity < 0 {
+			http.Error(w, "quantity must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		tr, err := RefundTransaction(id, u, req.Quantity, req.Reason, provider, uow)
+		switch {
+		case errors.Is(err, repos.ErrTransactionNotFound):
+			http.Error(w, "transaction not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errNotRefunder):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, errRefundTooLarge):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, errNotRefundable),
+			errors.Is(err, repos.ErrTransactionStatusConflict),
+			errors.Is(err, repos.ErrContractStatusConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, payments.ErrPaymentNotFound):
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		case err != nil:
+			http.Error(w, "failed to refund: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		refunds, err := rs.Refunds.FindAllByTransactionID(tr.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch refunds: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&TransactionRefunds{Transaction: tr, Refunds: refunds})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+// resaleCheckout starts a checkout of resale as another user would,
+// holding its contract in StatusMatched.
+func (m *testMarket) resaleCheckout(t *testing.T, resale *models.ResaleListing) *models.TransactionRecord {
+	t.Helper()
+	other := m.user(t, "other buyer")
+	tr := &models.TransactionRecord{
+		ID:                uuid.New(),
+		InitiatedAt:       time.Now(),
+		SellerID:          resale.SellerID,
+		BuyerID:           other.ID,
+		PurchaseQuantity:  1,
+		TransactionStatus: models.StatusRequiresPayment,
+		Kind:              models.KindResale,
+		ResaleListingID:   resale.ID,
+	}
+	err := m.uow.WithTx(func(tx *repos.Repos) error {
+		state, err := tx.States.FindByID(resale.HeaderID)
+		if err != nil {
+			return err
+		}
+		err = lifecycle.TransitionContract(tx, state, models.StatusMatched, other.ID, "resale checkout")
+		if err != nil {
+			return err
+		}
+		if err := tx.Transactions.Create(tr); err != nil {
+			return err
+		}
+		return tx.Reservations.Create(&models.SupplyReservation{
+			ID:            uuid.New(),
+			Kind:          models.KindResale,
+			ListingID:     resale.ID,
+			TransactionID: tr.ID,
+			Quantity:      1,
+			Status:        models.ReservationActive,
+			ExpiresAt:     time.Now().Add(ReservationTTL()),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestDisputeWithdrawsResoldContracts(t *testing.T) {
+	m := newTestMarket(t)
+	listing := m.listing(t, &ListingParams{SupplyLimit: 2})
+	purchase := m.buy(t, listing.ID, 2)
+	owned := m.owned(t, m.buyer)
+
+	var resales []*models.ResaleListing
+	for _, state := range owned {
+		resale, err := CreateResaleListing(m.buyer.ID, state.HeaderID, 2_000_000_000, m.provider, m.uow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resales = append(resales, resale)
+	}
+	checkout := m.resaleCheckout(t, resales[1])
+
+	if _, err := m.provider.OpenDispute(purchase.StripePaymentIntentID, "fraudulent"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.transaction(t, purchase.ID).TransactionStatus; got != models.StatusDisputed {
+		t.Fatalf("disputed purchase is %s", got)
+	}
+	rs := m.uow.Repos()
+	for i, resale := range resales {
+		state, err := rs.States.FindByID(resale.HeaderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Status != models.StatusFrozen {
+			t.Errorf("contract %d is %s, want frozen", i, state.Status)
+		}
+		resale, err = rs.Resales.FindByID(resale.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resale.Status != models.ResaleCancelled {
+			t.Errorf("resale %d is %v, want cancelled", i, resale.Status)
+		}
+	}
+	if got := m.transaction(t, checkout.ID).TransactionStatus; got != models.StatusExpired {
+		t.Errorf("checkout of a disputed contract is %s, want expired", got)
+	}
+	reservation, err := rs.Reservations.FindByTransactionID(checkout.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reservation.Status != models.ReservationReleased {
+		t.Errorf("checkout hold is %v, want released", reservation.Status)
+	}
+}
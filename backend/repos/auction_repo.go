@@ -0,0 +1,186 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAuctionNotFound        = errors.New("auction not found")
+	ErrAuctionNotOpen         = errors.New("auction is no longer open")
+	ErrAuctionVersionConflict = errors.New("auction was modified concurrently")
+	ErrAuctionBidNotFound     = errors.New("bid not found")
+)
+
+type AuctionRepository interface {
+	BaseRepository[models.AuctionListing]
+	FindAllOpen() ([]models.AuctionListing, error)
+	FindAllOpenByListingID(listingID uuid.UUID) ([]models.AuctionListing, error)
+	FindAllBySellerID(sellerID uuid.UUID) ([]models.AuctionListing, error)
+	// FindAllDueToClose returns up to limit open auctions whose EndsAt is
+	// at or before now.
+	FindAllDueToClose(now time.Time, limit int) ([]models.AuctionListing, error)
+
+	// FindBidsByAuctionID returns the auction's bids best first: highest
+	// price, then earliest placed.
+	FindBidsByAuctionID(auctionID uuid.UUID) ([]models.AuctionBid, error)
+	FindBidsByBidderID(bidderID uuid.UUID) ([]models.AuctionBid, error)
+	FindBid(auctionID, bidderID uuid.UUID) (*models.AuctionBid, error)
+	SaveBid(bid *models.AuctionBid) error
+}
+
+type auctionRepository struct {
+	db *gorm.DB
+}
+
+func NewAuctionRepository(db *gorm.DB) AuctionRepository {
+	return &auctionRepository{db: db}
+}
+
+func (r *auctionRepository) FindByID(id uuid.UUID) (*models.AuctionListing, error) {
+	var auction models.AuctionListing
+	result := r.db.First(&auction, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrAuctionNotFound
+		}
+		return nil, result.Error
+	}
+	return &auction, nil
+}
+
+func (r *auctionRepository) FindAll() ([]models.AuctionListing, error) {
+	var auctions []models.AuctionListing
+	result := r.db.Find(&auctions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return auctions, nil
+}
+
+func (r *auctionRepository) FindAllOpen() ([]models.AuctionListing, error) {
+	var auctions []models.AuctionListing
+	result := r.db.Where("status = ?", models.AuctionOpen).Order("ends_at ASC").Find(&auctions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return auctions, nil
+}
+
+func (r *auctionRepository) FindAllOpenByListingID(listingID uuid.UUID) ([]models.AuctionListing, error) {
+	var auctions []models.AuctionListing
+	result := r.db.
+		Where("listing_id = ? AND status = ?", listingID, models.AuctionOpen).
+		Order("ends_at ASC").
+		Find(&auctions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return auctions, nil
+}
+
+func (r *auctionRepository) FindAllBySellerID(sellerID uuid.UUID) ([]models.AuctionListing, error) {
+	var auctions []models.AuctionListing
+	result := r.db.Where("seller_id = ?", sellerID).Order("created_at ASC").Find(&auctions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return auctions, nil
+}
+
+func (r *auctionRepository) FindAllDueToClose(now time.Time, limit int) ([]models.AuctionListing, error) {
+	var auctions []models.AuctionListing
+	result := r.db.
+		Where("status = ? AND ends_at <= ?", models.AuctionOpen, now).
+		Order("ends_at ASC").
+		Limit(limit).
+		Find(&auctions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return auctions, nil
+}
+
+func (r *auctionRepository) Create(auction *models.AuctionListing) error {
+	result := r.db.Create(auction)
+	return result.Error
+}
+
+// Update writes the auction only if nobody else has since it was read,
+// returning ErrAuctionVersionConflict otherwise.
+func (r *auctionRepository) Update(auction *models.AuctionListing) error {
+	expected := auction.Version
+	auction.Version++
+
+	result := r.db.Model(auction).
+		Where("version = ?", expected).
+		Select("*").
+		Omit("created_at").
+		Updates(auction)
+	if result.Error != nil {
+		auction.Version = expected
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		auction.Version = expected
+		if _, err := r.FindByID(auction.ID); err != nil {
+			return err
+		}
+		return ErrAuctionVersionConflict
+	}
+	return nil
+}
+
+func (r *auctionRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.AuctionListing{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAuctionNotFound
+	}
+	return nil
+}
+
+func (r *auctionRepository) FindBidsByAuctionID(auctionID uuid.UUID) ([]models.AuctionBid, error) {
+	var bids []models.AuctionBid
+	result := r.db.
+		Where("auction_id = ?", auctionID).
+		Order("price_nanos DESC").
+		Order("placed_at ASC").
+		Find(&bids)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return bids, nil
+}
+
+func (r *auctionRepository) FindBidsByBidderID(bidderID uuid.UUID) ([]models.AuctionBid, error) {
+	var bids []models.AuctionBid
+	result := r.db.Where("bidder_id = ?", bidderID).Order("placed_at DESC").Find(&bids)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return bids, nil
+}
+
+func (r *auctionRepository) FindBid(auctionID, bidderID uuid.UUID) (*models.AuctionBid, error) {
+	var bid models.AuctionBid
+	result := r.db.First(&bid, "auction_id = ? AND bidder_id = ?", auctionID, bidderID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrAuctionBidNotFound
+		}
+		return nil, result.Error
+	}
+	return &bid, nil
+}
+
+func (r *auctionRepository) SaveBid(bid *models.AuctionBid) error {
+	result := r.db.Save(bid)
+	return result.Error
+}
@@ -0,0 +1,94 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrBookFillNotFound = errors.New("fill not found")
+
+type BookFillRepository interface {
+	BaseRepository[models.BookFill]
+	FindAllByListingID(listingID uuid.UUID) ([]models.BookFill, error)
+	FindAllByTraderID(traderID uuid.UUID) ([]models.BookFill, error)
+}
+
+type bookFillRepository struct {
+	db *gorm.DB
+}
+
+func NewBookFillRepository(db *gorm.DB) BookFillRepository {
+	return &bookFillRepository{db: db}
+}
+
+func (r *bookFillRepository) FindByID(id uuid.UUID) (*models.BookFill, error) {
+	var fill models.BookFill
+	result := r.db.First(&fill, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrBookFillNotFound
+		}
+		return nil, result.Error
+	}
+	return &fill, nil
+}
+
+func (r *bookFillRepository) FindAll() ([]models.BookFill, error) {
+	var fills []models.BookFill
+	result := r.db.Find(&fills)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return fills, nil
+}
+
+func (r *bookFillRepository) FindAllByListingID(listingID uuid.UUID) ([]models.BookFill, error) {
+	var fills []models.BookFill
+	result := r.db.Where("listing_id = ?", listingID).Order("created_at ASC").Find(&fills)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return fills, nil
+}
+
+func (r *bookFillRepository) FindAllByTraderID(traderID uuid.UUID) ([]models.BookFill, error) {
+	var fills []models.BookFill
+	result := r.db.
+		Where("buyer_id = ? OR seller_id = ?", traderID, traderID).
+		Order("created_at DESC").
+		Find(&fills)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return fills, nil
+}
+
+func (r *bookFillRepository) Create(fill *models.BookFill) error {
+	result := r.db.Create(fill)
+	return result.Error
+}
+
+func (r *bookFillRepository) Update(fill *models.BookFill) error {
+	result := r.db.Save(fill)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBookFillNotFound
+	}
+	return nil
+}
+
+func (r *bookFillRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.BookFill{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBookFillNotFound
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrBookOrderNotFound   = errors.New("order not found")
+	ErrBookOrderNotOpen    = errors.New("order is no longer open")
+	ErrAskContractNotFound = errors.New("contract is not offered by an ask")
+)
+
+type BookOrderRepository interface {
+	BaseRepository[models.BookOrder]
+	FindAllOpenByListingID(listingID uuid.UUID) ([]models.BookOrder, error)
+	FindAllByTraderID(traderID uuid.UUID) ([]models.BookOrder, error)
+
+	// SetRemaining records how much of an open order is left, marking it
+	// filled at zero.
+	SetRemaining(id uuid.UUID, remaining uint64) error
+	// Cancel closes an open order, failing with ErrBookOrderNotOpen if it
+	// was already filled or cancelled.
+	Cancel(id uuid.UUID) error
+	// Reopen adds quantity back to an open or filled order, reopening it if
+	// need be. It fails with ErrBookOrderNotOpen if the order was cancelled.
+	Reopen(id uuid.UUID, quantity uint64) error
+
+	AddAskContracts(orderID uuid.UUID, headerIDs []uuid.UUID) error
+	FindAskContractByHeaderID(headerID uuid.UUID) (*models.AskContract, error)
+	// FindUnmatchedAskContracts returns up to limit contracts of the ask
+	// that have not been matched yet, locking them for the transaction.
+	FindUnmatchedAskContracts(orderID uuid.UUID, limit int) ([]models.AskContract, error)
+	FindAskContractsByFillID(fillID uuid.UUID) ([]models.AskContract, error)
+	MatchAskContracts(headerIDs []uuid.UUID, fillID uuid.UUID) error
+	UnmatchAskContracts(headerIDs []uuid.UUID) error
+	RemoveAskContracts(headerIDs []uuid.UUID) error
+}
+
+type bookOrderRepository struct {
+	db *gorm.DB
+}
+
+func NewBookOrderRepository(db *gorm.DB) BookOrderRepository {
+	return &bookOrderRepository{db: db}
+}
+
+func (r *bookOrderRepository) FindByID(id uuid.UUID) (*models.BookOrder, error) {
+	var order models.BookOrder
+	result := r.db.First(&order, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrBookOrderNotFound
+		}
+		return nil, result.Error
+	}
+	return &order, nil
+}
+
+func (r *bookOrderRepository) FindAll() ([]models.BookOrder, error) {
+	var orders []models.BookOrder
+	result := r.db.Find(&orders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return orders, nil
+}
+
+func (r *bookOrderRepository) FindAllOpenByListingID(listingID uuid.UUID) ([]models.BookOrder, error) {
+	var orders []models.BookOrder
+	result := r.db.
+		Where("listing_id = ? AND status = ?", listingID, models.OrderOpen).
+		Order("seq ASC").
+		Find(&orders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return orders, nil
+}
+
+func (r *bookOrderRepository) FindAllByTraderID(traderID uuid.UUID) ([]models.BookOrder, error) {
+	var orders []models.BookOrder
+	result := r.db.Where("trader_id = ?", traderID).Order("created_at DESC").Find(&orders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return orders, nil
+}
+
+func (r *bookOrderRepository) Create(order *models.BookOrder) error {
+	result := r.db.Create(order)
+	return result.Error
+}
+
+func (r *bookOrderRepository) Update(order *models.BookOrder) error {
+	result := r.db.Save(order)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBookOrderNotFound
+	}
+	return nil
+}
+
+func (r *bookOrderRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.BookOrder{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrBookOrderNotFound
+	}
+	return nil
+}
+
+func (r *bookOrderRepository) SetRemaining(id uuid.UUID, remaining uint64) error {
+	status := models.OrderOpen
+	if remaining == 0 {
+		status = models.OrderFilled
+	}
+	return r.closeOpen(id, map[string]any{
+		"remaining":  remaining,
+		"status":     status,
+		"updated_at": time.Now(),
+	})
+}
+
+func (r *bookOrderRepository) Cancel(id uuid.UUID) error {
+	return r.closeOpen(id, map[string]any{
+		"status":     models.OrderCancelled,
+		"updated_at": time.Now(),
+	})
+}
+
+func (r *bookOrderRepository) Reopen(id uuid.UUID, quantity uint64) error {
+	result := r.db.Model(&models.BookOrder{}).
+		Where("id = ? AND status IN ?", id, []models.OrderStatus{models.OrderOpen, models.OrderFilled}).
+		Updates(map[string]any{
+			"remaining":  gorm.Expr("remaining + ?", quantity),
+			"status":     models.OrderOpen,
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(id); err != nil {
+			return err
+		}
+		return ErrBookOrderNotOpen
+	}
+	return nil
+}
+
+// closeOpen applies updates to an order only while it is open.
+func (r *bookOrderRepository) closeOpen(id uuid.UUID, updates map[string]any) error {
+	result := r.db.Model(&models.BookOrder{}).
+		Where("id = ? AND status = ?", id, models.OrderOpen).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(id); err != nil {
+			return err
+		}
+		return ErrBookOrderNotOpen
+	}
+	return nil
+}
+
+func (r *bookOrderRepository) AddAskContracts(orderID uuid.UUID, headerIDs []uuid.UUID) error {
+	rows := make([]models.AskContract, len(headerIDs))
+	for i, id := range headerIDs {
+		rows[i] = models.AskContract{HeaderID: id, OrderID: orderID}
+	}
+	result := r.db.Create(&rows)
+	return result.Error
+}
+
+func (r *bookOrderRepository) FindAskContractByHeaderID(headerID uuid.UUID) (*models.AskContract, error) {
+	var row models.AskContract
+	result := r.db.First(&row, "header_id = ?", headerID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrAskContractNotFound
+		}
+		return nil, result.Error
+	}
+	return &row, nil
+}
+
+func (r *bookOrderRepository) FindUnmatchedAskContracts(orderID uuid.UUID, limit int) ([]models.AskContract, error) {
+	var rows []models.AskContract
+	result := r.db.
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND fill_id IS NULL", orderID).
+		Order("header_id ASC").
+		Limit(limit).
+		Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return rows, nil
+}
+
+func (r *bookOrderRepository) FindAskContractsByFillID(fillID uuid.UUID) ([]models.AskContract, error) {
+	var rows []models.AskContract
+	result := r.db.Where("fill_id = ?", fillID).Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return rows, nil
+}
+
+func (r *bookOrderRepository) MatchAskContracts(headerIDs []uuid.UUID, fillID uuid.UUID) error {
+	result := r.db.Model(&models.AskContract{}).
+		Where("header_id IN ? AND fill_id IS NULL", headerIDs).
+		Update("fill_id", fillID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != int64(len(headerIDs)) {
+		return ErrAskContractNotFound
+	}
+	return nil
+}
+
+func (r *bookOrderRepository) UnmatchAskContracts(headerIDs []uuid.UUID) error {
+	if len(headerIDs) == 0 {
+		return nil
+	}
+	result := r.db.Model(&models.AskContract{}).
+		Where("header_id IN ?", headerIDs).
+		Update("fill_id", nil)
+	return result.Error
+}
+
+func (r *bookOrderRepository) RemoveAskContracts(headerIDs []uuid.UUID) error {
+	if len(headerIDs) == 0 {
+		return nil
+	}
+	result := r.db.Delete(&models.AskContract{}, "header_id IN ?", headerIDs)
+	return result.Error
+}
@@ -18,6 +18,8 @@ type ContractHeaderRepository interface {
 	FindAllBySellerID(sellerID uuid.UUID) ([]models.ContractHeader, error)
 	FindAllByDatastreamID(datastreamID uuid.UUID) ([]models.ContractHeader, error)
 	FindAllByListingID(listingID uuid.UUID) ([]models.ContractHeader, error)
+	FindAllBySubscriptionID(subscriptionID uuid.UUID) ([]models.ContractHeader, error)
+	CountByListingID(listingID uuid.UUID) (int64, error)
 
 	FindAllByRemainingQuota(minRemainingQuota uint64) ([]models.ContractHeader, error)
 	FindAllByQuotaRange(minQuota, maxQuota uint64) ([]models.ContractHeader, error)
@@ -29,6 +31,15 @@ type ContractHeaderRepository interface {
 	FindAllActive(now time.Time) ([]models.ContractHeader, error)
 
 	FindAllByPriceRange(minPriceNanos, maxPriceNanos int64) ([]models.ContractHeader, error)
+
+	CreateInBatches(headers []*models.ContractHeader, batchSize int) error
+
+	// AttachSubscription makes the contracts part of a subscription that
+	// runs until exerciseBy, issuing one UPDATE per batchSize contracts.
+	AttachSubscription(headerIDs []uuid.UUID, subscriptionID uuid.UUID, exerciseBy time.Time, batchSize int) error
+	// SetSubscriptionExpiry moves the ExerciseBy of every contract in the
+	// subscription.
+	SetSubscriptionExpiry(subscriptionID uuid.UUID, exerciseBy time.Time) error
 }
 
 type contractHeaderRepository struct {
@@ -65,6 +76,46 @@ func (r *contractHeaderRepository) Create(contractHeader *models.ContractHeader)
 	return result.Error
 }
 
+func (r *contractHeaderRepository) CreateInBatches(headers []*models.ContractHeader, batchSize int) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	result := r.db.CreateInBatches(headers, batchSize)
+	return result.Error
+}
+
+func (r *contractHeaderRepository) FindAllBySubscriptionID(subscriptionID uuid.UUID) ([]models.ContractHeader, error) {
+	var contractHeaders []models.ContractHeader
+	result := r.db.Where("subscription_id = ?", subscriptionID).Find(&contractHeaders)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return contractHeaders, nil
+}
+
+func (r *contractHeaderRepository) AttachSubscription(headerIDs []uuid.UUID, subscriptionID uuid.UUID, exerciseBy time.Time, batchSize int) error {
+	for start := 0; start < len(headerIDs); start += batchSize {
+		end := min(start+batchSize, len(headerIDs))
+		result := r.db.Model(&models.ContractHeader{}).
+			Where("id IN ?", headerIDs[start:end]).
+			Updates(map[string]any{
+				"subscription_id": subscriptionID,
+				"exercise_by":     exerciseBy,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+func (r *contractHeaderRepository) SetSubscriptionExpiry(subscriptionID uuid.UUID, exerciseBy time.Time) error {
+	result := r.db.Model(&models.ContractHeader{}).
+		Where("subscription_id = ?", subscriptionID).
+		Update("exercise_by", exerciseBy)
+	return result.Error
+}
+
 func (r *contractHeaderRepository) Update(contractHeader *models.ContractHeader) error {
 	result := r.db.Save(contractHeader)
 	if result.Error != nil {
@@ -114,6 +165,15 @@ func (r *contractHeaderRepository) FindAllByListingID(listingID uuid.UUID) ([]mo
 	return contractHeaders, nil
 }
 
+func (r *contractHeaderRepository) CountByListingID(listingID uuid.UUID) (int64, error) {
+	var count int64
+	result := r.db.Model(&models.ContractHeader{}).Where("listing_id = ?", listingID).Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return count, nil
+}
+
 func (r *contractHeaderRepository) FindAllByRemainingQuota(minRemainingQuota uint64) ([]models.ContractHeader, error) {
 	var headers []models.ContractHeader
 	result := r.db.Where("quota_reads >= ?", minRemainingQuota).Find(&headers)
@@ -161,7 +221,7 @@ func (r *contractHeaderRepository) FindAllExpired(now time.Time) ([]models.Contr
 
 func (r *contractHeaderRepository) FindAllActive(now time.Time) ([]models.ContractHeader, error) {
 	var headers []models.ContractHeader
-	result := r.db.Where("exercise_by > ?", now).Find(&headers)
+	result := r.db.Where("exercise_by IS NULL OR exercise_by > ?", now).Find(&headers)
 	if result.Error != nil {
 		return nil, result.Error
 	}
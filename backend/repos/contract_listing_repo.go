@@ -10,7 +10,9 @@ import (
 )
 
 var (
-	ErrListingNotFound = errors.New("listing not found")
+	ErrListingNotFound        = errors.New("listing not found")
+	ErrListingVersionConflict = errors.New("listing was modified concurrently")
+	ErrInsufficientSupply     = errors.New("not enough supply")
 	// ErrInvalidSellerID = errors.New("invalid seller ID")
 	// ErrInvalidDatastreamID = errors.New("invalid datastream ID")
 	// ErrListingIssued = errors.New("cannot perform this operation after the listing has been issued")
@@ -29,6 +31,14 @@ type ContractListingRepository interface {
 
 	FindAllExpiringBefore(deadline time.Time) ([]models.ContractListing, error)
 	FindAllValidListings(now time.Time) ([]models.ContractListing, error)
+
+	// DecrementSupply atomically takes quantity units from a listing's
+	// remaining supply, failing with ErrInsufficientSupply rather than
+	// letting it go below zero.
+	DecrementSupply(id uuid.UUID, quantity uint64) error
+	// RestoreSupply gives quantity units back to a listing's remaining
+	// supply, such as those an auction did not sell.
+	RestoreSupply(id uuid.UUID, quantity uint64) error
 }
 
 type contractListingRepository struct {
@@ -57,7 +67,7 @@ func NewListingRepository(db *gorm.DB) ContractListingRepository {
 
 func (r *contractListingRepository) FindByID(id uuid.UUID) (*models.ContractListing, error) {
 	var listing models.ContractListing
-	result := r.db.First(&listing, "listing_id = ?", id)
+	result := r.db.First(&listing, "id = ?", id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, ErrListingNotFound
@@ -82,20 +92,40 @@ func (r *contractListingRepository) Create(listing *models.ContractListing) erro
 	return result.Error
 }
 
+// Update writes the listing only if nobody else has since it was read,
+// returning ErrListingVersionConflict otherwise.
 func (r *contractListingRepository) Update(listing *models.ContractListing) error {
-	result := r.db.Save(listing)
+	expected := listing.Version
+	listing.Version++
+
+	result := r.db.Model(listing).
+		Where("version = ?", expected).
+		Select("*").
+		Omit("created_at").
+		Updates(listing)
+	if result.Error != nil {
+		listing.Version = expected
+		return result.Error
+	}
 	if result.RowsAffected == 0 {
-		return ErrListingNotFound
+		listing.Version = expected
+		if _, err := r.FindByID(listing.ID); err != nil {
+			return err
+		}
+		return ErrListingVersionConflict
 	}
-	return result.Error
+	return nil
 }
 
 func (r *contractListingRepository) Delete(id uuid.UUID) error {
-	result := r.db.Delete(&models.ContractListing{}, "listing_id = ?", id)
+	result := r.db.Delete(&models.ContractListing{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
 	if result.RowsAffected == 0 {
 		return ErrListingNotFound
 	}
-	return result.Error
+	return nil
 }
 
 func (r *contractListingRepository) FindAllBySellerID(sellerID uuid.UUID) ([]models.ContractListing, error) {
@@ -153,9 +183,46 @@ func (r *contractListingRepository) FindAllExpiringBefore(deadline time.Time) ([
 
 func (r *contractListingRepository) FindAllValidListings(now time.Time) ([]models.ContractListing, error) {
 	var listings []models.ContractListing
-	result := r.db.Where("exercise_by > ?", now).Find(&listings)
+	result := r.db.Where("exercise_by IS NULL OR exercise_by > ?", now).Find(&listings)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 	return listings, nil
 }
+
+func (r *contractListingRepository) DecrementSupply(id uuid.UUID, quantity uint64) error {
+	result := r.db.Model(&models.ContractListing{}).
+		Where("id = ? AND supply_remaining >= ?", id, quantity).
+		Updates(map[string]any{
+			"supply_remaining": gorm.Expr("supply_remaining - ?", quantity),
+			"version":          gorm.Expr("version + 1"),
+			"updated_at":       time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(id); err != nil {
+			return err
+		}
+		return ErrInsufficientSupply
+	}
+	return nil
+}
+
+func (r *contractListingRepository) RestoreSupply(id uuid.UUID, quantity uint64) error {
+	result := r.db.Model(&models.ContractListing{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"supply_remaining": gorm.Expr("supply_remaining + ?", quantity),
+			"version":          gorm.Expr("version + 1"),
+			"updated_at":       time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrListingNotFound
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ContractStateHistoryRepository is append-only: history is never updated
+// or deleted.
+type ContractStateHistoryRepository interface {
+	Create(entry *models.ContractStateHistory) error
+	CreateInBatches(entries []*models.ContractStateHistory, batchSize int) error
+	FindAllByHeaderID(headerID uuid.UUID) ([]models.ContractStateHistory, error)
+}
+
+type contractStateHistoryRepository struct {
+	db *gorm.DB
+}
+
+func NewContractStateHistoryRepository(db *gorm.DB) ContractStateHistoryRepository {
+	return &contractStateHistoryRepository{db: db}
+}
+
+func (r *contractStateHistoryRepository) Create(entry *models.ContractStateHistory) error {
+	result := r.db.Create(entry)
+	return result.Error
+}
+
+func (r *contractStateHistoryRepository) CreateInBatches(entries []*models.ContractStateHistory, batchSize int) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	result := r.db.CreateInBatches(entries, batchSize)
+	return result.Error
+}
+
+func (r *contractStateHistoryRepository) FindAllByHeaderID(headerID uuid.UUID) ([]models.ContractStateHistory, error) {
+	var entries []models.ContractStateHistory
+	result := r.db.Where("header_id = ?", headerID).Order("created_at ASC").Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
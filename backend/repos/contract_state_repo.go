@@ -1,15 +1,21 @@
 package repos
 
 import (
-	"errors"
 	"contract_market_demo/backend/models"
+	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 var (
-	ErrContractStateNotFound = errors.New("contract state not found")
+	ErrContractStateNotFound  = errors.New("contract state not found")
+	ErrContractStatusConflict = errors.New("contract status changed concurrently")
+	ErrContractNotUsable      = errors.New("contract is not in a usable status")
+	ErrQuotaExhausted         = errors.New("contract quota exhausted")
+	ErrOverageCapReached      = errors.New("overage spending cap reached")
+	ErrOverageBillingConflict = errors.New("overage was billed concurrently")
 )
 
 type ContractStateRepository interface {
@@ -21,8 +27,57 @@ type ContractStateRepository interface {
 
 	FindByContractID(contractID uuid.UUID) (*models.ContractState, error)
 
-	UpdateStatus(contractID uuid.UUID, newStatus models.ContractStatus) error
+	// FindAllDueForExpiry returns up to limit contracts whose access ends,
+	// at the header's access_until if set and its exercise_by otherwise, at
+	// or before now and that are in one of the given statuses, soonest due
+	// first.
+	FindAllDueForExpiry(now time.Time, statuses []models.ContractStatus, limit int) ([]models.ContractState, error)
+
+	// UpdateStatus and UpdateOwner only write if the contract is still in
+	// the from status, failing with ErrContractStatusConflict otherwise.
+	// Callers should go through the lifecycle package rather than use them
+	// directly.
+	UpdateStatus(contractID uuid.UUID, from, to models.ContractStatus) error
+	UpdateOwner(contractID uuid.UUID, from models.ContractStatus, ownerID uuid.UUID, to models.ContractStatus, purchasedAt time.Time) error
 	UpdateReadsRemaining(contractID uuid.UUID, readsRemaining uint64) error
+
+	// DebitUsage atomically records reads and bytes consumed by a contract
+	// in one of the usable statuses. Where limitReads or limitBytes is set
+	// the matching remaining counter is debited too, and the whole debit is
+	// refused with ErrQuotaExhausted if it would go below zero. A contract
+	// in any other status fails with ErrContractNotUsable.
+	DebitUsage(contractID uuid.UUID, reads, bytes uint64, limitReads, limitBytes bool, usable []models.ContractStatus) error
+	// DebitUsageWithOverage is DebitUsage for a contract whose read quota
+	// may be overdrawn at overagePriceNanos a read. Reads past
+	// ReadsRemaining are added to OverageReads instead of being refused,
+	// unless that would take the overage not yet billed past
+	// OverageCapCents, in which case the debit fails with
+	// ErrOverageCapReached (or ErrQuotaExhausted if the owner set no cap).
+	DebitUsageWithOverage(contractID uuid.UUID, reads, bytes uint64, limitBytes bool, overagePriceNanos int64, usable []models.ContractStatus) error
+	// ChargeUsage records usage that has already happened, whatever the
+	// contract's status, clamping the remaining counters at zero rather
+	// than refusing. With overage set, reads past the quota are added to
+	// OverageReads.
+	ChargeUsage(contractID uuid.UUID, reads, bytes uint64, overage bool) error
+	// ResetSubscriptionQuotas gives every contract in the subscription its
+	// header's full quota of reads and bytes again, for a new period.
+	ResetSubscriptionQuotas(subscriptionID uuid.UUID) error
+
+	// SetOverageCap sets how much the owner allows to be spent on overage,
+	// failing with ErrContractStatusConflict if ownerID no longer owns the
+	// contract.
+	SetOverageCap(contractID, ownerID uuid.UUID, capCents int64) error
+	// FindAllUnbilledOverage returns up to limit contracts with overage
+	// reads not yet billed, in header ID order starting after afterID.
+	FindAllUnbilledOverage(afterID uuid.UUID, limit int) ([]models.ContractState, error)
+	// MarkOverageBilled moves OverageReadsBilled from one count to another,
+	// failing with ErrOverageBillingConflict if it is no longer from.
+	MarkOverageBilled(contractID uuid.UUID, from, to uint64) error
+
+	CreateInBatches(states []*models.ContractState, batchSize int) error
+	// UpdateOwnerInBatches is UpdateOwner for many contracts, issuing one
+	// UPDATE per batchSize contracts.
+	UpdateOwnerInBatches(headerIDs []uuid.UUID, from models.ContractStatus, ownerID uuid.UUID, to models.ContractStatus, purchasedAt time.Time, batchSize int) error
 }
 
 type contractStateRepository struct {
@@ -59,6 +114,14 @@ func (r *contractStateRepository) Create(contractState *models.ContractState) er
 	return result.Error
 }
 
+func (r *contractStateRepository) CreateInBatches(states []*models.ContractState, batchSize int) error {
+	if len(states) == 0 {
+		return nil
+	}
+	result := r.db.CreateInBatches(states, batchSize)
+	return result.Error
+}
+
 func (r *contractStateRepository) Update(contractState *models.ContractState) error {
 	result := r.db.Save(contractState)
 	if result.Error != nil {
@@ -71,7 +134,7 @@ func (r *contractStateRepository) Update(contractState *models.ContractState) er
 }
 
 func (r *contractStateRepository) Delete(id uuid.UUID) error {
-	result := r.db.Delete(&models.ContractState{}, "contract_id = ?", id)
+	result := r.db.Delete(&models.ContractState{}, "header_id = ?", id)
 	if result.Error != nil {
 		return result.Error
 	}
@@ -101,7 +164,7 @@ func (r *contractStateRepository) FindAllByStatus(status models.ContractStatus)
 
 func (r *contractStateRepository) FindByContractID(contractID uuid.UUID) (*models.ContractState, error) {
 	var contractState models.ContractState
-	result := r.db.Where("contract_id = ?", contractID).First(&contractState)
+	result := r.db.Where("header_id = ?", contractID).First(&contractState)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, ErrContractStateNotFound
@@ -113,7 +176,7 @@ func (r *contractStateRepository) FindByContractID(contractID uuid.UUID) (*model
 
 func (r *contractStateRepository) FindByContractIDAndStatus(contractID uuid.UUID, status models.ContractStatus) (*models.ContractState, error) {
 	var contractState models.ContractState
-	result := r.db.Where("contract_id = ? AND status = ?", contractID, status).First(&contractState)
+	result := r.db.Where("header_id = ? AND status = ?", contractID, status).First(&contractState)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			return nil, ErrContractStateNotFound
@@ -123,23 +186,73 @@ func (r *contractStateRepository) FindByContractIDAndStatus(contractID uuid.UUID
 	return &contractState, nil
 }
 
-func (r *contractStateRepository) UpdateStatus(contractID uuid.UUID, newStatus models.ContractStatus) error {
+func (r *contractStateRepository) FindAllDueForExpiry(now time.Time, statuses []models.ContractStatus, limit int) ([]models.ContractState, error) {
+	var contractStates []models.ContractState
+	result := r.db.
+		Joins("JOIN contract_headers ON contract_headers.id = contract_states.header_id").
+		Where("COALESCE(contract_headers.access_until, contract_headers.exercise_by) <= ? AND contract_states.status IN ?",
+			now, statuses).
+		Order("COALESCE(contract_headers.access_until, contract_headers.exercise_by) ASC").
+		Limit(limit).
+		Find(&contractStates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return contractStates, nil
+}
+
+func (r *contractStateRepository) UpdateStatus(contractID uuid.UUID, from, to models.ContractStatus) error {
 	result := r.db.Model(&models.ContractState{}).
-		Where("contract_id = ?", contractID).
-		Update("status", newStatus)
+		Where("header_id = ? AND status = ?", contractID, from).
+		Update("status", to)
 
 	if result.Error != nil {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return ErrContractStateNotFound
+		return r.conflictOrNotFound(contractID)
+	}
+	return nil
+}
+
+func (r *contractStateRepository) UpdateOwner(contractID uuid.UUID, from models.ContractStatus, ownerID uuid.UUID, to models.ContractStatus, purchasedAt time.Time) error {
+	result := r.db.Model(&models.ContractState{}).
+		Where("header_id = ? AND status = ?", contractID, from).
+		Updates(newOwnerUpdates(ownerID, to, purchasedAt))
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return r.conflictOrNotFound(contractID)
 	}
 	return nil
 }
 
+// newOwnerUpdates hands a contract to ownerID. The previous owner's
+// overage cap does not carry over, and since a contract cannot change hands
+// with overage unbilled, the overage counters start again too.
+func newOwnerUpdates(ownerID uuid.UUID, to models.ContractStatus, purchasedAt time.Time) map[string]any {
+	return map[string]any{
+		"owner_id":             ownerID,
+		"status":               to,
+		"last_purchase_at":     purchasedAt,
+		"overage_reads":        0,
+		"overage_reads_billed": 0,
+		"overage_cap_cents":    0,
+	}
+}
+
+func (r *contractStateRepository) conflictOrNotFound(contractID uuid.UUID) error {
+	if _, err := r.FindByID(contractID); err != nil {
+		return err
+	}
+	return ErrContractStatusConflict
+}
+
 func (r *contractStateRepository) UpdateReadsRemaining(contractID uuid.UUID, readsRemaining uint64) error {
 	result := r.db.Model(&models.ContractState{}).
-		Where("contract_id = ?", contractID).
+		Where("header_id = ?", contractID).
 		Update("reads_remaining", readsRemaining)
 
 	if result.Error != nil {
@@ -150,3 +263,185 @@ func (r *contractStateRepository) UpdateReadsRemaining(contractID uuid.UUID, rea
 	}
 	return nil
 }
+
+func (r *contractStateRepository) DebitUsage(
+	contractID uuid.UUID,
+	reads, bytes uint64,
+	limitReads, limitBytes bool,
+	usable []models.ContractStatus) error {
+
+	query := r.db.Model(&models.ContractState{}).
+		Where("header_id = ? AND status IN ?", contractID, usable)
+	updates := map[string]any{
+		"reads_used": gorm.Expr("reads_used + ?", reads),
+		"bytes_used": gorm.Expr("bytes_used + ?", bytes),
+	}
+	if limitReads {
+		query = query.Where("reads_remaining >= ?", reads)
+		updates["reads_remaining"] = gorm.Expr("reads_remaining - ?", reads)
+	}
+	if limitBytes {
+		query = query.Where("bytes_remaining >= ?", bytes)
+		updates["bytes_remaining"] = gorm.Expr("bytes_remaining - ?", bytes)
+	}
+
+	result := query.Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		state, err := r.FindByID(contractID)
+		if err != nil {
+			return err
+		}
+		for _, status := range usable {
+			if state.Status == status {
+				return ErrQuotaExhausted
+			}
+		}
+		return ErrContractNotUsable
+	}
+	return nil
+}
+
+func (r *contractStateRepository) DebitUsageWithOverage(
+	contractID uuid.UUID,
+	reads, bytes uint64,
+	limitBytes bool,
+	overagePriceNanos int64,
+	usable []models.ContractStatus) error {
+
+	// Every expression sees the row as it was before the UPDATE, so the
+	// overage is the part of reads that reads_remaining cannot cover. The
+	// cap is compared in numeric, where the products cannot overflow.
+	query := r.db.Model(&models.ContractState{}).
+		Where("header_id = ? AND status IN ?", contractID, usable).
+		Where("(overage_reads - overage_reads_billed + GREATEST(? - reads_remaining, 0))::numeric * ? <= overage_cap_cents::numeric * 10000000",
+			reads, overagePriceNanos)
+	updates := map[string]any{
+		"reads_used":      gorm.Expr("reads_used + ?", reads),
+		"bytes_used":      gorm.Expr("bytes_used + ?", bytes),
+		"reads_remaining": gorm.Expr("GREATEST(reads_remaining - ?, 0)", reads),
+		"overage_reads":   gorm.Expr("overage_reads + GREATEST(? - reads_remaining, 0)", reads),
+	}
+	if limitBytes {
+		query = query.Where("bytes_remaining >= ?", bytes)
+		updates["bytes_remaining"] = gorm.Expr("bytes_remaining - ?", bytes)
+	}
+
+	result := query.Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		state, err := r.FindByID(contractID)
+		if err != nil {
+			return err
+		}
+		for _, status := range usable {
+			if state.Status != status {
+				continue
+			}
+			if (limitBytes && state.BytesRemaining < bytes) || state.OverageCapCents == 0 {
+				return ErrQuotaExhausted
+			}
+			return ErrOverageCapReached
+		}
+		return ErrContractNotUsable
+	}
+	return nil
+}
+
+func (r *contractStateRepository) ChargeUsage(contractID uuid.UUID, reads, bytes uint64, overage bool) error {
+	updates := map[string]any{
+		"reads_used":      gorm.Expr("reads_used + ?", reads),
+		"bytes_used":      gorm.Expr("bytes_used + ?", bytes),
+		"reads_remaining": gorm.Expr("GREATEST(reads_remaining - ?, 0)", reads),
+		"bytes_remaining": gorm.Expr("GREATEST(bytes_remaining - ?, 0)", bytes),
+	}
+	if overage {
+		updates["overage_reads"] = gorm.Expr("overage_reads + GREATEST(? - reads_remaining, 0)", reads)
+	}
+	result := r.db.Model(&models.ContractState{}).
+		Where("header_id = ?", contractID).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrContractStateNotFound
+	}
+	return nil
+}
+
+func (r *contractStateRepository) ResetSubscriptionQuotas(subscriptionID uuid.UUID) error {
+	result := r.db.Model(&models.ContractState{}).
+		Where("header_id IN (?)", r.db.Model(&models.ContractHeader{}).
+			Select("id").
+			Where("subscription_id = ?", subscriptionID)).
+		Updates(map[string]any{
+			"reads_remaining": gorm.Expr("(SELECT quota_reads FROM contract_headers WHERE contract_headers.id = contract_states.header_id)"),
+			"bytes_remaining": gorm.Expr("(SELECT read_bytes FROM contract_headers WHERE contract_headers.id = contract_states.header_id)"),
+		})
+	return result.Error
+}
+
+func (r *contractStateRepository) SetOverageCap(contractID, ownerID uuid.UUID, capCents int64) error {
+	result := r.db.Model(&models.ContractState{}).
+		Where("header_id = ? AND owner_id = ?", contractID, ownerID).
+		Update("overage_cap_cents", capCents)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return r.conflictOrNotFound(contractID)
+	}
+	return nil
+}
+
+func (r *contractStateRepository) FindAllUnbilledOverage(afterID uuid.UUID, limit int) ([]models.ContractState, error) {
+	var states []models.ContractState
+	result := r.db.
+		Where("overage_reads > overage_reads_billed AND header_id > ?", afterID).
+		Order("header_id ASC").
+		Limit(limit).
+		Find(&states)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return states, nil
+}
+
+func (r *contractStateRepository) MarkOverageBilled(contractID uuid.UUID, from, to uint64) error {
+	result := r.db.Model(&models.ContractState{}).
+		Where("header_id = ? AND overage_reads_billed = ?", contractID, from).
+		Update("overage_reads_billed", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(contractID); err != nil {
+			return err
+		}
+		return ErrOverageBillingConflict
+	}
+	return nil
+}
+
+func (r *contractStateRepository) UpdateOwnerInBatches(headerIDs []uuid.UUID, from models.ContractStatus, ownerID uuid.UUID, to models.ContractStatus, purchasedAt time.Time, batchSize int) error {
+	for start := 0; start < len(headerIDs); start += batchSize {
+		end := min(start+batchSize, len(headerIDs))
+		batch := headerIDs[start:end]
+
+		result := r.db.Model(&models.ContractState{}).
+			Where("header_id IN ? AND status = ?", batch, from).
+			Updates(newOwnerUpdates(ownerID, to, purchasedAt))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != int64(len(batch)) {
+			return ErrContractStatusConflict
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrContractTransferNotFound   = errors.New("transfer not found")
+	ErrContractTransferNotPending = errors.New("transfer is no longer pending")
+)
+
+type ContractTransferRepository interface {
+	BaseRepository[models.ContractTransfer]
+	// FindAllByUserID returns the transfers the user sent or received,
+	// newest first.
+	FindAllByUserID(userID uuid.UUID) ([]models.ContractTransfer, error)
+	FindAllByHeaderID(headerID uuid.UUID) ([]models.ContractTransfer, error)
+	FindByClaimCodeHash(hash string) (*models.ContractTransfer, error)
+	// FindAllPendingExpired returns up to limit pending transfers whose
+	// ExpiresAt is at or before now.
+	FindAllPendingExpired(now time.Time, limit int) ([]models.ContractTransfer, error)
+
+	// Claim names the recipient of a pending email invitation, failing
+	// with ErrContractTransferNotPending if it was already claimed or
+	// closed.
+	Claim(id, recipientID uuid.UUID) error
+	// Close moves a pending transfer to status, failing with
+	// ErrContractTransferNotPending if it was already closed.
+	Close(id uuid.UUID, status models.TransferStatus, at time.Time) error
+}
+
+type contractTransferRepository struct {
+	db *gorm.DB
+}
+
+func NewContractTransferRepository(db *gorm.DB) ContractTransferRepository {
+	return &contractTransferRepository{db: db}
+}
+
+func (r *contractTransferRepository) FindByID(id uuid.UUID) (*models.ContractTransfer, error) {
+	var transfer models.ContractTransfer
+	result := r.db.First(&transfer, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrContractTransferNotFound
+		}
+		return nil, result.Error
+	}
+	return &transfer, nil
+}
+
+func (r *contractTransferRepository) FindAll() ([]models.ContractTransfer, error) {
+	var transfers []models.ContractTransfer
+	result := r.db.Find(&transfers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transfers, nil
+}
+
+func (r *contractTransferRepository) FindAllByUserID(userID uuid.UUID) ([]models.ContractTransfer, error) {
+	var transfers []models.ContractTransfer
+	result := r.db.
+		Where("sender_id = ? OR recipient_id = ?", userID, userID).
+		Order("created_at DESC").
+		Find(&transfers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transfers, nil
+}
+
+func (r *contractTransferRepository) FindAllByHeaderID(headerID uuid.UUID) ([]models.ContractTransfer, error) {
+	var transfers []models.ContractTransfer
+	result := r.db.Where("header_id = ?", headerID).Order("created_at ASC").Find(&transfers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transfers, nil
+}
+
+func (r *contractTransferRepository) FindByClaimCodeHash(hash string) (*models.ContractTransfer, error) {
+	var transfer models.ContractTransfer
+	result := r.db.First(&transfer, "claim_code_hash = ? AND claim_code_hash <> ''", hash)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrContractTransferNotFound
+		}
+		return nil, result.Error
+	}
+	return &transfer, nil
+}
+
+func (r *contractTransferRepository) FindAllPendingExpired(now time.Time, limit int) ([]models.ContractTransfer, error) {
+	var transfers []models.ContractTransfer
+	result := r.db.
+		Where("status = ? AND expires_at <= ?", models.TransferPending, now).
+		Order("expires_at ASC").
+		Limit(limit).
+		Find(&transfers)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return transfers, nil
+}
+
+func (r *contractTransferRepository) Create(transfer *models.ContractTransfer) error {
+	result := r.db.Create(transfer)
+	return result.Error
+}
+
+func (r *contractTransferRepository) Update(transfer *models.ContractTransfer) error {
+	result := r.db.Save(transfer)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrContractTransferNotFound
+	}
+	return nil
+}
+
+func (r *contractTransferRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.ContractTransfer{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrContractTransferNotFound
+	}
+	return nil
+}
+
+func (r *contractTransferRepository) Claim(id, recipientID uuid.UUID) error {
+	result := r.db.Model(&models.ContractTransfer{}).
+		Where("id = ? AND status = ? AND recipient_id = ?", id, models.TransferPending, uuid.Nil).
+		Updates(map[string]any{
+			"recipient_id": recipientID,
+			"updated_at":   time.Now(),
+		})
+	return r.checkPending(id, result)
+}
+
+func (r *contractTransferRepository) Close(id uuid.UUID, status models.TransferStatus, at time.Time) error {
+	updates := map[string]any{
+		"status":     status,
+		"updated_at": at,
+	}
+	if status == models.TransferCompleted {
+		updates["completed_at"] = at
+	}
+	result := r.db.Model(&models.ContractTransfer{}).
+		Where("id = ? AND status = ?", id, models.TransferPending).
+		Updates(updates)
+	return r.checkPending(id, result)
+}
+
+// checkPending turns a conditional update on a pending transfer into
+// ErrContractTransferNotPending when it matched nothing.
+func (r *contractTransferRepository) checkPending(id uuid.UUID, result *gorm.DB) error {
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(id); err != nil {
+			return err
+		}
+		return ErrContractTransferNotPending
+	}
+	return nil
+}
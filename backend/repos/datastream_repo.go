@@ -0,0 +1,81 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrDatastreamNotFound = errors.New("datastream not found")
+
+type DatastreamRepository interface {
+	BaseRepository[models.Datastream]
+	FindAllByOwnerID(ownerID uuid.UUID) ([]models.Datastream, error)
+}
+
+type datastreamRepository struct {
+	db *gorm.DB
+}
+
+func NewDatastreamRepository(db *gorm.DB) DatastreamRepository {
+	return &datastreamRepository{db: db}
+}
+
+func (r *datastreamRepository) FindByID(id uuid.UUID) (*models.Datastream, error) {
+	var datastream models.Datastream
+	result := r.db.First(&datastream, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrDatastreamNotFound
+		}
+		return nil, result.Error
+	}
+	return &datastream, nil
+}
+
+func (r *datastreamRepository) FindAll() ([]models.Datastream, error) {
+	var datastreams []models.Datastream
+	result := r.db.Find(&datastreams)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return datastreams, nil
+}
+
+func (r *datastreamRepository) FindAllByOwnerID(ownerID uuid.UUID) ([]models.Datastream, error) {
+	var datastreams []models.Datastream
+	result := r.db.Where("owner_id = ?", ownerID).Order("created_at ASC").Find(&datastreams)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return datastreams, nil
+}
+
+func (r *datastreamRepository) Create(datastream *models.Datastream) error {
+	result := r.db.Create(datastream)
+	return result.Error
+}
+
+func (r *datastreamRepository) Update(datastream *models.Datastream) error {
+	result := r.db.Save(datastream)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDatastreamNotFound
+	}
+	return nil
+}
+
+func (r *datastreamRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.Datastream{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDatastreamNotFound
+	}
+	return nil
+}
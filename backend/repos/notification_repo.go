@@ -0,0 +1,64 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+type NotificationRepository interface {
+	Create(notification *models.Notification) error
+	// FindAllByUserID returns up to limit of the user's notifications,
+	// newest first.
+	FindAllByUserID(userID uuid.UUID, limit int) ([]models.Notification, error)
+	// MarkRead sets ReadAt on the user's notification if it is unread. It
+	// fails with ErrNotificationNotFound if the user has no such
+	// notification.
+	MarkRead(id, userID uuid.UUID, at time.Time) error
+}
+
+type notificationRepository struct {
+	db *gorm.DB
+}
+
+func NewNotificationRepository(db *gorm.DB) NotificationRepository {
+	return &notificationRepository{db: db}
+}
+
+func (r *notificationRepository) Create(notification *models.Notification) error {
+	result := r.db.Create(notification)
+	return result.Error
+}
+
+func (r *notificationRepository) FindAllByUserID(userID uuid.UUID, limit int) ([]models.Notification, error) {
+	var notifications []models.Notification
+	result := r.db.
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&notifications)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return notifications, nil
+}
+
+func (r *notificationRepository) MarkRead(id, userID uuid.UUID, at time.Time) error {
+	var notification models.Notification
+	result := r.db.First(&notification, "id = ? AND user_id = ?", id, userID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrNotificationNotFound
+		}
+		return result.Error
+	}
+	result = r.db.Model(&models.Notification{}).
+		Where("id = ? AND read_at IS NULL", id).
+		Update("read_at", at)
+	return result.Error
+}
@@ -0,0 +1,47 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OverageLineRepository stores the breakdown of overage charges. Lines are
+// written with their transaction and never change afterwards.
+type OverageLineRepository interface {
+	CreateInBatches(lines []*models.OverageLine, batchSize int) error
+	// FindAllByTransactionIDs returns the lines of every given transaction.
+	FindAllByTransactionIDs(transactionIDs []uuid.UUID) ([]models.OverageLine, error)
+}
+
+type overageLineRepository struct {
+	db *gorm.DB
+}
+
+func NewOverageLineRepository(db *gorm.DB) OverageLineRepository {
+	return &overageLineRepository{db: db}
+}
+
+func (r *overageLineRepository) CreateInBatches(lines []*models.OverageLine, batchSize int) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	result := r.db.CreateInBatches(lines, batchSize)
+	return result.Error
+}
+
+func (r *overageLineRepository) FindAllByTransactionIDs(transactionIDs []uuid.UUID) ([]models.OverageLine, error) {
+	var lines []models.OverageLine
+	if len(transactionIDs) == 0 {
+		return lines, nil
+	}
+	result := r.db.
+		Where("transaction_id IN ?", transactionIDs).
+		Order("created_at ASC, header_id ASC").
+		Find(&lines)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return lines, nil
+}
@@ -0,0 +1,118 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// OwnershipLedgerRepository is append-only: entries are never updated or
+// deleted.
+type OwnershipLedgerRepository interface {
+	Create(entry *models.OwnershipEntry) error
+	CreateInBatches(entries []*models.OwnershipEntry, batchSize int) error
+	// FindAllByHeaderID returns the contract's entries in Seq order.
+	FindAllByHeaderID(headerID uuid.UUID) ([]models.OwnershipEntry, error)
+	// FindAllByTransactionID returns the entries of one kind that name the
+	// transaction, in header order.
+	FindAllByTransactionID(transactionID uuid.UUID, kind models.OwnershipEventKind) ([]models.OwnershipEntry, error)
+	// LastSeqs returns the highest Seq recorded for each contract, querying
+	// batchSize contracts at a time. Contracts with no entries are absent.
+	LastSeqs(headerIDs []uuid.UUID, batchSize int) (map[uuid.UUID]uint64, error)
+	// Backfill gives every contract with no entries, because it was issued
+	// before the ledger existed, an issuance entry to its listing's seller,
+	// followed by a sale to its current owner if that is someone else. It
+	// returns how many entries it wrote.
+	Backfill() (int64, error)
+}
+
+type ownershipLedgerRepository struct {
+	db *gorm.DB
+}
+
+func NewOwnershipLedgerRepository(db *gorm.DB) OwnershipLedgerRepository {
+	return &ownershipLedgerRepository{db: db}
+}
+
+func (r *ownershipLedgerRepository) Create(entry *models.OwnershipEntry) error {
+	result := r.db.Create(entry)
+	return result.Error
+}
+
+func (r *ownershipLedgerRepository) CreateInBatches(entries []*models.OwnershipEntry, batchSize int) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	result := r.db.CreateInBatches(entries, batchSize)
+	return result.Error
+}
+
+func (r *ownershipLedgerRepository) FindAllByHeaderID(headerID uuid.UUID) ([]models.OwnershipEntry, error) {
+	var entries []models.OwnershipEntry
+	result := r.db.Where("header_id = ?", headerID).Order("seq ASC").Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
+
+func (r *ownershipLedgerRepository) FindAllByTransactionID(transactionID uuid.UUID, kind models.OwnershipEventKind) ([]models.OwnershipEntry, error) {
+	var entries []models.OwnershipEntry
+	result := r.db.
+		Where("transaction_id = ? AND kind = ?", transactionID, kind).
+		Order("header_id ASC").
+		Find(&entries)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return entries, nil
+}
+
+// backfillLedgerSQL writes both entries in one statement, so that both see
+// the contract as having none. What happened between issue and the current
+// owner is not known, so the sale carries no transaction or price.
+const backfillLedgerSQL = `
+INSERT INTO contract_ownership_ledger
+	(id, header_id, seq, kind, from_owner_id, to_owner_id, transaction_id, price_cents, created_at)
+SELECT uuid_generate_v4(), h.id, 1, ?, ?, l.seller_id, ?, 0, h.created_at
+FROM contract_headers h
+JOIN contract_listings l ON l.id = h.listing_id
+WHERE NOT EXISTS (SELECT 1 FROM contract_ownership_ledger o WHERE o.header_id = h.id)
+UNION ALL
+SELECT uuid_generate_v4(), h.id, 2, ?, l.seller_id, s.owner_id, ?, 0, s.last_purchase_at
+FROM contract_headers h
+JOIN contract_listings l ON l.id = h.listing_id
+JOIN contract_states s ON s.header_id = h.id
+WHERE s.owner_id <> l.seller_id
+AND NOT EXISTS (SELECT 1 FROM contract_ownership_ledger o WHERE o.header_id = h.id)`
+
+func (r *ownershipLedgerRepository) Backfill() (int64, error) {
+	result := r.db.Exec(backfillLedgerSQL,
+		models.OwnershipIssued, uuid.Nil, uuid.Nil,
+		models.OwnershipSold, uuid.Nil)
+	return result.RowsAffected, result.Error
+}
+
+func (r *ownershipLedgerRepository) LastSeqs(headerIDs []uuid.UUID, batchSize int) (map[uuid.UUID]uint64, error) {
+	seqs := make(map[uuid.UUID]uint64, len(headerIDs))
+	for start := 0; start < len(headerIDs); start += batchSize {
+		end := min(start+batchSize, len(headerIDs))
+		var rows []struct {
+			HeaderID uuid.UUID
+			Seq      uint64
+		}
+		result := r.db.Model(&models.OwnershipEntry{}).
+			Select("header_id, MAX(seq) AS seq").
+			Where("header_id IN ?", headerIDs[start:end]).
+			Group("header_id").
+			Scan(&rows)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		for _, row := range rows {
+			seqs[row.HeaderID] = row.Seq
+		}
+	}
+	return seqs, nil
+}
@@ -0,0 +1,38 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RefundRepository is append-only: refunds are never updated or deleted.
+type RefundRepository interface {
+	Create(refund *models.RefundRecord) error
+	// FindAllByTransactionID returns the transaction's refunds, oldest
+	// first.
+	FindAllByTransactionID(transactionID uuid.UUID) ([]models.RefundRecord, error)
+}
+
+type refundRepository struct {
+	db *gorm.DB
+}
+
+func NewRefundRepository(db *gorm.DB) RefundRepository {
+	return &refundRepository{db: db}
+}
+
+func (r *refundRepository) Create(refund *models.RefundRecord) error {
+	result := r.db.Create(refund)
+	return result.Error
+}
+
+func (r *refundRepository) FindAllByTransactionID(transactionID uuid.UUID) ([]models.RefundRecord, error) {
+	var refunds []models.RefundRecord
+	result := r.db.Where("transaction_id = ?", transactionID).Order("created_at ASC").Find(&refunds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return refunds, nil
+}
@@ -0,0 +1,161 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefundRequestNotFound       = errors.New("refund request not found")
+	ErrRefundRequestStatusConflict = errors.New("refund request status changed concurrently")
+)
+
+type RefundRequestRepository interface {
+	BaseRepository[models.RefundRequest]
+	// FindAllByUserID returns the requests the user made as a buyer or
+	// received as a seller, newest first.
+	FindAllByUserID(userID uuid.UUID) ([]models.RefundRequest, error)
+	// FindPendingByTransactionID returns the transaction's open request,
+	// pending or refunding, of which there is at most one.
+	FindPendingByTransactionID(transactionID uuid.UUID) (*models.RefundRequest, error)
+	// FindAllPendingDue returns up to limit pending requests whose
+	// RespondBy is at or before now, soonest due first.
+	FindAllPendingDue(now time.Time, limit int) ([]models.RefundRequest, error)
+	// FindAllRefundingSince returns up to limit requests that have been
+	// refunding since before, longest first.
+	FindAllRefundingSince(before time.Time, limit int) ([]models.RefundRequest, error)
+
+	// UpdateFromStatus writes the whole request, but only if it is still
+	// in the from status; otherwise it fails with
+	// ErrRefundRequestStatusConflict.
+	UpdateFromStatus(request *models.RefundRequest, from models.RefundRequestStatus) error
+}
+
+type refundRequestRepository struct {
+	db *gorm.DB
+}
+
+func NewRefundRequestRepository(db *gorm.DB) RefundRequestRepository {
+	return &refundRequestRepository{db: db}
+}
+
+func (r *refundRequestRepository) FindByID(id uuid.UUID) (*models.RefundRequest, error) {
+	var request models.RefundRequest
+	result := r.db.First(&request, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrRefundRequestNotFound
+		}
+		return nil, result.Error
+	}
+	return &request, nil
+}
+
+func (r *refundRequestRepository) FindAll() ([]models.RefundRequest, error) {
+	var requests []models.RefundRequest
+	result := r.db.Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+func (r *refundRequestRepository) FindAllByUserID(userID uuid.UUID) ([]models.RefundRequest, error) {
+	var requests []models.RefundRequest
+	result := r.db.
+		Where("buyer_id = ? OR seller_id = ?", userID, userID).
+		Order("created_at DESC").
+		Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+func (r *refundRequestRepository) FindPendingByTransactionID(transactionID uuid.UUID) (*models.RefundRequest, error) {
+	var request models.RefundRequest
+	result := r.db.First(&request, "transaction_id = ? AND status IN ?", transactionID,
+		[]models.RefundRequestStatus{models.RefundRequestPending, models.RefundRequestRefunding})
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrRefundRequestNotFound
+		}
+		return nil, result.Error
+	}
+	return &request, nil
+}
+
+func (r *refundRequestRepository) FindAllPendingDue(now time.Time, limit int) ([]models.RefundRequest, error) {
+	var requests []models.RefundRequest
+	result := r.db.
+		Where("status = ? AND respond_by <= ?", models.RefundRequestPending, now).
+		Order("respond_by ASC").
+		Limit(limit).
+		Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+func (r *refundRequestRepository) FindAllRefundingSince(before time.Time, limit int) ([]models.RefundRequest, error) {
+	var requests []models.RefundRequest
+	result := r.db.
+		Where("status = ? AND updated_at <= ?", models.RefundRequestRefunding, before).
+		Order("updated_at ASC").
+		Limit(limit).
+		Find(&requests)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return requests, nil
+}
+
+func (r *refundRequestRepository) Create(request *models.RefundRequest) error {
+	result := r.db.Create(request)
+	return result.Error
+}
+
+func (r *refundRequestRepository) Update(request *models.RefundRequest) error {
+	result := r.db.Save(request)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRefundRequestNotFound
+	}
+	return nil
+}
+
+func (r *refundRequestRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.RefundRequest{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrRefundRequestNotFound
+	}
+	return nil
+}
+
+func (r *refundRequestRepository) UpdateFromStatus(request *models.RefundRequest, from models.RefundRequestStatus) error {
+	result := r.db.Model(request).
+		Where("status = ?", from).
+		Select("*").
+		Updates(request)
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(request.ID); err != nil {
+			return err
+		}
+		return ErrRefundRequestStatusConflict
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrResaleListingNotFound = errors.New("resale listing not found")
+	ErrResaleListingNotOpen  = errors.New("resale listing is no longer open")
+)
+
+type ResaleListingRepository interface {
+	BaseRepository[models.ResaleListing]
+	FindAllOpen() ([]models.ResaleListing, error)
+	FindAllBySellerID(sellerID uuid.UUID) ([]models.ResaleListing, error)
+	FindOpenByHeaderID(headerID uuid.UUID) (*models.ResaleListing, error)
+
+	// Close moves an open resale listing to status, failing with
+	// ErrResaleListingNotOpen if it was already sold or cancelled.
+	Close(id uuid.UUID, status models.ResaleStatus) error
+}
+
+type resaleListingRepository struct {
+	db *gorm.DB
+}
+
+func NewResaleListingRepository(db *gorm.DB) ResaleListingRepository {
+	return &resaleListingRepository{db: db}
+}
+
+func (r *resaleListingRepository) FindByID(id uuid.UUID) (*models.ResaleListing, error) {
+	var resale models.ResaleListing
+	result := r.db.First(&resale, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrResaleListingNotFound
+		}
+		return nil, result.Error
+	}
+	return &resale, nil
+}
+
+func (r *resaleListingRepository) FindAll() ([]models.ResaleListing, error) {
+	var resales []models.ResaleListing
+	result := r.db.Find(&resales)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return resales, nil
+}
+
+func (r *resaleListingRepository) FindAllOpen() ([]models.ResaleListing, error) {
+	var resales []models.ResaleListing
+	result := r.db.Where("status = ?", models.ResaleOpen).Order("created_at ASC").Find(&resales)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return resales, nil
+}
+
+func (r *resaleListingRepository) FindAllBySellerID(sellerID uuid.UUID) ([]models.ResaleListing, error) {
+	var resales []models.ResaleListing
+	result := r.db.Where("seller_id = ?", sellerID).Order("created_at ASC").Find(&resales)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return resales, nil
+}
+
+func (r *resaleListingRepository) FindOpenByHeaderID(headerID uuid.UUID) (*models.ResaleListing, error) {
+	var resale models.ResaleListing
+	result := r.db.First(&resale, "header_id = ? AND status = ?", headerID, models.ResaleOpen)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrResaleListingNotFound
+		}
+		return nil, result.Error
+	}
+	return &resale, nil
+}
+
+func (r *resaleListingRepository) Create(resale *models.ResaleListing) error {
+	result := r.db.Create(resale)
+	return result.Error
+}
+
+func (r *resaleListingRepository) Update(resale *models.ResaleListing) error {
+	result := r.db.Save(resale)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrResaleListingNotFound
+	}
+	return nil
+}
+
+func (r *resaleListingRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.ResaleListing{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrResaleListingNotFound
+	}
+	return nil
+}
+
+func (r *resaleListingRepository) Close(id uuid.UUID, status models.ResaleStatus) error {
+	result := r.db.Model(&models.ResaleListing{}).
+		Where("id = ? AND status = ?", id, models.ResaleOpen).
+		Updates(map[string]any{
+			"status":     status,
+			"updated_at": time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(id); err != nil {
+			return err
+		}
+		return ErrResaleListingNotOpen
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrReservationNotFound  = errors.New("reservation not found")
+	ErrReservationNotActive = errors.New("reservation is no longer active")
+)
+
+type ReservationRepository interface {
+	BaseRepository[models.SupplyReservation]
+	FindByTransactionID(transactionID uuid.UUID) (*models.SupplyReservation, error)
+	FindAllExpired(now time.Time) ([]models.SupplyReservation, error)
+
+	// SumActive returns the units of listings held by unexpired KindPrimary
+	// reservations, keyed by listing. With no listing IDs it covers every
+	// listing.
+	SumActive(now time.Time, listingIDs ...uuid.UUID) (map[uuid.UUID]uint64, error)
+
+	// Hold reserves quantity units of a listing for a KindPrimary
+	// transaction, failing with ErrInsufficientSupply if remaining supply
+	// less the units already held cannot cover it.
+	Hold(listingID, transactionID uuid.UUID, quantity uint64, expiresAt time.Time) (*models.SupplyReservation, error)
+	Convert(id uuid.UUID) error
+	Release(id uuid.UUID) error
+}
+
+type reservationRepository struct {
+	db *gorm.DB
+}
+
+func NewReservationRepository(db *gorm.DB) ReservationRepository {
+	return &reservationRepository{db: db}
+}
+
+func (r *reservationRepository) FindByID(id uuid.UUID) (*models.SupplyReservation, error) {
+	var reservation models.SupplyReservation
+	result := r.db.First(&reservation, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrReservationNotFound
+		}
+		return nil, result.Error
+	}
+	return &reservation, nil
+}
+
+func (r *reservationRepository) FindAll() ([]models.SupplyReservation, error) {
+	var reservations []models.SupplyReservation
+	result := r.db.Find(&reservations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return reservations, nil
+}
+
+func (r *reservationRepository) Create(reservation *models.SupplyReservation) error {
+	result := r.db.Create(reservation)
+	return result.Error
+}
+
+func (r *reservationRepository) Update(reservation *models.SupplyReservation) error {
+	result := r.db.Save(reservation)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+func (r *reservationRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.SupplyReservation{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+func (r *reservationRepository) FindByTransactionID(transactionID uuid.UUID) (*models.SupplyReservation, error) {
+	var reservation models.SupplyReservation
+	result := r.db.First(&reservation, "transaction_id = ?", transactionID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrReservationNotFound
+		}
+		return nil, result.Error
+	}
+	return &reservation, nil
+}
+
+func (r *reservationRepository) FindAllExpired(now time.Time) ([]models.SupplyReservation, error) {
+	var reservations []models.SupplyReservation
+	result := r.db.Where("status = ? AND expires_at <= ?", models.ReservationActive, now).Find(&reservations)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return reservations, nil
+}
+
+func (r *reservationRepository) SumActive(now time.Time, listingIDs ...uuid.UUID) (map[uuid.UUID]uint64, error) {
+	var rows []struct {
+		ListingID uuid.UUID
+		Held      uint64
+	}
+	query := r.db.Model(&models.SupplyReservation{}).
+		Select("listing_id, COALESCE(SUM(quantity), 0) AS held").
+		Where("kind = ? AND status = ? AND expires_at > ?", models.KindPrimary, models.ReservationActive, now)
+	if len(listingIDs) > 0 {
+		query = query.Where("listing_id IN ?", listingIDs)
+	}
+	result := query.Group("listing_id").Scan(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	held := make(map[uuid.UUID]uint64, len(rows))
+	for _, row := range rows {
+		held[row.ListingID] = row.Held
+	}
+	return held, nil
+}
+
+func (r *reservationRepository) Hold(listingID, transactionID uuid.UUID, quantity uint64, expiresAt time.Time) (*models.SupplyReservation, error) {
+	reservation := &models.SupplyReservation{
+		ID:            uuid.New(),
+		ListingID:     listingID,
+		TransactionID: transactionID,
+		Quantity:      quantity,
+		Status:        models.ReservationActive,
+		ExpiresAt:     expiresAt,
+	}
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// Locking the listing row serialises holds against the same listing.
+		var listing models.ContractListing
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&listing, "id = ?", listingID)
+		if result.Error != nil {
+			if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+				return ErrListingNotFound
+			}
+			return result.Error
+		}
+
+		var held uint64
+		result = tx.Model(&models.SupplyReservation{}).
+			Select("COALESCE(SUM(quantity), 0)").
+			Where("listing_id = ? AND kind = ? AND status = ? AND expires_at > ?",
+				listingID, models.KindPrimary, models.ReservationActive, time.Now()).
+			Scan(&held)
+		if result.Error != nil {
+			return result.Error
+		}
+		if listing.SupplyRemaining < held+quantity {
+			return ErrInsufficientSupply
+		}
+
+		return tx.Create(reservation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (r *reservationRepository) Convert(id uuid.UUID) error {
+	return r.setStatus(id, models.ReservationConverted)
+}
+
+func (r *reservationRepository) Release(id uuid.UUID) error {
+	return r.setStatus(id, models.ReservationReleased)
+}
+
+func (r *reservationRepository) setStatus(id uuid.UUID, status models.ReservationStatus) error {
+	result := r.db.Model(&models.SupplyReservation{}).
+		Where("id = ? AND status = ?", id, models.ReservationActive).
+		Update("status", status)
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrReservationNotActive
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package repos
+
+import (
+	"contract_market_demo/backend/models"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+)
+
+type SubscriptionRepository interface {
+	BaseRepository[models.Subscription]
+	FindByProviderSubscriptionID(providerID string) (*models.Subscription, error)
+	FindAllBySubscriberID(subscriberID uuid.UUID) ([]models.Subscription, error)
+	// FindAllPastGrace returns up to limit past-due subscriptions whose
+	// grace period ended at or before now.
+	FindAllPastGrace(now time.Time, limit int) ([]models.Subscription, error)
+}
+
+type subscriptionRepository struct {
+	db *gorm.DB
+}
+
+func NewSubscriptionRepository(db *gorm.DB) SubscriptionRepository {
+	return &subscriptionRepository{db: db}
+}
+
+func (r *subscriptionRepository) FindByID(id uuid.UUID) (*models.Subscription, error) {
+	var sub models.Subscription
+	result := r.db.First(&sub, "id = ?", id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, result.Error
+	}
+	return &sub, nil
+}
+
+func (r *subscriptionRepository) FindAll() ([]models.Subscription, error) {
+	var subs []models.Subscription
+	result := r.db.Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return subs, nil
+}
+
+func (r *subscriptionRepository) FindByProviderSubscriptionID(providerID string) (*models.Subscription, error) {
+	var sub models.Subscription
+	result := r.db.First(&sub, "provider_subscription_id = ?", providerID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, result.Error
+	}
+	return &sub, nil
+}
+
+func (r *subscriptionRepository) FindAllBySubscriberID(subscriberID uuid.UUID) ([]models.Subscription, error) {
+	var subs []models.Subscription
+	result := r.db.Where("subscriber_id = ?", subscriberID).Order("created_at DESC").Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return subs, nil
+}
+
+func (r *subscriptionRepository) FindAllPastGrace(now time.Time, limit int) ([]models.Subscription, error) {
+	var subs []models.Subscription
+	result := r.db.
+		Where("status = ? AND grace_until <= ?", models.SubscriptionPastDue, now).
+		Order("grace_until ASC").
+		Limit(limit).
+		Find(&subs)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return subs, nil
+}
+
+func (r *subscriptionRepository) Create(sub *models.Subscription) error {
+	result := r.db.Create(sub)
+	return result.Error
+}
+
+func (r *subscriptionRepository) Update(sub *models.Subscription) error {
+	result := r.db.Save(sub)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+func (r *subscriptionRepository) Delete(id uuid.UUID) error {
+	result := r.db.Delete(&models.Subscription{}, "id = ?", id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
@@ -3,13 +3,58 @@ package repos
 import (
 	"contract_market_demo/backend/models"
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+var (
+	ErrTransactionNotFound       = errors.New("transaction not found")
+	ErrTransactionStatusConflict = errors.New("transaction status changed concurrently")
+)
+
 type TransactionRepository interface {
 	BaseRepository[models.TransactionRecord]
+	FindByCheckoutSessionID(sessionID string) (*models.TransactionRecord, error)
+	FindByStripeInvoiceID(invoiceID string) (*models.TransactionRecord, error)
+	FindByStripePaymentIntentID(paymentIntentID string) (*models.TransactionRecord, error)
+	// FindOpenByResaleListingID returns the newest checkout of a resale
+	// listing that is still awaiting payment.
+	FindOpenByResaleListingID(resaleListingID uuid.UUID) (*models.TransactionRecord, error)
+	// FindOpenExerciseByHeaderID returns the newest exercise of an option
+	// that is still awaiting payment.
+	FindOpenExerciseByHeaderID(headerID uuid.UUID) (*models.TransactionRecord, error)
+	// FindAllByBuyerIDAndKind returns the buyer's transactions of one kind,
+	// newest first.
+	FindAllByBuyerIDAndKind(buyerID uuid.UUID, kind models.TransactionKind) ([]models.TransactionRecord, error)
+	// FindAllByKindAndStatus returns up to limit transactions of one kind
+	// in one status, oldest first.
+	FindAllByKindAndStatus(kind models.TransactionKind, status models.TransactionStatus, limit int) ([]models.TransactionRecord, error)
+	// CountUnpaidFillsByBuyerID counts the buyer's order book fills that
+	// are still awaiting payment, or that expired unpaid since since.
+	CountUnpaidFillsByBuyerID(buyerID uuid.UUID, since time.Time) (int64, error)
+
+	// UpdateFromStatus writes the whole record, but only if it is still in
+	// the from status; otherwise it fails with ErrTransactionStatusConflict.
+	// Status changes should go through the lifecycle package.
+	UpdateFromStatus(record *models.TransactionRecord, from models.TransactionStatus) error
+	// UpdateFromRefunded writes the whole record, but only if it is still
+	// in the from status with fromRefundedCents refunded; otherwise it
+	// fails with ErrTransactionStatusConflict.
+	UpdateFromRefunded(record *models.TransactionRecord, from models.TransactionStatus, fromRefundedCents int64) error
+
+	// FindAllRoyaltiesByRecipientID returns the fulfilled sales that earned
+	// the recipient a royalty, newest first.
+	FindAllRoyaltiesByRecipientID(recipientID uuid.UUID) ([]models.TransactionRecord, error)
+	// FindAllPayableRoyalties returns up to limit fulfilled sales whose
+	// royalty has not been transferred yet and whose recipient has a
+	// connected account to transfer it to, in ID order starting after
+	// afterID.
+	FindAllPayableRoyalties(afterID uuid.UUID, limit int) ([]models.TransactionRecord, error)
+	// MarkRoyaltyPaid records the transfer that paid a sale's royalty. A
+	// royalty already marked paid is left as it is.
+	MarkRoyaltyPaid(id uuid.UUID, transferID string, paidAt time.Time) error
 }
 
 type transactionRepository struct {
@@ -25,7 +70,7 @@ func (r *transactionRepository) FindByID(id uuid.UUID) (*models.TransactionRecor
 	result := r.db.First(&record, "id = ?", id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, ErrContractHeaderNotFound
+			return nil, ErrTransactionNotFound
 		}
 		return nil, result.Error
 	}
@@ -52,7 +97,7 @@ func (r *transactionRepository) Update(record *models.TransactionRecord) error {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return ErrContractHeaderNotFound
+		return ErrTransactionNotFound
 	}
 	return nil
 }
@@ -63,7 +108,191 @@ func (r *transactionRepository) Delete(id uuid.UUID) error {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return ErrContractHeaderNotFound
+		return ErrTransactionNotFound
+	}
+	return nil
+}
+
+func (r *transactionRepository) FindByCheckoutSessionID(sessionID string) (*models.TransactionRecord, error) {
+	var record models.TransactionRecord
+	result := r.db.First(&record, "stripe_checkout_sesson_id = ?", sessionID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, result.Error
+	}
+	return &record, nil
+}
+
+func (r *transactionRepository) FindByStripeInvoiceID(invoiceID string) (*models.TransactionRecord, error) {
+	var record models.TransactionRecord
+	result := r.db.First(&record, "stripe_invoice_id = ? AND stripe_invoice_id <> ''", invoiceID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, result.Error
+	}
+	return &record, nil
+}
+
+func (r *transactionRepository) FindByStripePaymentIntentID(paymentIntentID string) (*models.TransactionRecord, error) {
+	var record models.TransactionRecord
+	result := r.db.First(&record, "stripe_payment_intent_id = ? AND stripe_payment_intent_id <> ''", paymentIntentID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, result.Error
+	}
+	return &record, nil
+}
+
+func (r *transactionRepository) FindOpenByResaleListingID(resaleListingID uuid.UUID) (*models.TransactionRecord, error) {
+	return r.findOpen("kind = ? AND resale_listing_id = ?", models.KindResale, resaleListingID)
+}
+
+func (r *transactionRepository) FindOpenExerciseByHeaderID(headerID uuid.UUID) (*models.TransactionRecord, error) {
+	return r.findOpen("kind = ? AND header_id = ?", models.KindExercise, headerID)
+}
+
+// findOpen returns the newest transaction matching query that is still
+// awaiting payment.
+func (r *transactionRepository) findOpen(query string, args ...any) (*models.TransactionRecord, error) {
+	var record models.TransactionRecord
+	result := r.db.
+		Where(query, args...).
+		Where("transaction_status IN ?", []models.TransactionStatus{models.StatusPending, models.StatusRequiresPayment}).
+		Order("initiated_at DESC").
+		First(&record)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTransactionNotFound
+		}
+		return nil, result.Error
+	}
+	return &record, nil
+}
+
+func (r *transactionRepository) FindAllByBuyerIDAndKind(buyerID uuid.UUID, kind models.TransactionKind) ([]models.TransactionRecord, error) {
+	var records []models.TransactionRecord
+	result := r.db.
+		Where("buyer_id = ? AND kind = ?", buyerID, kind).
+		Order("initiated_at DESC").
+		Find(&records)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return records, nil
+}
+
+func (r *transactionRepository) FindAllByKindAndStatus(kind models.TransactionKind, status models.TransactionStatus, limit int) ([]models.TransactionRecord, error) {
+	var records []models.TransactionRecord
+	result := r.db.
+		Where("kind = ? AND transaction_status = ?", kind, status).
+		Order("initiated_at ASC").
+		Limit(limit).
+		Find(&records)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return records, nil
+}
+
+func (r *transactionRepository) CountUnpaidFillsByBuyerID(buyerID uuid.UUID, since time.Time) (int64, error) {
+	var count int64
+	result := r.db.Model(&models.TransactionRecord{}).
+		Where("kind = ? AND buyer_id = ?", models.KindOrderFill, buyerID).
+		Where("transaction_status IN ? OR (transaction_status = ? AND expired_at >= ?)",
+			[]models.TransactionStatus{models.StatusPending, models.StatusRequiresPayment},
+			models.StatusExpired, since).
+		Count(&count)
+	return count, result.Error
+}
+
+func (r *transactionRepository) UpdateFromStatus(record *models.TransactionRecord, from models.TransactionStatus) error {
+	result := r.db.Model(record).
+		Where("transaction_status = ?", from).
+		Select("*").
+		Updates(record)
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(record.ID); err != nil {
+			return err
+		}
+		return ErrTransactionStatusConflict
+	}
+	return nil
+}
+
+func (r *transactionRepository) UpdateFromRefunded(
+	record *models.TransactionRecord,
+	from models.TransactionStatus,
+	fromRefundedCents int64) error {
+
+	result := r.db.Model(record).
+		Where("transaction_status = ? AND refunded_cents = ?", from, fromRefundedCents).
+		Select("*").
+		Updates(record)
+
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if _, err := r.FindByID(record.ID); err != nil {
+			return err
+		}
+		return ErrTransactionStatusConflict
+	}
+	return nil
+}
+
+func (r *transactionRepository) FindAllRoyaltiesByRecipientID(recipientID uuid.UUID) ([]models.TransactionRecord, error) {
+	var records []models.TransactionRecord
+	result := r.db.
+		Where("royalty_recipient_id = ? AND royalty_cents > 0 AND transaction_status = ?",
+			recipientID, models.StatusFulfilled).
+		Order("fulfilled_at DESC").
+		Find(&records)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return records, nil
+}
+
+func (r *transactionRepository) FindAllPayableRoyalties(afterID uuid.UUID, limit int) ([]models.TransactionRecord, error) {
+	var records []models.TransactionRecord
+	result := r.db.
+		Joins("JOIN users ON users.id = transaction_records.royalty_recipient_id").
+		Where("transaction_records.royalty_cents > 0 AND transaction_records.royalty_transfer_id = ''").
+		Where("transaction_records.transaction_status = ? AND transaction_records.id > ?", models.StatusFulfilled, afterID).
+		Where("users.stripe_connect_account_id <> ''").
+		Order("transaction_records.id ASC").
+		Limit(limit).
+		Find(&records)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return records, nil
+}
+
+func (r *transactionRepository) MarkRoyaltyPaid(id uuid.UUID, transferID string, paidAt time.Time) error {
+	result := r.db.Model(&models.TransactionRecord{}).
+		Where("id = ? AND royalty_transfer_id = ''", id).
+		Updates(map[string]any{
+			"royalty_transfer_id": transferID,
+			"royalty_paid_at":     paidAt,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		_, err := r.FindByID(id)
+		return err
 	}
 	return nil
 }
@@ -0,0 +1,83 @@
+package repos
+
+import (
+	"gorm.io/gorm"
+)
+
+// Repos bundles one instance of every repository, all sharing a *gorm.DB.
+type Repos struct {
+	Users          UserRepository
+	Transactions   TransactionRepository
+	Listings       ContractListingRepository
+	Headers        ContractHeaderRepository
+	States         ContractStateRepository
+	StateHistory   ContractStateHistoryRepository
+	Reservations   ReservationRepository
+	Datastreams    DatastreamRepository
+	Resales        ResaleListingRepository
+	Orders         BookOrderRepository
+	Fills          BookFillRepository
+	Auctions       AuctionRepository
+	Transfers      ContractTransferRepository
+	Ownership      OwnershipLedgerRepository
+	Subscriptions  SubscriptionRepository
+	OverageLines   OverageLineRepository
+	Refunds        RefundRepository
+	RefundRequests RefundRequestRepository
+	Notifications  NotificationRepository
+}
+
+func NewRepos(db *gorm.DB) *Repos {
+	return &Repos{
+		Users:          NewUserRepository(db),
+		Transactions:   NewTransactionRepository(db),
+		Listings:       NewContractListingRepository(db),
+		Headers:        NewContractHeaderRepository(db),
+		States:         NewContractStateRepository(db),
+		StateHistory:   NewContractStateHistoryRepository(db),
+		Reservations:   NewReservationRepository(db),
+		Datastreams:    NewDatastreamRepository(db),
+		Resales:        NewResaleListingRepository(db),
+		Orders:         NewBookOrderRepository(db),
+		Fills:          NewBookFillRepository(db),
+		Auctions:       NewAuctionRepository(db),
+		Transfers:      NewContractTransferRepository(db),
+		Ownership:      NewOwnershipLedgerRepository(db),
+		Subscriptions:  NewSubscriptionRepository(db),
+		OverageLines:   NewOverageLineRepository(db),
+		Refunds:        NewRefundRepository(db),
+		RefundRequests: NewRefundRequestRepository(db),
+		Notifications:  NewNotificationRepository(db),
+	}
+}
+
+// UnitOfWork runs multi-entity operations in a single database transaction.
+type UnitOfWork interface {
+	// Repos returns repositories that run outside any transaction.
+	Repos() *Repos
+
+	// WithTx calls fn with repositories bound to a new transaction, which
+	// is committed if fn returns nil and rolled back otherwise. Calling
+	// WithTx on the repositories of an enclosing transaction is not
+	// possible; pass the tx Repos down instead.
+	WithTx(fn func(tx *Repos) error) error
+}
+
+type unitOfWork struct {
+	db    *gorm.DB
+	repos *Repos
+}
+
+func NewUnitOfWork(db *gorm.DB) UnitOfWork {
+	return &unitOfWork{db: db, repos: NewRepos(db)}
+}
+
+func (u *unitOfWork) Repos() *Repos {
+	return u.repos
+}
+
+func (u *unitOfWork) WithTx(fn func(tx *Repos) error) error {
+	return u.db.Transaction(func(tx *gorm.DB) error {
+		return fn(NewRepos(tx))
+	})
+}
@@ -14,6 +14,8 @@ type UserRepository interface {
 	BaseRepository[models.User]
 	FindByAuth(provider, subject string) (*models.User, error)
 	FindOrCreateByAuth(provider, subject, email string) (*models.User, error)
+	FindByStripeConnectAccountID(accountID string) (*models.User, error)
+	FindByStripeCustomerID(customerID string) (*models.User, error)
 }
 
 type userRepository struct {
@@ -29,7 +31,7 @@ func (r *userRepository) FindByID(id uuid.UUID) (*models.User, error) {
 	result := r.db.First(&user, "id = ?", id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			return nil, ErrContractHeaderNotFound
+			return nil, ErrUserNotFound
 		}
 		return nil, result.Error
 	}
@@ -48,6 +50,30 @@ func (r *userRepository) FindByAuth(provider, subject string) (*models.User, err
 	return &user, nil
 }
 
+func (r *userRepository) FindByStripeConnectAccountID(accountID string) (*models.User, error) {
+	var user models.User
+	result := r.db.First(&user, "stripe_connect_account_id = ?", accountID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, result.Error
+	}
+	return &user, nil
+}
+
+func (r *userRepository) FindByStripeCustomerID(customerID string) (*models.User, error) {
+	var user models.User
+	result := r.db.First(&user, "stripe_customer_id = ?", customerID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, result.Error
+	}
+	return &user, nil
+}
+
 func (r *userRepository) FindOrCreateByAuth(provider, subject, email string) (*models.User, error) {
 	u, err := r.FindByAuth(provider, subject)
 	if err == nil {
@@ -93,7 +119,7 @@ func (r *userRepository) Update(user *models.User) error {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return ErrContractHeaderNotFound
+		return ErrUserNotFound
 	}
 	return nil
 }
@@ -104,7 +130,7 @@ func (r *userRepository) Delete(id uuid.UUID) error {
 		return result.Error
 	}
 	if result.RowsAffected == 0 {
-		return ErrContractHeaderNotFound
+		return ErrUserNotFound
 	}
 	return nil
 }
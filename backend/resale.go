@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+type ResaleCreateRequest struct {
+	ContractID string `json:"contract_id"`
+	PriceNanos int64  `json:"price_nanos"`
+}
+
+var errContractUnavailable = errors.New("contract is not available for resale")
+
+// ResaleListingsHandler serves /v1/resale: GET lists open resale listings,
+// or the caller's own with ?mine=true, and POST lets the owner of an owned
+// contract offer it for sale. The contract is StatusListed while on offer.
+func ResaleListingsHandler(provider payments.PaymentProvider, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var resales []models.ResaleListing
+			if r.URL.Query().Get("mine") == "true" {
+				resales, err = rs.Resales.FindAllBySellerID(u.ID)
+			} else {
+				resales, err = rs.Resales.FindAllOpen()
+			}
+			if err != nil {
+				http.Error(w, "failed to fetch resale listings: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(resales)
+		case http.MethodPost:
+			req := &ResaleCreateRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+				http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			headerID, err := uuid.Parse(req.ContractID)
+			if err != nil {
+				http.Error(w, "invalid contract_id: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.PriceNanos <= 0 {
+				http.Error(w, "price_nanos must be positive", http.StatusBadRequest)
+				return
+			}
+
+			resale, err := CreateResaleListing(u.ID, headerID, req.PriceNanos, provider, uow)
+			switch {
+			case errors.Is(err, repos.ErrContractHeaderNotFound), errors.Is(err, repos.ErrContractStateNotFound):
+				http.Error(w, "contract not found", http.StatusNotFound)
+				return
+			case errors.Is(err, errNotParticipant):
+				http.Error(w, "only the owner may resell this contract", http.StatusForbidden)
+				return
+			case errors.Is(err, errOverageUnpaid):
+				http.Error(w, err.Error(), http.StatusPaymentRequired)
+				return
+			case errors.Is(err, errContractUnavailable),
+				errors.Is(err, lifecycle.ErrIllegalTransition),
+				errors.Is(err, repos.ErrContractStatusConflict):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			case err != nil:
+				http.Error(w, "failed to create resale listing: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(resale)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// CreateResaleListing offers a contract the seller owns for sale, moving it
+// from StatusOwned to StatusListed. Overage the seller still owes on it is
+// charged first.
+func CreateResaleListing(
+	sellerID uuid.UUID,
+	headerID uuid.UUID,
+	priceNanos int64,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (*models.ResaleListing, error) {
+
+	if err := BillOverageBeforeListing(sellerID, []uuid.UUID{headerID}, provider, uow); err != nil {
+		return nil, err
+	}
+	var resale *models.ResaleListing
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		header, err := tx.Headers.FindByID(headerID)
+		if err != nil {
+			return err
+		}
+		state, err := tx.States.FindByID(headerID)
+		if err != nil {
+			return err
+		}
+		if state.OwnerID != sellerID {
+			return errNotParticipant
+		}
+		if header.ExerciseBy != nil && !header.ExerciseBy.After(time.Now()) {
+			return errContractUnavailable
+		}
+		if header.SubscriptionID != uuid.Nil {
+			return fmt.Errorf("%w: it belongs to a subscription", errContractUnavailable)
+		}
+		if _, err := tx.Resales.FindOpenByHeaderID(headerID); err == nil {
+			return errContractUnavailable
+		} else if !errors.Is(err, repos.ErrResaleListingNotFound) {
+			return err
+		}
+
+		err = lifecycle.TransitionContract(tx, state, models.StatusListed, sellerID, "offered for resale")
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		resale = &models.ResaleListing{
+			ID:         uuid.New(),
+			HeaderID:   headerID,
+			SellerID:   sellerID,
+			PriceNanos: priceNanos,
+			Status:     models.ResaleOpen,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		return tx.Resales.Create(resale)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resale, nil
+}
+
+// ResaleListingHandler serves /v1/resale/{id}: GET shows a resale listing
+// and DELETE lets its seller withdraw it, returning the contract to
+// StatusOwned. A listing cannot be withdrawn while a buyer is checking out.
+func ResaleListingHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid resale listing id", http.StatusBadRequest)
+			return
+		}
+		resale, err := rs.Resales.FindByID(id)
+		if err != nil {
+			http.Error(w, "resale listing not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(resale)
+		case http.MethodDelete:
+			if resale.SellerID != u.ID {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			err := uow.WithTx(func(tx *repos.Repos) error {
+				state, err := tx.States.FindByID(resale.HeaderID)
+				if err != nil {
+					return err
+				}
+				if state.Status == models.StatusMatched {
+					return errors.New("a buyer is checking out; try again later")
+				}
+				if err := tx.Resales.Close(resale.ID, models.ResaleCancelled); err != nil {
+					return err
+				}
+				if state.Status != models.StatusListed || state.OwnerID != u.ID {
+					// Expired while on offer; nothing to take back.
+					return nil
+				}
+				return lifecycle.TransitionContract(tx, state, models.StatusOwned, u.ID, "resale withdrawn")
+			})
+			if err != nil {
+				http.Error(w, "failed to withdraw resale listing: "+err.Error(), http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// ResaleCheckoutHandler serves POST /v1/resale/{id}/checkout. The contract
+// moves to StatusMatched for as long as the buyer's checkout is open, so no
+// one else can buy it meanwhile, and payment goes to the reseller's Connect
+// account.
+func ResaleCheckoutHandler(provider payments.PaymentProvider, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		buyer, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "not authorized", 401)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid resale listing id", 400)
+			return
+		}
+		resale, err := rs.Resales.FindByID(id)
+		if err != nil {
+			http.Error(w, "resale listing not found", 404)
+			return
+		}
+		if resale.Status != models.ResaleOpen {
+			http.Error(w, repos.ErrResaleListingNotOpen.Error(), 409)
+			return
+		}
+		if resale.SellerID == buyer.ID {
+			http.Error(w, "cannot buy your own contract", 409)
+			return
+		}
+		header, err := rs.Headers.FindByID(resale.HeaderID)
+		if err != nil {
+			http.Error(w, "contract not found", 500)
+			return
+		}
+		if header.ExerciseBy != nil && !header.ExerciseBy.After(time.Now()) {
+			http.Error(w, "contract has expired", 409)
+			return
+		}
+
+		seller, ok := payableSeller(w, rs.Users, resale.SellerID)
+		if !ok {
+			return
+		}
+		productName := "Data Contract (resale)"
+		if header.DatastreamID != uuid.Nil {
+			datastream, err := rs.Datastreams.FindByID(header.DatastreamID)
+			if err != nil {
+				http.Error(w, "datastream not found", 500)
+				return
+			}
+			productName = datastream.Name + " (resale)"
+		}
+
+		unitCents := (resale.PriceNanos + 5_000_000) / 10_000_000
+		tr := &models.TransactionRecord{
+			ID:                uuid.New(),
+			InitiatedAt:       time.Now(),
+			ListingID:         header.ListingID,
+			SellerID:          resale.SellerID,
+			BuyerID:           buyer.ID,
+			PurchaseQuantity:  1,
+			PurchaseCents:     uint64(unitCents),
+			Currency:          os.Getenv("CURRENCY"),
+			PlatformFeeCents:  platformFeeCents(unitCents),
+			TransactionStatus: models.StatusPending,
+			Kind:              models.KindResale,
+			ResaleListingID:   resale.ID,
+		}
+		if err := applyRoyalty(tr, rs.Listings); err != nil {
+			http.Error(w, "failed to compute royalty: "+err.Error(), 500)
+			return
+		}
+		hold := &models.SupplyReservation{
+			ID:            uuid.New(),
+			Kind:          models.KindResale,
+			ListingID:     resale.ID,
+			TransactionID: tr.ID,
+			Quantity:      1,
+			Status:        models.ReservationActive,
+			ExpiresAt:     time.Now().Add(ReservationTTL()),
+			CreatedAt:     time.Now(),
+			UpdatedAt:     time.Now(),
+		}
+		err = uow.WithTx(func(tx *repos.Repos) error {
+			state, err := tx.States.FindByID(resale.HeaderID)
+			if err != nil {
+				return err
+			}
+			if state.OwnerID != resale.SellerID || state.Status != models.StatusListed {
+				return errContractUnavailable
+			}
+			err = lifecycle.TransitionContract(tx, state, models.StatusMatched, buyer.ID, "resale checkout")
+			if err != nil {
+				return err
+			}
+			if err := tx.Transactions.Create(tr); err != nil {
+				return err
+			}
+			return tx.Reservations.Create(hold)
+		})
+		if errors.Is(err, errContractUnavailable) || errors.Is(err, repos.ErrContractStatusConflict) {
+			http.Error(w, "contract is being bought by someone else", 409)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to hold contract: "+err.Error(), 500)
+			return
+		}
+
+		openCheckout(w, provider, uow, &checkoutOrder{
+			record:      tr,
+			hold:        hold,
+			seller:      seller,
+			productName: productName,
+			unitCents:   unitCents,
+			metadata: map[string]string{
+				"transaction_id":    tr.ID.String(),
+				"resale_listing_id": resale.ID.String(),
+				"contract_id":       resale.HeaderID.String(),
+				"buyer_id":          buyer.ID.String(),
+			},
+		})
+	}
+}
+
+// relistResale puts a contract whose resale checkout was abandoned back on
+// offer.
+func relistResale(resaleID uuid.UUID, tx *repos.Repos) error {
+	resale, err := tx.Resales.FindByID(resaleID)
+	if err != nil {
+		return err
+	}
+	state, err := tx.States.FindByID(resale.HeaderID)
+	if err != nil {
+		return err
+	}
+	if state.Status != models.StatusMatched {
+		return nil
+	}
+	return lifecycle.TransitionContract(tx, state, models.StatusListed, lifecycle.SystemActor, "resale checkout released")
+}
+
+// settleResale hands a paid-for resale contract to the buyer. A payment that
+// arrives after its checkout expired still buys the contract if it is back
+// on offer; if someone else has it by then, ErrResaleListingNotOpen is
+// returned so the payment can be refunded.
+func settleResale(record *models.TransactionRecord, tx *repos.Repos) error {
+	resale, err := tx.Resales.FindByID(record.ResaleListingID)
+	if err != nil {
+		return err
+	}
+	state, err := tx.States.FindByID(resale.HeaderID)
+	if err != nil {
+		return err
+	}
+
+	held := false
+	reservation, err := tx.Reservations.FindByTransactionID(record.ID)
+	switch {
+	case err == nil:
+		err = tx.Reservations.Convert(reservation.ID)
+		if err == nil {
+			held = true
+		} else if !errors.Is(err, repos.ErrReservationNotActive) {
+			return err
+		}
+	case !errors.Is(err, repos.ErrReservationNotFound):
+		return err
+	}
+
+	available := state.Status == models.StatusListed || (held && state.Status == models.StatusMatched)
+	if resale.Status != models.ResaleOpen || state.OwnerID != resale.SellerID || !available {
+		return repos.ErrResaleListingNotOpen
+	}
+	if err := tx.Resales.Close(resale.ID, models.ResaleSold); err != nil {
+		return err
+	}
+	_, err = TransferOwnership(record, state, tx)
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Stripe refuses checkout sessions that expire sooner than 30 minutes,
+	// and the hold has to outlive the session it backs.
+	minReservationTTL           = 30 * time.Minute
+	defaultReservationSweepTick = time.Minute
+)
+
+// ReservationTTL reads how long a checkout holds supply from RESERVATION_TTL.
+func ReservationTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("RESERVATION_TTL"))
+	if err != nil || ttl < minReservationTTL {
+		return minReservationTTL
+	}
+	return ttl
+}
+
+// ReleaseCheckout gives back what an unpaid transaction was holding and
+// marks it expired. Transactions that have meanwhile been paid are left alone.
+func ReleaseCheckout(transactionID uuid.UUID, uow repos.UnitOfWork, bus *events.Bus) error {
+	var record *models.TransactionRecord
+	released := false
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		var err error
+		record, err = tx.Transactions.FindByID(transactionID)
+		if err != nil {
+			return err
+		}
+		released, err = releaseHold(record, tx)
+		if err != nil {
+			return err
+		}
+
+		if !lifecycle.CanTransitionTransaction(record.TransactionStatus, models.StatusExpired) {
+			return nil
+		}
+		err = lifecycle.TransitionTransaction(tx.Transactions, record, models.StatusExpired, "")
+		if errors.Is(err, repos.ErrTransactionStatusConflict) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if released {
+		publishHoldReleased(bus, record)
+	}
+	return nil
+}
+
+// publishHoldReleased tells the market about a fill whose contracts
+// releaseHold has put back on offer.
+func publishHoldReleased(bus *events.Bus, record *models.TransactionRecord) {
+	if record.Kind != models.KindOrderFill {
+		return
+	}
+	bus.Publish(events.Event{
+		Type:          events.FillReleased,
+		At:            time.Now(),
+		TransactionID: record.ID,
+		UserID:        record.BuyerID,
+		Reason:        "fill not paid for",
+	})
+}
+
+// releaseHold releases the transaction's reservation, if it is still
+// active, and reports whether it did. For a resale that also puts the
+// contract back on offer, for an order book fill it puts the contracts back
+// in their ask, and for an option exercise it gives the option back
+// unexercised.
+func releaseHold(record *models.TransactionRecord, tx *repos.Repos) (bool, error) {
+	reservation, err := tx.Reservations.FindByTransactionID(record.ID)
+	if errors.Is(err, repos.ErrReservationNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = tx.Reservations.Release(reservation.ID)
+	if errors.Is(err, repos.ErrReservationNotActive) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	switch record.Kind {
+	case models.KindResale:
+		err = relistResale(record.ResaleListingID, tx)
+	case models.KindOrderFill:
+		err = releaseFill(record.FillID, tx)
+	case models.KindExercise:
+		err = releaseExercise(record.HeaderID, tx)
+	}
+	return err == nil, err
+}
+
+// SweepExpiredReservations releases every hold that expired by now.
+func SweepExpiredReservations(now time.Time, uow repos.UnitOfWork, bus *events.Bus) (int, error) {
+	expired, err := uow.Repos().Reservations.FindAllExpired(now)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, reservation := range expired {
+		if err := ReleaseCheckout(reservation.TransactionID, uow, bus); err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+// StartReservationSweeper runs SweepExpiredReservations every interval until
+// the returned stop function is called.
+func StartReservationSweeper(interval time.Duration, uow repos.UnitOfWork, bus *events.Bus) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				n, err := SweepExpiredReservations(now, uow, bus)
+				if err != nil {
+					log.Printf("reservation sweep failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("released %d expired reservations", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// FillSupplyAvailable sets SupplyAvailable on each listing from its
+// remaining supply and the units currently held by open checkouts.
+func FillSupplyAvailable(
+	reservationRepo repos.ReservationRepository,
+	listings ...*models.ContractListing) error {
+
+	if len(listings) == 0 {
+		return nil
+	}
+	ids := make([]uuid.UUID, len(listings))
+	for i, listing := range listings {
+		ids[i] = listing.ID
+	}
+	held, err := reservationRepo.SumActive(time.Now(), ids...)
+	if err != nil {
+		return err
+	}
+
+	for _, listing := range listings {
+		listing.SupplyAvailable = 0
+		if h := held[listing.ID]; h < listing.SupplyRemaining {
+			listing.SupplyAvailable = listing.SupplyRemaining - h
+		}
+	}
+	return nil
+}
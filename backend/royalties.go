@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRoyaltyTick = time.Minute
+	royaltyBatchSize   = 100
+)
+
+var errRoyaltyRecipientNotPayable = errors.New("royalty recipient has no connected account")
+
+// validRoyaltyBps checks a listing's royalty leaves the reseller something
+// once the platform fee is taken too.
+func validRoyaltyBps(bps int64) error {
+	if bps < 0 {
+		return errors.New("royalty_bps cannot be negative")
+	}
+	if bps+platformFeeBps() >= 10_000 {
+		return fmt.Errorf("royalty_bps must be below %d", 10_000-platformFeeBps())
+	}
+	return nil
+}
+
+// applyRoyalty sets the royalty a secondary sale owes the original seller
+// of the contracts, from the royalty their listing declares. Nothing is
+// owed when the original seller is the one reselling, or when the listing
+// is gone.
+func applyRoyalty(record *models.TransactionRecord, listingRepo repos.ContractListingRepository) error {
+	listing, err := listingRepo.FindByID(record.ListingID)
+	if errors.Is(err, repos.ErrListingNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if listing.RoyaltyBps <= 0 || listing.SellerID == record.SellerID {
+		return nil
+	}
+
+	royalty := int64(record.PurchaseCents) * listing.RoyaltyBps / 10_000
+	royalty = min(royalty, int64(record.PurchaseCents)-record.PlatformFeeCents)
+	if royalty <= 0 {
+		return nil
+	}
+	record.RoyaltyCents = royalty
+	record.RoyaltyRecipientID = listing.SellerID
+	return nil
+}
+
+// PayRoyalty transfers a fulfilled sale's royalty to the original seller's
+// Connect account. The transfer is keyed on the transaction, so paying the
+// same royalty twice moves the money once.
+func PayRoyalty(
+	record *models.TransactionRecord,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) error {
+
+	if record.RoyaltyCents <= 0 || record.RoyaltyTransferID != "" {
+		return nil
+	}
+	if record.TransactionStatus != models.StatusFulfilled {
+		return fmt.Errorf("transaction %s is %s, not fulfilled", record.ID, record.TransactionStatus)
+	}
+	recipient, err := uow.Repos().Users.FindByID(record.RoyaltyRecipientID)
+	if err != nil {
+		return err
+	}
+	if recipient.StripeConnectAccountID == "" {
+		return errRoyaltyRecipientNotPayable
+	}
+
+	transfer, err := provider.CreateTransfer(&payments.TransferParams{
+		AmountCents:          record.RoyaltyCents,
+		Currency:             record.Currency,
+		DestinationAccountID: recipient.StripeConnectAccountID,
+		TransferGroup:        record.ID.String(),
+		IdempotencyKey:       "royalty-" + record.ID.String(),
+		Metadata: map[string]string{
+			"transaction_id": record.ID.String(),
+			"listing_id":     record.ListingID.String(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := uow.Repos().Transactions.MarkRoyaltyPaid(record.ID, transfer.ID, now); err != nil {
+		return err
+	}
+	record.RoyaltyTransferID = transfer.ID
+	record.RoyaltyPaidAt = &now
+	return nil
+}
+
+// PayOwedRoyalties pays every royalty owed on fulfilled sales to a
+// recipient who has onboarded. Royalties that cannot be paid yet, because
+// the recipient has not onboarded or the transfer failed, are left owed and
+// tried again on the next run; they do not hold up the ones behind them.
+func PayOwedRoyalties(provider payments.PaymentProvider, uow repos.UnitOfWork) (int, error) {
+	paid := 0
+	after := uuid.Nil
+	for {
+		owed, err := uow.Repos().Transactions.FindAllPayableRoyalties(after, royaltyBatchSize)
+		if err != nil {
+			return paid, err
+		}
+		for i := range owed {
+			record := &owed[i]
+			if err := PayRoyalty(record, provider, uow); err != nil {
+				if !errors.Is(err, errRoyaltyRecipientNotPayable) {
+					log.Printf("royalty for transaction %s: %v", record.ID, err)
+				}
+				continue
+			}
+			paid++
+		}
+		if len(owed) < royaltyBatchSize {
+			return paid, nil
+		}
+		after = owed[len(owed)-1].ID
+	}
+}
+
+// StartRoyaltyPayer runs PayOwedRoyalties on every tick of clk until the
+// returned stop function is called.
+func StartRoyaltyPayer(
+	interval time.Duration,
+	clk clock.Clock,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (stop func()) {
+
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := PayOwedRoyalties(provider, uow)
+				if err != nil {
+					log.Printf("royalty payout failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("paid %d royalties", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+type ListingRoyalties struct {
+	ListingID   uuid.UUID `json:"listing_id"`
+	Sales       int       `json:"sales"`
+	EarnedCents int64     `json:"earned_cents"`
+}
+
+// RoyaltySale is one resale that earned a royalty, as the original seller
+// sees it: nothing about the buyer, the reseller or the payment.
+type RoyaltySale struct {
+	TransactionID uuid.UUID  `json:"transaction_id"`
+	ListingID     uuid.UUID  `json:"listing_id"`
+	Quantity      int64      `json:"quantity"`
+	SaleCents     uint64     `json:"sale_cents"`
+	RoyaltyCents  int64      `json:"royalty_cents"`
+	Currency      string     `json:"currency"`
+	SoldAt        *time.Time `json:"sold_at"`
+	PaidAt        *time.Time `json:"paid_at,omitempty"`
+}
+
+// RoyaltyReport is what a seller has earned from resales of contracts they
+// first sold. OwedCents is earned but not transferred yet.
+type RoyaltyReport struct {
+	SellerID    uuid.UUID          `json:"seller_id"`
+	Sales       int                `json:"sales"`
+	EarnedCents int64              `json:"earned_cents"`
+	PaidCents   int64              `json:"paid_cents"`
+	OwedCents   int64              `json:"owed_cents"`
+	ByListing   []ListingRoyalties `json:"by_listing"`
+	Recent      []RoyaltySale      `json:"recent"`
+}
+
+const royaltyReportRecent = 50
+
+func NewRoyaltyReport(sellerID uuid.UUID, records []models.TransactionRecord) *RoyaltyReport {
+	report := &RoyaltyReport{SellerID: sellerID, ByListing: []ListingRoyalties{}, Recent: []RoyaltySale{}}
+	byListing := map[uuid.UUID]int{}
+	for _, record := range records {
+		report.Sales++
+		report.EarnedCents += record.RoyaltyCents
+		if record.RoyaltyTransferID != "" {
+			report.PaidCents += record.RoyaltyCents
+		} else {
+			report.OwedCents += record.RoyaltyCents
+		}
+
+		i, ok := byListing[record.ListingID]
+		if !ok {
+			i = len(report.ByListing)
+			byListing[record.ListingID] = i
+			report.ByListing = append(report.ByListing, ListingRoyalties{ListingID: record.ListingID})
+		}
+		report.ByListing[i].Sales++
+		report.ByListing[i].EarnedCents += record.RoyaltyCents
+	}
+	for _, record := range records[:min(len(records), royaltyReportRecent)] {
+		report.Recent = append(report.Recent, RoyaltySale{
+			TransactionID: record.ID,
+			ListingID:     record.ListingID,
+			Quantity:      record.PurchaseQuantity,
+			SaleCents:     record.PurchaseCents,
+			RoyaltyCents:  record.RoyaltyCents,
+			Currency:      record.Currency,
+			SoldAt:        record.FulfilledAt,
+			PaidAt:        record.RoyaltyPaidAt,
+		})
+	}
+	return report
+}
+
+// RoyaltiesHandler serves GET /v1/royalties, the caller's royalty earnings.
+func RoyaltiesHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		records, err := rs.Transactions.FindAllRoyaltiesByRecipientID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch royalties: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(NewRoyaltyReport(u.ID, records))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+
+	"github.com/google/uuid"
+)
+
+func TestApplyRoyalty(t *testing.T) {
+	cases := []struct {
+		name          string
+		purchaseCents uint64
+		feeCents      int64
+		royaltyBps    int64
+		// byOriginalSeller resells as the listing's own seller.
+		byOriginalSeller bool
+		deleted          bool
+		want             int64
+	}{
+		{name: "rounds down", purchaseCents: 999, royaltyBps: 1000, want: 99},
+		{name: "too small to owe anything", purchaseCents: 1, royaltyBps: 100, want: 0},
+		{name: "limited to what the fee leaves", purchaseCents: 1000, feeCents: 500, royaltyBps: 9000, want: 500},
+		{name: "no royalty on the listing", purchaseCents: 1000, want: 0},
+		{name: "original seller reselling", purchaseCents: 1000, royaltyBps: 1000, byOriginalSeller: true, want: 0},
+		{name: "listing deleted", purchaseCents: 1000, royaltyBps: 1000, deleted: true, want: 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newTestMarket(t)
+			listing := m.listing(t, &ListingParams{SupplyLimit: 1, RoyaltyBps: c.royaltyBps})
+			record := &models.TransactionRecord{
+				ListingID:        listing.ID,
+				SellerID:         m.buyer.ID,
+				PurchaseCents:    c.purchaseCents,
+				PlatformFeeCents: c.feeCents,
+			}
+			if c.byOriginalSeller {
+				record.SellerID = m.seller.ID
+			}
+			if c.deleted {
+				record.ListingID = uuid.New()
+			}
+
+			if err := applyRoyalty(record, m.uow.Repos().Listings); err != nil {
+				t.Fatal(err)
+			}
+			if record.RoyaltyCents != c.want {
+				t.Errorf("royalty = %d cents, want %d", record.RoyaltyCents, c.want)
+			}
+			wantRecipient := uuid.Nil
+			if c.want > 0 {
+				wantRecipient = m.seller.ID
+			}
+			if record.RoyaltyRecipientID != wantRecipient {
+				t.Errorf("royalty recipient = %s, want %s", record.RoyaltyRecipientID, wantRecipient)
+			}
+		})
+	}
+}
+
+// resell has the buyer offer their contract at priceNanos and a new user
+// buy and pay for it, returning the sale.
+func (m *testMarket) resell(t *testing.T, headerID uuid.UUID, priceNanos int64) *models.TransactionRecord {
+	t.Helper()
+	acct, err := m.provider.CreateConnectedAccount(&payments.AccountParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.buyer.StripeConnectAccountID = acct.ID
+	m.buyer.StripeChargesEnabled = true
+	if err := m.uow.Repos().Users.Update(m.buyer); err != nil {
+		t.Fatal(err)
+	}
+	resale, err := CreateResaleListing(m.buyer.ID, headerID, priceNanos, m.provider, m.uow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := as(httptest.NewRequest(http.MethodPost, "/v1/resale/"+resale.ID.String()+"/checkout", nil), m.user(t, "second buyer"))
+	r.SetPathValue("id", resale.ID.String())
+	w := httptest.NewRecorder()
+	ResaleCheckoutHandler(m.provider, m.uow)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("resale checkout: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	sale := m.transaction(t, uuid.MustParse(resp.TransactionID))
+	if _, err := m.provider.CompleteCheckoutSession(sale.StripeCheckoutSessonID); err != nil {
+		t.Fatal(err)
+	}
+	return m.transaction(t, sale.ID)
+}
+
+func TestResaleRoyaltyPaidToOriginalSeller(t *testing.T) {
+	m := newTestMarket(t)
+	listing := m.listing(t, &ListingParams{SupplyLimit: 1, RoyaltyBps: 1000})
+	m.buy(t, listing.ID, 1)
+	contract := m.owned(t, m.buyer)[0]
+
+	sale := m.resell(t, contract.HeaderID, 25_000_000_000)
+	if sale.TransactionStatus != models.StatusFulfilled || sale.RoyaltyCents != 250 {
+		t.Fatalf("resale is %s with a %d cent royalty, want fulfilled with 250", sale.TransactionStatus, sale.RoyaltyCents)
+	}
+
+	for range 2 {
+		if _, err := PayOwedRoyalties(m.provider, m.uow); err != nil {
+			t.Fatal(err)
+		}
+	}
+	royalties := m.provider.Transfers()
+	if len(royalties) != 1 {
+		t.Fatalf("royalty transfers %+v, want exactly one", royalties)
+	}
+	if got := royalties[0]; got.AmountCents != 250 || got.DestinationAccountID != m.seller.StripeConnectAccountID {
+		t.Errorf("royalty transfer %+v, want 250 cents to the original seller", got)
+	}
+	if paid := m.transaction(t, sale.ID); paid.RoyaltyTransferID != royalties[0].ID || paid.RoyaltyPaidAt == nil {
+		t.Errorf("sale records royalty transfer %q at %v, want %q", paid.RoyaltyTransferID, paid.RoyaltyPaidAt, royalties[0].ID)
+	}
+}
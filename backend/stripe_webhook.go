@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"contract_market_demo/backend/events"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const maxWebhookBodyBytes = 65536
+
+func StripeWebhookHandler(
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork,
+	bus *events.Bus) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusServiceUnavailable)
+			return
+		}
+
+		event, err := provider.ConstructEvent(payload, r.Header.Get("Stripe-Signature"))
+		if err != nil {
+			http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := HandlePaymentEvent(event, provider, uow, bus); err != nil {
+			log.Printf("webhook %s: %s handling failed: %v", event.ID, event.Type, err)
+			http.Error(w, "event handling failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// HandlePaymentEvent applies a verified payment event. It is shared by the
+// webhook endpoint and by FakeProvider, which delivers events in-process.
+func HandlePaymentEvent(event *payments.Event, provider payments.PaymentProvider, uow repos.UnitOfWork, bus *events.Bus) error {
+	switch event.Type {
+	case payments.EventCheckoutSessionCompleted, payments.EventCheckoutSessionAsyncPaymentSucceeded:
+		if event.CheckoutSession == nil {
+			return errors.New("event has no checkout session")
+		}
+		if event.CheckoutSession.Mode == payments.CheckoutModeSetup {
+			return SavePaymentMethod(event.CheckoutSession, uow.Repos().Users)
+		}
+		return FulfillCheckout(event.ID, event.CheckoutSession, provider, uow)
+	case payments.EventCheckoutSessionExpired:
+		if event.CheckoutSession == nil {
+			return errors.New("event has no checkout session")
+		}
+		record, err := findCheckoutTransaction(event.CheckoutSession, uow.Repos().Transactions)
+		if errors.Is(err, repos.ErrTransactionNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return ReleaseCheckout(record.ID, uow, bus)
+	case payments.EventInvoicePaid:
+		if event.Invoice == nil {
+			return errors.New("event has no invoice")
+		}
+		return RenewSubscription(event.ID, event.Invoice, uow)
+	case payments.EventInvoicePaymentFailed:
+		if event.Invoice == nil {
+			return errors.New("event has no invoice")
+		}
+		return FailSubscriptionRenewal(event.Invoice, uow)
+	case payments.EventSubscriptionDeleted:
+		if event.Subscription == nil {
+			return errors.New("event has no subscription")
+		}
+		return EndSubscription(event.Subscription, uow)
+	case payments.EventChargeRefunded:
+		if event.Charge == nil {
+			return errors.New("event has no charge")
+		}
+		return ReconcileRefund(event.Charge, uow)
+	case payments.EventChargeDisputeCreated:
+		if event.Dispute == nil {
+			return errors.New("event has no dispute")
+		}
+		return FreezeDisputed(event.Dispute, uow, bus)
+	case payments.EventChargeDisputeClosed:
+		if event.Dispute == nil {
+			return errors.New("event has no dispute")
+		}
+		return SettleDispute(event.Dispute, uow)
+	case payments.EventPaymentIntentSucceeded, payments.EventPaymentIntentPaymentFailed:
+		if event.PaymentIntent == nil {
+			return errors.New("event has no payment intent")
+		}
+		return SettleOverageCharge(event.PaymentIntent, event.Type == payments.EventPaymentIntentSucceeded, uow)
+	case payments.EventAccountUpdated:
+		if event.Account == nil {
+			return errors.New("event has no account")
+		}
+		_, err := SyncConnectAccount(event.Account, uow.Repos().Users)
+		if errors.Is(err, repos.ErrUserNotFound) {
+			// Not one of our sellers, or the account ID has not been stored yet.
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// SyncConnectAccount copies a connected account's capability flags onto the
+// user that owns it.
+func SyncConnectAccount(acct *payments.Account, userRepo repos.UserRepository) (*models.User, error) {
+	u, err := userRepo.FindByStripeConnectAccountID(acct.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	u.StripeChargesEnabled = acct.ChargesEnabled
+	u.StripePayoutsEnabled = acct.PayoutsEnabled
+	u.StripeDetailsSubmitted = acct.DetailsSubmitted
+	if err := userRepo.Update(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// FulfillCheckout issues the contracts paid for by a completed checkout
+// session and hands them to the buyer. Everything happens in one database
+// transaction: either the buyer owns every contract and the record is
+// fulfilled, or nothing changed and the event can be retried. Redelivered
+// events, and events for transactions that were already fulfilled, are
+// acknowledged without effect. A subscription started by a checkout that
+// cannot be fulfilled is cancelled so it does not bill again.
+func FulfillCheckout(
+	eventID string,
+	s *payments.CheckoutSession,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) error {
+
+	if !s.Paid {
+		// Delayed payment methods complete the session before the funds
+		// arrive; checkout.session.async_payment_succeeded follows later.
+		return nil
+	}
+
+	record, err := findCheckoutTransaction(s, uow.Repos().Transactions)
+	if err != nil {
+		return err
+	}
+	if record.IsFulfilled || record.StripeEventLastID == eventID {
+		return nil
+	}
+	paymentIntentID, err := checkoutPaymentIntentID(s, provider)
+	if err != nil {
+		return err
+	}
+
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		// Work on a copy so a rollback leaves record as it is stored.
+		paid := *record
+		paid.StripeSubscriptionID = s.SubscriptionID
+		if err := markPaid(&paid, eventID, paymentIntentID, tx); err != nil {
+			return err
+		}
+		if err := issueToBuyer(&paid, tx); err != nil {
+			return err
+		}
+		return lifecycle.TransitionTransaction(tx.Transactions, &paid, models.StatusFulfilled, "")
+	})
+	switch {
+	case err == nil:
+		return nil
+	case alreadyProcessed(err):
+		return nil
+	case errors.Is(err, repos.ErrInsufficientSupply),
+		errors.Is(err, repos.ErrListingNotFound),
+		errors.Is(err, repos.ErrResaleListingNotOpen),
+		errors.Is(err, errFillReleased),
+		errors.Is(err, errOptionNotExercisable),
+		errors.Is(err, lifecycle.ErrIllegalTransition):
+		// Retrying cannot help, so record the failure and acknowledge.
+		log.Printf("transaction %s: cannot fulfil: %v", record.ID, err)
+		if s.SubscriptionID != "" {
+			if _, err := provider.CancelSubscription(s.SubscriptionID, false); err != nil {
+				log.Printf("transaction %s: cancel subscription %s: %v", record.ID, s.SubscriptionID, err)
+			}
+		}
+		return markCheckoutFailed(record, eventID, paymentIntentID, err.Error(), uow)
+	default:
+		return err
+	}
+}
+
+// checkoutPaymentIntentID returns the payment intent that paid for a
+// checkout session. A subscription's session has none of its own, so it is
+// taken from the invoice the subscription started with; without it the
+// purchase could be neither refunded nor matched to a dispute.
+func checkoutPaymentIntentID(s *payments.CheckoutSession, provider payments.PaymentProvider) (string, error) {
+	if s.PaymentIntentID != "" || s.SubscriptionID == "" {
+		return s.PaymentIntentID, nil
+	}
+	sub, err := provider.RetrieveSubscription(s.SubscriptionID)
+	if err != nil {
+		return "", fmt.Errorf("subscription %s: %w", s.SubscriptionID, err)
+	}
+	if sub.LatestPaymentIntentID == "" {
+		return "", fmt.Errorf("subscription %s: first invoice has no payment intent", s.SubscriptionID)
+	}
+	return sub.LatestPaymentIntentID, nil
+}
+
+// markPaid records the payment event on the transaction and moves it to
+// Paid. It fails with a transition or status conflict error if another
+// delivery got there first.
+func markPaid(
+	record *models.TransactionRecord,
+	eventID string,
+	paymentIntentID string,
+	tx *repos.Repos) error {
+
+	record.StripeEventLastID = eventID
+	record.StripePaymentIntentID = paymentIntentID
+	return lifecycle.TransitionTransaction(tx.Transactions, record, models.StatusPaid, "")
+}
+
+// markCheckoutFailed records a payment that was taken but cannot be
+// fulfilled, so the buyer can be refunded.
+func markCheckoutFailed(
+	record *models.TransactionRecord,
+	eventID string,
+	paymentIntentID string,
+	reason string,
+	uow repos.UnitOfWork) error {
+
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		if err := markPaid(record, eventID, paymentIntentID, tx); err != nil {
+			return err
+		}
+		return lifecycle.TransitionTransaction(tx.Transactions, record, models.StatusFailed, reason)
+	})
+	if alreadyProcessed(err) {
+		return nil
+	}
+	return err
+}
+
+// alreadyProcessed reports whether err means the transaction had already
+// left the stage a payment event applies to.
+func alreadyProcessed(err error) bool {
+	var transitionErr *lifecycle.TransactionTransitionError
+	return errors.As(err, &transitionErr) ||
+		errors.Is(err, repos.ErrTransactionStatusConflict)
+}
+
+func findCheckoutTransaction(
+	s *payments.CheckoutSession,
+	transactionRepo repos.TransactionRepository) (*models.TransactionRecord, error) {
+
+	if id, err := uuid.Parse(s.ClientReferenceID); err == nil {
+		return transactionRepo.FindByID(id)
+	}
+	return transactionRepo.FindByCheckoutSessionID(s.ID)
+}
+
+func issueToBuyer(record *models.TransactionRecord, tx *repos.Repos) error {
+	switch record.Kind {
+	case models.KindResale:
+		return settleResale(record, tx)
+	case models.KindOrderFill:
+		return settleFill(record, tx)
+	case models.KindExercise:
+		return settleExercise(record, tx)
+	}
+
+	listing, err := tx.Listings.FindByID(record.ListingID)
+	if err != nil {
+		return err
+	}
+
+	headers, states, err := IssueFromListing(listing, int(record.PurchaseQuantity), tx)
+	if err != nil {
+		return err
+	}
+	if record.StripeSubscriptionID != "" {
+		if err := startSubscription(record, listing, headers, tx); err != nil {
+			return err
+		}
+	}
+
+	reservation, err := tx.Reservations.FindByTransactionID(record.ID)
+	switch {
+	case err == nil:
+		err = tx.Reservations.Convert(reservation.ID)
+		if err != nil && !errors.Is(err, repos.ErrReservationNotActive) {
+			return err
+		}
+	case !errors.Is(err, repos.ErrReservationNotFound):
+		return err
+	}
+
+	return TransferOwnershipInBatches(record, states, tx)
+}
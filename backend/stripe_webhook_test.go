@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/clerk/clerk-sdk-go/v2"
+	"github.com/google/uuid"
+)
+
+// testMarket is a marketplace on the fake payment provider, with one
+// onboarded seller and one buyer. newTestMarket keeps it in memory.
+type testMarket struct {
+	uow      repos.UnitOfWork
+	provider *payments.FakeProvider
+	seller   *models.User
+	buyer    *models.User
+	// subjectPrefix keeps users apart from other runs' in a store that
+	// outlives the test.
+	subjectPrefix string
+}
+
+func newTestMarket(t *testing.T) *testMarket {
+	t.Helper()
+	return newTestMarketOn(t, newMemUnitOfWork(), "")
+}
+
+func newTestMarketOn(t *testing.T, uow repos.UnitOfWork, subjectPrefix string) *testMarket {
+	t.Helper()
+	m := &testMarket{
+		uow:           uow,
+		provider:      payments.NewFakeProvider("http://fake.test"),
+		subjectPrefix: subjectPrefix,
+	}
+	acct, err := m.provider.CreateConnectedAccount(&payments.AccountParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.seller = m.user(t, "seller")
+	m.seller.StripeConnectAccountID = acct.ID
+	m.seller.StripeChargesEnabled = true
+	if err := m.uow.Repos().Users.Update(m.seller); err != nil {
+		t.Fatal(err)
+	}
+	m.buyer = m.user(t, "buyer")
+	return m
+}
+
+func (m *testMarket) user(t *testing.T, subject string) *models.User {
+	t.Helper()
+	u, err := m.uow.Repos().Users.FindOrCreateByAuth("clerk", m.subjectPrefix+subject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// deliverInProcess hands every event the fake emits straight to
+// HandlePaymentEvent, as if the webhook had been called.
+func (m *testMarket) deliverInProcess() {
+	m.provider.OnEvent(func(ev *payments.Event) error {
+		return HandlePaymentEvent(ev, m.provider, m.uow, nil)
+	})
+}
+
+func (m *testMarket) listing(t *testing.T, p *ListingParams) *models.ContractListing {
+	t.Helper()
+	p.SellerID = m.seller.ID
+	if p.ListPriceNanos == 0 {
+		p.ListPriceNanos = 1_000_000_000
+	}
+	listing, err := CreateListing(p, m.uow.Repos().Listings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listing
+}
+
+// as returns r signed in as u.
+func as(r *http.Request, u *models.User) *http.Request {
+	claims := &clerk.SessionClaims{RegisteredClaims: clerk.RegisteredClaims{Subject: u.AuthSubject}}
+	return r.WithContext(clerk.ContextWithSessionClaims(r.Context(), claims))
+}
+
+// checkout starts a checkout through the API and returns its transaction.
+func (m *testMarket) checkout(t *testing.T, listingID uuid.UUID, quantity int) *models.TransactionRecord {
+	t.Helper()
+	body, _ := json.Marshal(ContractPurchaseRequest{ListingID: listingID.String(), PurchaseQuantity: quantity})
+	r := as(httptest.NewRequest(http.MethodPost, "/v1/checkout", bytes.NewReader(body)), m.buyer)
+	w := httptest.NewRecorder()
+	CheckoutHandler(m.provider, m.uow)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout: %d %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return m.transaction(t, uuid.MustParse(resp.TransactionID))
+}
+
+func (m *testMarket) transaction(t *testing.T, id uuid.UUID) *models.TransactionRecord {
+	t.Helper()
+	tr, err := m.uow.Repos().Transactions.FindByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func (m *testMarket) supplyRemaining(t *testing.T, listingID uuid.UUID) uint64 {
+	t.Helper()
+	listing, err := m.uow.Repos().Listings.FindByID(listingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listing.SupplyRemaining
+}
+
+// owned returns the contracts u owns.
+func (m *testMarket) owned(t *testing.T, u *models.User) []models.ContractState {
+	t.Helper()
+	states, err := m.uow.Repos().States.FindAllByOwnerID(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owned []models.ContractState
+	for _, s := range states {
+		if s.Status == models.StatusOwned {
+			owned = append(owned, s)
+		}
+	}
+	return owned
+}
+
+// buy checks out quantity units of listing and pays for them.
+func (m *testMarket) buy(t *testing.T, listingID uuid.UUID, quantity int) *models.TransactionRecord {
+	t.Helper()
+	m.deliverInProcess()
+	tr := m.checkout(t, listingID, quantity)
+	if _, err := m.provider.CompleteCheckoutSession(tr.StripeCheckoutSessonID); err != nil {
+		t.Fatal(err)
+	}
+	return m.transaction(t, tr.ID)
+}
+
+func TestCheckoutFulfilledByWebhook(t *testing.T) {
+	m := newTestMarket(t)
+	m.deliverInProcess()
+	listing := m.listing(t, &ListingParams{SupplyLimit: 5})
+
+	tr := m.checkout(t, listing.ID, 2)
+	if tr.TransactionStatus != models.StatusRequiresPayment {
+		t.Fatalf("before payment the transaction is %s", tr.TransactionStatus)
+	}
+	if _, err := m.provider.CompleteCheckoutSession(tr.StripeCheckoutSessonID); err != nil {
+		t.Fatal(err)
+	}
+
+	tr = m.transaction(t, tr.ID)
+	if tr.TransactionStatus != models.StatusFulfilled || !tr.IsFulfilled {
+		t.Fatalf("after payment the transaction is %s", tr.TransactionStatus)
+	}
+	if tr.StripePaymentIntentID == "" {
+		t.Error("payment intent not recorded")
+	}
+	if got := len(m.owned(t, m.buyer)); got != 2 {
+		t.Errorf("buyer owns %d contracts, want 2", got)
+	}
+	if got := m.supplyRemaining(t, listing.ID); got != 3 {
+		t.Errorf("supply remaining %d, want 3", got)
+	}
+	reservation, err := m.uow.Repos().Reservations.FindByTransactionID(tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reservation.Status != models.ReservationConverted {
+		t.Errorf("reservation is %v, want converted", reservation.Status)
+	}
+}
+
+func TestDuplicateWebhookDeliveryIsIgnored(t *testing.T) {
+	m := newTestMarket(t)
+	listing := m.listing(t, &ListingParams{SupplyLimit: 5})
+	tr := m.checkout(t, listing.ID, 2)
+
+	// Nothing is delivered in process: the event only arrives through the
+	// webhook endpoint, twice.
+	ev, err := m.provider.CompleteCheckoutSession(tr.StripeCheckoutSessonID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, err := m.provider.SignedPayload(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook := StripeWebhookHandler(m.provider, m.uow, nil)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/v1/stripe/webhook", bytes.NewReader(payload))
+		r.Header.Set("Stripe-Signature", signature)
+		w := httptest.NewRecorder()
+		webhook(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("delivery %d: %d %s", i+1, w.Code, w.Body)
+		}
+	}
+
+	if got := m.transaction(t, tr.ID).TransactionStatus; got != models.StatusFulfilled {
+		t.Fatalf("transaction is %s", got)
+	}
+	if got := len(m.owned(t, m.buyer)); got != 2 {
+		t.Errorf("buyer owns %d contracts after a redelivery, want 2", got)
+	}
+	if got := m.supplyRemaining(t, listing.ID); got != 3 {
+		t.Errorf("supply remaining %d after a redelivery, want 3", got)
+	}
+}
+
+func TestWebhookRejectsBadSignature(t *testing.T) {
+	m := newTestMarket(t)
+	listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+	tr := m.checkout(t, listing.ID, 1)
+	ev, err := m.provider.CompleteCheckoutSession(tr.StripeCheckoutSessonID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _, err := m.provider.SignedPayload(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/stripe/webhook", bytes.NewReader(payload))
+	r.Header.Set("Stripe-Signature", "forged")
+	w := httptest.NewRecorder()
+	StripeWebhookHandler(m.provider, m.uow, nil)(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("forged event: %d", w.Code)
+	}
+	if got := m.transaction(t, tr.ID).TransactionStatus; got != models.StatusRequiresPayment {
+		t.Errorf("transaction is %s after a forged event", got)
+	}
+}
+
+func TestCheckoutPaidAfterHoldExpired(t *testing.T) {
+	m := newTestMarket(t)
+	m.deliverInProcess()
+	listing := m.listing(t, &ListingParams{SupplyLimit: 5})
+	tr := m.checkout(t, listing.ID, 2)
+
+	if _, err := SweepExpiredReservations(time.Now().Add(ReservationTTL()+time.Minute), m.uow, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.transaction(t, tr.ID).TransactionStatus; got != models.StatusExpired {
+		t.Fatalf("after the hold lapsed the transaction is %s", got)
+	}
+
+	// The buyer still had the payment page open and pays anyway. The
+	// supply is there, so the purchase goes through.
+	if _, err := m.provider.CompleteCheckoutSession(tr.StripeCheckoutSessonID); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.transaction(t, tr.ID).TransactionStatus; got != models.StatusFulfilled {
+		t.Fatalf("late payment left the transaction %s", got)
+	}
+	if got := len(m.owned(t, m.buyer)); got != 2 {
+		t.Errorf("buyer owns %d contracts, want 2", got)
+	}
+	if got := m.supplyRemaining(t, listing.ID); got != 3 {
+		t.Errorf("supply remaining %d, want 3", got)
+	}
+}
+
+func TestCheckoutPaidAfterHoldExpiredAndSoldOut(t *testing.T) {
+	m := newTestMarket(t)
+	m.deliverInProcess()
+	listing := m.listing(t, &ListingParams{SupplyLimit: 2})
+	late := m.checkout(t, listing.ID, 2)
+
+	if _, err := SweepExpiredReservations(time.Now().Add(ReservationTTL()+time.Minute), m.uow, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else buys the released supply before the late payment lands.
+	other := m.buy(t, listing.ID, 2)
+	if other.TransactionStatus != models.StatusFulfilled {
+		t.Fatalf("second purchase is %s", other.TransactionStatus)
+	}
+
+	if _, err := m.provider.CompleteCheckoutSession(late.StripeCheckoutSessonID); err != nil {
+		t.Fatal(err)
+	}
+	tr := m.transaction(t, late.ID)
+	if tr.TransactionStatus != models.StatusFailed {
+		t.Fatalf("late payment for sold-out supply left the transaction %s", tr.TransactionStatus)
+	}
+	if tr.StripePaymentIntentID == "" {
+		t.Error("payment intent not recorded, so the buyer cannot be refunded")
+	}
+	if got := m.supplyRemaining(t, listing.ID); got != 0 {
+		t.Errorf("supply remaining %d, want 0", got)
+	}
+	if got := len(m.owned(t, m.buyer)); got != 2 {
+		t.Errorf("buyer owns %d contracts, want only the 2 from the second purchase", got)
+	}
+}
+
+func TestSubscriptionCheckoutRecordsFirstPayment(t *testing.T) {
+	m := newTestMarket(t)
+	listing := m.listing(t, &ListingParams{
+		SupplyLimit:          1,
+		ContractType:         models.ContractSubscription,
+		BillingInterval:      models.BillingMonth,
+		BillingIntervalCount: 1,
+	})
+	tr := m.buy(t, listing.ID, 1)
+	if tr.TransactionStatus != models.StatusFulfilled {
+		t.Fatalf("subscription purchase is %s", tr.TransactionStatus)
+	}
+	if tr.StripeSubscriptionID == "" {
+		t.Fatal("subscription not recorded")
+	}
+	sub, err := m.provider.RetrieveSubscription(tr.StripeSubscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.StripePaymentIntentID == "" || tr.StripePaymentIntentID != sub.LatestPaymentIntentID {
+		t.Fatalf("payment intent %q recorded, want the first invoice's %q", tr.StripePaymentIntentID, sub.LatestPaymentIntentID)
+	}
+
+	if _, err := RefundTransaction(tr.ID, m.seller, 1, "changed mind", m.provider, m.uow); err != nil {
+		t.Fatalf("refund a subscription purchase: %v", err)
+	}
+	if got := m.transaction(t, tr.ID).TransactionStatus; got != models.StatusRefunded {
+		t.Errorf("refunded subscription purchase is %s", got)
+	}
+}
+
+// webhook delivers ev through the webhook endpoint and returns the status.
+func (m *testMarket) webhook(t *testing.T, ev *payments.Event) int {
+	t.Helper()
+	payload, signature, err := m.provider.SignedPayload(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/v1/stripe/webhook", bytes.NewReader(payload))
+	r.Header.Set("Stripe-Signature", signature)
+	w := httptest.NewRecorder()
+	StripeWebhookHandler(m.provider, m.uow, nil)(w, r)
+	return w.Code
+}
+
+func TestAccountUpdatedSyncsSeller(t *testing.T) {
+	m := newTestMarket(t)
+	steps := []struct {
+		charges, payouts, details bool
+	}{
+		{charges: true, payouts: true, details: true},
+		{charges: false, payouts: true, details: true},
+		{charges: false, payouts: false, details: false},
+	}
+	for _, step := range steps {
+		ev, err := m.provider.UpdateAccount(m.seller.StripeConnectAccountID, step.charges, step.payouts, step.details)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := m.webhook(t, ev); code != http.StatusOK {
+			t.Fatalf("account.updated: %d", code)
+		}
+		seller := m.user(t, "seller")
+		got := struct{ charges, payouts, details bool }{
+			seller.StripeChargesEnabled, seller.StripePayoutsEnabled, seller.StripeDetailsSubmitted,
+		}
+		if got != step {
+			t.Errorf("seller has %+v after account.updated with %+v", got, step)
+		}
+	}
+	if got := m.user(t, "buyer"); got.StripeChargesEnabled || got.StripePayoutsEnabled || got.StripeDetailsSubmitted {
+		t.Errorf("buyer changed by the seller's account.updated: %+v", got)
+	}
+}
+
+func TestAccountUpdatedForUnknownAccountIsAcknowledged(t *testing.T) {
+	m := newTestMarket(t)
+	acct, err := m.provider.CreateConnectedAccount(&payments.AccountParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := m.provider.UpdateAccount(acct.ID, true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := m.webhook(t, ev); code != http.StatusOK {
+		t.Fatalf("account.updated for an account no user has: %d", code)
+	}
+	if _, err := SyncConnectAccount(ev.Account, m.uow.Repos().Users); !errors.Is(err, repos.ErrUserNotFound) {
+		t.Errorf("SyncConnectAccount = %v, want %v", err, repos.ErrUserNotFound)
+	}
+	for _, subject := range []string{"seller", "buyer"} {
+		if u := m.user(t, subject); u.StripePayoutsEnabled || u.StripeDetailsSubmitted {
+			t.Errorf("%s changed by another account's account.updated: %+v", subject, u)
+		}
+	}
+}
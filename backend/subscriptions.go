@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSubscriptionGrace     = 3 * 24 * time.Hour
+	defaultSubscriptionSweepTick = time.Minute
+	subscriptionSweepBatchSize   = 100
+)
+
+var errSubscriptionNotCancellable = errors.New("subscription cannot be cancelled")
+
+// SubscriptionGrace reads how long a subscription whose renewal failed
+// keeps its contracts, waiting for the payment to be retried, from
+// SUBSCRIPTION_GRACE_PERIOD.
+func SubscriptionGrace() time.Duration {
+	grace, err := time.ParseDuration(os.Getenv("SUBSCRIPTION_GRACE_PERIOD"))
+	if err != nil || grace < 0 {
+		return defaultSubscriptionGrace
+	}
+	return grace
+}
+
+// listingBilling checks the billing period a listing asks for against its
+// contract type. Subscriptions bill monthly unless told otherwise and
+// expire only when they stop renewing, so they take no exercise_by.
+func listingBilling(
+	contractType models.ContractType,
+	interval string,
+	intervalCount int64,
+	exerciseBy *time.Time) (models.BillingInterval, int64, error) {
+
+	if contractType != models.ContractSubscription {
+		if interval != "" || intervalCount != 0 {
+			return 0, 0, errors.New("billing_interval is only for subscriptions")
+		}
+		return 0, 0, nil
+	}
+	if exerciseBy != nil {
+		return 0, 0, errors.New("subscriptions run until cancelled and take no exercise_by")
+	}
+	billing := models.BillingMonth
+	if interval != "" {
+		var err error
+		billing, err = models.ParseBillingInterval(interval)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	switch {
+	case intervalCount == 0:
+		intervalCount = 1
+	case intervalCount < 0:
+		return 0, 0, errors.New("billing_interval_count must be positive")
+	}
+	return billing, intervalCount, nil
+}
+
+// listingRecurring is how often a purchase from the listing is billed, or
+// nil if it is paid for once.
+func listingRecurring(listing *models.ContractListing) *payments.Recurring {
+	if listing.ContractType != models.ContractSubscription {
+		return nil
+	}
+	return &payments.Recurring{
+		Interval:      listing.BillingInterval.String(),
+		IntervalCount: listing.BillingIntervalCount,
+	}
+}
+
+// startSubscription records the subscription a primary purchase started
+// and ties the contracts it issued to it. They expire a grace period after
+// the first billing period unless a renewal moves them on.
+func startSubscription(
+	record *models.TransactionRecord,
+	listing *models.ContractListing,
+	headers []*models.ContractHeader,
+	tx *repos.Repos) error {
+
+	now := time.Now()
+	sub := &models.Subscription{
+		ID:                     uuid.New(),
+		ListingID:              listing.ID,
+		SellerID:               listing.SellerID,
+		SubscriberID:           record.BuyerID,
+		TransactionID:          record.ID,
+		ProviderSubscriptionID: record.StripeSubscriptionID,
+		Quantity:               record.PurchaseQuantity,
+		Status:                 models.SubscriptionActive,
+		CurrentPeriodEnd:       listingRecurring(listing).PeriodEnd(now),
+		CreatedAt:              now,
+		UpdatedAt:              now,
+	}
+	if err := tx.Subscriptions.Create(sub); err != nil {
+		return err
+	}
+	headerIDs := make([]uuid.UUID, len(headers))
+	for i, header := range headers {
+		headerIDs[i] = header.ID
+	}
+	return tx.Headers.AttachSubscription(headerIDs, sub.ID, sub.CurrentPeriodEnd.Add(SubscriptionGrace()), issueBatchSize)
+}
+
+// RenewSubscription records a paid renewal invoice and extends the
+// subscription's contracts by another billing period, with their read and
+// byte quotas full again. The first period's invoice, paid through the
+// checkout, and invoices already recorded are ignored.
+//
+// A renewal can be paid after the contracts lapsed, or even after the
+// subscription ended, if the provider's last retry lands late. As long as
+// the period it pays for has not ended yet, the lapsed contracts get their
+// access back for it.
+func RenewSubscription(eventID string, inv *payments.Invoice, uow repos.UnitOfWork) error {
+	if inv.BillingReason == payments.BillingReasonSubscriptionCreate {
+		return nil
+	}
+	return uow.WithTx(func(tx *repos.Repos) error {
+		sub, err := tx.Subscriptions.FindByProviderSubscriptionID(inv.SubscriptionID)
+		if errors.Is(err, repos.ErrSubscriptionNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Transactions.FindByStripeInvoiceID(inv.ID); err == nil {
+			return nil
+		} else if !errors.Is(err, repos.ErrTransactionNotFound) {
+			return err
+		}
+		// The invoice was charged off-session, so the renewal is recorded
+		// already paid for and fulfilled.
+		now := time.Now()
+		tr := &models.TransactionRecord{
+			ID:                   uuid.New(),
+			InitiatedAt:          now,
+			ListingID:            sub.ListingID,
+			SellerID:             sub.SellerID,
+			BuyerID:              sub.SubscriberID,
+			PurchaseQuantity:     sub.Quantity,
+			PurchaseCents:        uint64(inv.AmountPaidCents),
+			Currency:             inv.Currency,
+			PlatformFeeCents:     platformFeeCents(inv.AmountPaidCents),
+			TransactionStatus:    models.StatusFulfilled,
+			Kind:                 models.KindRenewal,
+			PaidAt:               &now,
+			FulfilledAt:          &now,
+			IsFulfilled:          true,
+			StripeEventLastID:    eventID,
+			StripeSubscriptionID: inv.SubscriptionID,
+			StripeInvoiceID:      inv.ID,
+		}
+		if err := tx.Transactions.Create(tr); err != nil {
+			return err
+		}
+
+		newPeriod := inv.PeriodEnd.After(sub.CurrentPeriodEnd)
+		if newPeriod {
+			sub.CurrentPeriodEnd = inv.PeriodEnd
+		}
+		if sub.Status == models.SubscriptionPastDue {
+			sub.Status = models.SubscriptionActive
+		}
+		sub.GraceUntil = nil
+		sub.UpdatedAt = now
+		if err := tx.Subscriptions.Update(sub); err != nil {
+			return err
+		}
+		expiry := subscriptionExpiry(sub)
+		if err := tx.Headers.SetSubscriptionExpiry(sub.ID, expiry); err != nil {
+			return err
+		}
+		if newPeriod {
+			if err := tx.States.ResetSubscriptionQuotas(sub.ID); err != nil {
+				return err
+			}
+		}
+		if !expiry.After(now) {
+			log.Printf("subscription %s: invoice %s paid for a period already over", sub.ID, inv.ID)
+			return nil
+		}
+		return reopenLapsedContracts(tx, sub)
+	})
+}
+
+// reopenLapsedContracts gives back the subscriber's contracts in sub that
+// expired, once a renewal has paid for more time.
+func reopenLapsedContracts(tx *repos.Repos, sub *models.Subscription) error {
+	headers, err := tx.Headers.FindAllBySubscriptionID(sub.ID)
+	if err != nil {
+		return err
+	}
+	for _, header := range headers {
+		state, err := tx.States.FindByID(header.ID)
+		if err != nil {
+			return err
+		}
+		if state.Status != models.StatusExpiryReached || state.OwnerID != sub.SubscriberID {
+			continue
+		}
+		err = lifecycle.TransitionContract(tx, state, models.StatusOwned, lifecycle.SystemActor, "late renewal paid")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FailSubscriptionRenewal puts a subscription whose renewal could not be
+// charged into its grace period. The provider keeps retrying; if no
+// payment lands by GraceUntil the contracts expire.
+func FailSubscriptionRenewal(inv *payments.Invoice, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		sub, err := tx.Subscriptions.FindByProviderSubscriptionID(inv.SubscriptionID)
+		if errors.Is(err, repos.ErrSubscriptionNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sub.Status != models.SubscriptionActive {
+			return nil
+		}
+		graceUntil := sub.CurrentPeriodEnd.Add(SubscriptionGrace())
+		sub.Status = models.SubscriptionPastDue
+		sub.GraceUntil = &graceUntil
+		sub.UpdatedAt = time.Now()
+		if err := tx.Subscriptions.Update(sub); err != nil {
+			return err
+		}
+		return tx.Headers.SetSubscriptionExpiry(sub.ID, graceUntil)
+	})
+}
+
+// EndSubscription records that the provider stopped billing a
+// subscription. Its contracts expire at the end of the period already paid
+// for, or at once if that has passed.
+func EndSubscription(s *payments.Subscription, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		sub, err := tx.Subscriptions.FindByProviderSubscriptionID(s.ID)
+		if errors.Is(err, repos.ErrSubscriptionNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sub.Status == models.SubscriptionEnded {
+			return nil
+		}
+		return endSubscription(tx, sub, time.Now())
+	})
+}
+
+func endSubscription(tx *repos.Repos, sub *models.Subscription, now time.Time) error {
+	sub.Status = models.SubscriptionEnded
+	sub.GraceUntil = nil
+	sub.UpdatedAt = now
+	if err := tx.Subscriptions.Update(sub); err != nil {
+		return err
+	}
+	expiry := sub.CurrentPeriodEnd
+	if now.Before(expiry) {
+		return tx.Headers.SetSubscriptionExpiry(sub.ID, expiry)
+	}
+	return tx.Headers.SetSubscriptionExpiry(sub.ID, now)
+}
+
+// subscriptionExpiry is when sub's contracts expire if nothing else
+// happens: a grace period after the paid-up period while it renews, and at
+// the end of that period once it will not.
+func subscriptionExpiry(sub *models.Subscription) time.Time {
+	switch sub.Status {
+	case models.SubscriptionActive:
+		return sub.CurrentPeriodEnd.Add(SubscriptionGrace())
+	case models.SubscriptionPastDue:
+		if sub.GraceUntil != nil {
+			return *sub.GraceUntil
+		}
+	}
+	return sub.CurrentPeriodEnd
+}
+
+// CancelSubscription stops sub from renewing. An active subscription runs
+// to the end of the period already paid for; one past due ends at once,
+// since nothing more is owed for it.
+func CancelSubscription(
+	id, subscriberID uuid.UUID,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (*models.Subscription, error) {
+
+	sub, err := uow.Repos().Subscriptions.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if sub.SubscriberID != subscriberID {
+		return nil, errNotParticipant
+	}
+	if sub.Status != models.SubscriptionActive && sub.Status != models.SubscriptionPastDue {
+		return nil, fmt.Errorf("%w: it is %s", errSubscriptionNotCancellable, sub.Status)
+	}
+
+	pastDue := sub.Status == models.SubscriptionPastDue
+	_, err = provider.CancelSubscription(sub.ProviderSubscriptionID, !pastDue)
+	if err != nil && !errors.Is(err, payments.ErrSubscriptionNotFound) {
+		return nil, fmt.Errorf("failed to cancel with payment provider: %w", err)
+	}
+
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		fresh, err := tx.Subscriptions.FindByID(id)
+		if err != nil {
+			return err
+		}
+		*sub = *fresh
+		now := time.Now()
+		switch sub.Status {
+		case models.SubscriptionActive:
+			if !pastDue {
+				sub.Status = models.SubscriptionCancelled
+				sub.UpdatedAt = now
+				if err := tx.Subscriptions.Update(sub); err != nil {
+					return err
+				}
+				return tx.Headers.SetSubscriptionExpiry(sub.ID, subscriptionExpiry(sub))
+			}
+			return endSubscription(tx, sub, now)
+		case models.SubscriptionPastDue:
+			return endSubscription(tx, sub, now)
+		}
+		// The provider's deletion event got here first.
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// EndLapsedSubscriptions ends every past-due subscription whose grace
+// period ran out without a payment, cancelling it with the provider so it
+// stops retrying. The contracts themselves are expired by the expiry
+// scheduler, since their ExerciseBy is already GraceUntil.
+func EndLapsedSubscriptions(now time.Time, provider payments.PaymentProvider, uow repos.UnitOfWork) (int, error) {
+	ended := 0
+	for {
+		due, err := uow.Repos().Subscriptions.FindAllPastGrace(now, subscriptionSweepBatchSize)
+		if err != nil {
+			return ended, err
+		}
+
+		progressed := false
+		for i := range due {
+			sub := &due[i]
+			_, err := provider.CancelSubscription(sub.ProviderSubscriptionID, false)
+			if err != nil && !errors.Is(err, payments.ErrSubscriptionNotFound) {
+				log.Printf("subscription %s: cancel with provider failed: %v", sub.ID, err)
+				continue
+			}
+			err = uow.WithTx(func(tx *repos.Repos) error {
+				fresh, err := tx.Subscriptions.FindByID(sub.ID)
+				if err != nil {
+					return err
+				}
+				if fresh.Status != models.SubscriptionPastDue {
+					return nil
+				}
+				return endSubscription(tx, fresh, now)
+			})
+			if err != nil {
+				return ended, err
+			}
+			ended++
+			progressed = true
+		}
+
+		if len(due) < subscriptionSweepBatchSize || !progressed {
+			return ended, nil
+		}
+	}
+}
+
+// StartSubscriptionSweeper runs EndLapsedSubscriptions on every tick of clk
+// until the returned stop function is called.
+func StartSubscriptionSweeper(
+	interval time.Duration,
+	clk clock.Clock,
+	provider payments.PaymentProvider,
+	uow repos.UnitOfWork) (stop func()) {
+
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := EndLapsedSubscriptions(clk.Now(), provider, uow)
+				if err != nil {
+					log.Printf("subscription sweep failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("ended %d lapsed subscriptions", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// SubscriptionsHandler serves GET /v1/subscriptions, the caller's
+// subscriptions newest first.
+func SubscriptionsHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		subs, err := rs.Subscriptions.FindAllBySubscriberID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch subscriptions: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(subs)
+	}
+}
+
+// CancelSubscriptionHandler serves POST /v1/subscriptions/{id}/cancel,
+// where a subscriber turns off renewal.
+func CancelSubscriptionHandler(provider payments.PaymentProvider, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid subscription id", http.StatusBadRequest)
+			return
+		}
+
+		sub, err := CancelSubscription(id, u.ID, provider, uow)
+		switch {
+		case errors.Is(err, repos.ErrSubscriptionNotFound):
+			http.Error(w, "subscription not found", http.StatusNotFound)
+			return
+		case errors.Is(err, errNotParticipant):
+			http.Error(w, "only the subscriber may cancel this subscription", http.StatusForbidden)
+			return
+		case errors.Is(err, errSubscriptionNotCancellable):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sub)
+	}
+}
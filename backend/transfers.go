@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"contract_market_demo/backend/clock"
+	"contract_market_demo/backend/lifecycle"
+	"contract_market_demo/backend/mail"
+	"contract_market_demo/backend/models"
+	"contract_market_demo/backend/payments"
+	"contract_market_demo/backend/repos"
+
+	"github.com/clerk/clerk-sdk-go/v2/user"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultTransferTTL       = 7 * 24 * time.Hour
+	defaultTransferSweepTick = time.Minute
+	transferSweepBatchSize   = 100
+)
+
+var (
+	errContractNotTransferable = errors.New("contract cannot be transferred")
+	errNotInvited              = errors.New("the invitation was sent to an email address you have not verified")
+)
+
+// VerifiedEmails returns the email addresses the user with an auth subject
+// has verified with the identity provider.
+type VerifiedEmails func(ctx context.Context, subject string) ([]string, error)
+
+// ClerkVerifiedEmails is VerifiedEmails for Clerk users.
+func ClerkVerifiedEmails(ctx context.Context, subject string) ([]string, error) {
+	u, err := user.Get(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	var emails []string
+	for _, e := range u.EmailAddresses {
+		if e.Verification != nil && e.Verification.Status == "verified" {
+			emails = append(emails, e.EmailAddress)
+		}
+	}
+	return emails, nil
+}
+
+// TransferTTL reads how long a transfer may wait for its recipient from
+// CONTRACT_TRANSFER_TTL.
+func TransferTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("CONTRACT_TRANSFER_TTL"))
+	if err != nil || ttl <= 0 {
+		return defaultTransferTTL
+	}
+	return ttl
+}
+
+type TransferRequest struct {
+	// Exactly one of RecipientID and RecipientEmail is given. An email
+	// invitation mails a claim code to RecipientEmail, which only a user
+	// who has verified that address can use.
+	RecipientID    string `json:"recipient_id"`
+	RecipientEmail string `json:"recipient_email"`
+	// RequireAcceptance holds a transfer to RecipientID until they accept.
+	RequireAcceptance bool   `json:"require_acceptance"`
+	Note              string `json:"note"`
+}
+
+type TransferResponse struct {
+	Transfer *models.ContractTransfer `json:"transfer"`
+	// ClaimCode is only returned for email invitations, and only once, so
+	// the sender can pass it on if the invitation goes astray.
+	ClaimCode string `json:"claim_code,omitempty"`
+}
+
+type TransferClaimRequest struct {
+	ClaimCode string `json:"claim_code"`
+}
+
+// checkTransferable checks that senderID owns the contract and that it is
+// in a state it may change hands from: owned, not expired, and neither
+// unlocked nor caught up in a sale.
+func checkTransferable(
+	header *models.ContractHeader,
+	state *models.ContractState,
+	senderID uuid.UUID,
+	now time.Time) error {
+
+	if state.OwnerID != senderID {
+		return errNotParticipant
+	}
+	if header.SubscriptionID != uuid.Nil {
+		return fmt.Errorf("%w: it belongs to a subscription", errContractNotTransferable)
+	}
+	if header.ExerciseBy != nil && !header.ExerciseBy.After(now) {
+		return fmt.Errorf("%w: it has expired", errContractNotTransferable)
+	}
+	switch state.Status {
+	case models.StatusOwned:
+		return nil
+	case models.StatusUnlocked:
+		return fmt.Errorf("%w: it has been unlocked", errContractNotTransferable)
+	case models.StatusMatched:
+		return fmt.Errorf("%w: a checkout for it is in progress", errContractNotTransferable)
+	case models.StatusListed:
+		return fmt.Errorf("%w: it is on offer; withdraw it first", errContractNotTransferable)
+	default:
+		return fmt.Errorf("%w: it is %s", errContractNotTransferable, state.Status)
+	}
+}
+
+func newClaimCode() (code, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	code = base64.RawURLEncoding.EncodeToString(buf)
+	return code, hashClaimCode(code), nil
+}
+
+func hashClaimCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartTransfer offers a contract the sender owns to someone else. A
+// transfer to a known user that needs no acceptance completes at once;
+// otherwise the contract is held in StatusListed until the recipient
+// accepts or claims it, or the transfer lapses after TransferTTL. An email
+// invitation is sent before the transfer is committed, so a transfer nobody
+// was told about never holds the contract. Overage the sender still owes
+// on the contract is charged first.
+func StartTransfer(
+	headerID, senderID uuid.UUID,
+	req *TransferRequest,
+	now time.Time,
+	provider payments.PaymentProvider,
+	mailer mail.Sender,
+	uow repos.UnitOfWork) (*models.ContractTransfer, string, error) {
+
+	transfer := &models.ContractTransfer{
+		ID:                uuid.New(),
+		HeaderID:          headerID,
+		SenderID:          senderID,
+		RequireAcceptance: req.RequireAcceptance,
+		Note:              req.Note,
+		Status:            models.TransferPending,
+		ExpiresAt:         now.Add(TransferTTL()),
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	var claimCode string
+	switch {
+	case req.RecipientID != "" && req.RecipientEmail != "":
+		return nil, "", errors.New("give recipient_id or recipient_email, not both")
+	case req.RecipientID != "":
+		id, err := uuid.Parse(req.RecipientID)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid recipient_id: %w", err)
+		}
+		if _, err := uow.Repos().Users.FindByID(id); err != nil {
+			return nil, "", err
+		}
+		if id == senderID {
+			return nil, "", errors.New("cannot transfer a contract to yourself")
+		}
+		transfer.RecipientID = id
+	case req.RecipientEmail != "":
+		addr, err := netmail.ParseAddress(req.RecipientEmail)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid recipient_email: %w", err)
+		}
+		code, hash, err := newClaimCode()
+		if err != nil {
+			return nil, "", err
+		}
+		transfer.RecipientEmail = addr.Address
+		transfer.ClaimCodeHash = hash
+		transfer.RequireAcceptance = true
+		claimCode = code
+	default:
+		return nil, "", errors.New("recipient_id or recipient_email is required")
+	}
+
+	if err := BillOverageBeforeListing(senderID, []uuid.UUID{headerID}, provider, uow); err != nil {
+		return nil, "", err
+	}
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		header, err := tx.Headers.FindByID(headerID)
+		if err != nil {
+			return err
+		}
+		state, err := tx.States.FindByID(headerID)
+		if err != nil {
+			return err
+		}
+		if err := checkTransferable(header, state, senderID, now); err != nil {
+			return err
+		}
+		if header.ExerciseBy != nil && header.ExerciseBy.Before(transfer.ExpiresAt) {
+			transfer.ExpiresAt = *header.ExerciseBy
+		}
+
+		err = lifecycle.TransitionContract(tx, state, models.StatusListed, senderID, "transfer offered")
+		if err != nil {
+			return err
+		}
+		if err := tx.Transfers.Create(transfer); err != nil {
+			return err
+		}
+		if transfer.RecipientEmail != "" {
+			return mailer.Send(transferInvitation(transfer, claimCode))
+		}
+		if transfer.RequireAcceptance {
+			return nil
+		}
+		return completeTransfer(tx, transfer, state, senderID, now)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return transfer, claimCode, nil
+}
+
+func transferInvitation(transfer *models.ContractTransfer, claimCode string) mail.Message {
+	var body strings.Builder
+	body.WriteString("Someone has transferred a data contract to you.\n\n")
+	if transfer.Note != "" {
+		body.WriteString("Their note: " + transfer.Note + "\n\n")
+	}
+	fmt.Fprintf(&body, "Sign in with this email address and claim it with this code before %s:\n\n%s\n",
+		transfer.ExpiresAt.UTC().Format(time.RFC1123), claimCode)
+	return mail.Message{
+		To:      transfer.RecipientEmail,
+		Subject: "A data contract has been transferred to you",
+		Body:    body.String(),
+	}
+}
+
+// completeTransfer hands a held contract to the transfer's recipient.
+func completeTransfer(
+	tx *repos.Repos,
+	transfer *models.ContractTransfer,
+	state *models.ContractState,
+	actorID uuid.UUID,
+	now time.Time) error {
+
+	if state.Status != models.StatusListed || state.OwnerID != transfer.SenderID {
+		return fmt.Errorf("%w: it is no longer held for this transfer", errContractNotTransferable)
+	}
+	if err := tx.Transfers.Close(transfer.ID, models.TransferCompleted, now); err != nil {
+		return err
+	}
+	conv := lifecycle.Conveyance{Kind: models.OwnershipTransferred, OwnerID: transfer.RecipientID}
+	err := lifecycle.TransferContract(
+		tx, state, conv, models.StatusOwned, actorID, "transferred from "+transfer.SenderID.String())
+	if err != nil {
+		return err
+	}
+	transfer.Status = models.TransferCompleted
+	transfer.CompletedAt = &now
+	return nil
+}
+
+// returnTransfer closes a pending transfer with status and gives the
+// contract back to the sender, if it is still held for them. A contract
+// that expired while held stays expired.
+func returnTransfer(
+	tx *repos.Repos,
+	transfer *models.ContractTransfer,
+	status models.TransferStatus,
+	actorID uuid.UUID,
+	now time.Time) error {
+
+	if err := tx.Transfers.Close(transfer.ID, status, now); err != nil {
+		return err
+	}
+	transfer.Status = status
+	state, err := tx.States.FindByID(transfer.HeaderID)
+	if err != nil {
+		return err
+	}
+	if state.Status != models.StatusListed || state.OwnerID != transfer.SenderID {
+		return nil
+	}
+	return lifecycle.TransitionContract(tx, state, models.StatusOwned, actorID, "transfer "+status.String())
+}
+
+// pendingTransfer loads a transfer that is still waiting on its recipient.
+func pendingTransfer(tx *repos.Repos, id uuid.UUID, now time.Time) (*models.ContractTransfer, error) {
+	transfer, err := tx.Transfers.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if transfer.Status != models.TransferPending || !now.Before(transfer.ExpiresAt) {
+		return nil, repos.ErrContractTransferNotPending
+	}
+	return transfer, nil
+}
+
+// RespondToTransfer accepts or declines a transfer addressed to userID.
+func RespondToTransfer(
+	id, userID uuid.UUID,
+	accept bool,
+	now time.Time,
+	uow repos.UnitOfWork) (*models.ContractTransfer, error) {
+
+	var transfer *models.ContractTransfer
+	err := uow.WithTx(func(tx *repos.Repos) error {
+		var err error
+		transfer, err = pendingTransfer(tx, id, now)
+		if err != nil {
+			return err
+		}
+		if transfer.RecipientID != userID {
+			return errNotParticipant
+		}
+		if !accept {
+			return returnTransfer(tx, transfer, models.TransferDeclined, userID, now)
+		}
+		state, err := tx.States.FindByID(transfer.HeaderID)
+		if err != nil {
+			return err
+		}
+		return completeTransfer(tx, transfer, state, userID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// ClaimTransfer completes the email invitation whose claim code is given,
+// making userID its recipient. verifiedEmails are the addresses userID has
+// proven they own; one of them must be the one the invitation went to.
+func ClaimTransfer(
+	code string,
+	userID uuid.UUID,
+	verifiedEmails []string,
+	now time.Time,
+	uow repos.UnitOfWork) (*models.ContractTransfer, error) {
+
+	found, err := uow.Repos().Transfers.FindByClaimCodeHash(hashClaimCode(code))
+	if err != nil {
+		return nil, err
+	}
+
+	var transfer *models.ContractTransfer
+	err = uow.WithTx(func(tx *repos.Repos) error {
+		var err error
+		transfer, err = pendingTransfer(tx, found.ID, now)
+		if err != nil {
+			return err
+		}
+		if transfer.SenderID == userID {
+			return errors.New("cannot claim your own transfer")
+		}
+		invited := func(email string) bool { return strings.EqualFold(email, transfer.RecipientEmail) }
+		if transfer.RecipientEmail == "" || !slices.ContainsFunc(verifiedEmails, invited) {
+			return errNotInvited
+		}
+		if err := tx.Transfers.Claim(transfer.ID, userID); err != nil {
+			return err
+		}
+		transfer.RecipientID = userID
+		state, err := tx.States.FindByID(transfer.HeaderID)
+		if err != nil {
+			return err
+		}
+		return completeTransfer(tx, transfer, state, userID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transfer, nil
+}
+
+// CancelTransfer lets the sender take back a transfer nobody has accepted.
+func CancelTransfer(id, senderID uuid.UUID, now time.Time, uow repos.UnitOfWork) error {
+	return uow.WithTx(func(tx *repos.Repos) error {
+		transfer, err := tx.Transfers.FindByID(id)
+		if err != nil {
+			return err
+		}
+		if transfer.SenderID != senderID {
+			return errNotParticipant
+		}
+		if transfer.Status != models.TransferPending {
+			return repos.ErrContractTransferNotPending
+		}
+		return returnTransfer(tx, transfer, models.TransferCancelled, senderID, now)
+	})
+}
+
+// ExpireTransfers lapses every pending transfer whose time is up and gives
+// the contracts back to their senders.
+func ExpireTransfers(now time.Time, uow repos.UnitOfWork) (int, error) {
+	expired := 0
+	for {
+		due, err := uow.Repos().Transfers.FindAllPendingExpired(now, transferSweepBatchSize)
+		if err != nil {
+			return expired, err
+		}
+
+		progressed := false
+		for i := range due {
+			transfer := &due[i]
+			err := uow.WithTx(func(tx *repos.Repos) error {
+				return returnTransfer(tx, transfer, models.TransferExpired, lifecycle.SystemActor, now)
+			})
+			if errors.Is(err, repos.ErrContractTransferNotPending) || errors.Is(err, repos.ErrContractStatusConflict) {
+				continue
+			}
+			if err != nil {
+				return expired, err
+			}
+			expired++
+			progressed = true
+		}
+
+		if len(due) < transferSweepBatchSize || !progressed {
+			return expired, nil
+		}
+	}
+}
+
+// StartTransferSweeper runs ExpireTransfers on every tick of clk until the
+// returned stop function is called.
+func StartTransferSweeper(interval time.Duration, clk clock.Clock, uow repos.UnitOfWork) (stop func()) {
+	done := make(chan struct{})
+	ticker := clk.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				n, err := ExpireTransfers(clk.Now(), uow)
+				if err != nil {
+					log.Printf("transfer expiry failed: %v", err)
+				}
+				if n > 0 {
+					log.Printf("expired %d transfers", n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func transferError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, repos.ErrContractHeaderNotFound),
+		errors.Is(err, repos.ErrContractStateNotFound),
+		errors.Is(err, repos.ErrContractTransferNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, repos.ErrUserNotFound):
+		http.Error(w, "recipient not found", http.StatusNotFound)
+	case errors.Is(err, errNotParticipant):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, errNotInvited):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errOverageUnpaid):
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+	case errors.Is(err, errContractNotTransferable),
+		errors.Is(err, repos.ErrContractTransferNotPending),
+		errors.Is(err, repos.ErrContractStatusConflict),
+		errors.Is(err, lifecycle.ErrIllegalTransition):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// ContractTransferHandler serves POST /v1/contracts/{id}/transfer, where an
+// owner gives the contract to another user.
+func ContractTransferHandler(provider payments.PaymentProvider, mailer mail.Sender, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid contract id", http.StatusBadRequest)
+			return
+		}
+		req := &TransferRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		transfer, claimCode, err := StartTransfer(id, u.ID, req, time.Now(), provider, mailer, uow)
+		if err != nil {
+			transferError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(&TransferResponse{Transfer: transfer, ClaimCode: claimCode})
+	}
+}
+
+// ContractTransfersHandler serves GET /v1/contracts/{id}/transfers: every
+// transfer of the contract, oldest first, for its owner and its seller.
+func ContractTransfersHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, header, _, ok := contractForParticipant(w, r, uow)
+		if !ok {
+			return
+		}
+		transfers, err := uow.Repos().Transfers.FindAllByHeaderID(header.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch transfers: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transfers)
+	}
+}
+
+// TransfersHandler serves GET /v1/transfers, the transfers the caller sent
+// or received.
+func TransfersHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rs := uow.Repos()
+		u, err := CurrentUser(r, rs.Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		transfers, err := rs.Transfers.FindAllByUserID(u.ID)
+		if err != nil {
+			http.Error(w, "failed to fetch transfers: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transfers)
+	}
+}
+
+// TransferResponseHandler serves POST /v1/transfers/{id}/accept and
+// /decline for the transfer's recipient.
+func TransferResponseHandler(accept bool, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid transfer id", http.StatusBadRequest)
+			return
+		}
+		transfer, err := RespondToTransfer(id, u.ID, accept, time.Now(), uow)
+		if err != nil {
+			transferError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transfer)
+	}
+}
+
+// TransferClaimHandler serves POST /v1/transfers/claim, where the recipient
+// of an email invitation takes the contract with its claim code.
+func TransferClaimHandler(verifiedEmails VerifiedEmails, uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req := &TransferClaimRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		emails, err := verifiedEmails(r.Context(), u.AuthSubject)
+		if err != nil {
+			http.Error(w, "failed to look up your email addresses: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		transfer, err := ClaimTransfer(req.ClaimCode, u.ID, emails, time.Now(), uow)
+		if err != nil {
+			transferError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(transfer)
+	}
+}
+
+// CancelTransferHandler serves DELETE /v1/transfers/{id}, where the sender
+// withdraws a transfer that is still pending.
+func CancelTransferHandler(uow repos.UnitOfWork) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := CurrentUser(r, uow.Repos().Users)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "invalid transfer id", http.StatusBadRequest)
+			return
+		}
+		if err := CancelTransfer(id, u.ID, time.Now(), uow); err != nil {
+			transferError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"contract_market_demo/backend/mail"
+	"contract_market_demo/backend/models"
+)
+
+func TestEmailTransferOnlyClaimedByInvitedAddress(t *testing.T) {
+	m := newTestMarket(t)
+	listing := m.listing(t, &ListingParams{SupplyLimit: 1})
+	m.buy(t, listing.ID, 1)
+	contract := m.owned(t, m.buyer)[0]
+	mailer := mail.NewFakeSender()
+	now := time.Now()
+
+	req := &TransferRequest{RecipientEmail: "Friend <friend@example.com>"}
+	transfer, code, err := StartTransfer(contract.HeaderID, m.buyer.ID, req, now, m.provider, mailer, m.uow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := mailer.Sent()
+	if len(sent) != 1 || sent[0].To != "friend@example.com" || !strings.Contains(sent[0].Body, code) {
+		t.Fatalf("sent %+v, want the claim code mailed to friend@example.com", sent)
+	}
+
+	stranger := m.user(t, "stranger")
+	for _, emails := range [][]string{nil, {"stranger@example.com"}} {
+		_, err := ClaimTransfer(code, stranger.ID, emails, now, m.uow)
+		if !errors.Is(err, errNotInvited) {
+			t.Errorf("claim with verified %v: err = %v, want errNotInvited", emails, err)
+		}
+	}
+
+	friend := m.user(t, "friend")
+	claimed, err := ClaimTransfer(code, friend.ID, []string{"other@example.com", "FRIEND@example.com"}, now, m.uow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != transfer.ID || claimed.Status != models.TransferCompleted || claimed.RecipientID != friend.ID {
+		t.Errorf("claimed transfer %+v, want it completed for the invited user", claimed)
+	}
+	if got := m.owned(t, friend); len(got) != 1 || got[0].HeaderID != contract.HeaderID {
+		t.Errorf("invited user owns %+v, want the transferred contract", got)
+	}
+}